@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachList looks passwords up in a local copy of the Have I Been Pwned
+// Pwned Passwords corpus (SHA-1), so no password or hash prefix ever leaves
+// the server. Two layouts are understood:
+//
+//   - a directory of range files named by the 5-character hash prefix
+//     (00000.txt ... FFFFF.txt), holding "SUFFIX:COUNT" lines as the range
+//     API returns them;
+//   - a single file of "HASH:COUNT" lines sorted by hash, as the downloader
+//     writes it, which is binary searched in place.
+type BreachList struct {
+	path string
+	dir  bool
+}
+
+// OpenBreachList checks that path exists and tells the two layouts apart.
+func OpenBreachList(path string) (*BreachList, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("breach list: %w", err)
+	}
+	return &BreachList{path: path, dir: fi.IsDir()}, nil
+}
+
+// Contains reports whether password appears in the corpus.
+func (b *BreachList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	if b.dir {
+		return b.searchRange(hash)
+	}
+	return b.searchSorted(hash)
+}
+
+func (b *BreachList) searchRange(hash string) (bool, error) {
+	f, err := os.Open(filepath.Join(b.path, hash[:5]+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(b.path, hash[:5]))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if found, ok := matchLine(sc.Text(), hash[5:]); ok {
+			return found, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// searchSorted finds the first line whose hash is >= hash. Offsets are
+// searched rather than lines: lineFrom maps any offset to the next line start.
+func (b *BreachList) searchSorted(hash string) (bool, error) {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	lo, hi := int64(0), fi.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, err := lineFrom(f, mid)
+		if err != nil {
+			return false, err
+		}
+		if line == "" || strings.ToUpper(prefixOf(line)) >= hash {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	line, err := lineFrom(f, lo)
+	if err != nil {
+		return false, err
+	}
+	found, _ := matchLine(line, hash)
+	return found, nil
+}
+
+// lineFrom returns the first whole line starting at or after off, without
+// its line ending, or "" at the end of the file.
+func lineFrom(f *os.File, off int64) (string, error) {
+	buf := make([]byte, 256)
+	if off > 0 {
+		// a line starts at off when the byte before it ends a line
+		n, err := f.ReadAt(buf, off-1)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		i := bytes.IndexByte(buf[:n], '\n')
+		if i < 0 {
+			return "", nil
+		}
+		off += int64(i)
+	}
+	n, err := f.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line, _, _ := bytes.Cut(buf[:n], []byte{'\n'})
+	return strings.TrimRight(string(line), "\r"), nil
+}
+
+func prefixOf(line string) string {
+	p, _, _ := strings.Cut(line, ":")
+	return p
+}
+
+// matchLine checks a "HASH:COUNT" line against hash; ok is false when the
+// line is about another hash. Padding entries with a count of 0 don't count.
+func matchLine(line, hash string) (found, ok bool) {
+	h, count, _ := strings.Cut(strings.TrimSpace(line), ":")
+	if !strings.EqualFold(h, hash) {
+		return false, false
+	}
+	return strings.TrimSpace(count) != "0", true
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeSortedList writes "HASH:COUNT" lines sorted by hash, ending each
+// with eol, and returns the hashes in file order.
+func writeSortedList(t *testing.T, counts map[string]string, eol string) (string, []string) {
+	t.Helper()
+	var hashes []string
+	byHash := map[string]string{}
+	for pw, count := range counts {
+		h := sha1Hex(pw)
+		hashes = append(hashes, h)
+		byHash[h] = count
+	}
+	sort.Strings(hashes)
+	var b strings.Builder
+	for _, h := range hashes {
+		b.WriteString(h + ":" + byHash[h] + eol)
+	}
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, hashes
+}
+
+func TestBreachListSorted(t *testing.T) {
+	counts := map[string]string{"padding": "0"}
+	for _, pw := range []string{"password", "123456", "letmein", "hunter2", "correct horse", "monkey", "zxcvbn", "iloveyou"} {
+		counts[pw] = "1234"
+	}
+	for _, eol := range []string{"\n", "\r\n"} {
+		path, hashes := writeSortedList(t, counts, eol)
+		b, err := OpenBreachList(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byHash := map[string]string{}
+		for pw := range counts {
+			byHash[sha1Hex(pw)] = pw
+		}
+		first, last := byHash[hashes[0]], byHash[hashes[len(hashes)-1]]
+
+		tests := []struct {
+			name, password string
+			want           bool
+		}{
+			{"first line", first, counts[first] != "0"},
+			{"last line", last, counts[last] != "0"},
+			{"middle", "hunter2", true},
+			{"count 0 is padding", "padding", false},
+			{"absent", "plum orbit canvas ladder", false},
+			{"empty", "", false},
+		}
+		for _, tt := range tests {
+			got, err := b.Contains(tt.password)
+			if err != nil {
+				t.Fatalf("%q %s: %v", eol, tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("%q %s: Contains(%q) = %v, want %v", eol, tt.name, tt.password, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestBreachListSortedEdges(t *testing.T) {
+	// the first and last hashes of the file are found; a final line without
+	// a line ending still counts
+	h := []string{sha1Hex("a"), sha1Hex("b"), sha1Hex("c")}
+	sort.Strings(h)
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(path, []byte(h[0]+":3\r\n"+h[1]+":0\r\n"+h[2]+":9"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenBreachList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		hash string
+		want bool
+	}{{h[0], true}, {h[1], false}, {h[2], true}, {strings.Repeat("0", 40), false}, {strings.Repeat("F", 40), false}} {
+		got, err := b.searchSorted(tt.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("searchSorted(%s) = %v, want %v", tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestBreachListRangeDir(t *testing.T) {
+	dir := t.TempDir()
+	pw, pad := sha1Hex("password"), sha1Hex("padding")
+	files := map[string]string{
+		pw[:5] + ".txt": "0000000000000000000000000000000000A:1\r\n" + pw[5:] + ":3861493\r\n",
+		pad[:5]:         pad[5:] + ":0\n",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := OpenBreachList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		password string
+		want     bool
+	}{{"password", true}, {"padding", false}, {"plum orbit canvas ladder", false}} {
+		got, err := b.Contains(tt.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestPasswordPolicyBreached(t *testing.T) {
+	path, _ := writeSortedList(t, map[string]string{"plum orbit canvas ladder": "7"}, "\n")
+	b, err := OpenBreachList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PasswordPolicy{MinLength: 8, Breached: b}
+	vs, err := p.Check("plum orbit canvas ladder", PasswordContext{})
+	if err != nil || len(vs) != 1 || vs[0].Code != "breached" {
+		t.Fatalf("Check = %v, %v; want breached", vs, err)
+	}
+}
@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Scheme verifies passwords hashed by one algorithm. Only Argon2id hashes
+// are ever written; the other schemes exist so users imported from other
+// systems can sign in, after which the store rewrites their hash (see
+// NeedsRehash).
+type Scheme interface {
+	Name() string
+	// Match reports whether encoded is in this scheme's format.
+	Match(encoded string) bool
+	// Parse checks that a matching hash is well formed and that its
+	// parameters are ones Verify accepts, without hashing anything.
+	Parse(encoded string) error
+	Verify(plain, encoded string) bool
+}
+
+var (
+	ErrUnknownScheme = errors.New("unknown password hash scheme")
+	ErrMalformedHash = errors.New("malformed password hash")
+)
+
+var (
+	schemesMu sync.RWMutex
+	schemes   = []Scheme{argon2idScheme{}, bcryptScheme{}, scryptScheme{}, pbkdf2Scheme{}}
+)
+
+// RegisterScheme adds a scheme, for ones that need configuration such as
+// FirebaseScrypt. Schemes registered later are tried after the built-in ones.
+func RegisterScheme(s Scheme) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	schemes = append(schemes, s)
+}
+
+// SchemeOf returns the scheme an encoded hash is in.
+func SchemeOf(encoded string) (Scheme, bool) {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+	for _, s := range schemes {
+		if s.Match(encoded) {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// ParseHash finds the scheme of encoded and checks the hash with it, so a
+// hash that could never verify is refused before it is stored.
+func ParseHash(encoded string) (Scheme, error) {
+	s, ok := SchemeOf(encoded)
+	if !ok {
+		return nil, ErrUnknownScheme
+	}
+	if err := s.Parse(encoded); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// bcrypt: $2a$, $2b$ or $2y$ (PHP, Laravel, Devise, ...)
+type bcryptScheme struct{}
+
+func (bcryptScheme) Name() string { return "bcrypt" }
+
+func (bcryptScheme) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// x/crypto/bcrypt doesn't know the PHP prefix; the algorithm is the same
+func bcryptHash(encoded string) []byte {
+	if strings.HasPrefix(encoded, "$2y$") {
+		encoded = "$2b$" + encoded[4:]
+	}
+	return []byte(encoded)
+}
+
+func (bcryptScheme) Parse(encoded string) error {
+	// Cost decodes the whole hash; a compare would also run the rounds
+	if _, err := bcrypt.Cost(bcryptHash(encoded)); err != nil || len(encoded) != 60 {
+		return ErrMalformedHash
+	}
+	return nil
+}
+
+func (bcryptScheme) Verify(plain, encoded string) bool {
+	return bcrypt.CompareHashAndPassword(bcryptHash(encoded), []byte(plain)) == nil
+}
+
+// scrypt in passlib's format: $scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<hash>
+type scryptScheme struct{}
+
+func (scryptScheme) Name() string { return "scrypt" }
+
+func (scryptScheme) Match(encoded string) bool { return strings.HasPrefix(encoded, "$scrypt$") }
+
+type scryptHash struct {
+	ln, r, p   int
+	salt, want []byte
+}
+
+func parseScrypt(encoded string) (scryptHash, error) {
+	var h scryptHash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return h, ErrMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &h.ln, &h.r, &h.p); err != nil ||
+		h.ln < 1 || h.ln > 20 || h.r < 1 || h.r > 32 || h.p < 1 || h.p > 16 {
+		return h, ErrMalformedHash
+	}
+	var err1, err2 error
+	h.salt, err1 = decodeB64(parts[3])
+	h.want, err2 = decodeB64(parts[4])
+	if err1 != nil || err2 != nil || len(h.want) == 0 {
+		return h, ErrMalformedHash
+	}
+	return h, nil
+}
+
+func (scryptScheme) Parse(encoded string) error {
+	_, err := parseScrypt(encoded)
+	return err
+}
+
+func (scryptScheme) Verify(plain, encoded string) bool {
+	h, err := parseScrypt(encoded)
+	if err != nil {
+		return false
+	}
+	got, err := scrypt.Key([]byte(plain), h.salt, 1<<h.ln, h.r, h.p, len(h.want))
+	return err == nil && subtle.ConstantTimeCompare(got, h.want) == 1
+}
+
+// PBKDF2-SHA256 as Django stores it, pbkdf2_sha256$<iterations>$<salt>$<hash>,
+// or as passlib does, $pbkdf2-sha256$<iterations>$<salt>$<hash>. Django's salt
+// is used as is; passlib's is base64.
+type pbkdf2Scheme struct{}
+
+func (pbkdf2Scheme) Name() string { return "pbkdf2-sha256" }
+
+func (pbkdf2Scheme) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "pbkdf2_sha256$") || strings.HasPrefix(encoded, "$pbkdf2-sha256$")
+}
+
+type pbkdf2Hash struct {
+	iter       int
+	salt, want []byte
+}
+
+func parsePBKDF2(encoded string) (pbkdf2Hash, error) {
+	var h pbkdf2Hash
+	passlib := strings.HasPrefix(encoded, "$")
+	parts := strings.Split(strings.TrimPrefix(encoded, "$"), "$")
+	if len(parts) != 4 {
+		return h, ErrMalformedHash
+	}
+	var err error
+	if h.iter, err = strconv.Atoi(parts[1]); err != nil || h.iter < 1 || h.iter > 10_000_000 {
+		return h, ErrMalformedHash
+	}
+	h.salt = []byte(parts[2])
+	if passlib {
+		if h.salt, err = decodeB64(parts[2]); err != nil {
+			return h, ErrMalformedHash
+		}
+	}
+	if h.want, err = decodeB64(parts[3]); err != nil || len(h.want) == 0 {
+		return h, ErrMalformedHash
+	}
+	return h, nil
+}
+
+func (pbkdf2Scheme) Parse(encoded string) error {
+	_, err := parsePBKDF2(encoded)
+	return err
+}
+
+func (pbkdf2Scheme) Verify(plain, encoded string) bool {
+	h, err := parsePBKDF2(encoded)
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, plain, h.salt, h.iter, len(h.want))
+	return err == nil && subtle.ConstantTimeCompare(got, h.want) == 1
+}
+
+// FirebaseScrypt verifies hashes exported from Firebase Authentication, which
+// uses a modified scrypt keyed by project-wide parameters (Console >
+// Authentication > Users > Password hash parameters). Imported hashes are
+// written as $firebase-scrypt$<salt>$<passwordHash>, both base64 as exported.
+type FirebaseScrypt struct {
+	SignerKey     []byte
+	SaltSeparator []byte
+	Rounds        int
+	MemCost       int
+}
+
+// NewFirebaseScrypt builds the scheme from the base64 parameters Firebase shows.
+func NewFirebaseScrypt(signerKey, saltSeparator string, rounds, memCost int) (FirebaseScrypt, error) {
+	key, err := base64.StdEncoding.DecodeString(signerKey)
+	if err != nil || len(key) == 0 {
+		return FirebaseScrypt{}, fmt.Errorf("firebase signer key: invalid base64")
+	}
+	sep, err := base64.StdEncoding.DecodeString(saltSeparator)
+	if err != nil {
+		return FirebaseScrypt{}, fmt.Errorf("firebase salt separator: invalid base64")
+	}
+	if rounds < 1 || rounds > 8 || memCost < 1 || memCost > 14 {
+		return FirebaseScrypt{}, fmt.Errorf("firebase hash parameters out of range")
+	}
+	return FirebaseScrypt{SignerKey: key, SaltSeparator: sep, Rounds: rounds, MemCost: memCost}, nil
+}
+
+func (FirebaseScrypt) Name() string { return "firebase-scrypt" }
+
+func (FirebaseScrypt) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$firebase-scrypt$")
+}
+
+func parseFirebase(encoded string) (salt, want []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 {
+		return nil, nil, ErrMalformedHash
+	}
+	salt, err1 := decodeB64(parts[2])
+	want, err2 := decodeB64(parts[3])
+	if err1 != nil || err2 != nil || len(want) == 0 {
+		return nil, nil, ErrMalformedHash
+	}
+	return salt, want, nil
+}
+
+func (FirebaseScrypt) Parse(encoded string) error {
+	_, _, err := parseFirebase(encoded)
+	return err
+}
+
+func (f FirebaseScrypt) Verify(plain, encoded string) bool {
+	salt, want, err := parseFirebase(encoded)
+	if err != nil {
+		return false
+	}
+	key, err := scrypt.Key([]byte(plain), append(salt, f.SaltSeparator...), 1<<f.MemCost, f.Rounds, 1, 32)
+	if err != nil {
+		return false
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return false
+	}
+	got := make([]byte, len(f.SignerKey))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(got, f.SignerKey)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// decodeB64 takes standard base64 with or without padding, and passlib's
+// variant that writes "." for "+".
+func decodeB64(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.ReplaceAll(s, ".", "+"), "=")
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -1,49 +1,246 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// HMAC secret
+// kid used for the JWT_SECRET key when no explicit key id is configured
+const DefaultHMACKeyID = "default"
+
+// JWT "typ" headers; they keep one kind of token from being accepted as another
+const (
+	TypAccess  = "at+jwt" // RFC 9068
+	TypIDToken = "JWT"    // OpenID Connect ID tokens keep the plain type clients expect
+)
+
+// signs with the active key and verifies against every key in the ring by kid
 type JWTMaker struct {
-	secret []byte
+	mu     sync.RWMutex
+	active SigningKey
+	keys   map[string]SigningKey
 }
-// parse and sign JWT tokens
+// parse and sign JWT tokens with a single HS256 secret
 func NewJWTMaker(secret string) *JWTMaker {
-	return &JWTMaker{secret: []byte(secret)}
+	return NewJWTMakerWithKey(NewHMACKey(DefaultHMACKeyID, []byte(secret)))
+}
+// parse and sign JWT tokens with the given key (HS256, EdDSA or RS256);
+// verifyOnly keys are still accepted until their RetireAfter
+func NewJWTMakerWithKey(key SigningKey, verifyOnly ...SigningKey) *JWTMaker {
+	j := &JWTMaker{}
+	j.SetKeys(key, verifyOnly...)
+	return j
+}
+
+// SetKeys replaces the whole key ring, e.g. after the key ring file was edited.
+func (j *JWTMaker) SetKeys(active SigningKey, verifyOnly ...SigningKey) {
+	keys := map[string]SigningKey{}
+	for _, k := range verifyOnly {
+		keys[k.ID] = k
+	}
+	active.RetireAfter = time.Time{}
+	keys[active.ID] = active
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.active = active
+	j.keys = keys
+}
+
+// Rotate makes next the signing key. The previous active key keeps verifying
+// tokens until retireAfter so sessions survive the switch; keys whose window
+// has already closed are dropped from the ring.
+func (j *JWTMaker) Rotate(next SigningKey, retireAfter time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for id, k := range j.keys {
+		if k.Retired(now) {
+			delete(j.keys, id)
+		}
+	}
+	prev := j.active
+	prev.RetireAfter = retireAfter
+	j.keys[prev.ID] = prev
+	next.RetireAfter = time.Time{}
+	j.keys[next.ID] = next
+	j.active = next
+}
+
+// KeyInfo describes a ring entry without exposing key material.
+type KeyInfo struct {
+	ID          string     `json:"kid"`
+	Alg         string     `json:"alg"`
+	Active      bool       `json:"active"`
+	Retired     bool       `json:"retired"`
+	RetireAfter *time.Time `json:"retire_after,omitempty"`
+}
+
+// Keys lists the ring, active key first.
+func (j *JWTMaker) Keys() []KeyInfo {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	now := time.Now()
+	out := make([]KeyInfo, 0, len(j.keys))
+	for _, k := range j.keys {
+		info := KeyInfo{ID: k.ID, Alg: k.Method.Alg(), Active: k.ID == j.active.ID, Retired: k.Retired(now)}
+		if !k.RetireAfter.IsZero() {
+			t := k.RetireAfter
+			info.RetireAfter = &t
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Active != out[b].Active {
+			return out[a].Active
+		}
+		return out[a].ID < out[b].ID
+	})
+	return out
 }
 
 type Claims struct {
-	UserID string `json:"sub"`
+	UserID    string `json:"sub"`
+	SessionID string `json:"sid,omitempty"`
+	// set on tokens issued to OAuth clients rather than to our own apps
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
-// Builds a new HS256 JWT with userID and an expiry. Returns the token string and the expiry time.
-func (j *JWTMaker) NewAccess(userID string, ttlMin int) (string, time.Time, error) {
+// Builds a new JWT with userID, the session it belongs to, a unique jti and an expiry,
+// signed by the active key. Returns the token string and the expiry time.
+func (j *JWTMaker) NewAccess(userID, sessionID string, ttlMin int) (string, time.Time, error) {
+	return j.NewOAuthAccess(userID, sessionID, "", "", ttlMin)
+}
+// Like NewAccess, but records the OAuth client and granted scope in the token.
+func (j *JWTMaker) NewOAuthAccess(userID, sessionID, clientID, scope string, ttlMin int) (string, time.Time, error) {
 	now := time.Now()
 	exp := now.Add(time.Duration(ttlMin) * time.Minute)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		UserID: userID,
+	s, err := j.Sign(TypAccess, Claims{
+		UserID:    userID,
+		SessionID: sessionID,
+		ClientID:  clientID,
+		Scope:     scope,
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(exp),
 			Subject:   userID,
+			ID:        newJTI(),
 		},
 	})
-	s, err := token.SignedString(j.secret)
 	return s, exp, err
 }
+
+// Sign signs claims with the active key, stamping the kid and the given typ header.
+func (j *JWTMaker) Sign(typ string, claims jwt.Claims) (string, error) {
+	return signWith(j.activeKey(), typ, claims)
+}
+
+func (j *JWTMaker) activeKey() SigningKey {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.active
+}
+
+func signWith(key SigningKey, typ string, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typ
+	return token.SignedString(key.sign)
+}
+
+// ParseTyped verifies a token we signed with Sign(typ, ...) into claims.
+// Tokens of any other typ are rejected, so e.g. a state cookie can't pass as an access token.
+func (j *JWTMaker) ParseTyped(tokenStr, typ string, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(tokenStr, claims, j.keyFunc)
+	if err != nil {
+		return err
+	}
+	if t, _ := token.Header["typ"].(string); t != typ || !token.Valid {
+		return jwt.ErrTokenInvalidClaims
+	}
+	return nil
+}
+
+// Alg is the algorithm of the active signing key.
+func (j *JWTMaker) Alg() string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.active.Method.Alg()
+}
+
+// Asymmetric reports whether the active key can be verified from the JWKS,
+// which clients need for ID tokens.
+func (j *JWTMaker) Asymmetric() bool {
+	return !j.activeKey().Symmetric()
+}
+
 // validate or return claim if expired or error
 func (j *JWTMaker) Parse(tokenStr string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (any, error) {
-		return j.secret, nil
-	})
+	c := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, c, j.keyFunc)
 	if err != nil {
 		return nil, err
 	}
-	if c, ok := token.Claims.(*Claims); ok && token.Valid {
-		return c, nil
+	// access tokens from before typ was set are plain "JWT"; ID tokens share that
+	// type but always carry an audience, which access tokens never do
+	typ, _ := token.Header["typ"].(string)
+	if typ != TypAccess && (typ != "JWT" || len(c.Audience) > 0) {
+		return nil, jwt.ErrTokenInvalidClaims
 	}
-	return nil, jwt.ErrTokenInvalidClaims
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	return c, nil
+}
+
+// JWKS returns the public keys that downstream services need to verify our tokens.
+// Retired keys are dropped so verifiers stop trusting them too.
+func (j *JWTMaker) JWKS() JWKSet {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	now := time.Now()
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range j.keys {
+		if k.Retired(now) {
+			continue
+		}
+		if jwk, ok := k.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// keyFunc picks the verification key by kid and refuses any alg other than the key's own.
+// Tokens without a kid predate key ids and are checked against the active key.
+func (j *JWTMaker) keyFunc(token *jwt.Token) (any, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	key := j.active
+	if kid, ok := token.Header["kid"].(string); ok {
+		k, found := j.keys[kid]
+		if !found {
+			return nil, ErrUnknownKey
+		}
+		key = k
+	}
+	if key.Retired(time.Now()) {
+		return nil, ErrKeyRetired
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return key.verify, nil
+}
+
+func newJTI() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func mustKey(t *testing.T, alg string) SigningKey {
+	t.Helper()
+	k, err := GenerateSigningKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// publicFromJWK rebuilds the verification key a downstream service would get from our JWKS.
+func publicFromJWK(t *testing.T, k JWK) any {
+	t.Helper()
+	dec := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	switch k.Kty {
+	case "OKP":
+		return ed25519.PublicKey(dec(k.X))
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(dec(k.N)), E: int(new(big.Int).SetBytes(dec(k.E)).Int64())}
+	}
+	t.Fatalf("unexpected kty %q", k.Kty)
+	return nil
+}
+
+func TestAsymmetricTokensVerifyWithJWKS(t *testing.T) {
+	for _, alg := range []string{"EdDSA", "RS256"} {
+		t.Run(alg, func(t *testing.T) {
+			key := mustKey(t, alg)
+			j := NewJWTMakerWithKey(key)
+			tok, _, err := j.NewAccess("u_1", "s_1", 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := j.Parse(tok)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if c.UserID != "u_1" || c.SessionID != "s_1" || c.ID == "" {
+				t.Fatalf("claims = %+v", c)
+			}
+
+			set := j.JWKS()
+			if len(set.Keys) != 1 || set.Keys[0].Kid != key.ID || set.Keys[0].Alg != alg {
+				t.Fatalf("jwks = %+v", set)
+			}
+			pub := publicFromJWK(t, set.Keys[0])
+			parsed, err := jwt.Parse(tok, func(*jwt.Token) (any, error) { return pub, nil },
+				jwt.WithValidMethods([]string{alg}))
+			if err != nil || !parsed.Valid {
+				t.Fatalf("token does not verify with the published key: %v", err)
+			}
+			if parsed.Header["kid"] != key.ID || parsed.Header["typ"] != TypAccess {
+				t.Fatalf("header = %v", parsed.Header)
+			}
+		})
+	}
+}
+
+func TestJWKSNeverPublishesSecrets(t *testing.T) {
+	j := NewJWTMakerWithKey(NewHMACKey("old", []byte("s3cret")), mustKey(t, "EdDSA"))
+	for _, k := range j.JWKS().Keys {
+		if k.Kid == "old" {
+			t.Fatalf("HMAC key in JWKS: %+v", k)
+		}
+	}
+	if n := len(NewJWTMaker("s3cret").JWKS().Keys); n != 0 {
+		t.Fatalf("HS256-only ring publishes %d keys", n)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	ed := mustKey(t, "EdDSA")
+	j := NewJWTMakerWithKey(ed)
+	claims := Claims{UserID: "u_1", RegisteredClaims: jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}}
+	sign := func(method jwt.SigningMethod, header map[string]any, key any) string {
+		tok := jwt.NewWithClaims(method, claims)
+		for k, v := range header {
+			tok.Header[k] = v
+		}
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	// the published Ed25519 public key used as an HMAC secret
+	pubBytes := []byte(ed.verify.(ed25519.PublicKey))
+	other := mustKey(t, "EdDSA")
+	withAud := claims
+	withAud.Audience = jwt.ClaimStrings{"client"}
+	idTok, _ := j.Sign(TypIDToken, withAud)
+
+	tests := []struct {
+		name string
+		tok  string
+	}{
+		{"alg confusion", sign(jwt.SigningMethodHS256, map[string]any{"kid": ed.ID, "typ": TypAccess}, pubBytes)},
+		{"none", sign(jwt.SigningMethodNone, map[string]any{"kid": ed.ID, "typ": TypAccess}, jwt.UnsafeAllowNoneSignatureType)},
+		{"foreign key", sign(jwt.SigningMethodEdDSA, map[string]any{"kid": ed.ID, "typ": TypAccess}, other.sign)},
+		{"unknown kid", sign(jwt.SigningMethodEdDSA, map[string]any{"kid": other.ID, "typ": TypAccess}, other.sign)},
+		{"id token", idTok},
+		{"other typ", sign(jwt.SigningMethodEdDSA, map[string]any{"kid": ed.ID, "typ": "state+jwt"}, ed.sign)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := j.Parse(tt.tok); err == nil {
+				t.Fatal("token accepted")
+			}
+		})
+	}
+}
+
+func TestLoadSigningKeyPEM(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadSigningKey("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, _ := k.JWK()
+	if k.ID != k.thumbprint() || jwk.X != base64.RawURLEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)) {
+		t.Fatalf("key = %s, jwk = %+v", k.ID, jwk)
+	}
+
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if _, err := NewSigningKey("", small); err == nil {
+		t.Fatal("1024-bit RSA key accepted")
+	}
+	if _, err := GenerateSigningKey("ES256"); !errors.Is(err, ErrUnsupportedKey) {
+		t.Fatalf("ES256: %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	first := mustKey(t, "EdDSA")
+	j := NewJWTMakerWithKey(first)
+	old, _, _ := j.NewAccess("u_1", "s_1", 5)
+
+	second := mustKey(t, "RS256")
+	j.Rotate(second, time.Now().Add(time.Hour))
+	if _, err := j.Parse(old); err != nil {
+		t.Fatalf("token from the outgoing key within its grace: %v", err)
+	}
+	fresh, _, _ := j.NewAccess("u_1", "s_1", 5)
+	if tok, _, _ := new(jwt.Parser).ParseUnverified(fresh, &Claims{}); tok.Header["kid"] != second.ID {
+		t.Fatalf("new tokens signed with %v, want %s", tok.Header["kid"], second.ID)
+	}
+	if keys := j.Keys(); len(keys) != 2 || keys[0].ID != second.ID || !keys[0].Active || keys[1].RetireAfter == nil {
+		t.Fatalf("keys = %+v", keys)
+	}
+
+	// close the outgoing key's window
+	j.Rotate(mustKey(t, "EdDSA"), time.Now().Add(time.Hour))
+	j.mu.Lock()
+	k := j.keys[first.ID]
+	k.RetireAfter = time.Now().Add(-time.Second)
+	j.keys[first.ID] = k
+	j.mu.Unlock()
+	if _, err := j.Parse(old); !errors.Is(err, ErrKeyRetired) {
+		t.Fatalf("retired key: err = %v, want ErrKeyRetired", err)
+	}
+	for _, k := range j.JWKS().Keys {
+		if k.Kid == first.ID {
+			t.Fatal("retired key still published")
+		}
+	}
+
+	j.Rotate(mustKey(t, "EdDSA"), time.Now().Add(time.Hour))
+	if _, err := j.Parse(old); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("pruned key: err = %v, want ErrUnknownKey", err)
+	}
+	if n := len(j.Keys()); n != 3 {
+		t.Fatalf("ring has %d keys after pruning, want 3", n)
+	}
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	dir := t.TempDir()
+	_, priv, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pemPath := filepath.Join(dir, "new.pem")
+	if err := os.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ring := `{"active": "new", "keys": [
+		{"kid": "new", "private_key_file": "` + pemPath + `"},
+		{"kid": "default", "secret": "old_secret", "retire_after": "2999-01-01T00:00:00Z"}]}`
+	path := filepath.Join(dir, "ring.json")
+	if err := os.WriteFile(path, []byte(ring), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	active, others, err := LoadKeyRing(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ID != "new" || active.Symmetric() || len(others) != 1 || !others[0].Symmetric() {
+		t.Fatalf("active = %s, others = %+v", active.ID, others)
+	}
+
+	// tokens signed with JWT_SECRET before the switch still verify
+	old, _, _ := NewJWTMaker("old_secret").NewAccess("u_1", "", 5)
+	if _, err := NewJWTMakerWithKey(active, others...).Parse(old); err != nil {
+		t.Fatalf("token from the previous secret: %v", err)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	_ = os.WriteFile(bad, []byte(`{"active": "missing", "keys": []}`), 0o600)
+	if _, _, err := LoadKeyRing(bad); err == nil {
+		t.Fatal("ring without its active key loaded")
+	}
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnsupportedKey = errors.New("unsupported signing key type")
+	ErrUnknownKey     = errors.New("unknown signing key")
+	ErrKeyRetired     = errors.New("signing key retired")
+)
+
+// SigningKey is a single JWT key: an HS256 secret, an Ed25519 key or an RSA key.
+// Asymmetric keys are published in the JWKS so other services can verify tokens.
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	// RetireAfter stops the key from verifying tokens after this instant (zero = never).
+	RetireAfter time.Time
+	sign        any // []byte | ed25519.PrivateKey | *rsa.PrivateKey
+	verify      any // []byte | ed25519.PublicKey | *rsa.PublicKey
+}
+
+// NewHMACKey wraps a shared secret as an HS256 key.
+func NewHMACKey(id string, secret []byte) SigningKey {
+	return SigningKey{ID: id, Method: jwt.SigningMethodHS256, sign: secret, verify: secret}
+}
+
+// NewSigningKey wraps an Ed25519 (EdDSA) or RSA (RS256) private key.
+// If id is empty the RFC 7638 thumbprint of the public key is used.
+func NewSigningKey(id string, priv crypto.Signer) (SigningKey, error) {
+	var k SigningKey
+	switch p := priv.(type) {
+	case ed25519.PrivateKey:
+		k = SigningKey{Method: jwt.SigningMethodEdDSA, sign: p, verify: p.Public()}
+	case *rsa.PrivateKey:
+		if p.N.BitLen() < 2048 {
+			return SigningKey{}, fmt.Errorf("rsa key too small: %d bits", p.N.BitLen())
+		}
+		k = SigningKey{Method: jwt.SigningMethodRS256, sign: p, verify: &p.PublicKey}
+	default:
+		return SigningKey{}, ErrUnsupportedKey
+	}
+	k.ID = id
+	if k.ID == "" {
+		k.ID = k.thumbprint()
+	}
+	return k, nil
+}
+
+// GenerateSigningKey creates a fresh random key for "EdDSA", "RS256" or "HS256".
+func GenerateSigningKey(alg string) (SigningKey, error) {
+	switch alg {
+	case "EdDSA", "":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		return NewSigningKey("", priv)
+	case "RS256":
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		return NewSigningKey("", priv)
+	case "HS256":
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return SigningKey{}, err
+		}
+		id := make([]byte, 8)
+		_, _ = rand.Read(id)
+		return NewHMACKey("hs-"+hex.EncodeToString(id), secret), nil
+	}
+	return SigningKey{}, fmt.Errorf("%w: %s", ErrUnsupportedKey, alg)
+}
+
+// Retired reports whether the key may no longer verify tokens at time t.
+func (k SigningKey) Retired(t time.Time) bool {
+	return !k.RetireAfter.IsZero() && t.After(k.RetireAfter)
+}
+
+// LoadSigningKey reads a PEM encoded private key (PKCS#8 or PKCS#1) from disk.
+func LoadSigningKey(id, path string) (SigningKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	priv, err := ParsePrivateKeyPEM(raw)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewSigningKey(id, priv)
+}
+
+// ParsePrivateKeyPEM decodes the first PEM block as a private key.
+func ParsePrivateKeyPEM(raw []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if s, ok := key.(crypto.Signer); ok {
+			return s, nil
+		}
+		return nil, ErrUnsupportedKey
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// keyRingFile is the on-disk layout of JWT_KEYRING_FILE.
+//
+//	{"active": "2026-10", "keys": [
+//	  {"kid": "2026-10", "private_key_file": "keys/2026-10.pem"},
+//	  {"kid": "default", "secret": "old_jwt_secret", "retire_after": "2026-10-20T00:00:00Z"}]}
+type keyRingFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		Kid            string    `json:"kid"`
+		PrivateKeyFile string    `json:"private_key_file"`
+		Secret         string    `json:"secret"`
+		RetireAfter    time.Time `json:"retire_after"`
+	} `json:"keys"`
+}
+
+// LoadKeyRing reads a key ring file and returns the active key plus every other
+// key that is still accepted for verification.
+func LoadKeyRing(path string) (SigningKey, []SigningKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, nil, err
+	}
+	var f keyRingFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return SigningKey{}, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var (
+		active SigningKey
+		found  bool
+		others []SigningKey
+	)
+	for _, e := range f.Keys {
+		var k SigningKey
+		switch {
+		case e.PrivateKeyFile != "":
+			k, err = LoadSigningKey(e.Kid, e.PrivateKeyFile)
+			if err != nil {
+				return SigningKey{}, nil, err
+			}
+		case e.Secret != "" && e.Kid != "":
+			k = NewHMACKey(e.Kid, []byte(e.Secret))
+		default:
+			return SigningKey{}, nil, fmt.Errorf("%s: key %q needs a kid and a private_key_file or secret", path, e.Kid)
+		}
+		k.RetireAfter = e.RetireAfter
+		if k.ID == f.Active {
+			active, found = k, true
+			continue
+		}
+		others = append(others, k)
+	}
+	if !found {
+		return SigningKey{}, nil, fmt.Errorf("%s: active key %q not found", path, f.Active)
+	}
+	return active, others, nil
+}
+
+// Symmetric reports whether the key is a shared secret (never published).
+func (k SigningKey) Symmetric() bool {
+	_, ok := k.verify.([]byte)
+	return ok
+}
+
+// JWK is the public half of a signing key as served from /.well-known/jwks.json.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public JWK for an asymmetric key; ok is false for HMAC keys.
+func (k SigningKey) JWK() (JWK, bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := k.verify.(type) {
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Kid: k.ID, Use: "sig", Alg: k.Method.Alg(), Crv: "Ed25519", X: b64(pub)}, true
+	case *rsa.PublicKey:
+		e := big.NewInt(int64(pub.E)).Bytes()
+		return JWK{Kty: "RSA", Kid: k.ID, Use: "sig", Alg: k.Method.Alg(), N: b64(pub.N.Bytes()), E: b64(e)}, true
+	}
+	return JWK{}, false
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint (members in lexicographic order).
+func (k SigningKey) thumbprint() string {
+	jwk, _ := k.JWK()
+	var members any
+	switch jwk.Kty {
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	default:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	}
+	b, _ := json.Marshal(members)
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IDClaims are the OpenID Connect claims of an ID token.
+type IDClaims struct {
+	Nonce         string `json:"nonce,omitempty"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	AtHash        string `json:"at_hash,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// ErrSymmetricKey is returned for ID tokens while the active key is an HS256
+// secret: clients couldn't verify them without being able to forge them too.
+var ErrSymmetricKey = errors.New("ID tokens need an Ed25519 or RSA signing key")
+
+// NewIDToken signs an ID token for audience clientID. accessToken, when set,
+// is bound to it through at_hash.
+func (j *JWTMaker) NewIDToken(issuer, clientID string, c IDClaims, accessToken string, ttl time.Duration) (string, error) {
+	key := j.activeKey()
+	if key.Symmetric() {
+		return "", ErrSymmetricKey
+	}
+	now := time.Now()
+	c.Issuer = issuer
+	c.Audience = jwt.ClaimStrings{clientID}
+	c.IssuedAt = jwt.NewNumericDate(now)
+	c.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	if accessToken != "" {
+		c.AtHash = halfHash(key.Method.Alg(), accessToken)
+	}
+	return signWith(key, TypIDToken, c)
+}
+
+// halfHash is the left-most half of the token hash, using the hash that goes
+// with the signing alg (OIDC Core 3.1.3.6).
+func halfHash(alg, token string) string {
+	var h hash.Hash
+	switch alg {
+	case "EdDSA":
+		h = sha512.New() // Ed25519 signs with SHA-512
+	default:
+		h = sha256.New()
+	}
+	h.Write([]byte(token))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
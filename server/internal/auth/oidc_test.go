@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestNewIDToken(t *testing.T) {
+	if _, err := NewJWTMaker("secret").NewIDToken("https://mahi.test", "web", IDClaims{}, "", time.Minute); !errors.Is(err, ErrSymmetricKey) {
+		t.Fatalf("HS256: err = %v, want ErrSymmetricKey", err)
+	}
+
+	for _, alg := range []string{"EdDSA", "RS256"} {
+		t.Run(alg, func(t *testing.T) {
+			j := NewJWTMakerWithKey(mustKey(t, alg))
+			access, _, _ := j.NewOAuthAccess("u_1", "s_1", "web", "openid", 5)
+			tok, err := j.NewIDToken("https://mahi.test", "web", IDClaims{Nonce: "n-0S6"}, access, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c IDClaims
+			if err := j.ParseTyped(tok, TypIDToken, &c); err != nil {
+				t.Fatal(err)
+			}
+			if c.Issuer != "https://mahi.test" || len(c.Audience) != 1 || c.Audience[0] != "web" || c.Nonce != "n-0S6" {
+				t.Fatalf("claims = %+v", c)
+			}
+			if c.AtHash != halfHash(alg, access) || c.AtHash == halfHash(alg, access+"x") {
+				t.Fatalf("at_hash = %q", c.AtHash)
+			}
+			// an ID token is no access token
+			if _, err := j.Parse(tok); !errors.Is(err, jwt.ErrTokenInvalidClaims) {
+				t.Fatalf("ID token accepted as access token: %v", err)
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"golang.org/x/crypto/argon2"
@@ -18,11 +20,31 @@ const (
 	argonThreads uint8  = 4
 	argonKeyLen  uint32 = 32
 	saltLen             = 16
+
+	// upper bounds on what a stored hash may ask for, so a bad row can't
+	// make one login burn minutes of CPU or gigabytes of memory. Memory is
+	// held for the whole hash and the scheduler runs several at once, so it
+	// stays a small multiple of what we write ourselves.
+	maxArgonTime    uint32 = 64
+	maxArgonMemory  uint32 = 4 * argonMemory // 256MB
+	maxArgonThreads uint8  = 16
 )
 
-// HashPassword returns a versioned Argon2id hash string.
+// HashPassword returns a versioned Argon2id hash string. It hashes at once;
+// request handlers go through HashScheduler.HashPassword instead.
 // Format: v=1$t=<time>$m=<memory>$p=<threads>$<base64url(salt)>$<base64url(hash)>
 func HashPassword(plain string) (string, error) {
+	return hashPassword(context.Background(), nil, plain)
+}
+
+// HashPassword is HashPassword on the scheduler; it gives up with
+// ErrHashBusy or ctx's error.
+func (h *HashScheduler) HashPassword(ctx context.Context, plain string) (string, error) {
+	return hashPassword(ctx, h, plain)
+}
+
+// hashPassword hashes on h, or right away when h is nil.
+func hashPassword(ctx context.Context, h *HashScheduler, plain string) (string, error) {
 	if plain == "" {
 		return "", errors.New("empty password")
 	}
@@ -33,7 +55,13 @@ func HashPassword(plain string) (string, error) {
 		return "", fmt.Errorf("salt: %w", err)
 	}
 
-	sum := argon2.IDKey([]byte(plain), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	var sum []byte
+	err := h.run(ctx, func() {
+		sum = argon2.IDKey([]byte(plain), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	})
+	if err != nil {
+		return "", err
+	}
 
 	saltB64 := base64.RawURLEncoding.EncodeToString(salt)
 	sumB64 := base64.RawURLEncoding.EncodeToString(sum)
@@ -42,31 +70,111 @@ func HashPassword(plain string) (string, error) {
 	return encoded, nil
 }
 
-// VerifyPassword parses an encoded Argon2id hash and compares it to the provided password.
-func VerifyPassword(plain, encoded string) bool {
-	if plain == "" || encoded == "" {
-		return false
-	}
+// argonHash is a decoded v=1 hash string.
+type argonHash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	sum     []byte
+}
 
+func parseArgonHash(encoded string) (argonHash, bool) {
 	parts := strings.Split(encoded, "$")
 	// expect: v=1, t=.., m=.., p=.., salt, sum => 6 parts
 	if len(parts) != 6 || !strings.HasPrefix(parts[0], "v=") {
-		return false
+		return argonHash{}, false
+	}
+	t, errT := parseParam(parts[1], "t=", 32)
+	m, errM := parseParam(parts[2], "m=", 32)
+	p, errP := parseParam(parts[3], "p=", 8)
+	if errT != nil || errM != nil || errP != nil {
+		return argonHash{}, false
+	}
+	h := argonHash{time: uint32(t), memory: uint32(m), threads: uint8(p)}
+	if h.time == 0 || h.time > maxArgonTime || h.threads == 0 || h.threads > maxArgonThreads ||
+		h.memory < 8*uint32(h.threads) || h.memory > maxArgonMemory {
+		return argonHash{}, false
 	}
-	// We ignore the parsed t/m/p in this demo and use the constants above.
-	// If you want to support variable params, parse parts[1..3] and pass them into argon2.IDKey.
+	var err error
+	if h.salt, err = base64.RawURLEncoding.DecodeString(parts[4]); err != nil {
+		return argonHash{}, false
+	}
+	if h.sum, err = base64.RawURLEncoding.DecodeString(parts[5]); err != nil || len(h.sum) == 0 {
+		return argonHash{}, false
+	}
+	return h, true
+}
 
-	salt, err := base64.RawURLEncoding.DecodeString(parts[4])
-	if err != nil {
-		return false
+func parseParam(part, prefix string, bits int) (uint64, error) {
+	if !strings.HasPrefix(part, prefix) {
+		return 0, fmt.Errorf("missing %s", prefix)
 	}
-	want, err := base64.RawURLEncoding.DecodeString(parts[5])
-	if err != nil {
-		return false
+	return strconv.ParseUint(part[len(prefix):], 10, bits)
+}
+
+// argon2idScheme is our own format, the one HashPassword writes.
+type argon2idScheme struct{}
+
+func (argon2idScheme) Name() string { return "argon2id" }
+
+func (argon2idScheme) Match(encoded string) bool { return strings.HasPrefix(encoded, "v=") }
+
+func (argon2idScheme) Parse(encoded string) error {
+	if _, ok := parseArgonHash(encoded); !ok {
+		return ErrMalformedHash
 	}
+	return nil
+}
 
-	got := argon2.IDKey([]byte(plain), salt, argonTime, argonMemory, argonThreads, uint32(len(want)))
+func (argon2idScheme) Verify(plain, encoded string) bool {
+	h, ok := parseArgonHash(encoded)
+	if !ok {
+		return false
+	}
+	got := argon2.IDKey([]byte(plain), h.salt, h.time, h.memory, h.threads, uint32(len(h.sum)))
 
 	// constant-time compare
-	return subtle.ConstantTimeCompare(got, want) == 1
+	return subtle.ConstantTimeCompare(got, h.sum) == 1
+}
+
+// VerifyPassword compares a password to an encoded hash in any registered
+// scheme (see SchemeOf). Like HashPassword it runs at once.
+func VerifyPassword(plain, encoded string) bool {
+	ok, _ := verifyPassword(context.Background(), nil, plain, encoded)
+	return ok
+}
+
+// VerifyPassword is VerifyPassword on the scheduler. Legacy schemes are
+// scheduled too: scrypt is as hungry as Argon2. The error is ErrHashBusy or
+// ctx's when the password wasn't checked.
+func (h *HashScheduler) VerifyPassword(ctx context.Context, plain, encoded string) (bool, error) {
+	return verifyPassword(ctx, h, plain, encoded)
+}
+
+func verifyPassword(ctx context.Context, h *HashScheduler, plain, encoded string) (bool, error) {
+	if plain == "" || encoded == "" {
+		return false, nil
+	}
+	s, ok := SchemeOf(encoded)
+	if !ok {
+		return false, nil
+	}
+	err := h.run(ctx, func() { ok = s.Verify(plain, encoded) })
+	return ok && err == nil, err
+}
+
+// NeedsRehash reports whether encoded should be replaced: it is in another
+// scheme than ours, or was made with less work than the current parameters
+// ask for. Call it after a successful VerifyPassword and store a fresh
+// HashPassword when it returns true.
+func NeedsRehash(encoded string) bool {
+	if s, ok := SchemeOf(encoded); !ok || s.Name() != "argon2id" {
+		return ok
+	}
+	h, ok := parseArgonHash(encoded)
+	if !ok {
+		return false
+	}
+	return h.time < argonTime || h.memory < argonMemory || uint32(len(h.sum)) < argonKeyLen
 }
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseArgonHashBounds(t *testing.T) {
+	const salt, sum = "c2FsdHNhbHRzYWx0c2FsdA", "aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g"
+	tests := []struct {
+		t, m, p uint64
+		ok      bool
+	}{
+		{uint64(argonTime), uint64(argonMemory), uint64(argonThreads), true},
+		{3, uint64(maxArgonMemory), uint64(maxArgonThreads), true},
+		{1, uint64(maxArgonMemory) + 1, 4, false},
+		{1, 2 * 1024 * 1024, 4, false}, // 2 GiB
+		{1, 64 * 1024, uint64(maxArgonThreads) + 1, false},
+		{1, 64 * 1024, 0, false},
+		{0, 64 * 1024, 4, false},
+		{uint64(maxArgonTime) + 1, 64 * 1024, 4, false},
+		{1, 16, 4, false}, // below 8 KiB per lane
+	}
+	for _, tt := range tests {
+		encoded := fmt.Sprintf("v=1$t=%d$m=%d$p=%d$%s$%s", tt.t, tt.m, tt.p, salt, sum)
+		if _, ok := parseArgonHash(encoded); ok != tt.ok {
+			t.Errorf("parseArgonHash(t=%d m=%d p=%d) ok = %v, want %v", tt.t, tt.m, tt.p, ok, tt.ok)
+		}
+	}
+}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	h, err := HashPassword("plum orbit canvas ladder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyPassword("plum orbit canvas ladder", h) || VerifyPassword("plum orbit canvas", h) {
+		t.Fatal("hash doesn't verify exactly its password")
+	}
+	if NeedsRehash(h) {
+		t.Fatal("a fresh hash needs a rehash")
+	}
+}
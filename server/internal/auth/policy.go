@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy decides whether a new password is acceptable.
+type PasswordPolicy struct {
+	MinLength   int         // in characters
+	MaxLength   int         // caps the work one Argon2 hash can be made to do
+	MinStrength int         // 0-4, see Strength
+	Breached    *BreachList // optional local Have I Been Pwned corpus
+}
+
+// PasswordContext is what we know about the account a password is for.
+type PasswordContext struct {
+	Email string
+	Name  string
+}
+
+// Violation is one reason a password was refused. Code is stable for
+// clients; Message can be shown to the user.
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Check returns everything wrong with password, or nil. The error is only
+// about reading the breach list; the other rules still apply when it fails.
+func (p PasswordPolicy) Check(password string, ctx PasswordContext) ([]Violation, error) {
+	var out []Violation
+	n := len([]rune(password))
+	if n < p.MinLength {
+		out = append(out, Violation{"too_short", fmt.Sprintf("Use at least %d characters.", p.MinLength)})
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		// nothing else is worth checking on a password we won't hash
+		return append(out, Violation{"too_long", fmt.Sprintf("Use at most %d characters.", p.MaxLength)}), nil
+	}
+	if containsPersonal(password, ctx) {
+		out = append(out, Violation{"contains_personal_info", "Don't use your name or email address in your password."})
+	}
+	if n >= p.MinLength && Strength(password) < p.MinStrength {
+		out = append(out, Violation{"too_weak", "This password is too easy to guess. Try a longer phrase or mix in unrelated words."})
+	}
+	var err error
+	if p.Breached != nil && password != "" {
+		var found bool
+		if found, err = p.Breached.Contains(password); found {
+			out = append(out, Violation{"breached", "This password has appeared in a data breach. Choose a different one."})
+		}
+	}
+	return out, err
+}
+
+// containsPersonal reports whether password contains the email address, its
+// local part or a part of the name (3 characters or more), ignoring case.
+func containsPersonal(password string, ctx PasswordContext) bool {
+	pw := strings.ToLower(password)
+	email := strings.ToLower(strings.TrimSpace(ctx.Email))
+	local, _, _ := strings.Cut(email, "@")
+	parts := []string{email}
+	parts = append(parts, strings.FieldsFunc(local, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })...)
+	parts = append(parts, strings.Fields(strings.ToLower(ctx.Name))...)
+	for _, part := range parts {
+		if len([]rune(part)) >= 3 && strings.Contains(pw, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strength estimates how hard password is to guess, from 0 (trivial) to 4
+// (strong). It is a rough entropy count over the character classes used, in
+// which repeats, keyboard or alphabet runs and common passwords or words add
+// next to nothing.
+func Strength(password string) int {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+	plain := unleet(strings.ToLower(password))
+	if commonPasswords[plain] {
+		return 0
+	}
+	// characters a guesser must actually find
+	effective := 0.0
+	for i, r := range runes {
+		switch {
+		case i > 0 && unicode.ToLower(r) == unicode.ToLower(runes[i-1]):
+			effective += 0.1 // aaaa
+		case i > 0 && (r-runes[i-1] == 1 || runes[i-1]-r == 1):
+			effective += 0.2 // abcd, 4321
+		case i > 0 && adjacentKeys(runes[i-1], r):
+			effective += 0.3 // qwerty
+		default:
+			effective++
+		}
+	}
+	for _, w := range commonWords {
+		if strings.Contains(plain, w) {
+			// a dictionary word costs about as much as two random characters
+			effective -= float64(len(w)) - 2
+		}
+	}
+	bits := math.Max(effective, 0) * math.Log2(float64(poolSize(runes)))
+	switch {
+	case bits < 25:
+		return 0
+	case bits < 35:
+		return 1
+	case bits < 50:
+		return 2
+	case bits < 65:
+		return 3
+	}
+	return 4
+}
+
+func poolSize(runes []rune) int {
+	var lower, upper, digit, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if c.used {
+			n += c.size
+		}
+	}
+	return max(n, 2)
+}
+
+var unleetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+func unleet(s string) string { return unleetReplacer.Replace(s) }
+
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+func adjacentKeys(a, b rune) bool {
+	a, b = unicode.ToLower(a), unicode.ToLower(b)
+	for _, row := range keyboardRows {
+		i, j := strings.IndexRune(row, a), strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// a short list of what people pick most; the breach list covers the long tail
+var commonPasswords = map[string]bool{}
+
+var commonWords = []string{
+	"password", "passwort", "letmein", "welcome", "qwerty", "dragon", "monkey", "master",
+	"login", "admin", "secret", "shadow", "sunshine", "princess", "football", "baseball",
+	"iloveyou", "trustno", "superman", "batman", "mahi", "hello", "freedom", "whatever",
+}
+
+func init() {
+	for _, p := range []string{
+		"123456", "123456789", "12345678", "password", "qwerty", "12345", "1234567", "111111",
+		"1234567890", "123123", "abc123", "000000", "iloveyou", "password1", "qwerty123",
+		"admin", "welcome", "letmein", "monkey", "dragon", "sunshine", "princess", "football",
+		"passw0rd", "changeme", "trustno1", "starwars", "whatever", "qwertyuiop", "1q2w3e4r",
+	} {
+		commonPasswords[unleet(p)] = true
+	}
+}
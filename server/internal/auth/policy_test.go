@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	p := PasswordPolicy{MinLength: 8, MaxLength: 64, MinStrength: 2}
+	ctx := PasswordContext{Email: "jane.doe@example.com", Name: "Jane Doe"}
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"passphrase", "plum orbit canvas ladder", nil},
+		{"empty", "", []string{"too_short"}},
+		{"short", "Xq7#", []string{"too_short"}},
+		{"too long skips the rest", strings.Repeat("a", 65), []string{"too_long"}},
+		{"common", "password", []string{"too_weak"}},
+		{"leet common", "P@ssw0rd", []string{"too_weak"}},
+		{"keyboard run", "qwertyuiop", []string{"too_weak"}},
+		{"repeats", "aaaaaaaaaaaa", []string{"too_weak"}},
+		{"email local part", "doe plum orbit canvas", []string{"contains_personal_info"}},
+		{"name, any case", "JANE plum orbit canvas", []string{"contains_personal_info"}},
+		{"short name parts don't count", "plum orbit canvas ex", nil},
+		{"short and personal", "jane", []string{"too_short", "contains_personal_info"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vs, err := p.Check(tt.password, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range vs {
+				got = append(got, v.Code)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Check(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		min, max int
+	}{
+		{"", 0, 0},
+		{"123456", 0, 0},
+		{"abcdefgh", 0, 0},
+		{"11111111111111", 0, 0},
+		{"Tr0ub4dor", 1, 2},
+		{"plum orbit canvas ladder", 4, 4},
+		{"k#8Vq!2zLp9@", 3, 4},
+	}
+	for _, tt := range tests {
+		if got := Strength(tt.password); got < tt.min || got > tt.max {
+			t.Errorf("Strength(%q) = %d, want %d..%d", tt.password, got, tt.min, tt.max)
+		}
+	}
+}
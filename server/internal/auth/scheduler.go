@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHashBusy means the hashing queue is full, or a caller waited in it for
+// longer than the scheduler allows. Callers should ask the client to retry.
+var ErrHashBusy = errors.New("password hashing is saturated")
+
+// HashScheduler bounds how many password hashes run at once. Each Argon2
+// hash takes argonMemory (64MB) for its duration, so without a bound a burst
+// of logins turns straight into a burst of allocations. Callers over the
+// limit wait in a queue of bounded length; when that is full they are
+// turned away at once rather than piling up.
+type HashScheduler struct {
+	slots    chan struct{}
+	maxQueue int64
+	maxWait  time.Duration
+
+	queued   atomic.Int64
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	completed uint64
+	rejected  uint64
+	canceled  uint64
+	hashTime  time.Duration // total, for the mean
+	waitTime  time.Duration
+	maxHash   time.Duration
+	avgHash   time.Duration // moving average, for RetryAfter
+}
+
+// HashStats is a snapshot of a HashScheduler's metrics.
+type HashStats struct {
+	MaxConcurrent int     `json:"max_concurrent"`
+	MaxQueue      int     `json:"max_queue"`
+	InFlight      int64   `json:"in_flight"`
+	QueueDepth    int64   `json:"queue_depth"`
+	Completed     uint64  `json:"completed"`
+	Rejected      uint64  `json:"rejected"` // queue full or waited too long
+	Canceled      uint64  `json:"canceled"` // the caller gave up while queued
+	MeanHashMS    float64 `json:"mean_hash_ms"`
+	MaxHashMS     float64 `json:"max_hash_ms"`
+	MeanWaitMS    float64 `json:"mean_wait_ms"`
+}
+
+// NewHashScheduler runs up to maxConcurrent hashes at once and queues up to
+// maxQueue more, each for at most maxWait.
+func NewHashScheduler(maxConcurrent, maxQueue int, maxWait time.Duration) *HashScheduler {
+	return &HashScheduler{
+		slots:    make(chan struct{}, max(1, maxConcurrent)),
+		maxQueue: int64(max(0, maxQueue)),
+		maxWait:  maxWait,
+	}
+}
+
+// run is Do, except that a nil scheduler runs fn right away.
+func (h *HashScheduler) run(ctx context.Context, fn func()) error {
+	if h == nil {
+		fn()
+		return nil
+	}
+	return h.Do(ctx, fn)
+}
+
+// Do runs fn once a slot is free. It returns ErrHashBusy when the queue is
+// full or the wait runs past maxWait, and ctx's error when ctx ends first;
+// fn has not run in either case.
+func (h *HashScheduler) Do(ctx context.Context, fn func()) error {
+	var waited time.Duration
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		if h.queued.Add(1) > h.maxQueue {
+			h.queued.Add(-1)
+			h.count(&h.rejected)
+			return ErrHashBusy
+		}
+		start := time.Now()
+		timer := time.NewTimer(h.maxWait)
+		select {
+		case h.slots <- struct{}{}:
+			timer.Stop()
+			h.queued.Add(-1)
+			waited = time.Since(start)
+		case <-timer.C:
+			h.queued.Add(-1)
+			h.count(&h.rejected)
+			return ErrHashBusy
+		case <-ctx.Done():
+			timer.Stop()
+			h.queued.Add(-1)
+			h.count(&h.canceled)
+			return ctx.Err()
+		}
+	}
+	h.inFlight.Add(1)
+	defer func() {
+		h.inFlight.Add(-1)
+		<-h.slots
+	}()
+
+	start := time.Now()
+	fn()
+	h.observe(time.Since(start), waited)
+	return nil
+}
+
+func (h *HashScheduler) count(n *uint64) {
+	h.mu.Lock()
+	*n++
+	h.mu.Unlock()
+}
+
+func (h *HashScheduler) observe(took, waited time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.completed++
+	h.hashTime += took
+	h.waitTime += waited
+	h.maxHash = max(h.maxHash, took)
+	if h.avgHash == 0 {
+		h.avgHash = took
+	} else {
+		h.avgHash += (took - h.avgHash) / 8
+	}
+}
+
+// RetryAfter estimates when a turned-away caller would find room: the time
+// to drain the current queue at the recent pace, and at least a second.
+func (h *HashScheduler) RetryAfter() time.Duration {
+	h.mu.Lock()
+	avg := h.avgHash
+	h.mu.Unlock()
+	rounds := h.queued.Load()/int64(cap(h.slots)) + 1
+	return max(time.Second, time.Duration(rounds)*avg)
+}
+
+// Stats returns the scheduler's metrics.
+func (h *HashScheduler) Stats() HashStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := HashStats{
+		MaxConcurrent: cap(h.slots),
+		MaxQueue:      int(h.maxQueue),
+		InFlight:      h.inFlight.Load(),
+		QueueDepth:    h.queued.Load(),
+		Completed:     h.completed,
+		Rejected:      h.rejected,
+		Canceled:      h.canceled,
+		MaxHashMS:     ms(h.maxHash),
+	}
+	if h.completed > 0 {
+		st.MeanHashMS = ms(h.hashTime / time.Duration(h.completed))
+		st.MeanWaitMS = ms(h.waitTime / time.Duration(h.completed))
+	}
+	return st
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
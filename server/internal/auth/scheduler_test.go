@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// occupy fills every slot of h until the returned func is called.
+func occupy(t *testing.T, h *HashScheduler) (release func()) {
+	t.Helper()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < cap(h.slots); i++ {
+		running := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = h.Do(context.Background(), func() { close(running); <-done })
+		}()
+		<-running
+	}
+	return func() { close(done); wg.Wait() }
+}
+
+func TestHashSchedulerDo(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxQueue      int
+		maxWait       time.Duration
+		busy          bool          // all slots taken when the call is made
+		releaseAfter  time.Duration // when they free up; 0 never during the call
+		cancelAfter   time.Duration
+		wantErr       error
+		wantRan       bool
+		wantRejected  uint64
+		wantCanceled  uint64
+		wantCompleted uint64
+	}{
+		{name: "free slot", maxQueue: 0, maxWait: time.Second, wantRan: true, wantCompleted: 1},
+		{name: "no queue", maxQueue: 0, maxWait: time.Second, busy: true, wantErr: ErrHashBusy, wantRejected: 1},
+		{name: "waits for a slot", maxQueue: 1, maxWait: time.Second, busy: true, releaseAfter: 20 * time.Millisecond,
+			wantRan: true, wantCompleted: 3},
+		{name: "waited too long", maxQueue: 1, maxWait: 20 * time.Millisecond, busy: true, wantErr: ErrHashBusy, wantRejected: 1},
+		{name: "caller gave up", maxQueue: 1, maxWait: time.Second, busy: true, cancelAfter: 20 * time.Millisecond,
+			wantErr: context.Canceled, wantCanceled: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHashScheduler(2, tt.maxQueue, tt.maxWait)
+			release := func() {}
+			if tt.busy {
+				release = occupy(t, h)
+			}
+			if tt.releaseAfter > 0 {
+				time.AfterFunc(tt.releaseAfter, release)
+			} else {
+				defer release()
+			}
+			ctx := context.Background()
+			if tt.cancelAfter > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(tt.cancelAfter, cancel)
+			}
+
+			ran := false
+			err := h.Do(ctx, func() { ran = true })
+			if !errors.Is(err, tt.wantErr) || ran != tt.wantRan {
+				t.Fatalf("err = %v ran = %v, want %v / %v", err, ran, tt.wantErr, tt.wantRan)
+			}
+			if tt.releaseAfter > 0 {
+				// the occupying calls finish right after ours starts
+				deadline := time.Now().Add(time.Second)
+				for h.Stats().Completed < tt.wantCompleted && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			st := h.Stats()
+			if st.Rejected != tt.wantRejected || st.Canceled != tt.wantCanceled || st.Completed != tt.wantCompleted {
+				t.Fatalf("stats %+v", st)
+			}
+			if st.QueueDepth != 0 {
+				t.Fatalf("queue depth %d after the call", st.QueueDepth)
+			}
+		})
+	}
+}
+
+func TestHashSchedulerQueueBound(t *testing.T) {
+	h := NewHashScheduler(1, 2, time.Second)
+	release := occupy(t, h)
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- h.Do(context.Background(), func() {}) }()
+	}
+	deadline := time.Now().Add(time.Second)
+	for h.Stats().QueueDepth < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// the queue is full: turned away at once, not after maxWait
+	start := time.Now()
+	if err := h.Do(context.Background(), func() {}); !errors.Is(err, ErrHashBusy) || time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("third caller: err = %v after %s", err, time.Since(start))
+	}
+	if ra := h.RetryAfter(); ra < time.Second {
+		t.Fatalf("RetryAfter = %s, want at least a second", ra)
+	}
+	release()
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("queued caller: %v", err)
+		}
+	}
+}
+
+func TestHashPasswordWhenSaturated(t *testing.T) {
+	h := NewHashScheduler(1, 0, time.Second)
+	release := occupy(t, h)
+	defer release()
+
+	if _, err := h.HashPassword(context.Background(), "plum orbit canvas ladder"); !errors.Is(err, ErrHashBusy) {
+		t.Fatalf("HashPassword err = %v", err)
+	}
+	ok, err := h.VerifyPassword(context.Background(), "plum orbit canvas ladder", "v=1$t=1$m=65536$p=4$c2FsdA$aGFzaA")
+	if ok || !errors.Is(err, ErrHashBusy) {
+		t.Fatalf("VerifyPassword = %v, %v", ok, err)
+	}
+}
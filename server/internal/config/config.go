@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -10,6 +11,42 @@ import (
 type Config struct {
 	Port           string
 	JWTSecret      string
+	JWTKeyFile     string // PEM private key (Ed25519 or RSA); when set it replaces JWT_SECRET for signing
+	JWTKeyID       string // kid for JWTKeyFile; defaults to the key's RFC 7638 thumbprint
+	JWTKeyRingFile string // JSON key ring (active + verify-only keys); takes precedence over the two above
+	AdminToken     string // shared secret for /v1/admin; admin routes are disabled when empty
+	TokenPepper    string // HMAC key for refresh tokens at rest; changing it logs everyone out
+	RevocationSyncSec int // how often each instance pulls revoked sessions/jtis from the store
+	OAuthClientsFile string // JSON list of OAuth clients registered on startup
+	Issuer         string // public base URL of this server; OIDC "iss" and discovery endpoints
+	FederationFile string // JSON config of upstream identity providers (Google, Apple, GitHub)
+	DataKey        string // encrypts secrets at rest (TOTP seeds); changing it breaks existing MFA enrollments
+	MFAIssuer      string // issuer label shown in authenticator apps
+	WebAuthnRPID   string // passkey relying party ID; defaults to the Issuer host
+	WebAuthnOrigins string // comma-separated origins allowed in passkey ceremonies; defaults to Issuer
+	AppURL         string // base of links into the app in emails: a deep link scheme or a universal link URL
+	MailDriver     string // "stdout" | "file" | "smtp"
+	MailFrom       string // From header of account emails
+	MailFile       string // where the "file" driver appends messages
+	SMTPAddr       string // host:port of the mail server for the "smtp" driver
+	SMTPUsername   string
+	SMTPPassword   string
+	PasswordMinLength   int
+	PasswordMaxLength   int    // caps Argon2 input
+	PasswordMinStrength int    // 0-4, see auth.Strength
+	PasswordBreachFile  string // local Have I Been Pwned SHA-1 corpus (file or directory of range files); off when empty
+	LoginMaxFailures    int // wrong passwords in a row before an account is locked
+	LoginLockoutMin     int
+	LoginIPMaxFailures  int // wrong passwords from one address before it is blocked
+	HashMaxConcurrent   int // password hashes at once; each Argon2 hash takes 64MB
+	HashQueueSize       int // hashes that may wait for a slot before we answer 503
+	HashQueueTimeoutMS  int
+	RateLimitBackend    string // "memory" | "store" (shared by all instances) | "off"
+	TrustedProxies      string // comma-separated addresses/CIDRs whose X-Forwarded-For we believe
+	FirebaseSignerKey     string // base64 "base64_signer_key" of a Firebase project whose users are imported
+	FirebaseSaltSeparator string // base64 "base64_salt_separator"
+	FirebaseRounds        int
+	FirebaseMemCost       int
 	AccessTTLMin   int
 	RefreshTTLDays int
 	DBPath          string
@@ -22,9 +59,46 @@ type Config struct {
 func Load() Config {
     _ = godotenv.Overload(".env") 
 
+    port := getEnv("PORT", "8080")
     return Config{
-        Port:           getEnv("PORT", "8080"),
+        Port:           port,
         JWTSecret:      getEnv("JWT_SECRET", "change_me"),
+        JWTKeyFile:     getEnv("JWT_KEY_FILE", ""),
+        JWTKeyID:       getEnv("JWT_KEY_ID", ""),
+        JWTKeyRingFile: getEnv("JWT_KEYRING_FILE", ""),
+        AdminToken:     getEnv("ADMIN_TOKEN", ""),
+        TokenPepper:    getEnv("TOKEN_PEPPER", "change_me_pepper"),
+        RevocationSyncSec: getEnvInt("REVOCATION_SYNC_SEC", 5),
+        OAuthClientsFile: getEnv("OAUTH_CLIENTS_FILE", ""),
+        Issuer:         strings.TrimSuffix(getEnv("ISSUER", "http://localhost:"+port), "/"),
+        FederationFile: getEnv("FEDERATION_FILE", ""),
+        DataKey:        getEnv("DATA_KEY", "change_me_data_key"),
+        MFAIssuer:      getEnv("MFA_ISSUER", "Mahi"),
+        WebAuthnRPID:   getEnv("WEBAUTHN_RP_ID", ""),
+        WebAuthnOrigins: getEnv("WEBAUTHN_ORIGINS", ""),
+        AppURL:         getEnv("APP_URL", "mahiapp://"),
+        MailDriver:     getEnv("MAIL_DRIVER", "stdout"),
+        MailFrom:       getEnv("MAIL_FROM", "Mahi <no-reply@localhost>"),
+        MailFile:       getEnv("MAIL_FILE", "data/mail.log"),
+        SMTPAddr:       getEnv("SMTP_ADDR", ""),
+        SMTPUsername:   getEnv("SMTP_USERNAME", ""),
+        SMTPPassword:   getEnv("SMTP_PASSWORD", ""),
+        PasswordMinLength:   getEnvInt("PASSWORD_MIN_LENGTH", 8),
+        PasswordMaxLength:   getEnvInt("PASSWORD_MAX_LENGTH", 128),
+        PasswordMinStrength: getEnvInt("PASSWORD_MIN_STRENGTH", 2),
+        PasswordBreachFile:  getEnv("PASSWORD_BREACH_FILE", ""),
+        LoginMaxFailures:    getEnvInt("LOGIN_MAX_FAILURES", 5),
+        LoginLockoutMin:     getEnvInt("LOGIN_LOCKOUT_MIN", 15),
+        LoginIPMaxFailures:  getEnvInt("LOGIN_IP_MAX_FAILURES", 50),
+        HashMaxConcurrent:   getEnvInt("HASH_MAX_CONCURRENT", 4),
+        HashQueueSize:       getEnvInt("HASH_QUEUE_SIZE", 32),
+        HashQueueTimeoutMS:  getEnvInt("HASH_QUEUE_TIMEOUT_MS", 5000),
+        RateLimitBackend:    getEnv("RATE_LIMIT_BACKEND", "memory"),
+        TrustedProxies:      getEnv("TRUSTED_PROXIES", ""),
+        FirebaseSignerKey:     getEnv("FIREBASE_SIGNER_KEY", ""),
+        FirebaseSaltSeparator: getEnv("FIREBASE_SALT_SEPARATOR", "Bw=="),
+        FirebaseRounds:        getEnvInt("FIREBASE_ROUNDS", 8),
+        FirebaseMemCost:       getEnvInt("FIREBASE_MEM_COST", 14),
         AccessTTLMin:   getEnvInt("ACCESS_TTL_MIN", 15),
         RefreshTTLDays: getEnvInt("REFRESH_TTL_DAYS", 30),
         DBPath:         getEnv("DB_PATH", "data/app.db"),
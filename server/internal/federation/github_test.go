@@ -0,0 +1,109 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type ghEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// newMockGitHub serves the token, user and emails endpoints GitHub sign-in uses.
+func newMockGitHub(t *testing.T, emails []ghEmail) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		// GitHub answers a bad code with 200 and an error field
+		if r.PostForm.Get("code") != "good" || r.PostForm.Get("code_verifier") != "v" || r.PostForm.Get("client_secret") != "s3cret" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad_verification_code"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "gho_test", "token_type": "bearer"})
+	})
+	authed := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer gho_test" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+	mux.HandleFunc("/user", authed(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"id": 583231, "login": "octocat", "name": ""})
+	}))
+	mux.HandleFunc("/user/emails", authed(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(emails)
+	}))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestGitHub(t *testing.T, srv *httptest.Server) Provider {
+	return newTestProvider(t, ProviderConfig{
+		Name: "github", ClientID: "gh-client", ClientSecret: "s3cret",
+		AuthURL: srv.URL + "/login/oauth/authorize", TokenURL: srv.URL + "/login/oauth/access_token",
+		UserInfoURL: srv.URL + "/user", EmailsURL: srv.URL + "/user/emails",
+	})
+}
+
+func TestGitHubExchange(t *testing.T) {
+	tests := []struct {
+		name         string
+		emails       []ghEmail
+		wantEmail    string
+		wantVerified bool
+	}{
+		{
+			name: "primary verified",
+			emails: []ghEmail{
+				{Email: "old@example.com", Verified: true},
+				{Email: "octo@example.com", Primary: true, Verified: true},
+			},
+			wantEmail: "octo@example.com", wantVerified: true,
+		},
+		{
+			name:   "primary unverified",
+			emails: []ghEmail{{Email: "octo@example.com", Primary: true}, {Email: "other@example.com", Verified: true}},
+		},
+		{name: "no emails"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestGitHub(t, newMockGitHub(t, tt.emails))
+			ident, err := p.Exchange(context.Background(), "good", "https://mahi.test/cb", "v", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// name falls back to the login; the subject is the numeric id
+			if ident.Subject != "583231" || ident.Name != "octocat" || ident.Provider != "github" {
+				t.Fatalf("identity = %+v", ident)
+			}
+			if ident.Email != tt.wantEmail || ident.EmailVerified != tt.wantVerified {
+				t.Fatalf("email = %q verified=%v, want %q verified=%v", ident.Email, ident.EmailVerified, tt.wantEmail, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestGitHubRejects(t *testing.T) {
+	p := newTestGitHub(t, newMockGitHub(t, nil))
+	if _, err := p.Exchange(context.Background(), "bad", "https://mahi.test/cb", "v", ""); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("bad code: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := p.Exchange(context.Background(), "good", "https://mahi.test/cb", "wrong", ""); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("wrong verifier: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := p.VerifyIDToken(context.Background(), "x", "n"); !errors.Is(err, ErrNoIDToken) {
+		t.Fatalf("VerifyIDToken: err = %v, want ErrNoIDToken", err)
+	}
+}
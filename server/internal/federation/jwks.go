@@ -0,0 +1,121 @@
+package federation
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstream keys rotate rarely; an unknown kid triggers an early refetch anyway
+const (
+	jwksMaxAge      = time.Hour
+	jwksMinInterval = 30 * time.Second
+)
+
+// keySet caches a provider's JWKS.
+type keySet struct {
+	url     string
+	client  *http.Client
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+}
+
+// key returns the verification key for kid, refetching the set when the
+// cache is old or the kid is new (but not more than every jwksMinInterval).
+func (ks *keySet) key(ctx context.Context, kid string) (any, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if k, ok := ks.keys[kid]; ok && time.Since(ks.fetched) < jwksMaxAge {
+		return k, nil
+	}
+	if time.Since(ks.fetched) >= jwksMinInterval {
+		if err := ks.refreshLocked(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if k, ok := ks.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: unknown kid %q", ErrInvalidToken, kid)
+}
+
+func (ks *keySet) refreshLocked(ctx context.Context) error {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, ks.client, ks.url, "", &set); err != nil {
+		return err
+	}
+	b64 := base64.RawURLEncoding.DecodeString
+	keys := map[string]any{}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := b64(k.N)
+			e, err2 := b64(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err1 := b64(k.X)
+			y, err2 := b64(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "OKP":
+			x, err := b64(k.X)
+			if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			keys[k.Kid] = ed25519.PublicKey(x)
+		}
+	}
+	ks.keys = keys
+	ks.fetched = time.Now()
+	return nil
+}
+
+// getJSON GETs url (with an optional bearer token) and decodes the JSON body into v.
+func getJSON(ctx context.Context, client *http.Client, url, bearer string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpstream, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: GET %s: %s", ErrUpstream, url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,233 @@
+package federation
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mahi/server/internal/auth"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// oidcProvider signs in with any OpenID Connect issuer (Google, Apple, ...).
+type oidcProvider struct {
+	cfg      ProviderConfig
+	client   *http.Client
+	appleKey *ecdsa.PrivateKey // set when the client secret is minted (Sign in with Apple)
+	discover sync.Mutex
+	keys     *keySet
+	algs     []string
+}
+
+func newOIDC(pc ProviderConfig, client *http.Client) (*oidcProvider, error) {
+	p := &oidcProvider{cfg: pc, client: client, algs: []string{"RS256", "ES256", "EdDSA"}}
+	if pc.PrivateKeyFile != "" {
+		raw, err := os.ReadFile(pc.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := auth.ParsePrivateKeyPEM(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pc.PrivateKeyFile, err)
+		}
+		ec, ok := priv.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: %w: need an ES256 key", pc.PrivateKeyFile, auth.ErrUnsupportedKey)
+		}
+		p.appleKey = ec
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) Name() string { return p.cfg.Name }
+
+// endpoints fills missing URLs from the issuer's discovery document (once).
+func (p *oidcProvider) endpoints(ctx context.Context) error {
+	p.discover.Lock()
+	defer p.discover.Unlock()
+	if p.cfg.AuthURL != "" && p.cfg.TokenURL != "" && p.cfg.JWKSURL != "" {
+		if p.keys == nil {
+			p.keys = &keySet{url: p.cfg.JWKSURL, client: p.client}
+		}
+		return nil
+	}
+	if p.cfg.Issuer == "" {
+		return fmt.Errorf("federation: provider %q needs an issuer or explicit endpoints", p.cfg.Name)
+	}
+	var doc struct {
+		AuthURL     string `json:"authorization_endpoint"`
+		TokenURL    string `json:"token_endpoint"`
+		UserInfoURL string `json:"userinfo_endpoint"`
+		JWKSURL     string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, p.client, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", "", &doc); err != nil {
+		return err
+	}
+	set := func(dst *string, v string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	set(&p.cfg.AuthURL, doc.AuthURL)
+	set(&p.cfg.TokenURL, doc.TokenURL)
+	set(&p.cfg.UserInfoURL, doc.UserInfoURL)
+	set(&p.cfg.JWKSURL, doc.JWKSURL)
+	p.keys = &keySet{url: p.cfg.JWKSURL, client: p.client}
+	return nil
+}
+
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, redirectURL, state, nonce, challenge string) (string, error) {
+	if err := p.endpoints(ctx); err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	if p.cfg.ResponseMode != "" {
+		q.Set("response_mode", p.cfg.ResponseMode)
+	}
+	return withQuery(p.cfg.AuthURL, q), nil
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code, redirectURL, verifier, nonce string) (Identity, error) {
+	if err := p.endpoints(ctx); err != nil {
+		return Identity{}, err
+	}
+	secret, err := p.clientSecret()
+	if err != nil {
+		return Identity{}, err
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {secret},
+		"code_verifier": {verifier},
+	}
+	if err := postForm(ctx, p.client, p.cfg.TokenURL, form, &tok); err != nil {
+		return Identity{}, err
+	}
+	if tok.IDToken == "" {
+		return Identity{}, fmt.Errorf("%w: no id_token in token response", ErrUpstream)
+	}
+	return p.VerifyIDToken(ctx, tok.IDToken, nonce)
+}
+
+// upstreamClaims are the ID token claims we read. Apple sends email_verified as a string.
+type upstreamClaims struct {
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"`
+	Name          string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+func (p *oidcProvider) VerifyIDToken(ctx context.Context, raw, nonce string) (Identity, error) {
+	if err := p.endpoints(ctx); err != nil {
+		return Identity{}, err
+	}
+	var c upstreamClaims
+	_, err := jwt.ParseWithClaims(raw, &c, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.keys.key(ctx, kid)
+	}, jwt.WithValidMethods(p.algs), jwt.WithExpirationRequired(), jwt.WithLeeway(time.Minute))
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	// Google also issues tokens with the scheme-less "accounts.google.com"
+	if c.Issuer != p.cfg.Issuer && c.Issuer != strings.TrimPrefix(p.cfg.Issuer, "https://") {
+		return Identity{}, fmt.Errorf("%w: issuer %q", ErrInvalidToken, c.Issuer)
+	}
+	if !p.audienceOK(c.Audience) {
+		return Identity{}, fmt.Errorf("%w: audience %v", ErrInvalidToken, c.Audience)
+	}
+	// without a nonce any ID token minted for our client id could be replayed until it expires
+	if nonce == "" || c.Nonce == "" {
+		return Identity{}, fmt.Errorf("%w: nonce required", ErrInvalidToken)
+	}
+	if c.Nonce != nonce {
+		return Identity{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	if c.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no sub", ErrInvalidToken)
+	}
+	verified := c.EmailVerified == true || c.EmailVerified == "true"
+	return Identity{Provider: p.cfg.Name, Subject: c.Subject, Email: c.Email, EmailVerified: verified, Name: c.Name}, nil
+}
+
+func (p *oidcProvider) audienceOK(aud jwt.ClaimStrings) bool {
+	for _, a := range aud {
+		if a == p.cfg.ClientID {
+			return true
+		}
+		for _, extra := range p.cfg.Audiences {
+			if a == extra {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientSecret is the configured secret, or for Apple a short-lived ES256 JWT.
+func (p *oidcProvider) clientSecret() (string, error) {
+	if p.appleKey == nil {
+		return p.cfg.ClientSecret, nil
+	}
+	now := time.Now()
+	t := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Issuer:    p.cfg.TeamID,
+		Subject:   p.cfg.ClientID,
+		Audience:  jwt.ClaimStrings{p.cfg.Issuer},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+	})
+	t.Header["kid"] = p.cfg.KeyID
+	return t.SignedString(p.appleKey)
+}
+
+// postForm POSTs a form and decodes the JSON answer into v.
+func postForm(ctx context.Context, client *http.Client, endpoint string, form url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpstream, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: POST %s: %s", ErrUpstream, endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func withQuery(base string, q url.Values) string {
+	if strings.Contains(base, "?") {
+		return base + "&" + q.Encode()
+	}
+	return base + "?" + q.Encode()
+}
@@ -0,0 +1,324 @@
+package federation
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, JWKS and a token
+// endpoint that enforces PKCE.
+type mockIdP struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+	kid string
+
+	mu    sync.Mutex
+	codes map[string]pendingCode
+	// checkSecret validates client_secret on the token endpoint when set
+	checkSecret func(string) error
+}
+
+type pendingCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, kid: "idp-1", codes: map[string]pendingCode{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.srv.URL,
+			"authorization_endpoint": idp.srv.URL + "/authorize",
+			"token_endpoint":         idp.srv.URL + "/token",
+			"jwks_uri":               idp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": idp.kid, "alg": "RS256",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		if idp.checkSecret != nil {
+			if err := idp.checkSecret(r.PostForm.Get("client_secret")); err != nil {
+				t.Errorf("client_secret: %v", err)
+				http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+				return
+			}
+		}
+		idp.mu.Lock()
+		pc, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != pc.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "id_token": idp.sign(t, pc.claims)})
+	})
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// authorize plays the user approving the sign-in and returns the code.
+func (idp *mockIdP) authorize(challenge string, claims jwt.MapClaims) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	code := "code-" + time.Now().Format("150405.000000000")
+	idp.codes[code] = pendingCode{challenge: challenge, claims: claims}
+	return code
+}
+
+func (idp *mockIdP) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = idp.kid
+	s, err := tok.SignedString(idp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// claims returns a valid ID token payload for client "web", overridden by extra.
+func (idp *mockIdP) claims(extra jwt.MapClaims) jwt.MapClaims {
+	c := jwt.MapClaims{
+		"iss":            idp.srv.URL,
+		"aud":            "web",
+		"sub":            "upstream-42",
+		"email":          "ana@example.com",
+		"email_verified": true,
+		"name":           "Ana",
+		"nonce":          "n-1",
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+func newTestProvider(t *testing.T, pc ProviderConfig) Provider {
+	t.Helper()
+	reg, err := New([]ProviderConfig{pc}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := reg.Get(pc.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestOIDCCodeFlowWithPKCE(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, ProviderConfig{Name: "mock", ClientID: "web", ClientSecret: "s3cret", Issuer: idp.srv.URL})
+	ctx := context.Background()
+
+	verifier := "verifier-0123456789-0123456789-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	dest, err := p.AuthCodeURL(ctx, "https://mahi.test/cb", "st-1", "n-1", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("code_challenge") != challenge || q.Get("code_challenge_method") != "S256" ||
+		q.Get("nonce") != "n-1" || q.Get("state") != "st-1" || q.Get("client_id") != "web" {
+		t.Fatalf("authorize URL = %s", dest)
+	}
+
+	code := idp.authorize(q.Get("code_challenge"), idp.claims(nil))
+	if _, err := p.Exchange(ctx, code, "https://mahi.test/cb", "wrong-verifier", "n-1"); !errors.Is(err, ErrUpstream) {
+		t.Fatalf("exchange with the wrong verifier: err = %v, want ErrUpstream", err)
+	}
+
+	code = idp.authorize(challenge, idp.claims(nil))
+	ident, err := p.Exchange(ctx, code, "https://mahi.test/cb", verifier, "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Provider: "mock", Subject: "upstream-42", Email: "ana@example.com", EmailVerified: true, Name: "Ana"}
+	if ident != want {
+		t.Fatalf("identity = %+v, want %+v", ident, want)
+	}
+
+	// the nonce from the sign-in cookie must come back in the token
+	code = idp.authorize(challenge, idp.claims(jwt.MapClaims{"nonce": "other"}))
+	if _, err := p.Exchange(ctx, code, "https://mahi.test/cb", verifier, "n-1"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("exchange with a foreign nonce: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, ProviderConfig{Name: "mock", ClientID: "web", Issuer: idp.srv.URL, Audiences: []string{"ios"}})
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.claims(nil))
+	foreign.Header["kid"] = idp.kid
+	forged, _ := foreign.SignedString(other)
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+		ok    bool
+	}{
+		{"valid", idp.sign(t, idp.claims(nil)), "n-1", true},
+		{"native audience", idp.sign(t, idp.claims(jwt.MapClaims{"aud": "ios"})), "n-1", true},
+		{"apple string email_verified", idp.sign(t, idp.claims(jwt.MapClaims{"email_verified": "true"})), "n-1", true},
+		{"nonce not sent", idp.sign(t, idp.claims(nil)), "", false},
+		{"no nonce claim", idp.sign(t, idp.claims(jwt.MapClaims{"nonce": nil})), "n-1", false},
+		{"nonce mismatch", idp.sign(t, idp.claims(nil)), "n-2", false},
+		{"wrong audience", idp.sign(t, idp.claims(jwt.MapClaims{"aud": "someone-else"})), "n-1", false},
+		{"wrong issuer", idp.sign(t, idp.claims(jwt.MapClaims{"iss": "https://evil.test"})), "n-1", false},
+		{"expired", idp.sign(t, idp.claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})), "n-1", false},
+		{"no expiry", idp.sign(t, idp.claims(jwt.MapClaims{"exp": nil})), "n-1", false},
+		{"no subject", idp.sign(t, idp.claims(jwt.MapClaims{"sub": nil})), "n-1", false},
+		{"bad signature", forged, "n-1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ident, err := p.VerifyIDToken(context.Background(), tt.token, tt.nonce)
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ident.Subject != "upstream-42" || !ident.EmailVerified {
+					t.Fatalf("identity = %+v", ident)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("err = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestAppleClientSecret(t *testing.T) {
+	idp := newMockIdP(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "apple.p8")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var checked bool
+	idp.checkSecret = func(secret string) error {
+		var c jwt.RegisteredClaims
+		tok, err := jwt.ParseWithClaims(secret, &c, func(*jwt.Token) (any, error) { return &key.PublicKey, nil },
+			jwt.WithValidMethods([]string{"ES256"}), jwt.WithExpirationRequired())
+		if err != nil {
+			return err
+		}
+		if tok.Header["kid"] != "KEY123" || c.Issuer != "TEAM123" || c.Subject != "com.mahi.signin" ||
+			len(c.Audience) != 1 || c.Audience[0] != idp.srv.URL {
+			return errors.New("unexpected claims or kid")
+		}
+		if c.ExpiresAt.Sub(c.IssuedAt.Time) > 6*time.Minute {
+			return errors.New("client secret lives too long")
+		}
+		checked = true
+		return nil
+	}
+
+	// every Apple endpoint is pointed at the mock
+	p := newTestProvider(t, ProviderConfig{
+		Name: "apple", ClientID: "com.mahi.signin", TeamID: "TEAM123", KeyID: "KEY123", PrivateKeyFile: keyFile,
+		Issuer: idp.srv.URL, AuthURL: idp.srv.URL + "/authorize", TokenURL: idp.srv.URL + "/token", JWKSURL: idp.srv.URL + "/jwks",
+	})
+	dest, err := p.AuthCodeURL(context.Background(), "https://mahi.test/cb", "st", "n-1", "ch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := url.Parse(dest); u.Query().Get("response_mode") != "form_post" {
+		t.Fatalf("authorize URL = %s, want response_mode=form_post", dest)
+	}
+
+	verifier := "apple-verifier"
+	sum := sha256.Sum256([]byte(verifier))
+	code := idp.authorize(base64.RawURLEncoding.EncodeToString(sum[:]),
+		idp.claims(jwt.MapClaims{"aud": "com.mahi.signin", "email_verified": "true", "name": nil}))
+	ident, err := p.Exchange(context.Background(), code, "https://mahi.test/cb", verifier, "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checked {
+		t.Fatal("token endpoint never saw a client secret")
+	}
+	if !ident.EmailVerified || ident.Email != "ana@example.com" {
+		t.Fatalf("identity = %+v", ident)
+	}
+}
+
+func TestAppleNeedsECKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "apple.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, pemBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New([]ProviderConfig{{Name: "apple", ClientID: "com.mahi.signin", PrivateKeyFile: keyFile}}, nil, nil)
+	if err == nil {
+		t.Fatal("New accepted an RSA key for Sign in with Apple")
+	}
+}
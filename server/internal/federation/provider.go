@@ -0,0 +1,189 @@
+// Package federation signs users in through upstream identity providers
+// (Google, Apple, GitHub or any OpenID Connect issuer).
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	ErrInvalidToken    = errors.New("upstream token rejected")
+	ErrUpstream        = errors.New("upstream provider error")
+	ErrNoIDToken       = errors.New("provider does not issue ID tokens")
+)
+
+// Identity is what an upstream provider told us about the user.
+type Identity struct {
+	Provider      string
+	Subject       string // stable user id at the provider
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider runs the upstream half of a federated sign-in.
+type Provider interface {
+	Name() string
+	// AuthCodeURL is where the user agent is sent to sign in upstream.
+	AuthCodeURL(ctx context.Context, redirectURL, state, nonce, challenge string) (string, error)
+	// Exchange trades the code from the callback for the user's identity.
+	Exchange(ctx context.Context, code, redirectURL, verifier, nonce string) (Identity, error)
+	// VerifyIDToken checks an ID token a native SDK obtained on the device.
+	// nonce is required and must equal the token's nonce claim.
+	VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (Identity, error)
+}
+
+// ProviderConfig is one provider in FEDERATION_FILE. Only name, client_id and
+// client_secret are needed for google, apple and github; every URL can be
+// overridden, e.g. to point at a local mock IdP.
+type ProviderConfig struct {
+	Name         string `json:"name"`
+	Kind         string `json:"kind"` // "oidc" (default) | "github"
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// other client ids whose ID tokens we accept, e.g. the iOS/Android ones native SDKs use
+	Audiences    []string `json:"audiences"`
+	Scopes       []string `json:"scopes"`
+	ResponseMode string   `json:"response_mode"` // Apple needs "form_post" to return email
+	Issuer       string   `json:"issuer"`        // OIDC: endpoints are discovered from it unless set below
+	AuthURL      string   `json:"auth_url"`
+	TokenURL     string   `json:"token_url"`
+	UserInfoURL  string   `json:"userinfo_url"`
+	EmailsURL    string   `json:"emails_url"` // github only
+	JWKSURL      string   `json:"jwks_url"`
+	// Sign in with Apple mints its client secret from an ES256 key
+	TeamID         string `json:"team_id"`
+	KeyID          string `json:"key_id"`
+	PrivateKeyFile string `json:"private_key_file"`
+}
+
+// file is the on-disk layout of FEDERATION_FILE.
+//
+//	{"app_redirects": ["mahiapp://auth/federated"],
+//	 "providers": [{"name": "google", "client_id": "...", "client_secret": "...", "audiences": ["<ios client id>"]},
+//	               {"name": "apple", "client_id": "com.mahi.signin", "team_id": "...", "key_id": "...", "private_key_file": "keys/apple.p8"},
+//	               {"name": "github", "client_id": "...", "client_secret": "..."}]}
+type file struct {
+	AppRedirects []string         `json:"app_redirects"`
+	Providers    []ProviderConfig `json:"providers"`
+}
+
+// Registry holds the configured providers.
+type Registry struct {
+	providers    map[string]Provider
+	appRedirects []string
+}
+
+// Load reads FEDERATION_FILE. client is used for every upstream call; nil means a 10s-timeout client.
+func Load(path string, client *http.Client) (*Registry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return New(f.Providers, f.AppRedirects, client)
+}
+
+// New builds a registry from provider configs.
+func New(configs []ProviderConfig, appRedirects []string, client *http.Client) (*Registry, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	reg := &Registry{providers: map[string]Provider{}, appRedirects: appRedirects}
+	for _, pc := range configs {
+		pc = withDefaults(pc)
+		if pc.Name == "" || pc.ClientID == "" {
+			return nil, fmt.Errorf("federation: provider %q needs a name and client_id", pc.Name)
+		}
+		var p Provider
+		switch pc.Kind {
+		case "oidc":
+			if pc.Issuer == "" {
+				return nil, fmt.Errorf("federation: provider %q needs an issuer", pc.Name)
+			}
+			op, err := newOIDC(pc, client)
+			if err != nil {
+				return nil, err
+			}
+			p = op
+		case "github":
+			p = &githubProvider{cfg: pc, client: client}
+		default:
+			return nil, fmt.Errorf("federation: provider %q has unknown kind %q", pc.Name, pc.Kind)
+		}
+		reg.providers[pc.Name] = p
+	}
+	return reg, nil
+}
+
+// Get returns the provider configured under name.
+func (r *Registry) Get(name string) (Provider, error) {
+	if r != nil {
+		if p, ok := r.providers[name]; ok {
+			return p, nil
+		}
+	}
+	return nil, ErrUnknownProvider
+}
+
+// AllowsAppRedirect reports whether uri is a registered app return address.
+func (r *Registry) AllowsAppRedirect(uri string) bool {
+	if r == nil {
+		return false
+	}
+	for _, u := range r.appRedirects {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// withDefaults fills in the well-known settings of google, apple and github.
+func withDefaults(pc ProviderConfig) ProviderConfig {
+	set := func(dst *string, v string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	switch pc.Name {
+	case "google":
+		set(&pc.Issuer, "https://accounts.google.com")
+		if pc.Scopes == nil {
+			pc.Scopes = []string{"openid", "email", "profile"}
+		}
+	case "apple":
+		set(&pc.Issuer, "https://appleid.apple.com")
+		set(&pc.AuthURL, "https://appleid.apple.com/auth/authorize")
+		set(&pc.TokenURL, "https://appleid.apple.com/auth/token")
+		set(&pc.JWKSURL, "https://appleid.apple.com/auth/keys")
+		set(&pc.ResponseMode, "form_post")
+		if pc.Scopes == nil {
+			pc.Scopes = []string{"name", "email"}
+		}
+	case "github":
+		set(&pc.Kind, "github")
+		set(&pc.AuthURL, "https://github.com/login/oauth/authorize")
+		set(&pc.TokenURL, "https://github.com/login/oauth/access_token")
+		set(&pc.UserInfoURL, "https://api.github.com/user")
+		set(&pc.EmailsURL, "https://api.github.com/user/emails")
+		if pc.Scopes == nil {
+			pc.Scopes = []string{"read:user", "user:email"}
+		}
+	}
+	set(&pc.Kind, "oidc")
+	if pc.Scopes == nil {
+		pc.Scopes = []string{"openid", "email", "profile"}
+	}
+	return pc
+}
@@ -0,0 +1,504 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mahi/server/internal/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authorization codes are exchanged right after the redirect; keep them short-lived
+const authCodeTTL = 2 * time.Minute
+
+const (
+	authorizeCookie  = "mahi_authorize"
+	authorizeCSRFTyp = "authorize-csrf+jwt"
+	// how long the sign-in page may stay open before it has to be reloaded
+	authorizeCSRFTTL = 30 * time.Minute
+)
+
+// scopes a client may ask for; anything else is dropped from the grant
+var oauthScopes = map[string]bool{"openid": true, "profile": true, "email": true}
+
+var authorizeTmpl = template.Must(template.New("authorize").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in to {{.ClientName}}</title></head>
+<body>
+<h1>Sign in to continue to {{.ClientName}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{$v}}">
+{{end}}{{if .MFAToken}}<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+<label>Authenticator code or recovery code <input type="text" name="code" autocomplete="one-time-code" required autofocus></label>
+<button type="submit">Verify</button>
+{{else}}<label>Email <input type="email" name="email" value="{{.Email}}" required autofocus></label>
+<label>Password <input type="password" name="password" required></label>
+<button type="submit">Sign in</button>
+{{end}}
+</form>
+</body></html>
+`))
+
+// authorizeReq is what a client sends to /oauth/authorize, validated.
+type authorizeReq struct {
+	client      store.Client
+	redirectURI string
+	state       string
+	scope       string
+	challenge   string
+	nonce       string
+	csrf        string // goes into the form next to the params
+}
+
+// authorizeCSRF ties the sign-in form to the browser that loaded it. The form
+// carries this token and the browser an HttpOnly cookie whose hash is Binding,
+// so another site can't post credentials (say, its own) through the user's browser.
+type authorizeCSRF struct {
+	Binding  string `json:"bnd"`
+	ClientID string `json:"client_id"`
+	jwt.RegisteredClaims
+}
+
+// newAuthorizeCSRF signs a form token for a, reusing the browser's cookie so
+// that pages open in several tabs all stay valid.
+func (s *Server) newAuthorizeCSRF(w http.ResponseWriter, r *http.Request, a authorizeReq) (string, error) {
+	binding := ""
+	if c, err := r.Cookie(authorizeCookie); err == nil && c.Value != "" {
+		binding = c.Value
+	} else {
+		binding = newRefreshToken()
+	}
+	tok, err := s.jwt.Sign(authorizeCSRFTyp, authorizeCSRF{
+		Binding:  pkceChallenge(binding),
+		ClientID: a.client.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(authorizeCSRFTTL)),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	c := &http.Cookie{
+		Name:     authorizeCookie,
+		Value:    binding,
+		Path:     "/oauth/authorize",
+		MaxAge:   int(authorizeCSRFTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   strings.HasPrefix(s.cfg.Issuer, "https://"),
+	}
+	http.SetCookie(w, c)
+	return tok, nil
+}
+
+// checkAuthorizeCSRF reports whether the posted form came from a page we
+// served to this browser for this client.
+func (s *Server) checkAuthorizeCSRF(r *http.Request, a authorizeReq) bool {
+	c, err := r.Cookie(authorizeCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	var claims authorizeCSRF
+	if s.jwt.ParseTyped(r.PostFormValue("csrf_token"), authorizeCSRFTyp, &claims) != nil {
+		return false
+	}
+	return claims.ClientID == a.client.ID &&
+		subtle.ConstantTimeCompare([]byte(claims.Binding), []byte(pkceChallenge(c.Value))) == 1
+}
+
+// params are carried through the login form as hidden fields.
+func (a authorizeReq) params() map[string]string {
+	return map[string]string{
+		"response_type":         "code",
+		"client_id":             a.client.ID,
+		"redirect_uri":          a.redirectURI,
+		"state":                 a.state,
+		"scope":                 a.scope,
+		"code_challenge":        a.challenge,
+		"code_challenge_method": "S256",
+		"nonce":                 a.nonce,
+	}
+}
+
+// parseAuthorize validates an authorization request. Until the client and
+// redirect URI are known to be good, errors are shown to the user instead of
+// being redirected (RFC 6749 4.1.2.1); after that redirectErr is set.
+func (s *Server) parseAuthorize(r *http.Request) (a authorizeReq, userErr string, redirectErr string) {
+	c, ok := s.st.GetClient(r.FormValue("client_id"))
+	if !ok || c.Disabled {
+		return a, "Unknown client.", ""
+	}
+	a.client = c
+	a.redirectURI = r.FormValue("redirect_uri")
+	if !c.AllowsRedirect(a.redirectURI) {
+		return a, "This redirect URI is not registered for the client.", ""
+	}
+	a.state = r.FormValue("state")
+	a.scope = normalizeScope(r.FormValue("scope"))
+	a.nonce = r.FormValue("nonce")
+	if r.FormValue("response_type") != "code" {
+		return a, "", "unsupported_response_type"
+	}
+	// clients can't check an ID token signed with a secret they don't have
+	if hasScope(a.scope, "openid") && !s.jwt.Asymmetric() {
+		return a, "", "invalid_scope"
+	}
+	// PKCE is mandatory for every client, and only with S256
+	a.challenge = r.FormValue("code_challenge")
+	if a.challenge == "" || r.FormValue("code_challenge_method") != "S256" {
+		return a, "", "invalid_request"
+	}
+	return a, "", ""
+}
+
+func normalizeScope(raw string) string {
+	seen := map[string]bool{}
+	var out []string
+	for _, sc := range strings.Fields(raw) {
+		if oauthScopes[sc] && !seen[sc] {
+			seen[sc] = true
+			out = append(out, sc)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// redirectWith sends the user agent back to the client with query parameters.
+func redirectWith(w http.ResponseWriter, r *http.Request, redirectURI string, q url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	existing := u.Query()
+	for k, v := range q {
+		existing[k] = v
+	}
+	u.RawQuery = existing.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// renderAuthorize shows the sign-in form, or the second-factor step when mfaToken is set.
+func renderAuthorize(w http.ResponseWriter, status int, a authorizeReq, email, mfaToken, errMsg string) {
+	name := a.client.Name
+	if name == "" {
+		name = a.client.ID
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	_ = authorizeTmpl.Execute(w, map[string]any{
+		"ClientName": name,
+		"Params":     a.params(),
+		"Email":      email,
+		"MFAToken":   mfaToken,
+		"Error":      errMsg,
+		"CSRFToken":  a.csrf,
+	})
+}
+
+// GET /oauth/authorize shows the sign-in form; POST checks the credentials
+// and redirects back to the client with an authorization code.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+	a, userErr, redirectErr := s.parseAuthorize(r)
+	if userErr != "" {
+		http.Error(w, userErr, http.StatusBadRequest)
+		return
+	}
+	if redirectErr != "" {
+		q := url.Values{"error": {redirectErr}}
+		if a.state != "" {
+			q.Set("state", a.state)
+		}
+		redirectWith(w, r, a.redirectURI, q)
+		return
+	}
+	if r.Method == http.MethodGet || !s.checkAuthorizeCSRF(r, a) {
+		status, msg := http.StatusOK, ""
+		if r.Method != http.MethodGet {
+			status, msg = http.StatusForbidden, "This sign-in page expired. Please try again."
+		}
+		var err error
+		if a.csrf, err = s.newAuthorizeCSRF(w, r, a); err != nil {
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		renderAuthorize(w, status, a, "", "", msg)
+		return
+	}
+	a.csrf = r.PostFormValue("csrf_token")
+
+	var u store.User
+	if mfaToken := r.PostFormValue("mfa_token"); mfaToken != "" {
+		var err error
+		req := mfaVerifyReq{MFAToken: mfaToken, Method: "totp", Code: r.PostFormValue("code")}
+		if isRecoveryCode(req.Code) {
+			req.Method = "recovery_code"
+		}
+		u, _, err = s.checkMFA(req)
+		if errors.Is(err, errMFACodeInvalid) {
+			renderAuthorize(w, http.StatusUnauthorized, a, "", mfaToken, "Wrong code.")
+			return
+		}
+		if errors.Is(err, errMFATooMany) {
+			renderAuthorize(w, http.StatusTooManyRequests, a, "", mfaToken,
+				fmt.Sprintf("Too many wrong codes. Try again in %d minutes.", int(mfaLockout.Minutes())))
+			return
+		}
+		if err != nil {
+			renderAuthorize(w, http.StatusUnauthorized, a, "", "", "Please sign in again.")
+			return
+		}
+	} else {
+		email := r.PostFormValue("email")
+		var err error
+		u, err = s.verifyLogin(r, email, r.PostFormValue("password"))
+		var locked *errLoginLocked
+		if errors.As(err, &locked) {
+			renderAuthorize(w, http.StatusTooManyRequests, a, email, "",
+				fmt.Sprintf("Too many failed sign-ins. Try again in %s.", locked.retryAfter.Round(time.Second)))
+			return
+		}
+		if isHashBusy(err) {
+			retry := max(time.Second, s.hashes.RetryAfter().Round(time.Second))
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+			renderAuthorize(w, http.StatusServiceUnavailable, a, email, "",
+				fmt.Sprintf("We're busy right now. Please try again in %s.", retry))
+			return
+		}
+		if err != nil {
+			renderAuthorize(w, http.StatusUnauthorized, a, email, "", "Wrong email or password.")
+			return
+		}
+		if methods := s.mfaMethods(u.ID); len(methods) > 0 {
+			// this page has no script, so only authenticator codes work here
+			if !slices.Contains(methods, "totp") {
+				renderAuthorize(w, http.StatusUnauthorized, a, email, "",
+					"Your account needs a security key to sign in, which this page doesn't support. Please sign in with the Mahi app.")
+				return
+			}
+			tok, err := s.newMFAToken(u.ID, "")
+			if err != nil {
+				renderAuthorize(w, http.StatusInternalServerError, a, email, "", "Something went wrong. Please try again.")
+				return
+			}
+			renderAuthorize(w, http.StatusOK, a, "", tok, "")
+			return
+		}
+	}
+	code := newRefreshToken()
+	err := s.st.SaveAuthCode(code, store.AuthCode{
+		ClientID:            a.client.ID,
+		UserID:              u.ID,
+		RedirectURI:         a.redirectURI,
+		Scope:               a.scope,
+		CodeChallenge:       a.challenge,
+		CodeChallengeMethod: "S256",
+		Nonce:               a.nonce,
+		AuthTime:            time.Now(),
+		Exp:                 time.Now().Add(authCodeTTL),
+	})
+	if err != nil {
+		log.Printf("oauth: save code: %v", err)
+		redirectWith(w, r, a.redirectURI, url.Values{"error": {"server_error"}, "state": {a.state}})
+		return
+	}
+	q := url.Values{"code": {code}}
+	if a.state != "" {
+		q.Set("state", a.state)
+	}
+	redirectWith(w, r, a.redirectURI, q)
+}
+
+// tokenClient identifies the caller of /oauth/token: confidential clients
+// authenticate with their secret, public clients only name themselves.
+func (s *Server) tokenClient(r *http.Request) (store.Client, error) {
+	if _, _, ok := r.BasicAuth(); ok || r.PostFormValue("client_secret") != "" {
+		return s.authenticateClient(r)
+	}
+	c, ok := s.st.GetClient(r.PostFormValue("client_id"))
+	if !ok || !c.Public || c.Disabled {
+		return store.Client{}, store.ErrClientInvalid
+	}
+	return c, nil
+}
+
+// verifyPKCE checks an RFC 7636 S256 code_verifier against the stored challenge.
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	got := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(got), []byte(challenge)) == 1
+}
+
+// POST /oauth/token
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+	c, err := s.tokenClient(r)
+	if err != nil {
+		writeOAuthErr(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		s.tokenFromCode(w, r, c)
+	case "refresh_token":
+		s.tokenFromRefresh(w, r, c)
+	case "client_credentials":
+		s.tokenForClient(w, r, c)
+	default:
+		writeOAuthErr(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+func (s *Server) tokenFromCode(w http.ResponseWriter, r *http.Request, c store.Client) {
+	code := r.PostFormValue("code")
+	ac, err := s.st.ConsumeAuthCode(code, c.ID, r.PostFormValue("redirect_uri"))
+	if errors.Is(err, store.ErrCodeReused) {
+		// a replayed code has leaked; take back what it was exchanged for (RFC 6749 4.1.2)
+		if ac.SessionID != "" {
+			if err := s.st.RevokeSession(ac.UserID, ac.SessionID); err != nil && !errors.Is(err, store.ErrSessionNotFound) {
+				log.Printf("oauth: revoke session of a reused code: %v", err)
+			}
+			s.revokeSessionAccess(ac.SessionID)
+		}
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_grant", "authorization code was already used; the tokens issued for it have been revoked")
+		return
+	}
+	if err != nil {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_grant", "authorization code is invalid, expired, or was issued to another client or redirect_uri")
+		return
+	}
+	if !verifyPKCE(r.PostFormValue("code_verifier"), ac.CodeChallenge) {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+		return
+	}
+	u, ok := s.st.GetUser(ac.UserID)
+	if !ok {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+
+	rt := newRefreshToken()
+	rtExp := time.Now().Add(time.Duration(s.cfg.RefreshTTLDays) * 24 * time.Hour)
+	meta := sessionMeta(r, c.Name)
+	meta.ClientID, meta.Scope = c.ID, ac.Scope
+	sessionID, err := s.st.SaveRefresh(rt, ac.UserID, rtExp, meta)
+	if err != nil {
+		writeOAuthErr(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if err := s.st.SetAuthCodeSession(code, sessionID); err != nil {
+		log.Printf("oauth: remember session of code: %v", err)
+	}
+	g := oauthGrant{userID: u.ID, sessionID: sessionID, clientID: c.ID, scope: ac.Scope, refreshToken: rt}
+	if hasScope(ac.Scope, "openid") {
+		g.idUser, g.nonce, g.authTime = &u, ac.Nonce, ac.AuthTime
+	}
+	s.writeOAuthTokens(w, g)
+}
+
+func (s *Server) tokenFromRefresh(w http.ResponseWriter, r *http.Request, c store.Client) {
+	old := r.PostFormValue("refresh_token")
+	if cur, ok := s.st.LookupRefresh(old); !ok || cur.ClientID != c.ID {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+	newRT := newRefreshToken()
+	newExp := time.Now().Add(time.Duration(s.cfg.RefreshTTLDays) * 24 * time.Hour)
+	rt, err := s.st.RotateRefresh(old, newRT, newExp, sessionMeta(r, ""))
+	if errors.Is(err, store.ErrRefreshReused) {
+		s.revokeSessionAccess(rt.SessionID)
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_grant", "refresh token was already used; the grant has been revoked")
+		return
+	}
+	if err != nil {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+	s.writeOAuthTokens(w, oauthGrant{userID: rt.UserID, sessionID: rt.SessionID, clientID: c.ID, scope: rt.Scope, refreshToken: newRT})
+}
+
+// tokenForClient issues a token to the client itself (RFC 6749 4.4): the
+// subject is the client_id and there is no session or refresh token.
+func (s *Server) tokenForClient(w http.ResponseWriter, r *http.Request, c store.Client) {
+	if c.Public {
+		writeOAuthErr(w, http.StatusBadRequest, "unauthorized_client", "public clients cannot use client_credentials")
+		return
+	}
+	requested := strings.Fields(r.PostFormValue("scope"))
+	if len(requested) == 0 {
+		requested = c.Scopes
+	}
+	if !c.AllowsScopes(requested) {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_scope", "")
+		return
+	}
+	s.writeOAuthTokens(w, oauthGrant{userID: c.ID, clientID: c.ID, scope: strings.Join(requested, " ")})
+}
+
+// oauthGrant is what a token response is issued for.
+type oauthGrant struct {
+	userID, sessionID, clientID, scope string
+	refreshToken                       string
+	// set when an OpenID Connect ID token goes along with the access token
+	idUser   *store.User
+	nonce    string
+	authTime time.Time
+}
+
+// writeOAuthTokens answers /oauth/token with an RFC 6749 5.1 body.
+func (s *Server) writeOAuthTokens(w http.ResponseWriter, g oauthGrant) {
+	access, _, err := s.jwt.NewOAuthAccess(g.userID, g.sessionID, g.clientID, g.scope, s.cfg.AccessTTLMin)
+	if err != nil {
+		writeOAuthErr(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	resp := map[string]any{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   s.cfg.AccessTTLMin * 60,
+	}
+	if g.refreshToken != "" {
+		resp["refresh_token"] = g.refreshToken
+	}
+	if g.scope != "" {
+		resp["scope"] = g.scope
+	}
+	if g.idUser != nil {
+		idt, err := s.idToken(*g.idUser, g.clientID, g.scope, g.nonce, g.authTime, access)
+		if err != nil {
+			writeOAuthErr(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		resp["id_token"] = idt
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,206 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"mahi/server/internal/store"
+)
+
+const (
+	testRedirect = "https://app.example/cb"
+	testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk-verifier"
+)
+
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+func authorizeParams(clientID string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {testRedirect},
+		"scope":                 {"profile"},
+		"state":                 {"xyz"},
+		"code_challenge":        {pkceChallenge(testVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// authorizePage loads the sign-in page and returns its cookie and CSRF token.
+func authorizePage(t *testing.T, s *Server, params url.Values) (*http.Cookie, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.authorize(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+params.Encode(), nil))
+	m := csrfField.FindStringSubmatch(w.Body.String())
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || m == nil || len(cookies) != 1 {
+		t.Fatalf("authorize page: %d %s", w.Code, w.Body)
+	}
+	return cookies[0], m[1]
+}
+
+// postAuthorize submits the sign-in form.
+func postAuthorize(s *Server, params url.Values, cookie *http.Cookie, csrf, email, password string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("csrf_token", csrf)
+	form.Set("email", email)
+	form.Set("password", password)
+	r := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.authorize(w, r)
+	return w
+}
+
+// authorizeCode signs the demo user in on the authorize page and returns the code.
+func authorizeCode(t *testing.T, s *Server, clientID string) string {
+	t.Helper()
+	params := authorizeParams(clientID)
+	cookie, csrf := authorizePage(t, s, params)
+	w := postAuthorize(s, params, cookie, csrf, "demo@demo.com", "password")
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || loc.Query().Get("code") == "" {
+		t.Fatalf("authorize: %d %s", w.Code, w.Body)
+	}
+	if loc.Query().Get("state") != "xyz" {
+		t.Fatalf("state not echoed: %s", loc)
+	}
+	return loc.Query().Get("code")
+}
+
+// exchange trades a code at /oauth/token as a public client.
+func exchange(s *Server, clientID, code, redirectURI, verifier string) (int, map[string]any) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	w, out := serve(s.token, formReq("/oauth/token", form, "", ""))
+	return w.Code, out
+}
+
+func newOAuthServer(t *testing.T) *Server {
+	t.Helper()
+	s, _ := newTestServer(t)
+	addClient(t, s, store.Client{ID: "web", Name: "Mahi Web", Public: true, RedirectURIs: []string{testRedirect}}, "")
+	addClient(t, s, store.Client{ID: "other", Public: true, RedirectURIs: []string{testRedirect}}, "")
+	return s
+}
+
+func TestAuthorizeFormNeedsCSRFToken(t *testing.T) {
+	s := newOAuthServer(t)
+	params := authorizeParams("web")
+	cookie, csrf := authorizePage(t, s, params)
+	otherCookie, otherCSRF := authorizePage(t, s, params)
+	_, webForOther := authorizePage(t, s, authorizeParams("other"))
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		csrf   string
+		params url.Values
+	}{
+		{"no token", cookie, "", params},
+		{"no cookie", nil, csrf, params},
+		{"token of another browser", otherCookie, csrf, params},
+		{"token for another client", cookie, webForOther, params},
+		{"forged token", cookie, otherCSRF + "x", params},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postAuthorize(s, tt.params, tt.cookie, tt.csrf, "demo@demo.com", "password")
+			if w.Code != http.StatusForbidden || w.Header().Get("Location") != "" {
+				t.Fatalf("status %d, location %q", w.Code, w.Header().Get("Location"))
+			}
+			// the page comes back with a fresh token to retry with
+			if !csrfField.MatchString(w.Body.String()) {
+				t.Fatal("no new form token")
+			}
+		})
+	}
+	if w := postAuthorize(s, params, cookie, csrf, "demo@demo.com", "password"); w.Code != http.StatusFound {
+		t.Fatalf("valid form: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthorizationCodeExchange(t *testing.T) {
+	s := newOAuthServer(t)
+	code := authorizeCode(t, s, "web")
+
+	// a mismatch is refused without spending the code
+	for _, tt := range []struct{ name, client, redirect string }{
+		{"another client", "other", testRedirect},
+		{"another redirect_uri", "web", "https://evil.example/cb"},
+	} {
+		if status, out := exchange(s, tt.client, code, tt.redirect, testVerifier); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+			t.Fatalf("%s: %d %v", tt.name, status, out)
+		}
+	}
+
+	status, out := exchange(s, "web", code, testRedirect, testVerifier)
+	if status != http.StatusOK || out["access_token"] == nil || out["refresh_token"] == nil || out["scope"] != "profile" {
+		t.Fatalf("exchange: %d %v", status, out)
+	}
+	access := out["access_token"].(string)
+	refresh := out["refresh_token"].(string)
+
+	// replaying the code revokes what it was exchanged for
+	if status, out := exchange(s, "web", code, testRedirect, testVerifier); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Fatalf("reused code: %d %v", status, out)
+	}
+	claims, err := s.jwt.Parse(access)
+	if err != nil || !s.revoked.isRevoked(claims) {
+		t.Fatalf("access token of a replayed code still valid: %v", err)
+	}
+	if _, ok := s.st.LookupRefresh(refresh); ok {
+		t.Fatal("refresh token of a replayed code still valid")
+	}
+}
+
+func TestAuthorizationCodeWrongVerifier(t *testing.T) {
+	s := newOAuthServer(t)
+	tests := []struct {
+		name     string
+		verifier string
+	}{
+		{"missing", ""},
+		{"wrong", strings.Repeat("a", 43)},
+		{"too short", testVerifier[:42]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := authorizeCode(t, s, "web")
+			if status, out := exchange(s, "web", code, testRedirect, tt.verifier); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+				t.Fatalf("%d %v", status, out)
+			}
+		})
+	}
+}
+
+func TestFirstPartyRefreshRejectsOAuthTokens(t *testing.T) {
+	s := newOAuthServer(t)
+	_, out := exchange(s, "web", authorizeCode(t, s, "web"), testRedirect, testVerifier)
+	refresh, _ := out["refresh_token"].(string)
+
+	w, body := serve(s.refresh, jsonReq(t, http.MethodPost, "/v1/auth/refresh", refreshReq{RefreshToken: refresh}))
+	if w.Code != http.StatusBadRequest || body["error"] != "refresh_wrong_endpoint" {
+		t.Fatalf("first-party refresh of an OAuth token: %d %v", w.Code, body)
+	}
+	// the token was left alone and still works where it belongs
+	form := url.Values{"grant_type": {"refresh_token"}, "client_id": {"web"}, "refresh_token": {refresh}}
+	if w, out := serve(s.token, formReq("/oauth/token", form, "", "")); w.Code != http.StatusOK {
+		t.Fatalf("oauth refresh: %d %v", w.Code, out)
+	}
+}
@@ -0,0 +1,127 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"mahi/server/internal/store"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type createClientReq struct {
+	ID           string   `json:"client_id"`
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Public       bool     `json:"public"`
+}
+
+type clientSecretResp struct {
+	store.Client
+	Secret string `json:"client_secret,omitempty"`
+	// until when the previous secret is still accepted after a rotation
+	PreviousValidUntil *time.Time `json:"previous_secret_valid_until,omitempty"`
+}
+
+// GET /v1/admin/clients
+func (s *Server) listClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := s.st.ListClients()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "client_error", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
+
+// POST /v1/admin/clients
+// The generated secret is returned once and never stored in plain text.
+func (s *Server) createClient(w http.ResponseWriter, r *http.Request) {
+	var req createClientReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if req.ID == "" {
+		req.ID = store.NewClientID()
+	}
+	for _, sc := range req.Scopes {
+		if sc == "" || strings.ContainsAny(sc, " \t\"\\") {
+			writeErr(w, http.StatusBadRequest, "invalid_scope", map[string]any{"field": "scopes", "scope": sc})
+			return
+		}
+	}
+	c := store.Client{ID: req.ID, Name: req.Name, Scopes: req.Scopes, RedirectURIs: req.RedirectURIs, Public: req.Public}
+	secret := ""
+	if !c.Public {
+		secret = newRefreshToken()
+	}
+	if err := s.st.CreateClient(c, secret); err != nil {
+		if errors.Is(err, store.ErrClientExists) {
+			writeErr(w, http.StatusConflict, "client_exists", map[string]any{"field": "client_id"})
+			return
+		}
+		writeErr(w, http.StatusInternalServerError, "client_error", nil)
+		return
+	}
+	c, _ = s.st.GetClient(c.ID)
+	writeJSON(w, http.StatusCreated, clientSecretResp{Client: c, Secret: secret})
+}
+
+type rotateSecretReq struct {
+	GraceMin int `json:"grace_min"`
+}
+
+// POST /v1/admin/clients/{id}/secret
+// Issues a new secret; the old one keeps working for grace_min minutes (default 0)
+// so deployments can roll over without downtime.
+func (s *Server) rotateClientSecret(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var req rotateSecretReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+			return
+		}
+	}
+	c, ok := s.st.GetClient(id)
+	if !ok {
+		writeErr(w, http.StatusNotFound, "client_not_found", nil)
+		return
+	}
+	if c.Public {
+		writeErr(w, http.StatusBadRequest, "client_public", map[string]any{"message": "Public clients have no secret."})
+		return
+	}
+	secret := newRefreshToken()
+	until := time.Now().Add(time.Duration(req.GraceMin) * time.Minute)
+	if err := s.st.RotateClientSecret(id, secret, until); err != nil {
+		writeErr(w, http.StatusInternalServerError, "client_error", nil)
+		return
+	}
+	resp := clientSecretResp{Client: c, Secret: secret}
+	if req.GraceMin > 0 {
+		resp.PreviousValidUntil = &until
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /v1/admin/clients/{id}/disable and /enable
+func (s *Server) setClientDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		if err := s.st.SetClientDisabled(id, disabled); err != nil {
+			if errors.Is(err, store.ErrClientNotFound) {
+				writeErr(w, http.StatusNotFound, "client_not_found", nil)
+				return
+			}
+			writeErr(w, http.StatusInternalServerError, "client_error", nil)
+			return
+		}
+		c, _ := s.st.GetClient(id)
+		writeJSON(w, http.StatusOK, c)
+	}
+}
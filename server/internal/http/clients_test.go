@@ -0,0 +1,153 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"mahi/server/internal/store"
+)
+
+func TestClientCredentials(t *testing.T) {
+	s, _ := newTestServer(t)
+	addClient(t, s, store.Client{ID: "billing-job", Scopes: []string{"billing:read", "billing:write"}}, "b-secret")
+	addClient(t, s, store.Client{ID: "web", Public: true, RedirectURIs: []string{testRedirect}}, "")
+
+	tests := []struct {
+		name, client, secret, scope string
+		code                        int
+		errCode, grantedScope       string
+	}{
+		{"all granted scopes", "billing-job", "b-secret", "", http.StatusOK, "", "billing:read billing:write"},
+		{"a subset", "billing-job", "b-secret", "billing:read", http.StatusOK, "", "billing:read"},
+		{"scope not granted", "billing-job", "b-secret", "billing:read admin", http.StatusBadRequest, "invalid_scope", ""},
+		{"wrong secret", "billing-job", "nope", "", http.StatusUnauthorized, "invalid_client", ""},
+		{"public client", "web", "", "", http.StatusBadRequest, "unauthorized_client", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"grant_type": {"client_credentials"}, "scope": {tt.scope}}
+			var r *http.Request
+			if tt.secret != "" {
+				r = formReq("/oauth/token", form, tt.client, tt.secret)
+			} else {
+				form.Set("client_id", tt.client)
+				r = formReq("/oauth/token", form, "", "")
+			}
+			w, out := serve(s.token, r)
+			if w.Code != tt.code || (tt.errCode != "" && out["error"] != tt.errCode) {
+				t.Fatalf("%d %v", w.Code, out)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			if out["scope"] != tt.grantedScope || out["refresh_token"] != nil {
+				t.Fatalf("response = %v", out)
+			}
+			claims, err := s.jwt.Parse(out["access_token"].(string))
+			if err != nil || claims.UserID != tt.client || claims.ClientID != tt.client || claims.SessionID != "" {
+				t.Fatalf("claims = %+v, %v", claims, err)
+			}
+		})
+	}
+}
+
+func TestDisabledClientIsCutOff(t *testing.T) {
+	s := newOAuthServer(t)
+	addClient(t, s, store.Client{ID: "billing-job", Scopes: []string{"billing:read"}}, "b-secret")
+	_, grant := exchange(s, "web", authorizeCode(t, s, "web"), testRedirect, testVerifier)
+	access, _ := grant["access_token"].(string)
+	refresh, _ := grant["refresh_token"].(string)
+
+	setDisabled := func(id string, disabled bool) {
+		t.Helper()
+		r := withURLParam(httptest.NewRequest(http.MethodPost, "/v1/admin/clients/"+id+"/disable", nil), "id", id)
+		w, out := serve(s.setClientDisabled(disabled), r)
+		if w.Code != http.StatusOK || out["disabled"] != disabled {
+			t.Fatalf("disable %s: %d %v", id, w.Code, out)
+		}
+	}
+	setDisabled("web", true)
+	setDisabled("billing-job", true)
+
+	checks := []struct {
+		name string
+		run  func() int
+		want int
+	}{
+		{"client credentials", func() int {
+			w, _ := serve(s.token, formReq("/oauth/token", url.Values{"grant_type": {"client_credentials"}}, "billing-job", "b-secret"))
+			return w.Code
+		}, http.StatusUnauthorized},
+		{"refresh at /oauth/token", func() int {
+			form := url.Values{"grant_type": {"refresh_token"}, "client_id": {"web"}, "refresh_token": {refresh}}
+			w, _ := serve(s.token, formReq("/oauth/token", form, "", ""))
+			return w.Code
+		}, http.StatusUnauthorized},
+		{"refresh at /v1/auth/refresh", func() int {
+			w, _ := serve(s.refresh, jsonReq(t, http.MethodPost, "/v1/auth/refresh", refreshReq{RefreshToken: refresh}))
+			return w.Code
+		}, http.StatusBadRequest},
+		{"userinfo", func() int {
+			r := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+			r.Header.Set("Authorization", "Bearer "+access)
+			w, _ := serve(s.bearerOnly(http.HandlerFunc(s.userinfo)).ServeHTTP, r)
+			return w.Code
+		}, http.StatusUnauthorized},
+		{"authorize page", func() int {
+			w := httptest.NewRecorder()
+			s.authorize(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+authorizeParams("web").Encode(), nil))
+			return w.Code
+		}, http.StatusBadRequest},
+	}
+	for _, c := range checks {
+		if got := c.run(); got != c.want {
+			t.Errorf("%s: %d, want %d", c.name, got, c.want)
+		}
+	}
+	addClient(t, s, store.Client{ID: "gateway"}, "gw-secret")
+	for _, tok := range []string{access, refresh} {
+		_, out := serve(s.introspect, formReq("/oauth/introspect", url.Values{"token": {tok}}, "gateway", "gw-secret"))
+		if out["active"] != false {
+			t.Errorf("token of a disabled client introspects as %v", out)
+		}
+	}
+
+	// enabling the client again brings its grant back
+	setDisabled("web", false)
+	form := url.Values{"grant_type": {"refresh_token"}, "client_id": {"web"}, "refresh_token": {refresh}}
+	if w, out := serve(s.token, formReq("/oauth/token", form, "", "")); w.Code != http.StatusOK {
+		t.Fatalf("refresh after enabling: %d %v", w.Code, out)
+	}
+}
+
+func TestRotateClientSecret(t *testing.T) {
+	s, _ := newTestServer(t)
+	addClient(t, s, store.Client{ID: "partner"}, "old-secret")
+	rotate := func(grace int) string {
+		t.Helper()
+		r := withURLParam(jsonReq(t, http.MethodPost, "/v1/admin/clients/partner/secret", rotateSecretReq{GraceMin: grace}), "id", "partner")
+		w := httptest.NewRecorder()
+		s.rotateClientSecret(w, r)
+		var resp clientSecretResp
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || resp.Secret == "" {
+			t.Fatalf("rotate: %d %s", w.Code, w.Body)
+		}
+		return resp.Secret
+	}
+	works := func(secret string) bool {
+		_, err := s.st.AuthenticateClient("partner", secret)
+		return err == nil
+	}
+
+	second := rotate(10)
+	if !works("old-secret") || !works(second) {
+		t.Fatal("both secrets should work during the grace period")
+	}
+	third := rotate(0)
+	if works("old-secret") || works(second) || !works(third) {
+		t.Fatal("only the newest secret should work without a grace period")
+	}
+}
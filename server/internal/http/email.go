@@ -0,0 +1,215 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"mahi/server/internal/config"
+	"mahi/server/internal/mail"
+	"mahi/server/internal/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	emailVerifyTyp = "email-verify+jwt"
+	emailVerifyTTL = 24 * time.Hour
+	// how long a request may wait on the mail server
+	mailTimeout = 15 * time.Second
+)
+
+var errEmailToken = errors.New("email_token_invalid")
+
+func newMailer(cfg config.Config) (mail.Mailer, error) {
+	switch cfg.MailDriver {
+	case "smtp":
+		if cfg.SMTPAddr == "" {
+			return nil, errors.New("MAIL_DRIVER=smtp needs SMTP_ADDR")
+		}
+		return &mail.SMTP{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword, From: cfg.MailFrom}, nil
+	case "file":
+		return mail.NewFile(cfg.MailFile, cfg.MailFrom)
+	case "stdout", "":
+		return mail.NewWriter(os.Stdout, cfg.MailFrom), nil
+	}
+	return nil, fmt.Errorf("unknown MAIL_DRIVER %q", cfg.MailDriver)
+}
+
+// sendMail delivers m and reports whether it went out. Failures are logged,
+// not returned: a broken mail server shouldn't fail the request behind it.
+func (s *Server) sendMail(r *http.Request, m mail.Message) bool {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), mailTimeout)
+	defer cancel()
+	if err := s.mail.Send(ctx, m); err != nil {
+		log.Printf("mail to %s: %v", m.To, err)
+		return false
+	}
+	return true
+}
+
+// appLink builds a link into the app (APP_URL, e.g. mahiapp:// or https://mahi.app/).
+func (s *Server) appLink(path string, q url.Values) string {
+	base := s.cfg.AppURL
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + path + "?" + q.Encode()
+}
+
+// emailClaims back the links we send by email. Email pins the address the
+// link was sent to, so it stops working if the account's address changes.
+type emailClaims struct {
+	UserID string `json:"sub"`
+	Email  string `json:"email"`
+	Prev   string `json:"prev,omitempty"` // the address before a change, for the revert link
+	jwt.RegisteredClaims
+}
+
+func (s *Server) newEmailToken(typ string, c emailClaims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	c.RegisteredClaims = jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		ID:        newRefreshToken(),
+	}
+	return s.jwt.Sign(typ, c)
+}
+
+// parseEmailToken checks the token and that it still matches the account.
+func (s *Server) parseEmailToken(tok, typ string) (emailClaims, store.User, error) {
+	var c emailClaims
+	if err := s.jwt.ParseTyped(tok, typ, &c); err != nil || c.UserID == "" {
+		return c, store.User{}, errEmailToken
+	}
+	u, ok := s.st.GetUser(c.UserID)
+	if !ok || u.Email != c.Email {
+		return c, store.User{}, errEmailToken
+	}
+	return c, u, nil
+}
+
+// sendVerification emails u a link that proves they own their address.
+func (s *Server) sendVerification(r *http.Request, u store.User) bool {
+	tok, err := s.newEmailToken(emailVerifyTyp, emailClaims{UserID: u.ID, Email: u.Email}, emailVerifyTTL)
+	if err != nil {
+		log.Printf("verify email: %v", err)
+		return false
+	}
+	link := s.cfg.Issuer + "/v1/auth/verify-email?token=" + url.QueryEscape(tok)
+	return s.sendMail(r, mail.Message{
+		To:      u.Email,
+		Subject: "Confirm your email address",
+		Text: "Welcome to Mahi!\n\n" +
+			"Please confirm that this is your email address by opening the link below:\n\n" +
+			link + "\n\n" +
+			"The link expires in 24 hours. If you didn't create an account, you can ignore this email.",
+	})
+}
+
+var verifiedTmpl = template.Must(template.New("verified").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Mahi</title></head>
+<body><p>{{.}}</p></body></html>
+`))
+
+type verifyEmailReq struct {
+	Token string `json:"token"`
+}
+
+// GET|POST /v1/auth/verify-email
+func (s *Server) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	tok, ok := linkToken(w, r)
+	if !ok {
+		return
+	}
+	if err := s.confirmEmail(tok); err != nil {
+		linkFailed(w, r, http.StatusBadRequest, err.Error(), "This link is invalid or has expired. Request a new one from the app.")
+		return
+	}
+	linkDone(w, r, "Thanks, your email address is confirmed. You can return to the app.",
+		map[string]any{"email_verified": true})
+}
+
+// Links we email come back two ways: GET is the link itself and answers with
+// a page; POST is for the app, which may intercept the link, and answers with
+// JSON. linkToken reads the token either way.
+func linkToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method == http.MethodGet {
+		return r.URL.Query().Get("token"), true
+	}
+	var req verifyEmailReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return "", false
+	}
+	return req.Token, true
+}
+
+func linkPage(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = verifiedTmpl.Execute(w, msg)
+}
+
+func linkDone(w http.ResponseWriter, r *http.Request, msg string, body map[string]any) {
+	if r.Method == http.MethodGet {
+		linkPage(w, http.StatusOK, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func linkFailed(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	if r.Method == http.MethodGet {
+		linkPage(w, status, msg)
+		return
+	}
+	writeErr(w, status, code, map[string]any{"message": msg})
+}
+
+func (s *Server) confirmEmail(tok string) error {
+	_, u, err := s.parseEmailToken(tok, emailVerifyTyp)
+	if err != nil {
+		return err
+	}
+	if u.EmailVerified {
+		return nil // clicking the link twice is fine
+	}
+	if err := s.st.SetEmailVerified(u.ID, true); err != nil {
+		return err
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditEmailVerified,
+		Detail: map[string]any{"email": u.Email}})
+	return nil
+}
+
+// POST /v1/auth/verify-email/resend
+func (s *Server) resendVerification(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		writeErr(w, http.StatusNotFound, "user_not_found", nil)
+		return
+	}
+	if u.EmailVerified {
+		writeErr(w, http.StatusConflict, "email_already_verified", nil)
+		return
+	}
+	if !s.sendVerification(r, u) {
+		writeErr(w, http.StatusBadGateway, "mail_unavailable", map[string]any{
+			"message": "We couldn't send the email. Please try again later.",
+		})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"sent": true})
+}
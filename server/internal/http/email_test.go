@@ -0,0 +1,235 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/mail"
+	"mahi/server/internal/store"
+)
+
+const testPassword = "plum orbit canvas ladder"
+
+func TestRegisterSendsVerificationMail(t *testing.T) {
+	s, rec := newTestServer(t)
+	w, body := serve(s.register, jsonReq(t, http.MethodPost, "/v1/auth/register",
+		registerReq{Email: "new@example.com", Name: "New", Password: testPassword}))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d body %v", w.Code, body)
+	}
+
+	m := waitMail(t, rec, "new@example.com")
+	if !strings.Contains(m.Text, s.cfg.Issuer+"/v1/auth/verify-email?token=") {
+		t.Fatalf("verification mail without a link:\n%s", m.Text)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/v1/auth/verify-email?token="+url.QueryEscape(mailToken(t, m.Text)), nil)
+	if w, _ := serve(s.verifyEmail, r); w.Code != http.StatusOK {
+		t.Fatalf("following the link: status %d", w.Code)
+	}
+	if u, _ := s.st.GetUserByEmail("new@example.com"); !u.EmailVerified {
+		t.Fatal("email not verified after following the link")
+	}
+}
+
+// stuckMailer never finishes sending until released or its context ends.
+type stuckMailer struct{ release chan struct{} }
+
+func (m stuckMailer) Send(ctx context.Context, _ mail.Message) error {
+	select {
+	case <-m.release:
+	case <-ctx.Done():
+	}
+	return ctx.Err()
+}
+
+func TestRegisterDoesNotWaitForMail(t *testing.T) {
+	s, _ := newTestServer(t)
+	stuck := stuckMailer{release: make(chan struct{})}
+	defer close(stuck.release)
+	s.mail = stuck
+
+	done := make(chan int, 1)
+	go func() {
+		w, _ := serve(s.register, jsonReq(t, http.MethodPost, "/v1/auth/register",
+			registerReq{Email: "slow@example.com", Password: testPassword}))
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusCreated {
+			t.Fatalf("status %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("register waited on the mail server")
+	}
+}
+
+func TestForgotPasswordSendsResetMail(t *testing.T) {
+	s, rec := newTestServer(t)
+	u, err := s.st.CreateUser("forgot@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"forgot@example.com", "nobody@example.com"} {
+		w, body := serve(s.forgotPassword, jsonReq(t, http.MethodPost, "/v1/auth/password/forgot", forgotPasswordReq{Email: email}))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("%s: status %d body %v", email, w.Code, body)
+		}
+	}
+	m := waitMail(t, rec, "forgot@example.com")
+	if m.Subject != "Reset your password" || !strings.Contains(m.Text, "mahiapp://reset-password?token=") {
+		t.Fatalf("reset mail = %+v", m)
+	}
+	if _, ok := rec.Last("nobody@example.com"); ok {
+		t.Fatal("mailed an address without an account")
+	}
+
+	tok := mailToken(t, m.Text)
+	w, body := serve(s.resetPassword, jsonReq(t, http.MethodPost, "/v1/auth/password/reset",
+		resetPasswordReq{Token: tok, Password: testPassword}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("reset: status %d body %v", w.Code, body)
+	}
+	if _, err := s.st.VerifyCreds(context.Background(), s.hashes, "forgot@example.com", testPassword); err != nil {
+		t.Fatalf("new password doesn't work: %v", err)
+	}
+	if got, _ := s.st.GetUser(u.ID); !got.EmailVerified {
+		t.Fatal("a used reset link should verify the address")
+	}
+	// the link is single-use
+	w, _ = serve(s.resetPassword, jsonReq(t, http.MethodPost, "/v1/auth/password/reset",
+		resetPasswordReq{Token: tok, Password: testPassword + " again"}))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("second reset: status %d", w.Code)
+	}
+}
+
+// asUser adds what the authn middleware would for a token from sessionID.
+func asUser(r *http.Request, userID, sessionID string) *http.Request {
+	ctx := context.WithValue(r.Context(), ctxKeyUserID{}, userID)
+	return r.WithContext(context.WithValue(ctx, ctxKeySessionID{}, sessionID))
+}
+
+func TestChangeEmailWithoutPassword(t *testing.T) {
+	s, rec := newTestServer(t)
+	u, err := s.st.CreateUser("passkey@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := s.st.SaveRefresh(newRefreshToken(), u.ID, time.Now().Add(time.Hour), store.SessionMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := auth.NewTOTPSecret()
+	if err := s.st.SaveTOTP(u.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / 30
+	if err := s.st.UseTOTPStep(u.ID, step-2, true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		session string
+		req     changeEmailReq
+		want    int
+	}{
+		{"stale session", "s_old", changeEmailReq{}, http.StatusForbidden},
+		{"wrong totp", "s_old", changeEmailReq{stepUp: stepUp{TOTPCode: "000000"}}, http.StatusForbidden},
+		{"forged passkey state", "s_old", changeEmailReq{stepUp: stepUp{State: "x.y.z"}}, http.StatusForbidden},
+		{"totp step-up", "s_old", changeEmailReq{stepUp: stepUp{TOTPCode: auth.TOTPCode(secret, step)}}, http.StatusAccepted},
+		{"fresh sign-in", fresh, changeEmailReq{}, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.req.TOTPCode == "000000" && auth.TOTPCode(secret, step) == "000000" {
+				t.Skip("the current code happens to be 000000")
+			}
+			tt.req.NewEmail = "new-" + strings.ReplaceAll(tt.name, " ", "-") + "@example.com"
+			r := asUser(jsonReq(t, http.MethodPost, "/v1/users/me/email", tt.req), u.ID, tt.session)
+			w, body := serve(s.changeEmail, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d body %v, want %d", w.Code, body, tt.want)
+			}
+			if tt.want == http.StatusForbidden && body["error"] != "reauth_required" {
+				t.Fatalf("error %v, want reauth_required", body["error"])
+			}
+			if tt.want == http.StatusAccepted {
+				waitMail(t, rec, tt.req.NewEmail)
+			}
+		})
+	}
+}
+
+func TestChangeEmailNeedsPasswordWhenSet(t *testing.T) {
+	s, _ := newTestServer(t)
+	u, err := s.st.CreateUser("pw@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.st.SetPassword(context.Background(), s.hashes, u.ID, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	fresh, _ := s.st.SaveRefresh(newRefreshToken(), u.ID, time.Now().Add(time.Hour), store.SessionMeta{})
+
+	// a fresh session alone doesn't replace a password the account has
+	r := asUser(jsonReq(t, http.MethodPost, "/v1/users/me/email", changeEmailReq{NewEmail: "pw2@example.com"}), u.ID, fresh)
+	if w, body := serve(s.changeEmail, r); w.Code != http.StatusBadRequest || body["error"] != "missing_fields" {
+		t.Fatalf("status %d body %v", w.Code, body)
+	}
+	r = asUser(jsonReq(t, http.MethodPost, "/v1/users/me/email",
+		changeEmailReq{NewEmail: "pw2@example.com", Password: "wrong password"}), u.ID, fresh)
+	if w, body := serve(s.changeEmail, r); w.Code != http.StatusForbidden || body["error"] != "invalid_current_password" {
+		t.Fatalf("status %d body %v", w.Code, body)
+	}
+	r = asUser(jsonReq(t, http.MethodPost, "/v1/users/me/email",
+		changeEmailReq{NewEmail: "pw2@example.com", Password: testPassword}), u.ID, fresh)
+	if w, body := serve(s.changeEmail, r); w.Code != http.StatusAccepted {
+		t.Fatalf("status %d body %v", w.Code, body)
+	}
+}
+
+func TestChangeEmailStepUpLockedOut(t *testing.T) {
+	s, _ := newTestServer(t)
+	u, err := s.st.CreateUser("guess@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := auth.NewTOTPSecret()
+	if err := s.st.SaveTOTP(u.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / 30
+	if err := s.st.UseTOTPStep(u.ID, step-2, true); err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	for off := int64(-1); off <= 1; off++ {
+		if auth.TOTPCode(secret, step+off) == wrong {
+			wrong = "999999"
+		}
+	}
+	change := func(code string) (*httptest.ResponseRecorder, map[string]any) {
+		req := changeEmailReq{NewEmail: "taken-over@example.com", stepUp: stepUp{TOTPCode: code}}
+		return serve(s.changeEmail, asUser(jsonReq(t, http.MethodPost, "/v1/users/me/email", req), u.ID, "s_old"))
+	}
+
+	for i := 0; i < mfaMaxTries; i++ {
+		if w, body := change(wrong); w.Code != http.StatusForbidden {
+			t.Fatalf("guess %d: status %d body %v", i+1, w.Code, body)
+		}
+	}
+	// guessing through step-up counts against the same limit as sign-in
+	w, body := change(auth.TOTPCode(secret, step))
+	if w.Code != http.StatusTooManyRequests || body["error"] != errMFATooMany.Error() || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("after %d wrong codes: status %d body %v", mfaMaxTries, w.Code, body)
+	}
+}
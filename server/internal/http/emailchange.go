@@ -0,0 +1,195 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/mail"
+	"mahi/server/internal/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	emailChangeTTL = 24 * time.Hour
+	emailRevertTyp = "email-revert+jwt"
+	// the old owner may not read their mail for a while
+	emailRevertTTL = 7 * 24 * time.Hour
+)
+
+type changeEmailReq struct {
+	NewEmail string `json:"new_email"`
+	Password string `json:"password"`
+	// accounts without a password re-authenticate instead
+	stepUp
+}
+
+// POST /v1/users/me/email
+// Nothing changes until the new address is confirmed through the link sent
+// to it; a later request replaces a pending one. Accounts without a password
+// confirm with a fresh sign-in, a TOTP code or a passkey instead.
+func (s *Server) changeEmail(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	var req changeEmailReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	req.NewEmail = strings.TrimSpace(req.NewEmail)
+	if req.NewEmail == "" {
+		writeErr(w, http.StatusBadRequest, "missing_fields", nil)
+		return
+	}
+	if !strings.Contains(req.NewEmail, "@") {
+		writeErr(w, http.StatusBadRequest, "invalid_email", map[string]any{"field": "new_email"})
+		return
+	}
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		writeErr(w, http.StatusNotFound, "user_not_found", nil)
+		return
+	}
+	if !s.st.HasPassword(userID) {
+		if !s.reauthOK(w, r, userID, req.stepUp) {
+			return
+		}
+	} else if req.Password == "" {
+		writeErr(w, http.StatusBadRequest, "missing_fields", map[string]any{"field": "password"})
+		return
+	} else if _, err := s.st.VerifyCreds(r.Context(), s.hashes, u.Email, req.Password); s.hashBusy(w, err) {
+		return
+	} else if err != nil {
+		writeErr(w, http.StatusForbidden, "invalid_current_password", map[string]any{"field": "password"})
+		return
+	}
+	if req.NewEmail == u.Email {
+		writeErr(w, http.StatusBadRequest, "email_unchanged", map[string]any{"field": "new_email"})
+		return
+	}
+	// checked again when the change is confirmed; this is for a quick answer
+	if _, taken := s.st.GetUserByEmail(req.NewEmail); taken {
+		writeErr(w, http.StatusConflict, "email_exists", map[string]any{"field": "new_email"})
+		return
+	}
+	token := newRefreshToken()
+	if err := s.st.SaveEmailChange(userID, req.NewEmail, token, time.Now().Add(emailChangeTTL)); err != nil {
+		writeErr(w, http.StatusInternalServerError, "email_change_failed", nil)
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditEmailChangeRequested,
+		Detail: map[string]any{"to": req.NewEmail, "ip": clientIP(r)}})
+	ok = s.sendMail(r, mail.Message{
+		To:      req.NewEmail,
+		Subject: "Confirm your new email address",
+		Text: "Please confirm that you want to use this address for your Mahi account by opening the link below:\n\n" +
+			s.cfg.Issuer + "/v1/auth/email-change/confirm?" + url.Values{"token": {token}}.Encode() + "\n\n" +
+			"The link expires in 24 hours. If you didn't ask for this, you can ignore this email.",
+	})
+	if !ok {
+		writeErr(w, http.StatusBadGateway, "mail_unavailable", map[string]any{
+			"message": "We couldn't send the email. Please try again later.",
+		})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"pending_email": req.NewEmail,
+		"expires_in":    int(emailChangeTTL.Seconds()),
+	})
+}
+
+// GET|POST /v1/auth/email-change/confirm
+func (s *Server) confirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	tok, ok := linkToken(w, r)
+	if !ok {
+		return
+	}
+	userID, email, err := s.st.ConsumeEmailChange(tok)
+	if err != nil {
+		linkFailed(w, r, http.StatusBadRequest, "email_change_invalid",
+			"This link is invalid or has expired. Start the change again from the app.")
+		return
+	}
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		linkFailed(w, r, http.StatusBadRequest, "email_change_invalid", "This account no longer exists.")
+		return
+	}
+	// two accounts may have asked for the same address; the store lets one win
+	err = s.st.ChangeEmail(userID, email)
+	if errors.Is(err, store.ErrEmailExists) {
+		linkFailed(w, r, http.StatusConflict, "email_exists", "This address is already used by another account.")
+		return
+	}
+	if err != nil {
+		linkFailed(w, r, http.StatusInternalServerError, "email_change_failed", "Something went wrong. Please try again.")
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditEmailChanged,
+		Detail: map[string]any{"from": u.Email, "to": email}})
+	s.sendEmailRevert(r, userID, u.Email, email)
+	linkDone(w, r, "Your email address is now "+email+". You can return to the app.",
+		map[string]any{"email": email, "email_verified": true})
+}
+
+// sendEmailRevert tells the previous address about the change, with a link
+// that undoes it in case the account was taken over.
+func (s *Server) sendEmailRevert(r *http.Request, userID, prev, email string) {
+	tok, err := s.newEmailToken(emailRevertTyp, emailClaims{UserID: userID, Email: email, Prev: prev}, emailRevertTTL)
+	if err != nil {
+		log.Printf("email revert: %v", err)
+		return
+	}
+	go s.sendMail(r, mail.Message{
+		To:      prev,
+		Subject: "Your Mahi email address was changed",
+		Text: "The email address of your Mahi account was changed to " + email + ".\n\n" +
+			"If this wasn't you, open the link below within 7 days to switch back to this address " +
+			"and sign out every device:\n\n" +
+			s.cfg.Issuer + "/v1/auth/email-change/revert?" + url.Values{"token": {tok}}.Encode(),
+	})
+}
+
+// GET|POST /v1/auth/email-change/revert
+// Whoever made the change may still be signed in, so every session ends.
+func (s *Server) revertEmailChange(w http.ResponseWriter, r *http.Request) {
+	tok, ok := linkToken(w, r)
+	if !ok {
+		return
+	}
+	c, u, err := s.parseEmailToken(tok, emailRevertTyp)
+	if err != nil || c.Prev == "" || s.revoked.isRevoked(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{ID: c.ID}}) {
+		linkFailed(w, r, http.StatusBadRequest, "email_revert_invalid", "This link is invalid, has expired or was already used.")
+		return
+	}
+	err = s.st.ChangeEmail(u.ID, c.Prev)
+	if errors.Is(err, store.ErrEmailExists) {
+		linkFailed(w, r, http.StatusConflict, "email_exists",
+			"This address now belongs to another account. Contact support to recover yours.")
+		return
+	}
+	if err != nil {
+		linkFailed(w, r, http.StatusInternalServerError, "email_revert_failed", "Something went wrong. Please try again.")
+		return
+	}
+	if err := s.revoked.revoke(store.RevokeKindJTI, c.ID, c.ExpiresAt.Time); err != nil {
+		log.Printf("email revert: spend token: %v", err)
+	}
+	revoked, err := s.st.RevokeOtherSessions(u.ID, "")
+	if err != nil {
+		log.Printf("email revert: revoke sessions: %v", err)
+	}
+	for _, id := range revoked {
+		s.revokeSessionAccess(id)
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditEmailChangeReverted,
+		Detail: map[string]any{"from": u.Email, "to": c.Prev, "sessions_revoked": len(revoked)}})
+	linkDone(w, r, "Your email address is back to "+c.Prev+" and every device was signed out. "+
+		"If someone else knew your password, reset it from the sign-in screen.",
+		map[string]any{"email": c.Prev, "sessions_revoked": len(revoked)})
+}
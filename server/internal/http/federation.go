@@ -0,0 +1,316 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mahi/server/internal/federation"
+	"mahi/server/internal/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	fedCookie   = "mahi_federation"
+	fedStateTyp = "fed-state+jwt"
+	// the user has this long to finish signing in upstream
+	fedStateTTL = 10 * time.Minute
+)
+
+// fedState travels in a signed, HttpOnly cookie from /start to /callback.
+// The PKCE verifier lives here so it never appears in a URL.
+type fedState struct {
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	Verifier     string `json:"verifier"`
+	AppRedirect  string `json:"app_redirect,omitempty"`
+	AppChallenge string `json:"app_challenge,omitempty"`
+	DeviceName   string `json:"device_name,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// fedError is a sign-in failure we can explain to the app.
+type fedError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *fedError) Error() string { return e.code }
+
+func (s *Server) callbackURL(provider string) string {
+	return s.cfg.Issuer + "/v1/auth/federated/" + url.PathEscape(provider) + "/callback"
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// GET /v1/auth/federated/{provider}/start?app_redirect=mahiapp://...&code_challenge=...
+// Sends the browser to the provider. Without app_redirect the callback answers
+// with tokens directly; with it the app receives a one-time code for /exchange.
+func (s *Server) federatedStart(w http.ResponseWriter, r *http.Request) {
+	p, err := s.fed.Get(chi.URLParam(r, "provider"))
+	if err != nil {
+		writeErr(w, http.StatusNotFound, "provider_unknown", nil)
+		return
+	}
+	q := r.URL.Query()
+	st := fedState{
+		Provider:     p.Name(),
+		State:        newRefreshToken(),
+		Nonce:        newRefreshToken(),
+		Verifier:     newRefreshToken(),
+		AppRedirect:  q.Get("app_redirect"),
+		AppChallenge: q.Get("code_challenge"),
+		DeviceName:   q.Get("device_name"),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(fedStateTTL)),
+		},
+	}
+	if st.AppRedirect != "" {
+		if !s.fed.AllowsAppRedirect(st.AppRedirect) {
+			writeErr(w, http.StatusBadRequest, "redirect_not_allowed", map[string]any{"field": "app_redirect"})
+			return
+		}
+		// the code goes through a deep link any app could claim; PKCE keeps it useless to them
+		if st.AppChallenge == "" {
+			writeErr(w, http.StatusBadRequest, "missing_fields", map[string]any{"field": "code_challenge"})
+			return
+		}
+	}
+	cookie, err := s.jwt.Sign(fedStateTyp, st)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "token_error", nil)
+		return
+	}
+	dest, err := p.AuthCodeURL(r.Context(), s.callbackURL(p.Name()), st.State, st.Nonce, pkceChallenge(st.Verifier))
+	if err != nil {
+		log.Printf("federation %s: %v", p.Name(), err)
+		writeErr(w, http.StatusBadGateway, "provider_unavailable", nil)
+		return
+	}
+	s.setFedCookie(w, cookie, int(fedStateTTL.Seconds()))
+	http.Redirect(w, r, dest, http.StatusFound)
+}
+
+// setFedCookie scopes the state cookie to the federation routes. Apple posts the
+// callback cross-site, which needs SameSite=None (and so Secure) outside dev.
+func (s *Server) setFedCookie(w http.ResponseWriter, value string, maxAge int) {
+	c := &http.Cookie{
+		Name:     fedCookie,
+		Value:    value,
+		Path:     "/v1/auth/federated/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if strings.HasPrefix(s.cfg.Issuer, "https://") {
+		c.Secure, c.SameSite = true, http.SameSiteNoneMode
+	}
+	http.SetCookie(w, c)
+}
+
+// GET|POST /v1/auth/federated/{provider}/callback
+func (s *Server) federatedCallback(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_request", nil)
+		return
+	}
+	c, err := r.Cookie(fedCookie)
+	var st fedState
+	if err != nil || s.jwt.ParseTyped(c.Value, fedStateTyp, &st) != nil ||
+		st.Provider != chi.URLParam(r, "provider") || st.State != r.FormValue("state") {
+		writeErr(w, http.StatusBadRequest, "federation_state_invalid", map[string]any{
+			"message": "The sign-in attempt expired or was started elsewhere. Please try again.",
+		})
+		return
+	}
+	s.setFedCookie(w, "", -1)
+
+	fail := func(fe *fedError) {
+		if st.AppRedirect != "" {
+			redirectWith(w, r, st.AppRedirect, url.Values{"error": {fe.code}})
+			return
+		}
+		writeErr(w, fe.status, fe.code, map[string]any{"message": fe.msg})
+	}
+	if upstreamErr := r.FormValue("error"); upstreamErr != "" {
+		fail(&fedError{http.StatusUnauthorized, "federation_denied", "Sign-in was cancelled at the provider."})
+		return
+	}
+	p, err := s.fed.Get(st.Provider)
+	if err != nil {
+		fail(&fedError{http.StatusNotFound, "provider_unknown", ""})
+		return
+	}
+	ident, err := p.Exchange(r.Context(), r.FormValue("code"), s.callbackURL(p.Name()), st.Verifier, st.Nonce)
+	if err != nil {
+		log.Printf("federation %s: %v", p.Name(), err)
+		fail(&fedError{http.StatusUnauthorized, "federated_token_invalid", "The provider did not confirm your identity."})
+		return
+	}
+	u, fe := s.federatedUser(ident)
+	if fe != nil {
+		fail(fe)
+		return
+	}
+
+	if st.AppRedirect == "" {
+		s.completeLogin(w, r, u, st.DeviceName)
+		return
+	}
+	code := newRefreshToken()
+	// no client id or redirect URI: the app proves itself with its PKCE verifier alone
+	err = s.st.SaveAuthCode(code, store.AuthCode{
+		UserID:              u.ID,
+		CodeChallenge:       st.AppChallenge,
+		CodeChallengeMethod: "S256",
+		AuthTime:            time.Now(),
+		Exp:                 time.Now().Add(authCodeTTL),
+	})
+	if err != nil {
+		log.Printf("federation: save code: %v", err)
+		fail(&fedError{http.StatusInternalServerError, "session_error", ""})
+		return
+	}
+	redirectWith(w, r, st.AppRedirect, url.Values{"code": {code}})
+}
+
+type federatedExchangeReq struct {
+	Code         string `json:"code"`
+	CodeVerifier string `json:"code_verifier"`
+	DeviceName   string `json:"device_name"`
+}
+
+// POST /v1/auth/federated/exchange
+// The app trades the code from its deep link (plus its PKCE verifier) for tokens.
+func (s *Server) federatedExchange(w http.ResponseWriter, r *http.Request) {
+	var req federatedExchangeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	// codes with a client id belong to third-party OAuth clients and don't match here
+	ac, err := s.st.ConsumeAuthCode(req.Code, "", "")
+	if err != nil || !verifyPKCE(req.CodeVerifier, ac.CodeChallenge) {
+		writeErr(w, http.StatusUnauthorized, "code_invalid", nil)
+		return
+	}
+	u, ok := s.st.GetUser(ac.UserID)
+	if !ok {
+		writeErr(w, http.StatusUnauthorized, "code_invalid", nil)
+		return
+	}
+	s.completeLogin(w, r, u, req.DeviceName)
+}
+
+type federatedTokenReq struct {
+	IDToken    string `json:"id_token"`
+	Nonce      string `json:"nonce"`
+	DeviceName string `json:"device_name"`
+}
+
+// POST /v1/auth/federated/{provider}/token
+// For native SDKs (Google Sign-In, Sign in with Apple) that hand the app an ID token.
+// nonce is required and compared verbatim with the token's nonce claim, so a
+// token captured elsewhere can't be replayed here on its own.
+func (s *Server) federatedToken(w http.ResponseWriter, r *http.Request) {
+	p, err := s.fed.Get(chi.URLParam(r, "provider"))
+	if err != nil {
+		writeErr(w, http.StatusNotFound, "provider_unknown", nil)
+		return
+	}
+	var req federatedTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if req.IDToken == "" {
+		writeErr(w, http.StatusBadRequest, "missing_fields", map[string]any{"field": "id_token"})
+		return
+	}
+	if req.Nonce == "" {
+		writeErr(w, http.StatusBadRequest, "missing_fields", map[string]any{"field": "nonce"})
+		return
+	}
+	ident, err := p.VerifyIDToken(r.Context(), req.IDToken, req.Nonce)
+	if errors.Is(err, federation.ErrNoIDToken) {
+		writeErr(w, http.StatusBadRequest, "provider_no_id_token", map[string]any{
+			"message": "This provider only supports the browser flow.",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("federation %s: %v", p.Name(), err)
+		writeErr(w, http.StatusUnauthorized, "federated_token_invalid", nil)
+		return
+	}
+	u, fe := s.federatedUser(ident)
+	if fe != nil {
+		writeErr(w, fe.status, fe.code, map[string]any{"message": fe.msg})
+		return
+	}
+	s.completeLogin(w, r, u, req.DeviceName)
+}
+
+// federatedUser finds the user linked to ident, links it to an existing
+// account, or signs a new user up.
+//
+// Linking by email only happens when both the provider and our own record
+// vouch for the address; otherwise whoever registered an email first (without
+// proving it) could take over the real owner's social login, or the reverse.
+func (s *Server) federatedUser(ident federation.Identity) (store.User, *fedError) {
+	if u, ok := s.st.FindIdentity(ident.Provider, ident.Subject); ok {
+		return u, nil
+	}
+	if ident.Email == "" || !ident.EmailVerified {
+		return store.User{}, &fedError{http.StatusForbidden, "federated_email_unverified",
+			"Your account at the provider has no verified email address."}
+	}
+	link := store.Identity{Provider: ident.Provider, Subject: ident.Subject, Email: ident.Email}
+	exists := &fedError{http.StatusConflict, "account_exists",
+		"An account with this email already exists. Sign in with your password first."}
+
+	if u, ok := s.st.GetUserByEmail(ident.Email); ok {
+		if !u.EmailVerified {
+			return store.User{}, exists
+		}
+		link.UserID = u.ID
+		if err := s.st.LinkIdentity(link); err != nil && !errors.Is(err, store.ErrIdentityExists) {
+			return store.User{}, &fedError{http.StatusInternalServerError, "identity_error", ""}
+		}
+		_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditIdentityLinked,
+			Detail: map[string]any{"provider": ident.Provider}})
+		return u, nil
+	}
+
+	u, err := s.st.CreateUser(ident.Email, ident.Name)
+	if errors.Is(err, store.ErrEmailExists) {
+		return store.User{}, exists // lost a race with another sign-up
+	}
+	if err != nil {
+		return store.User{}, &fedError{http.StatusInternalServerError, "identity_error", ""}
+	}
+	if err := s.st.SetEmailVerified(u.ID, true); err != nil {
+		return store.User{}, &fedError{http.StatusInternalServerError, "identity_error", ""}
+	}
+	u.EmailVerified = true
+	link.UserID = u.ID
+	if err := s.st.LinkIdentity(link); err != nil {
+		return store.User{}, &fedError{http.StatusInternalServerError, "identity_error", ""}
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditFederatedSignup,
+		Detail: map[string]any{"provider": ident.Provider}})
+	return u, nil
+}
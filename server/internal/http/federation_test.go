@@ -0,0 +1,105 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"mahi/server/internal/federation"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestFederatedUserLinksOnlyVerifiedEmails(t *testing.T) {
+	s, _ := newTestServer(t)
+	verified, err := s.st.CreateUser("verified@example.com", "Verified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.st.SetEmailVerified(verified.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.st.CreateUser("claimed@example.com", "Squatter"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		ident    federation.Identity
+		wantCode string // "" means signed in
+		wantUser string // expected user id when signed in to an existing account
+	}{
+		{
+			name:     "unverified at the provider",
+			ident:    federation.Identity{Provider: "google", Subject: "g-1", Email: "verified@example.com"},
+			wantCode: "federated_email_unverified",
+		},
+		{
+			name:     "unverified on our side",
+			ident:    federation.Identity{Provider: "google", Subject: "g-2", Email: "claimed@example.com", EmailVerified: true},
+			wantCode: "account_exists",
+		},
+		{
+			name:     "verified on both sides",
+			ident:    federation.Identity{Provider: "google", Subject: "g-3", Email: "verified@example.com", EmailVerified: true},
+			wantUser: verified.ID,
+		},
+		{
+			name:  "new address signs up",
+			ident: federation.Identity{Provider: "github", Subject: "42", Email: "new@example.com", EmailVerified: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, fe := s.federatedUser(tt.ident)
+			if tt.wantCode != "" {
+				if fe == nil || fe.code != tt.wantCode {
+					t.Fatalf("err = %v, want %s", fe, tt.wantCode)
+				}
+				if _, ok := s.st.FindIdentity(tt.ident.Provider, tt.ident.Subject); ok {
+					t.Fatal("identity was linked anyway")
+				}
+				return
+			}
+			if fe != nil {
+				t.Fatalf("err = %v", fe)
+			}
+			if tt.wantUser != "" && u.ID != tt.wantUser {
+				t.Fatalf("signed in as %s, want %s", u.ID, tt.wantUser)
+			}
+			if !u.EmailVerified {
+				t.Fatal("user email not verified")
+			}
+			linked, ok := s.st.FindIdentity(tt.ident.Provider, tt.ident.Subject)
+			if !ok || linked.ID != u.ID {
+				t.Fatalf("identity not linked to %s", u.ID)
+			}
+		})
+	}
+
+	// the squatted address stays unlinked even once the provider vouches for it again
+	if _, fe := s.federatedUser(federation.Identity{Provider: "apple", Subject: "a-1", Email: "claimed@example.com", EmailVerified: true}); fe == nil {
+		t.Fatal("linked to an account whose email was never verified")
+	}
+}
+
+func TestFederatedTokenRequiresNonce(t *testing.T) {
+	s, _ := newTestServer(t)
+	var err error
+	s.fed, err = federation.New([]federation.ProviderConfig{{Name: "google", ClientID: "web"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := jsonReq(t, http.MethodPost, "/v1/auth/federated/google/token", map[string]string{"id_token": "eyJ.x.y"})
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("provider", "google")
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+	w, body := serve(s.federatedToken, r)
+	if w.Code != http.StatusBadRequest || body["error"] != "missing_fields" {
+		t.Fatalf("status %d body %v, want 400 missing_fields", w.Code, body)
+	}
+	if d, _ := body["details"].(map[string]any); d["field"] != "nonce" {
+		t.Fatalf("details = %v, want field nonce", body["details"])
+	}
+}
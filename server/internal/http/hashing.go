@@ -0,0 +1,39 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"mahi/server/internal/auth"
+)
+
+// isHashBusy reports whether err means the password wasn't checked or hashed
+// because the hash scheduler turned us away, or the client left while queued.
+func isHashBusy(err error) bool {
+	return errors.Is(err, auth.ErrHashBusy) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// hashBusy answers 503 with a Retry-After when err is a saturated hash
+// scheduler, and reports whether it did.
+func (s *Server) hashBusy(w http.ResponseWriter, err error) bool {
+	if !isHashBusy(err) {
+		return false
+	}
+	secs := int(math.Ceil(s.hashes.RetryAfter().Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeErr(w, http.StatusServiceUnavailable, "server_busy", map[string]any{
+		"retry_after": secs,
+		"message":     "We're handling a lot of sign-ins right now. Please try again in a moment.",
+	})
+	return true
+}
+
+// GET /v1/admin/metrics/hashing
+// Queue depth, throughput and hash latency of the password hash scheduler.
+func (s *Server) hashingMetrics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.hashes.Stats())
+}
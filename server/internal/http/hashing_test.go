@@ -0,0 +1,62 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"mahi/server/internal/auth"
+)
+
+// saturateHashing installs a hash scheduler with one slot, no queue, and
+// that slot taken until the test ends.
+func saturateHashing(t *testing.T, s *Server) {
+	t.Helper()
+	s.hashes = auth.NewHashScheduler(1, 0, time.Second)
+	release, running := make(chan struct{}), make(chan struct{})
+	go s.hashes.Do(context.Background(), func() { close(running); <-release })
+	<-running
+	t.Cleanup(func() { close(release) })
+}
+
+func TestSaturatedHashingAnswers503(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(s *Server) http.HandlerFunc
+		path    string
+		body    any
+	}{
+		{"login", func(s *Server) http.HandlerFunc { return s.login }, "/v1/auth/login",
+			loginReq{Email: "demo@demo.com", Password: testPassword}},
+		{"register", func(s *Server) http.HandlerFunc { return s.register }, "/v1/auth/register",
+			registerReq{Email: "busy@example.com", Password: testPassword}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			saturateHashing(t, s)
+			w, body := serve(tt.handler(s), jsonReq(t, http.MethodPost, tt.path, tt.body))
+			if w.Code != http.StatusServiceUnavailable || body["error"] != "server_busy" || w.Header().Get("Retry-After") == "" {
+				t.Fatalf("status %d body %v, want 503 server_busy with Retry-After", w.Code, body)
+			}
+			// nothing happened that the retry would trip over
+			if th, _ := s.st.LoginThrottle(accountKey("demo@demo.com")); th.Failures != 0 {
+				t.Fatal("a busy login counted as a failure")
+			}
+			if _, ok := s.st.GetUserByEmail("busy@example.com"); ok {
+				t.Fatal("a busy register left an account behind")
+			}
+		})
+	}
+}
+
+func TestHashingMetrics(t *testing.T) {
+	s, _ := newTestServer(t)
+	saturateHashing(t, s)
+	serve(s.login, jsonReq(t, http.MethodPost, "/v1/auth/login", loginReq{Email: "demo@demo.com", Password: testPassword}))
+	_, body := serve(s.hashingMetrics, jsonReq(t, http.MethodGet, "/v1/admin/metrics/hashing", nil))
+	if body["rejected"] != float64(1) || body["in_flight"] != float64(1) || body["max_concurrent"] != float64(1) {
+		t.Fatalf("metrics %v", body)
+	}
+}
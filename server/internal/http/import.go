@@ -0,0 +1,95 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/store"
+)
+
+// most a single import request may carry; larger migrations are split
+const maxImportUsers = 1000
+
+type importUser struct {
+	Email         string `json:"email"`
+	Name          string `json:"name"`
+	PasswordHash  string `json:"password_hash"` // any format auth.SchemeOf knows; empty for no password
+	EmailVerified bool   `json:"email_verified"`
+}
+
+type importResult struct {
+	Email  string `json:"email"`
+	Status string `json:"status"` // "created", "exists" or "invalid"
+	// for "invalid": invalid_email, unknown_hash_scheme, malformed_hash or import_failed
+	UserID string `json:"user_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// POST /v1/admin/users/import
+// Creates users moved over from another system with their existing password
+// hashes. Each user is judged on its own; imported hashes are rewritten as
+// Argon2id when the user first signs in.
+func (s *Server) importUsers(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Users []importUser `json:"users"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if len(req.Users) == 0 || len(req.Users) > maxImportUsers {
+		writeErr(w, http.StatusBadRequest, "invalid_batch", map[string]any{"field": "users", "max": maxImportUsers})
+		return
+	}
+	results := make([]importResult, 0, len(req.Users))
+	counts := map[string]int{}
+	for _, in := range req.Users {
+		res := s.importUser(in)
+		counts[res.Status]++
+		results = append(results, res)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"created": counts["created"],
+		"exists":  counts["exists"],
+		"invalid": counts["invalid"],
+		"results": results,
+	})
+}
+
+func (s *Server) importUser(in importUser) importResult {
+	res := importResult{Email: strings.TrimSpace(in.Email)}
+	if !strings.Contains(res.Email, "@") {
+		res.Status, res.Error = "invalid", "invalid_email"
+		return res
+	}
+	// a hash that can't be parsed would leave an account nobody can sign in to
+	scheme := ""
+	if in.PasswordHash != "" {
+		sc, err := auth.ParseHash(in.PasswordHash)
+		if errors.Is(err, auth.ErrUnknownScheme) {
+			res.Status, res.Error = "invalid", "unknown_hash_scheme"
+			return res
+		}
+		if err != nil {
+			res.Status, res.Error = "invalid", "malformed_hash"
+			return res
+		}
+		scheme = sc.Name()
+	}
+	u, err := s.st.ImportUser(res.Email, in.Name, in.PasswordHash, in.EmailVerified)
+	if errors.Is(err, store.ErrEmailExists) {
+		res.Status = "exists"
+		return res
+	}
+	if err != nil {
+		res.Status, res.Error = "invalid", "import_failed"
+		return res
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditUserImported,
+		Detail: map[string]any{"hash_scheme": scheme}})
+	res.Status, res.UserID = "created", u.ID
+	return res
+}
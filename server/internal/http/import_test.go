@@ -0,0 +1,67 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestImportUsers(t *testing.T) {
+	s, _ := newTestServer(t)
+	good, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []importUser{
+		{Email: "bcrypt@example.com", PasswordHash: string(good)},
+		{Email: "nopass@example.com"},
+		{Email: "nopass2@example.com"},
+		{Email: "short@example.com", PasswordHash: string(good[:40])},
+		{Email: "huge@example.com", PasswordHash: "v=1$t=1$m=2097152$p=4$c2FsdHNhbHQ$aGFzaGhhc2g"},
+		{Email: "django@example.com", PasswordHash: "pbkdf2_sha256$lots$salt$aGFzaA"},
+		{Email: "md5@example.com", PasswordHash: "5f4dcc3b5aa765d61d8327deb882cf99"},
+		{Email: "not-an-email", PasswordHash: string(good)},
+		{Email: "bcrypt@example.com"},
+	}
+	want := []struct{ status, err string }{
+		{"created", ""},
+		{"created", ""},
+		{"created", ""},
+		{"invalid", "malformed_hash"},
+		{"invalid", "malformed_hash"},
+		{"invalid", "malformed_hash"},
+		{"invalid", "unknown_hash_scheme"},
+		{"invalid", "invalid_email"},
+		{"exists", ""},
+	}
+	w, body := serve(s.importUsers, jsonReq(t, http.MethodPost, "/v1/admin/users/import", map[string]any{"users": users}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d body %v", w.Code, body)
+	}
+	results := body["results"].([]any)
+	ids := map[string]bool{}
+	for i, r := range results {
+		res := r.(map[string]any)
+		errCode, _ := res["error"].(string)
+		if res["status"] != want[i].status || errCode != want[i].err {
+			t.Errorf("%s: %v/%q, want %s/%q", users[i].Email, res["status"], errCode, want[i].status, want[i].err)
+		}
+		if id, _ := res["user_id"].(string); id != "" {
+			if ids[id] {
+				t.Errorf("user id %s handed out twice", id)
+			}
+			ids[id] = true
+		}
+	}
+	if body["created"] != float64(3) || body["invalid"] != float64(5) || body["exists"] != float64(1) {
+		t.Errorf("counts = %v/%v/%v", body["created"], body["invalid"], body["exists"])
+	}
+	if _, ok := s.st.GetUserByEmail("short@example.com"); ok {
+		t.Error("a user with a malformed hash was created")
+	}
+	if _, err := s.st.VerifyCreds(context.Background(), s.hashes, "bcrypt@example.com", testPassword); err != nil {
+		t.Errorf("imported bcrypt password: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/config"
+)
+
+// loadKeys builds the signing key ring from config: JWT_KEYRING_FILE wins,
+// then JWT_KEY_FILE, then the plain JWT_SECRET.
+func loadKeys(cfg config.Config) (auth.SigningKey, []auth.SigningKey, error) {
+	if cfg.JWTKeyRingFile != "" {
+		return auth.LoadKeyRing(cfg.JWTKeyRingFile)
+	}
+	if cfg.JWTKeyFile != "" {
+		key, err := auth.LoadSigningKey(cfg.JWTKeyID, cfg.JWTKeyFile)
+		return key, nil, err
+	}
+	return auth.NewHMACKey(auth.DefaultHMACKeyID, []byte(cfg.JWTSecret)), nil, nil
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, s.jwt.JWKS())
+}
+
+// GET /v1/admin/keys
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"keys": s.jwt.Keys()})
+}
+
+type rotateKeyReq struct {
+	Alg string `json:"alg"` // EdDSA (default), RS256 or HS256
+	// how long the outgoing key keeps verifying tokens; defaults to the access token TTL
+	GraceMin int `json:"grace_min"`
+}
+
+// POST /v1/admin/keys/rotate
+// Generates a new in-memory key and makes it active on this instance only. The key
+// is never written anywhere: other instances keep signing with their own key and
+// reject tokens from this one, and a restart loses it. Use it on single-instance
+// deployments; anything behind a load balancer rotates by editing
+// JWT_KEYRING_FILE on every instance and calling /keys/reload.
+func (s *Server) rotateKey(w http.ResponseWriter, r *http.Request) {
+	var req rotateKeyReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+			return
+		}
+	}
+	key, err := auth.GenerateSigningKey(req.Alg)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, "unsupported_alg", map[string]any{"field": "alg"})
+		return
+	}
+	grace := req.GraceMin
+	if grace <= 0 {
+		grace = s.cfg.AccessTTLMin
+	}
+	s.jwt.Rotate(key, time.Now().Add(time.Duration(grace)*time.Minute))
+	writeJSON(w, http.StatusOK, map[string]any{"active": key.ID, "keys": s.jwt.Keys()})
+}
+
+// POST /v1/admin/keys/reload
+// Re-reads the key ring from config so edits to JWT_KEYRING_FILE apply without a restart.
+func (s *Server) reloadKeys(w http.ResponseWriter, r *http.Request) {
+	active, verifyOnly, err := loadKeys(s.cfg)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "keyring_invalid", map[string]any{"message": err.Error()})
+		return
+	}
+	s.jwt.SetKeys(active, verifyOnly...)
+	writeJSON(w, http.StatusOK, map[string]any{"active": active.ID, "keys": s.jwt.Keys()})
+}
@@ -0,0 +1,183 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/mail"
+	"mahi/server/internal/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accountUnlockTyp = "account-unlock+jwt"
+	accountUnlockTTL = 24 * time.Hour
+	// wait after the first wrong password; it doubles with each one after
+	loginBackoffBase = time.Second
+)
+
+// errLoginLocked is returned instead of checking the password while a key is
+// throttled. locked means the account reached the lockout, as opposed to
+// backing off between attempts or the client address being blocked.
+type errLoginLocked struct {
+	locked     bool
+	retryAfter time.Duration
+}
+
+func (e *errLoginLocked) Error() string {
+	return fmt.Sprintf("login throttled for %s", e.retryAfter.Round(time.Second))
+}
+
+func accountKey(email string) string { return "acct:" + strings.ToLower(strings.TrimSpace(email)) }
+
+func ipKey(r *http.Request) string { return "ip:" + clientIP(r) }
+
+func (s *Server) lockoutDuration() time.Duration {
+	return time.Duration(s.cfg.LoginLockoutMin) * time.Minute
+}
+
+// verifyLogin is VerifyCreds behind the per-account and per-address
+// throttles. Keys are checked before the password, so a locked account costs
+// no hashing, and the account key is the email whether or not it exists so
+// lockouts don't reveal which accounts do.
+func (s *Server) verifyLogin(r *http.Request, email, password string) (store.User, error) {
+	acct, ip := accountKey(email), ipKey(r)
+	now := time.Now()
+	for _, key := range []string{acct, ip} {
+		t, err := s.st.LoginThrottle(key)
+		if err != nil {
+			log.Printf("login throttle %s: %v", key, err)
+			continue
+		}
+		if now.Before(t.LockedUntil) {
+			return store.User{}, &errLoginLocked{
+				locked:     key == acct && t.Failures >= s.cfg.LoginMaxFailures,
+				retryAfter: t.LockedUntil.Sub(now),
+			}
+		}
+	}
+	u, err := s.st.VerifyCreds(r.Context(), s.hashes, email, password)
+	if err == nil {
+		// the address keeps its count: one good account mustn't launder the rest
+		if err := s.st.ClearLoginFailures(acct); err != nil {
+			log.Printf("login throttle %s: %v", acct, err)
+		}
+		return u, nil
+	}
+	if errors.Is(err, store.ErrInvalidCreds) {
+		s.loginFailed(r, email, acct, ip)
+	}
+	return store.User{}, err
+}
+
+func (s *Server) loginFailed(r *http.Request, email, acct, ip string) {
+	now := time.Now()
+	window := s.lockoutDuration()
+	n, err := s.st.AddLoginFailure(acct, now.Add(-window))
+	if err != nil {
+		log.Printf("login throttle %s: %v", acct, err)
+	} else if n >= s.cfg.LoginMaxFailures {
+		_ = s.st.LockLogin(acct, now.Add(window))
+		if n == s.cfg.LoginMaxFailures {
+			s.accountLocked(r, email)
+		}
+	} else {
+		backoff := loginBackoffBase * time.Duration(math.Pow(2, float64(n-1)))
+		_ = s.st.LockLogin(acct, now.Add(min(backoff, window)))
+	}
+
+	if m, err := s.st.AddLoginFailure(ip, now.Add(-window)); err != nil {
+		log.Printf("login throttle %s: %v", ip, err)
+	} else if m >= s.cfg.LoginIPMaxFailures {
+		_ = s.st.LockLogin(ip, now.Add(window))
+	}
+}
+
+// accountLocked records the lockout and mails the owner a link that lifts it.
+func (s *Server) accountLocked(r *http.Request, email string) {
+	u, ok := s.st.GetUserByEmail(email)
+	if !ok {
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditAccountLocked,
+		Detail: map[string]any{"ip": clientIP(r)}})
+	tok, err := s.newEmailToken(accountUnlockTyp, emailClaims{UserID: u.ID, Email: u.Email}, accountUnlockTTL)
+	if err != nil {
+		log.Printf("unlock link: %v", err)
+		return
+	}
+	go s.sendMail(r, mail.Message{
+		To:      u.Email,
+		Subject: "Your Mahi account was locked",
+		Text: fmt.Sprintf("Someone entered the wrong password for your Mahi account %d times, "+
+			"so we've paused sign-ins for %d minutes.\n\n", s.cfg.LoginMaxFailures, s.cfg.LoginLockoutMin) +
+			"If it was you, open this link to sign in again right away:\n\n" +
+			s.cfg.Issuer + "/v1/auth/unlock?" + url.Values{"token": {tok}}.Encode() + "\n\n" +
+			"If it wasn't you, your password held. Consider changing it if it's used anywhere else.",
+	})
+}
+
+// writeLoginLocked answers a throttled sign-in with how long to wait.
+func writeLoginLocked(w http.ResponseWriter, e *errLoginLocked) {
+	secs := int(math.Ceil(e.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	if e.locked {
+		writeErr(w, http.StatusLocked, "account_locked", map[string]any{
+			"retry_after": secs,
+			"message":     "Too many failed sign-ins. Try again later or use the unlock link we emailed you.",
+		})
+		return
+	}
+	writeErr(w, http.StatusTooManyRequests, "login_throttled", map[string]any{"retry_after": secs})
+}
+
+// GET|POST /v1/auth/unlock
+func (s *Server) unlockAccount(w http.ResponseWriter, r *http.Request) {
+	tok, ok := linkToken(w, r)
+	if !ok {
+		return
+	}
+	c, u, err := s.parseEmailToken(tok, accountUnlockTyp)
+	if err != nil || s.revoked.isRevoked(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{ID: c.ID}}) {
+		linkFailed(w, r, http.StatusBadRequest, "unlock_invalid", "This link is invalid, has expired or was already used.")
+		return
+	}
+	if err := s.st.ClearLoginFailures(accountKey(u.Email)); err != nil {
+		linkFailed(w, r, http.StatusInternalServerError, "unlock_failed", "Something went wrong. Please try again.")
+		return
+	}
+	if err := s.revoked.revoke(store.RevokeKindJTI, c.ID, c.ExpiresAt.Time); err != nil {
+		log.Printf("unlock: spend token: %v", err)
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditAccountUnlocked,
+		Detail: map[string]any{"by": "email"}})
+	linkDone(w, r, "Your account is unlocked. You can sign in again from the app.", map[string]any{"unlocked": true})
+}
+
+// POST /v1/admin/users/{id}/unlock
+func (s *Server) adminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.st.GetUser(chi.URLParam(r, "id"))
+	if !ok {
+		writeErr(w, http.StatusNotFound, "user_not_found", nil)
+		return
+	}
+	for _, key := range []string{accountKey(u.Email), mfaKey(u.ID)} {
+		if err := s.st.ClearLoginFailures(key); err != nil {
+			writeErr(w, http.StatusInternalServerError, "unlock_failed", nil)
+			return
+		}
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditAccountUnlocked,
+		Detail: map[string]any{"by": "admin"}})
+	writeJSON(w, http.StatusOK, map[string]any{"unlocked": true})
+}
@@ -0,0 +1,109 @@
+package httpserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFailures int
+		lockoutMin  int
+		failures    int
+		wantWait    time.Duration
+		wantLocked  bool
+	}{
+		{"first miss", 5, 15, 1, time.Second, false},
+		{"second miss", 5, 15, 2, 2 * time.Second, false},
+		{"third miss", 5, 15, 3, 4 * time.Second, false},
+		{"fourth miss", 5, 15, 4, 8 * time.Second, false},
+		{"lockout", 5, 15, 5, 15 * time.Minute, true},
+		{"past lockout", 5, 15, 7, 15 * time.Minute, true},
+		{"backoff capped at the window", 20, 1, 8, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			s.cfg.LoginMaxFailures, s.cfg.LoginLockoutMin, s.cfg.LoginIPMaxFailures = tt.maxFailures, tt.lockoutMin, 1000
+			r := httptest.NewRequest(http.MethodPost, "/v1/auth/login", nil)
+			acct := accountKey("Backoff@Example.com ")
+			for i := 0; i < tt.failures; i++ {
+				s.loginFailed(r, "backoff@example.com", acct, ipKey(r))
+			}
+			th, err := s.st.LoginThrottle(acct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if th.Failures != tt.failures {
+				t.Fatalf("%d failures recorded, want %d", th.Failures, tt.failures)
+			}
+			if wait := time.Until(th.LockedUntil); wait > tt.wantWait || wait < tt.wantWait-time.Second {
+				t.Fatalf("locked for %s, want %s", wait, tt.wantWait)
+			}
+
+			_, err = s.verifyLogin(r, "BACKOFF@example.com", testPassword)
+			var locked *errLoginLocked
+			if !errors.As(err, &locked) || locked.locked != tt.wantLocked {
+				t.Fatalf("verifyLogin err = %v, want throttled with locked=%v", err, tt.wantLocked)
+			}
+			w := httptest.NewRecorder()
+			writeLoginLocked(w, locked)
+			wantCode := http.StatusTooManyRequests
+			if tt.wantLocked {
+				wantCode = http.StatusLocked
+			}
+			if w.Code != wantCode || w.Header().Get("Retry-After") == "" {
+				t.Fatalf("status %d Retry-After %q, want %d", w.Code, w.Header().Get("Retry-After"), wantCode)
+			}
+		})
+	}
+}
+
+func TestLoginLockoutMailsOwnerOnce(t *testing.T) {
+	s, rec := newTestServer(t)
+	s.cfg.LoginIPMaxFailures = 1000
+	if _, err := s.st.CreateUser("locked@example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/v1/auth/login", nil)
+	for i := 0; i < s.cfg.LoginMaxFailures+2; i++ {
+		s.loginFailed(r, "locked@example.com", accountKey("locked@example.com"), ipKey(r))
+	}
+	m := waitMail(t, rec, "locked@example.com")
+	if m.Subject != "Your Mahi account was locked" {
+		t.Fatalf("mail = %+v", m)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(rec.Messages()); n != 1 {
+		t.Fatalf("%d mails sent, want 1", n)
+	}
+
+	// the link lifts the lockout
+	req := httptest.NewRequest(http.MethodGet, "/v1/auth/unlock?token="+mailToken(t, m.Text), nil)
+	req.Header.Set("Accept", "application/json")
+	if w, body := serve(s.unlockAccount, req); w.Code != http.StatusOK {
+		t.Fatalf("unlock: status %d body %v", w.Code, body)
+	}
+	if th, _ := s.st.LoginThrottle(accountKey("locked@example.com")); th.Failures != 0 || time.Now().Before(th.LockedUntil) {
+		t.Fatalf("still throttled after unlock: %+v", th)
+	}
+}
+
+func TestLoginIPThrottle(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.cfg.LoginIPMaxFailures = 3
+	r := httptest.NewRequest(http.MethodPost, "/v1/auth/login", nil)
+	// different accounts, one address
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		s.loginFailed(r, email, accountKey(email), ipKey(r))
+	}
+	_, err := s.verifyLogin(r, "d@example.com", testPassword)
+	var locked *errLoginLocked
+	if !errors.As(err, &locked) || locked.locked {
+		t.Fatalf("err = %v, want the address throttled", err)
+	}
+}
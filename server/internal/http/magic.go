@@ -0,0 +1,148 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/mail"
+	"mahi/server/internal/store"
+)
+
+const (
+	// how long an emailed link or code stays good
+	magicTTL = 15 * time.Minute
+	// wrong codes allowed per magicTTL window, however many codes are requested in it
+	magicMaxTries = 5
+)
+
+type magicStartReq struct {
+	Email  string `json:"email"`
+	Method string `json:"method"` // "link" (default) or "code"
+}
+
+// POST /v1/auth/magic/start
+// Emails a sign-in link (opened by the app through APP_URL) or a 6-digit code.
+// Like the password reset, the answer doesn't depend on the account existing.
+func (s *Server) magicStart(w http.ResponseWriter, r *http.Request) {
+	var req magicStartReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if req.Method == "" {
+		req.Method = "link"
+	}
+	if req.Method != "link" && req.Method != "code" {
+		writeErr(w, http.StatusBadRequest, "invalid_method", map[string]any{"field": "method"})
+		return
+	}
+	if req.Email == "" {
+		writeErr(w, http.StatusBadRequest, "missing_fields", map[string]any{"field": "email"})
+		return
+	}
+	if u, ok := s.st.GetUserByEmail(req.Email); ok {
+		s.sendMagicLogin(r, u, req.Method)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"message":    "If an account exists for this email, we've sent a way to sign in.",
+		"method":     req.Method,
+		"expires_in": int(magicTTL.Seconds()),
+	})
+}
+
+func (s *Server) sendMagicLogin(r *http.Request, u store.User, method string) {
+	var link, code string
+	var err error
+	if method == "code" {
+		code, err = auth.NewEmailCode()
+	} else {
+		link = newRefreshToken()
+	}
+	if err == nil {
+		err = s.st.SaveMagicLogin(u.ID, link, code, time.Now().Add(magicTTL))
+	}
+	if err != nil {
+		log.Printf("magic login: %v", err)
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditMagicRequested,
+		Detail: map[string]any{"method": method, "ip": clientIP(r)}})
+
+	msg := mail.Message{To: u.Email}
+	if method == "code" {
+		msg.Subject = "Your Mahi sign-in code: " + code
+		msg.Text = "Enter this code in the app to sign in:\n\n" + code + "\n\n" +
+			"It expires in 15 minutes. If you didn't try to sign in, you can ignore this email."
+	} else {
+		msg.Subject = "Sign in to Mahi"
+		msg.Text = "Open this link on your phone to sign in:\n\n" +
+			s.appLink("magic-login", url.Values{"token": {link}}) + "\n\n" +
+			"It expires in 15 minutes and works once. If you didn't try to sign in, you can ignore this email."
+	}
+	go s.sendMail(r, msg)
+}
+
+type magicCompleteReq struct {
+	Token      string `json:"token"` // from the link
+	Email      string `json:"email"` // with the code
+	Code       string `json:"code"`
+	DeviceName string `json:"device_name"`
+}
+
+// POST /v1/auth/magic/complete
+// Exchanges the link's token, or the email and code, for tokens (or an MFA
+// challenge, as after a password).
+func (s *Server) magicComplete(w http.ResponseWriter, r *http.Request) {
+	var req magicCompleteReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	var userID string
+	var err error
+	switch {
+	case req.Token != "":
+		userID, err = s.st.ConsumeMagicLink(req.Token)
+	case req.Email != "" && req.Code != "":
+		err = store.ErrMagicInvalid
+		if u, ok := s.st.GetUserByEmail(req.Email); ok {
+			userID = u.ID
+			err = s.st.ConsumeMagicCode(u.ID, strings.TrimSpace(req.Code), magicMaxTries)
+		}
+	default:
+		writeErr(w, http.StatusBadRequest, "missing_fields", nil)
+		return
+	}
+	if errors.Is(err, store.ErrMagicTooMany) {
+		writeErr(w, http.StatusTooManyRequests, "magic_too_many_attempts", map[string]any{
+			"message": "Too many wrong codes. Try again in a few minutes, or sign in with a link instead.",
+		})
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusUnauthorized, "magic_invalid", map[string]any{
+			"message": "This link or code is invalid or has expired.",
+		})
+		return
+	}
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		writeErr(w, http.StatusUnauthorized, "magic_invalid", nil)
+		return
+	}
+	// the link or code came through the inbox, which proves the address
+	if !u.EmailVerified {
+		if err := s.st.SetEmailVerified(u.ID, true); err == nil {
+			u.EmailVerified = true
+		}
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditMagicLogin,
+		Detail: map[string]any{"ip": clientIP(r)}})
+	s.completeLogin(w, r, u, req.DeviceName)
+}
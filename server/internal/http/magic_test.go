@@ -0,0 +1,73 @@
+package httpserver
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mahi/server/internal/store"
+)
+
+func TestMagicCodeAttemptsSurviveNewCode(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s, rec := newTestServer(t)
+			if backend == "sqlite" {
+				st, err := store.NewSQLite(filepath.Join(t.TempDir(), "app.db"),
+					store.Keys{TokenPepper: []byte("test-pepper"), SecretKey: make([]byte, 32)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.st = st
+			}
+			if _, err := s.st.CreateUser("magic@example.com", ""); err != nil {
+				t.Fatal(err)
+			}
+			// start asks for a fresh code and returns it
+			start := func() string {
+				sent := len(rec.Messages())
+				w, body := serve(s.magicStart, jsonReq(t, http.MethodPost, "/v1/auth/magic/start",
+					magicStartReq{Email: "magic@example.com", Method: "code"}))
+				if w.Code != http.StatusAccepted {
+					t.Fatalf("start: status %d body %v", w.Code, body)
+				}
+				deadline := time.Now().Add(2 * time.Second)
+				for len(rec.Messages()) == sent && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+				m := waitMail(t, rec, "magic@example.com")
+				return m.Subject[strings.LastIndex(m.Subject, " ")+1:]
+			}
+			complete := func(code string) int {
+				w, _ := serve(s.magicComplete, jsonReq(t, http.MethodPost, "/v1/auth/magic/complete",
+					magicCompleteReq{Email: "magic@example.com", Code: code}))
+				return w.Code
+			}
+			wrong := func(code string) string {
+				if code == "000000" {
+					return "111111"
+				}
+				return "000000"
+			}
+
+			// a new code after every guess must not reset the count
+			for i := 0; i < magicMaxTries-1; i++ {
+				if got := complete(wrong(start())); got != http.StatusUnauthorized {
+					t.Fatalf("guess %d: status %d", i+1, got)
+				}
+			}
+			code := start()
+			if got := complete(wrong(code)); got != http.StatusTooManyRequests {
+				t.Fatalf("last guess: status %d, want 429", got)
+			}
+			if got := complete(code); got != http.StatusTooManyRequests {
+				t.Fatalf("right code after the limit: status %d, want 429", got)
+			}
+			if got := complete(start()); got != http.StatusTooManyRequests {
+				t.Fatalf("new code within the window: status %d, want 429", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	mfaTokenTyp = "mfa+jwt"
+	// time between the password step and the second factor
+	mfaTokenTTL = 5 * time.Minute
+	// wrong second-factor codes per user before codes are refused for mfaLockout;
+	// counted in the store so every instance and every route shares them
+	mfaMaxTries = 5
+	mfaLockout  = 15 * time.Minute
+)
+
+var (
+	errMFATokenInvalid = errors.New("mfa_token_invalid")
+	errMFACodeInvalid  = errors.New("mfa_code_invalid")
+	errMFATooMany      = errors.New("mfa_too_many_attempts")
+)
+
+// mfaClaims are carried by the challenge token between the two login steps.
+type mfaClaims struct {
+	UserID     string `json:"sub"`
+	DeviceName string `json:"device_name,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type mfaChallengeResp struct {
+	MFARequired bool     `json:"mfa_required"`
+	MFAToken    string   `json:"mfa_token"`
+	Methods     []string `json:"mfa_methods"`
+	ExpiresIn   int      `json:"expires_in"`
+}
+
+// mfaMethods lists the second factors u has set up; empty means password only.
+func (s *Server) mfaMethods(userID string) []string {
+	var methods []string
+	if t, err := s.st.GetTOTP(userID); err == nil && t.Confirmed {
+		methods = append(methods, "totp")
+	}
+	if creds, err := s.st.ListWebAuthnCredentials(userID); err == nil && len(creds) > 0 {
+		methods = append(methods, "webauthn")
+	}
+	return methods
+}
+
+// newMFAToken signs the challenge that stands in for tokens until the second factor is in.
+func (s *Server) newMFAToken(userID, deviceName string) (string, error) {
+	now := time.Now()
+	return s.jwt.Sign(mfaTokenTyp, mfaClaims{
+		UserID:     userID,
+		DeviceName: deviceName,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+			ID:        newRefreshToken(),
+		},
+	})
+}
+
+// completeLogin finishes a first-factor login: straight to tokens, or an MFA
+// challenge when the account has a second factor.
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, u store.User, deviceName string) {
+	methods := s.mfaMethods(u.ID)
+	if len(methods) == 0 {
+		s.issueTokens(w, r, http.StatusOK, u, deviceName)
+		return
+	}
+	tok, err := s.newMFAToken(u.ID, deviceName)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "token_error", nil)
+		return
+	}
+	if s.recoveryCodesLeft(u.ID) > 0 {
+		methods = append(methods, "recovery_code")
+	}
+	writeJSON(w, http.StatusOK, mfaChallengeResp{
+		MFARequired: true,
+		MFAToken:    tok,
+		Methods:     methods,
+		ExpiresIn:   int(mfaTokenTTL.Seconds()),
+	})
+}
+
+// parseMFAToken checks that a challenge token is genuine and not yet spent.
+func (s *Server) parseMFAToken(token string) (mfaClaims, error) {
+	var c mfaClaims
+	if err := s.jwt.ParseTyped(token, mfaTokenTyp, &c); err != nil || c.UserID == "" ||
+		s.revoked.isRevoked(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{ID: c.ID}}) {
+		return mfaClaims{}, errMFATokenInvalid
+	}
+	return c, nil
+}
+
+// checkMFA verifies a challenge token and the second factor. On success the
+// challenge is spent, so it can't open a second session.
+func (s *Server) checkMFA(req mfaVerifyReq) (store.User, mfaClaims, error) {
+	c, err := s.parseMFAToken(req.MFAToken)
+	if err != nil {
+		return store.User{}, c, err
+	}
+	u, ok := s.st.GetUser(c.UserID)
+	if !ok {
+		return store.User{}, c, errMFATokenInvalid
+	}
+
+	switch req.Method {
+	case "totp", "":
+		err = s.checkTOTP(u.ID, req.Code, false)
+	case "webauthn":
+		err = s.checkMFAWebAuthn(u.ID, req.State, req.Credential)
+	case "recovery_code":
+		err = s.throttleMFA(u.ID, func() error { return s.checkRecoveryCode(u.ID, req.Code) })
+	default:
+		err = errMFACodeInvalid
+	}
+	if err != nil {
+		return store.User{}, c, err
+	}
+	if err := s.revoked.revoke(store.RevokeKindJTI, c.ID, c.ExpiresAt.Time); err != nil {
+		log.Printf("mfa: spend challenge: %v", err)
+	}
+	return u, c, nil
+}
+
+func mfaKey(userID string) string { return "mfa:" + userID }
+
+// throttleMFA runs check behind the user's count of wrong second-factor codes:
+// after mfaMaxTries misses within mfaLockout every code is refused with
+// errMFATooMany until the lockout ends, whichever route it comes through.
+func (s *Server) throttleMFA(userID string, check func() error) error {
+	key := mfaKey(userID)
+	now := time.Now()
+	if t, err := s.st.LoginThrottle(key); err != nil {
+		log.Printf("mfa throttle %s: %v", key, err)
+	} else if now.Before(t.LockedUntil) {
+		return errMFATooMany
+	}
+	err := check()
+	switch {
+	case err == nil:
+		if err := s.st.ClearLoginFailures(key); err != nil {
+			log.Printf("mfa throttle %s: %v", key, err)
+		}
+	default:
+		n, ferr := s.st.AddLoginFailure(key, now.Add(-mfaLockout))
+		if ferr != nil {
+			log.Printf("mfa throttle %s: %v", key, ferr)
+		} else if n >= mfaMaxTries {
+			_ = s.st.LockLogin(key, now.Add(mfaLockout))
+		}
+	}
+	return err
+}
+
+// checkTOTP accepts a current code that hasn't been used before.
+func (s *Server) checkTOTP(userID, code string, confirm bool) error {
+	return s.throttleMFA(userID, func() error {
+		t, err := s.st.GetTOTP(userID)
+		if err != nil || (!t.Confirmed && !confirm) {
+			return errMFACodeInvalid
+		}
+		step, ok := auth.VerifyTOTP(t.Secret, code, time.Now())
+		if !ok {
+			return errMFACodeInvalid
+		}
+		if err := s.st.UseTOTPStep(userID, step, confirm); err != nil {
+			return errMFACodeInvalid
+		}
+		return nil
+	})
+}
+
+// writeMFATooMany answers a code refused because of too many wrong ones.
+func writeMFATooMany(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(mfaLockout.Seconds())))
+	writeErr(w, http.StatusTooManyRequests, errMFATooMany.Error(), map[string]any{
+		"message": "Too many wrong codes. Try again later.",
+	})
+}
+
+// checkMFAWebAuthn verifies a passkey or security key assertion as the second factor.
+func (s *Server) checkMFAWebAuthn(userID, state string, cred credentialJSON) error {
+	st, err := s.parseWebAuthnState(state, "mfa")
+	if err != nil || st.UserID != userID {
+		return errMFACodeInvalid
+	}
+	if _, err := s.checkAssertion(st, cred, false); err != nil {
+		return errMFACodeInvalid
+	}
+	return nil
+}
+
+type mfaVerifyReq struct {
+	MFAToken string `json:"mfa_token"`
+	Method   string `json:"method"` // "totp" (default), "webauthn" or "recovery_code"
+	Code     string `json:"code"`
+
+	// method "webauthn": the state from /v1/auth/mfa/webauthn/options and the assertion
+	State      string         `json:"state"`
+	Credential credentialJSON `json:"credential"`
+}
+
+// POST /v1/auth/mfa/verify
+func (s *Server) mfaVerify(w http.ResponseWriter, r *http.Request) {
+	var req mfaVerifyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	u, c, err := s.checkMFA(req)
+	if errors.Is(err, errMFATooMany) {
+		writeMFATooMany(w)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusUnauthorized, err.Error(), nil)
+		return
+	}
+	s.issueTokens(w, r, http.StatusOK, u, c.DeviceName)
+}
+
+// GET /v1/users/me/mfa
+func (s *Server) mfaStatus(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	methods := s.mfaMethods(userID)
+	if methods == nil {
+		methods = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"enabled":                  len(methods) > 0,
+		"methods":                  methods,
+		"recovery_codes_remaining": s.recoveryCodesLeft(userID),
+	})
+}
+
+// POST /v1/users/me/mfa/totp
+// Starts (or restarts) enrollment. The secret is shown once; the enrollment
+// only counts after /confirm proves the app was set up.
+func (s *Server) totpEnroll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		writeErr(w, http.StatusNotFound, "user_not_found", nil)
+		return
+	}
+	if t, err := s.st.GetTOTP(userID); err == nil && t.Confirmed {
+		writeErr(w, http.StatusConflict, "mfa_already_enabled", map[string]any{
+			"message": "Disable the current authenticator before enrolling a new one.",
+		})
+		return
+	}
+	secret, err := auth.NewTOTPSecret()
+	if err == nil {
+		err = s.st.SaveTOTP(userID, secret)
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "mfa_error", nil)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"secret":      auth.TOTPSecretString(secret),
+		"otpauth_uri": auth.TOTPURI(s.cfg.MFAIssuer, u.Email, secret),
+	})
+}
+
+type totpCodeReq struct {
+	Code string `json:"code"`
+}
+
+// POST /v1/users/me/mfa/totp/confirm
+func (s *Server) totpConfirm(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	var req totpCodeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if t, err := s.st.GetTOTP(userID); err != nil || t.Confirmed {
+		writeErr(w, http.StatusConflict, "mfa_not_pending", nil)
+		return
+	}
+	if err := s.checkTOTP(userID, req.Code, true); err != nil {
+		if errors.Is(err, errMFATooMany) {
+			writeMFATooMany(w)
+			return
+		}
+		writeErr(w, http.StatusBadRequest, "mfa_code_invalid", map[string]any{"field": "code"})
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditMFAEnabled})
+	resp := map[string]any{"enabled": true, "methods": s.mfaMethods(userID)}
+	if codes := s.firstRecoveryCodes(userID); codes != nil {
+		w.Header().Set("Cache-Control", "no-store")
+		resp["recovery_codes"] = codes
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// DELETE /v1/users/me/mfa/totp
+// Needs a current code, so a stolen access token alone can't strip the second factor.
+func (s *Server) totpDisable(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	var req totpCodeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if err := s.checkTOTP(userID, req.Code, false); err != nil {
+		if errors.Is(err, errMFATooMany) {
+			writeMFATooMany(w)
+			return
+		}
+		writeErr(w, http.StatusBadRequest, "mfa_code_invalid", map[string]any{"field": "code"})
+		return
+	}
+	if err := s.st.DeleteTOTP(userID); err != nil {
+		writeErr(w, http.StatusInternalServerError, "mfa_error", nil)
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditMFADisabled})
+	s.dropRecoveryCodes(userID)
+	writeJSON(w, http.StatusOK, map[string]any{"enabled": len(s.mfaMethods(userID)) > 0})
+}
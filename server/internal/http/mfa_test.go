@@ -0,0 +1,129 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mahi/server/internal/auth"
+)
+
+// totpAt is the authenticator code of userID for the step offset from now.
+func totpAt(t *testing.T, s *Server, userID string, offset int64) string {
+	t.Helper()
+	enr, err := s.st.GetTOTP(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth.TOTPCode(enr.Secret, time.Now().Unix()/30+offset)
+}
+
+// enrollTOTP turns on TOTP for the demo user through the API, spending the previous step.
+func enrollTOTP(t *testing.T, s *Server, access string) {
+	t.Helper()
+	if w, out := withBearer(s, s.totpEnroll, httptest.NewRequest(http.MethodPost, "/v1/users/me/mfa/totp", nil), access); w.Code != http.StatusOK || out["otpauth_uri"] == nil {
+		t.Fatalf("enroll: %d %v", w.Code, out)
+	}
+	r := jsonReq(t, http.MethodPost, "/v1/users/me/mfa/totp/confirm", totpCodeReq{Code: totpAt(t, s, "u_1", -1)})
+	if w, out := withBearer(s, s.totpConfirm, r, access); w.Code != http.StatusOK || out["enabled"] != true {
+		t.Fatalf("confirm: %d %v", w.Code, out)
+	}
+}
+
+func TestTOTPLifecycle(t *testing.T) {
+	s, _ := newTestServer(t)
+	tok := login(t, s, "demo@demo.com", "password")
+	enrollTOTP(t, s, tok.AccessToken)
+
+	// the password alone now only gets a challenge
+	w, challenge := serve(s.login, jsonReq(t, http.MethodPost, "/v1/auth/login", loginReq{Email: "demo@demo.com", Password: "password"}))
+	if w.Code != http.StatusOK || challenge["mfa_required"] != true || challenge["access_token"] != nil {
+		t.Fatalf("login: %d %v", w.Code, challenge)
+	}
+	mfaToken, _ := challenge["mfa_token"].(string)
+	verify := func(code string) (int, map[string]any) {
+		w, out := serve(s.mfaVerify, jsonReq(t, http.MethodPost, "/v1/auth/mfa/verify", mfaVerifyReq{MFAToken: mfaToken, Code: code}))
+		return w.Code, out
+	}
+	if code, out := verify(totpAt(t, s, "u_1", -1)); code != http.StatusUnauthorized {
+		t.Fatalf("code already used to confirm: %d %v", code, out)
+	}
+	if code, out := verify(totpAt(t, s, "u_1", 0)); code != http.StatusOK || out["access_token"] == nil {
+		t.Fatalf("verify: %d %v", code, out)
+	}
+	if code, out := verify(totpAt(t, s, "u_1", 1)); code != http.StatusUnauthorized || out["error"] != "mfa_token_invalid" {
+		t.Fatalf("spent challenge: %d %v", code, out)
+	}
+
+	disable := func(code string) (int, map[string]any) {
+		r := jsonReq(t, http.MethodDelete, "/v1/users/me/mfa/totp", totpCodeReq{Code: code})
+		w, out := withBearer(s, s.totpDisable, r, tok.AccessToken)
+		return w.Code, out
+	}
+	if code, _ := disable("000000"); code != http.StatusBadRequest {
+		t.Fatalf("disable with a wrong code: %d", code)
+	}
+	if code, out := disable(totpAt(t, s, "u_1", 1)); code != http.StatusOK || out["enabled"] != false {
+		t.Fatalf("disable: %d %v", code, out)
+	}
+	if methods := s.mfaMethods("u_1"); len(methods) != 0 {
+		t.Fatalf("methods after disable: %v", methods)
+	}
+}
+
+func TestWrongTOTPCodesCountPerUser(t *testing.T) {
+	s, _ := newTestServer(t)
+	tok := login(t, s, "demo@demo.com", "password")
+	enrollTOTP(t, s, tok.AccessToken)
+
+	newChallenge := func() string {
+		c, err := s.newMFAToken("u_1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	disable := func(code string) *httptest.ResponseRecorder {
+		w, _ := withBearer(s, s.totpDisable, jsonReq(t, http.MethodDelete, "/v1/users/me/mfa/totp", totpCodeReq{Code: code}), tok.AccessToken)
+		return w
+	}
+
+	// misses add up across fresh challenges and routes
+	for i := 0; i < mfaMaxTries; i++ {
+		if i%2 == 0 {
+			w, _ := serve(s.mfaVerify, jsonReq(t, http.MethodPost, "/v1/auth/mfa/verify", mfaVerifyReq{MFAToken: newChallenge(), Code: "000000"}))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("wrong code %d at login: %d", i, w.Code)
+			}
+		} else if w := disable("000000"); w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong code %d at disable: %d", i, w.Code)
+		}
+	}
+
+	good := totpAt(t, s, "u_1", 0)
+	w, out := serve(s.mfaVerify, jsonReq(t, http.MethodPost, "/v1/auth/mfa/verify", mfaVerifyReq{MFAToken: newChallenge(), Code: good}))
+	if w.Code != http.StatusTooManyRequests || out["error"] != "mfa_too_many_attempts" || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("login after too many misses: %d %v", w.Code, out)
+	}
+	if w := disable(good); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("disable after too many misses: %d", w.Code)
+	}
+	if err := s.checkTOTP("u_1", good, false); err != errMFATooMany {
+		t.Fatalf("step-up after too many misses: %v", err)
+	}
+
+	// the count lives in the store: another instance sees the same lockout
+	peer := *s
+	peer.revoked = newRevocationCache(s.st)
+	if err := peer.checkTOTP("u_1", good, false); err != errMFATooMany {
+		t.Fatalf("other instance: %v", err)
+	}
+
+	if err := s.st.ClearLoginFailures(mfaKey("u_1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkTOTP("u_1", good, false); err != nil {
+		t.Fatalf("after the lockout: %v", err)
+	}
+}
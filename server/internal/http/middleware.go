@@ -2,13 +2,18 @@ package httpserver
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"net/http"
 	"strings"
 
+	"mahi/server/internal/auth"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type ctxKeyUserID struct{}
+type ctxKeySessionID struct{}
 
 func (s *Server) authn(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -20,14 +25,46 @@ func (s *Server) authn(next http.Handler) http.Handler {
 		raw := strings.TrimPrefix(h, "Bearer ")
 		claims, err := s.jwt.Parse(raw)
 		if err != nil || claims == nil || claims.UserID == "" {
-			if err != nil && err == jwt.ErrTokenExpired {
+			if errors.Is(err, jwt.ErrTokenExpired) {
 				writeErr(w, http.StatusUnauthorized, "token_expired", nil)
 				return
 			}
+			if errors.Is(err, auth.ErrKeyRetired) {
+				writeErr(w, http.StatusUnauthorized, "token_key_retired", map[string]any{
+					"message": "This token was signed with a key that has been retired. Refresh your session.",
+				})
+				return
+			}
 			writeErr(w, http.StatusUnauthorized, "token_invalid", nil)
 			return
 		}
+		if s.revoked.isRevoked(claims) {
+			writeErr(w, http.StatusUnauthorized, "token_revoked", nil)
+			return
+		}
+		// tokens granted to third-party clients don't open the first-party API
+		if claims.ClientID != "" {
+			writeErr(w, http.StatusForbidden, "client_token_not_allowed", nil)
+			return
+		}
 		ctx := context.WithValue(r.Context(), ctxKeyUserID{}, claims.UserID)
+		ctx = context.WithValue(ctx, ctxKeySessionID{}, claims.SessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// adminOnly guards operator endpoints with the static ADMIN_TOKEN.
+func (s *Server) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" {
+			writeErr(w, http.StatusNotFound, "not_found", nil)
+			return
+		}
+		got := r.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(s.cfg.AdminToken)) != 1 {
+			writeErr(w, http.StatusUnauthorized, "admin_unauthorized", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
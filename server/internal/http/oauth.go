@@ -0,0 +1,208 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"mahi/server/internal/store"
+)
+
+// seedClients registers the clients listed in OAUTH_CLIENTS_FILE:
+//
+//	[{"client_id": "gateway", "name": "API gateway", "client_secret": "..."},
+//	 {"client_id": "web", "name": "Mahi Web", "public": true, "redirect_uris": ["https://app.example/cb"]},
+//	 {"client_id": "billing-job", "client_secret": "...", "scopes": ["billing:read"]}]
+func seedClients(st Store, path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries []struct {
+		ID           string   `json:"client_id"`
+		Name         string   `json:"name"`
+		Secret       string   `json:"client_secret"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Public       bool     `json:"public"`
+		Scopes       []string `json:"scopes"`
+	}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, e := range entries {
+		if e.ID == "" || (e.Secret == "") != e.Public {
+			return fmt.Errorf("%s: client %q needs a client_id and either a client_secret or \"public\": true", path, e.ID)
+		}
+		c := store.Client{ID: e.ID, Name: e.Name, RedirectURIs: e.RedirectURIs, Public: e.Public, Scopes: e.Scopes}
+		if err := st.UpsertClient(c, e.Secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOAuthErr writes an RFC 6749 section 5.2 error body.
+func writeOAuthErr(w http.ResponseWriter, code int, errCode, desc string) {
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mahi"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	body := map[string]string{"error": errCode}
+	if desc != "" {
+		body["error_description"] = desc
+	}
+	writeJSON(w, code, body)
+}
+
+// authenticateClient reads client credentials from HTTP Basic auth or the
+// form body (client_secret_basic / client_secret_post).
+func (s *Server) authenticateClient(r *http.Request) (store.Client, error) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// RFC 6749 2.3.1: both parts are form-urlencoded before being joined
+		var err1, err2 error
+		id, err1 = url.QueryUnescape(id)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return store.Client{}, store.ErrClientInvalid
+		}
+	} else {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id == "" {
+		return store.Client{}, store.ErrClientInvalid
+	}
+	return s.st.AuthenticateClient(id, secret)
+}
+
+// clientActive reports whether tokens of clientID may still be used; disabling
+// a client cuts off its tokens right away. First-party tokens have no client.
+func (s *Server) clientActive(clientID string) bool {
+	if clientID == "" {
+		return true
+	}
+	c, ok := s.st.GetClient(clientID)
+	return ok && !c.Disabled
+}
+
+// POST /oauth/introspect (RFC 7662)
+func (s *Server) introspect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+	if _, err := s.authenticateClient(r); err != nil {
+		writeOAuthErr(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	resp := map[string]any{"active": false}
+	// the hint only changes the lookup order
+	if r.PostFormValue("token_type_hint") == "refresh_token" {
+		if !s.introspectRefresh(token, resp) {
+			s.introspectAccess(token, resp)
+		}
+	} else if !s.introspectAccess(token, resp) {
+		s.introspectRefresh(token, resp)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) introspectAccess(token string, resp map[string]any) bool {
+	claims, err := s.jwt.Parse(token)
+	if err != nil || claims.UserID == "" || s.revoked.isRevoked(claims) {
+		return false
+	}
+	if !s.clientActive(claims.ClientID) {
+		return false
+	}
+	resp["active"] = true
+	resp["token_type"] = "Bearer"
+	resp["sub"] = claims.UserID
+	if claims.ExpiresAt != nil {
+		resp["exp"] = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp["iat"] = claims.IssuedAt.Unix()
+	}
+	if claims.ID != "" {
+		resp["jti"] = claims.ID
+	}
+	if claims.SessionID != "" {
+		resp["sid"] = claims.SessionID
+	}
+	if claims.ClientID != "" {
+		resp["client_id"] = claims.ClientID
+	}
+	if claims.Scope != "" {
+		resp["scope"] = claims.Scope
+	}
+	if u, ok := s.st.GetUser(claims.UserID); ok {
+		resp["username"] = u.Email
+	}
+	return true
+}
+
+func (s *Server) introspectRefresh(token string, resp map[string]any) bool {
+	rt, ok := s.st.LookupRefresh(token)
+	if !ok || time.Now().After(rt.Exp) || !s.clientActive(rt.ClientID) {
+		return false
+	}
+	resp["active"] = true
+	resp["token_type"] = "refresh_token"
+	resp["sub"] = rt.UserID
+	resp["exp"] = rt.Exp.Unix()
+	resp["sid"] = rt.SessionID
+	if rt.ClientID != "" {
+		resp["client_id"] = rt.ClientID
+	}
+	if rt.Scope != "" {
+		resp["scope"] = rt.Scope
+	}
+	if u, ok := s.st.GetUser(rt.UserID); ok {
+		resp["username"] = u.Email
+	}
+	return true
+}
+
+// POST /oauth/revoke (RFC 7009)
+// Unknown or already invalid tokens are not an error: the answer is always 200.
+func (s *Server) revokeToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+	client, err := s.authenticateClient(r)
+	if err != nil {
+		writeOAuthErr(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthErr(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	// RFC 7009 2.1: a client may only revoke tokens issued to it; anything else
+	// is answered like an unknown token so it can't be used as an oracle
+	if rt, ok := s.st.LookupRefresh(token); ok {
+		if rt.ClientID == client.ID {
+			// a refresh token takes its session, and so every access token of it, along
+			s.revokeSessionAccess(rt.SessionID)
+			_ = s.st.DeleteRefresh(token)
+		}
+	} else if claims, err := s.jwt.Parse(token); err == nil && claims.ExpiresAt != nil && claims.ClientID == client.ID {
+		_ = s.revoked.revoke(store.RevokeKindJTI, claims.ID, claims.ExpiresAt.Time)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,113 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"mahi/server/internal/store"
+)
+
+// formReq builds a form POST authenticated as clientID with HTTP Basic auth.
+func formReq(path string, form url.Values, clientID, secret string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		r.SetBasicAuth(clientID, secret)
+	}
+	return r
+}
+
+func addClient(t *testing.T, s *Server, c store.Client, secret string) {
+	t.Helper()
+	if err := s.st.UpsertClient(c, secret); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	s, _ := newTestServer(t)
+	addClient(t, s, store.Client{ID: "gateway"}, "gw-secret")
+	tok := login(t, s, "demo@demo.com", "password")
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		secret string
+		code   int
+		active bool
+		typ    string
+	}{
+		{"access token", url.Values{"token": {tok.AccessToken}}, "gw-secret", http.StatusOK, true, "Bearer"},
+		{"refresh token", url.Values{"token": {tok.RefreshToken}, "token_type_hint": {"refresh_token"}}, "gw-secret", http.StatusOK, true, "refresh_token"},
+		{"wrong hint", url.Values{"token": {tok.RefreshToken}, "token_type_hint": {"access_token"}}, "gw-secret", http.StatusOK, true, "refresh_token"},
+		{"garbage", url.Values{"token": {"nope"}}, "gw-secret", http.StatusOK, false, ""},
+		{"bad client secret", url.Values{"token": {tok.AccessToken}}, "wrong", http.StatusUnauthorized, false, ""},
+		{"no token", url.Values{}, "gw-secret", http.StatusBadRequest, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, out := serve(s.introspect, formReq("/oauth/introspect", tt.form, "gateway", tt.secret))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %v", w.Code, tt.code, out)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			if out["active"] != tt.active {
+				t.Fatalf("active = %v: %v", out["active"], out)
+			}
+			if tt.active && (out["token_type"] != tt.typ || out["sub"] != "u_1" || out["sid"] != tok.SessionID || out["username"] != "demo@demo.com") {
+				t.Fatalf("response = %v", out)
+			}
+		})
+	}
+
+	s.revokeSessionAccess(tok.SessionID)
+	if _, out := serve(s.introspect, formReq("/oauth/introspect", url.Values{"token": {tok.AccessToken}}, "gateway", "gw-secret")); out["active"] != false {
+		t.Fatalf("revoked access token: %v", out)
+	}
+}
+
+func TestRevokeOnlyOwnTokens(t *testing.T) {
+	s, _ := newTestServer(t)
+	addClient(t, s, store.Client{ID: "partner"}, "p-secret")
+	addClient(t, s, store.Client{ID: "other"}, "o-secret")
+	refresh := newRefreshToken()
+	sessionID, err := s.st.SaveRefresh(refresh, "u_1", time.Now().Add(time.Hour), store.SessionMeta{ClientID: "partner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, _, _ := s.jwt.NewOAuthAccess("u_1", sessionID, "partner", "profile", 5)
+
+	active := func(token string) bool {
+		_, out := serve(s.introspect, formReq("/oauth/introspect", url.Values{"token": {token}}, "partner", "p-secret"))
+		return out["active"] == true
+	}
+	revoke := func(token, client, secret string) int {
+		w, _ := serve(s.revokeToken, formReq("/oauth/revoke", url.Values{"token": {token}}, client, secret))
+		return w.Code
+	}
+
+	// another client gets the same 200 as for an unknown token, and nothing happens
+	if code := revoke(refresh, "other", "o-secret"); code != http.StatusOK || !active(refresh) || !active(access) {
+		t.Fatalf("revoke by another client: %d", code)
+	}
+	if code := revoke("unknown", "partner", "p-secret"); code != http.StatusOK {
+		t.Fatalf("unknown token: %d", code)
+	}
+	if code := revoke(refresh, "partner", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("bad secret: %d", code)
+	}
+
+	// the refresh token takes its session's access tokens along
+	if code := revoke(refresh, "partner", "p-secret"); code != http.StatusOK {
+		t.Fatalf("revoke: %d", code)
+	}
+	if active(refresh) || active(access) {
+		t.Fatal("tokens still active after revoking the refresh token")
+	}
+}
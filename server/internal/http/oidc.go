@@ -0,0 +1,127 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/store"
+)
+
+// ID tokens only prove the sign-in to the client; they don't need to outlive the access token
+const idTokenTTL = 15 * time.Minute
+
+type ctxKeyClaims struct{}
+
+func hasScope(scope, want string) bool {
+	for _, sc := range strings.Fields(scope) {
+		if sc == want {
+			return true
+		}
+	}
+	return false
+}
+
+// userClaims fills the standard claims of u that the granted scope allows.
+// First-party tokens (no client) see everything.
+func userClaims(u store.User, clientID, scope string, c *auth.IDClaims) {
+	if clientID == "" || hasScope(scope, "email") {
+		verified := u.EmailVerified
+		c.Email, c.EmailVerified = u.Email, &verified
+	}
+	if clientID == "" || hasScope(scope, "profile") {
+		c.Name = u.Name
+	}
+}
+
+func (s *Server) idToken(u store.User, clientID, scope, nonce string, authTime time.Time, access string) (string, error) {
+	c := auth.IDClaims{Nonce: nonce}
+	c.Subject = u.ID
+	if !authTime.IsZero() {
+		c.AuthTime = authTime.Unix()
+	}
+	userClaims(u, clientID, scope, &c)
+	return s.jwt.NewIDToken(s.cfg.Issuer, clientID, c, access, idTokenTTL)
+}
+
+// GET /.well-known/openid-configuration
+// OpenID Connect is only offered while the active key is asymmetric (JWT_KEY_FILE
+// or JWT_KEYRING_FILE); with the plain JWT_SECRET there is no key to publish.
+func (s *Server) openIDConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.jwt.Asymmetric() {
+		writeErr(w, http.StatusNotFound, "oidc_unavailable", map[string]any{
+			"message": "OpenID Connect needs an Ed25519 or RSA signing key.",
+		})
+		return
+	}
+	iss := s.cfg.Issuer
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/oauth/authorize",
+		"token_endpoint":                        iss + "/oauth/token",
+		"userinfo_endpoint":                     iss + "/oauth/userinfo",
+		"jwks_uri":                              iss + "/.well-known/jwks.json",
+		"introspection_endpoint":                iss + "/oauth/introspect",
+		"revocation_endpoint":                   iss + "/oauth/revoke",
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{s.jwt.Alg()},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified", "name"},
+	})
+}
+
+// bearerOnly authenticates OAuth resource requests (RFC 6750 errors).
+// Unlike authn it accepts tokens issued to third-party clients.
+func (s *Server) bearerOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get("Authorization")
+		if !strings.HasPrefix(h, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mahi"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims, err := s.jwt.Parse(strings.TrimPrefix(h, "Bearer "))
+		if err != nil || claims.UserID == "" || s.revoked.isRevoked(claims) || !s.clientActive(claims.ClientID) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mahi", error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyClaims{}, claims)))
+	})
+}
+
+// GET|POST /oauth/userinfo
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(ctxKeyClaims{}).(*auth.Claims)
+	if claims.ClientID != "" && !hasScope(claims.Scope, "openid") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mahi", error="insufficient_scope", scope="openid"`)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	u, ok := s.st.GetUser(claims.UserID)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mahi", error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var c auth.IDClaims
+	userClaims(u, claims.ClientID, claims.Scope, &c)
+	resp := map[string]any{"sub": u.ID}
+	if c.EmailVerified != nil {
+		resp["email"] = c.Email
+		resp["email_verified"] = *c.EmailVerified
+	}
+	if c.Name != "" {
+		resp["name"] = c.Name
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,53 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"mahi/server/internal/auth"
+)
+
+func TestOpenIDConnectNeedsAsymmetricKey(t *testing.T) {
+	s := newOAuthServer(t) // signs with an HS256 secret
+	if w, _ := serve(s.openIDConfig, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil)); w.Code != http.StatusNotFound {
+		t.Fatalf("discovery with a secret: %d", w.Code)
+	}
+	params := authorizeParams("web")
+	params.Set("scope", "openid profile")
+	w := httptest.NewRecorder()
+	s.authorize(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+params.Encode(), nil))
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || loc.Query().Get("error") != "invalid_scope" {
+		t.Fatalf("openid with a secret: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	key, err := auth.GenerateSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.jwt.Rotate(key, time.Now().Add(time.Minute))
+	_, cfg := serve(s.openIDConfig, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+	if algs, _ := cfg["id_token_signing_alg_values_supported"].([]any); len(algs) != 1 || algs[0] != "EdDSA" {
+		t.Fatalf("discovery: %v", cfg)
+	}
+
+	params.Set("nonce", "n-0S6")
+	cookie, csrf := authorizePage(t, s, params)
+	w = postAuthorize(s, params, cookie, csrf, "demo@demo.com", "password")
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	status, out := exchange(s, "web", loc.Query().Get("code"), testRedirect, testVerifier)
+	idt, _ := out["id_token"].(string)
+	if status != http.StatusOK || idt == "" {
+		t.Fatalf("exchange: %d %v", status, out)
+	}
+	var c auth.IDClaims
+	if err := s.jwt.ParseTyped(idt, auth.TypIDToken, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject != "u_1" || c.Nonce != "n-0S6" || c.Name == "" || c.Email != "" || c.AuthTime == 0 {
+		t.Fatalf("id token claims = %+v", c)
+	}
+}
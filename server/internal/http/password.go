@@ -0,0 +1,230 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/config"
+	"mahi/server/internal/mail"
+	"mahi/server/internal/store"
+)
+
+// reset links are meant to be used right away
+const passwordResetTTL = 30 * time.Minute
+
+func passwordPolicy(cfg config.Config) (auth.PasswordPolicy, error) {
+	p := auth.PasswordPolicy{
+		MinLength:   cfg.PasswordMinLength,
+		MaxLength:   cfg.PasswordMaxLength,
+		MinStrength: cfg.PasswordMinStrength,
+	}
+	if cfg.PasswordBreachFile != "" {
+		var err error
+		if p.Breached, err = auth.OpenBreachList(cfg.PasswordBreachFile); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// checkNewPassword applies the password policy and writes the violations,
+// reported against field, if the password fails it.
+func (s *Server) checkNewPassword(w http.ResponseWriter, field, password string, ctx auth.PasswordContext) bool {
+	violations, err := s.pwPolicy.Check(password, ctx)
+	if err != nil {
+		log.Printf("password policy: %v", err)
+	}
+	if len(violations) == 0 {
+		return true
+	}
+	writeErr(w, http.StatusBadRequest, "weak_password", map[string]any{
+		"field":      field,
+		"message":    violations[0].Message,
+		"violations": violations,
+	})
+	return false
+}
+
+type forgotPasswordReq struct {
+	Email string `json:"email"`
+}
+
+// POST /v1/auth/password/forgot
+// Answers the same way whether or not the account exists, and mails in the
+// background so the response time doesn't tell either.
+func (s *Server) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req forgotPasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if req.Email == "" {
+		writeErr(w, http.StatusBadRequest, "missing_fields", map[string]any{"field": "email"})
+		return
+	}
+	if u, ok := s.st.GetUserByEmail(req.Email); ok {
+		s.sendPasswordReset(r, u)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"message": "If an account exists for this email, we've sent a link to reset the password.",
+	})
+}
+
+func (s *Server) sendPasswordReset(r *http.Request, u store.User) {
+	token := newRefreshToken()
+	if err := s.st.SavePasswordReset(token, u.ID, time.Now().Add(passwordResetTTL)); err != nil {
+		log.Printf("password reset: %v", err)
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: u.ID, Kind: store.AuditPasswordResetRequested,
+		Detail: map[string]any{"ip": clientIP(r)}})
+	msg := mail.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Text: "Someone asked to reset the password of your Mahi account.\n\n" +
+			"To choose a new password, open this link within 30 minutes:\n\n" +
+			s.appLink("reset-password", url.Values{"token": {token}}) + "\n\n" +
+			"If it wasn't you, ignore this email; your password stays the same.",
+	}
+	go s.sendMail(r, msg)
+}
+
+type resetPasswordReq struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// POST /v1/auth/password/reset
+// Sets the new password and signs the user out everywhere: whoever knew the
+// old password shouldn't keep a session.
+func (s *Server) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		writeErr(w, http.StatusBadRequest, "missing_fields", nil)
+		return
+	}
+	invalid := func() {
+		writeErr(w, http.StatusBadRequest, "reset_token_invalid", map[string]any{
+			"message": "This link is invalid or has expired. Request a new one.",
+		})
+	}
+	// the policy needs the account, and a refused password shouldn't use up
+	// the link, so look before consuming
+	userID, err := s.st.PasswordResetUser(req.Token)
+	if err != nil {
+		invalid()
+		return
+	}
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		invalid()
+		return
+	}
+	if !s.checkNewPassword(w, "password", req.Password, auth.PasswordContext{Email: u.Email, Name: u.Name}) {
+		return
+	}
+	// hash before spending the token, so a busy server doesn't cost them the link
+	hash, err := s.hashes.HashPassword(r.Context(), req.Password)
+	if s.hashBusy(w, err) {
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "password_set_failed", nil)
+		return
+	}
+	consumed, err := s.st.ConsumePasswordReset(req.Token)
+	if errors.Is(err, store.ErrResetInvalid) || (err == nil && consumed != userID) {
+		invalid()
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "password_reset_failed", nil)
+		return
+	}
+	if err := s.st.SetPasswordHash(userID, hash); err != nil {
+		writeErr(w, http.StatusInternalServerError, "password_set_failed", nil)
+		return
+	}
+	revoked, err := s.st.RevokeOtherSessions(userID, "")
+	if err != nil {
+		log.Printf("password reset: revoke sessions: %v", err)
+	}
+	for _, id := range revoked {
+		s.revokeSessionAccess(id)
+	}
+	// the link arrived in their inbox, which proves the address
+	if !u.EmailVerified {
+		_ = s.st.SetEmailVerified(userID, true)
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditPasswordReset,
+		Detail: map[string]any{"sessions_revoked": len(revoked)}})
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+type changePasswordReq struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// POST /v1/users/me/password
+// Keeps the session making the change and ends all the others.
+func (s *Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	current, _ := r.Context().Value(ctxKeySessionID{}).(string)
+	var req changePasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		writeErr(w, http.StatusBadRequest, "missing_fields", nil)
+		return
+	}
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		writeErr(w, http.StatusNotFound, "user_not_found", nil)
+		return
+	}
+	if _, err := s.st.VerifyCreds(r.Context(), s.hashes, u.Email, req.CurrentPassword); s.hashBusy(w, err) {
+		return
+	} else if err != nil {
+		writeErr(w, http.StatusForbidden, "invalid_current_password", map[string]any{"field": "current_password"})
+		return
+	}
+	if !s.checkNewPassword(w, "new_password", req.NewPassword, auth.PasswordContext{Email: u.Email, Name: u.Name}) {
+		return
+	}
+	if err := s.st.SetPassword(r.Context(), s.hashes, userID, req.NewPassword); s.hashBusy(w, err) {
+		return
+	} else if err != nil {
+		writeErr(w, http.StatusInternalServerError, "password_set_failed", nil)
+		return
+	}
+	revoked, err := s.st.RevokeOtherSessions(userID, current)
+	if err != nil {
+		log.Printf("change password: revoke sessions: %v", err)
+	}
+	for _, id := range revoked {
+		s.revokeSessionAccess(id)
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditPasswordChanged,
+		Detail: map[string]any{"ip": clientIP(r), "sessions_revoked": len(revoked)}})
+	go s.sendMail(r, mail.Message{
+		To:      u.Email,
+		Subject: "Your Mahi password was changed",
+		Text: "The password of your Mahi account was changed on " +
+			time.Now().UTC().Format("2 Jan 2006 at 15:04 UTC") + " from " + clientIP(r) + ".\n\n" +
+			"Your other devices have been signed out.\n\n" +
+			"If this wasn't you, reset your password right away from the sign-in screen.",
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "revoked": len(revoked)})
+}
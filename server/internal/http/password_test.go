@@ -0,0 +1,112 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResetLinkWorksOnce(t *testing.T) {
+	s, _ := newTestServer(t)
+	// two links from two "forgot password" requests
+	first, second := newRefreshToken(), newRefreshToken()
+	for _, tok := range []string{first, second} {
+		if err := s.st.SavePasswordReset(tok, "u_1", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reset := func(tok, password string) (int, map[string]any) {
+		w, body := serve(s.resetPassword, jsonReq(t, http.MethodPost, "/v1/auth/password/reset",
+			resetPasswordReq{Token: tok, Password: password}))
+		return w.Code, body
+	}
+
+	// a password the policy refuses leaves the link usable
+	if code, body := reset(first, "password"); code != http.StatusBadRequest || body["error"] == "reset_token_invalid" {
+		t.Fatalf("weak password: %d %v", code, body)
+	}
+
+	// the same link clicked twice at once
+	passwords := []string{testPassword, "violet harbor engine quill"}
+	codes := make([]int, len(passwords))
+	var wg sync.WaitGroup
+	for i, pw := range passwords {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i], _ = reset(first, pw)
+		}()
+	}
+	wg.Wait()
+	won := -1
+	for i, code := range codes {
+		switch {
+		case code == http.StatusOK && won < 0:
+			won = i
+		case code != http.StatusBadRequest:
+			t.Fatalf("statuses %v, want one 200 and one 400", codes)
+		}
+	}
+	if won < 0 {
+		t.Fatalf("statuses %v, want one 200", codes)
+	}
+	ctx := context.Background()
+	if _, err := s.st.VerifyCreds(ctx, s.hashes, "demo@demo.com", passwords[won]); err != nil {
+		t.Fatalf("the accepted password doesn't work: %v", err)
+	}
+	if _, err := s.st.VerifyCreds(ctx, s.hashes, "demo@demo.com", passwords[1-won]); err == nil {
+		t.Fatal("the refused reset changed the password too")
+	}
+
+	// later clicks on either link are refused
+	for _, tok := range []string{first, second} {
+		if code, body := reset(tok, "later wombat cactus drift"); code != http.StatusBadRequest || body["error"] != "reset_token_invalid" {
+			t.Fatalf("reuse: %d %v", code, body)
+		}
+	}
+}
+
+func TestChangePasswordEndsOtherSessions(t *testing.T) {
+	s, rec := newTestServer(t)
+	here := login(t, s, "demo@demo.com", "password")
+	there := login(t, s, "demo@demo.com", "password")
+	me := func(access string) int {
+		w, _ := withBearer(s, s.me, httptest.NewRequest(http.MethodGet, "/v1/users/me", nil), access)
+		return w.Code
+	}
+	refresh := func(token string) int {
+		w, _ := serve(s.refresh, jsonReq(t, http.MethodPost, "/v1/auth/refresh", refreshReq{RefreshToken: token}))
+		return w.Code
+	}
+
+	r := jsonReq(t, http.MethodPost, "/v1/users/me/password",
+		changePasswordReq{CurrentPassword: "password", NewPassword: testPassword})
+	if w, out := withBearer(s, s.changePassword, r, here.AccessToken); w.Code != http.StatusOK || out["revoked"] != float64(1) {
+		t.Fatalf("change: %d %v", w.Code, out)
+	}
+
+	// the other device is signed out at once, access and refresh token alike
+	if code := me(there.AccessToken); code != http.StatusUnauthorized {
+		t.Fatalf("other session's access token: status %d", code)
+	}
+	if code := refresh(there.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("other session's refresh token: status %d", code)
+	}
+	// the device that made the change stays signed in
+	if code := me(here.AccessToken); code != http.StatusOK {
+		t.Fatalf("current session's access token: status %d", code)
+	}
+	if code := refresh(here.RefreshToken); code != http.StatusOK {
+		t.Fatalf("current session's refresh token: status %d", code)
+	}
+	if sessions, _ := s.st.ListSessions("u_1"); len(sessions) != 1 || sessions[0].ID != here.SessionID {
+		t.Fatalf("sessions = %+v", sessions)
+	}
+	if m := waitMail(t, rec, "demo@demo.com"); !strings.Contains(m.Text, "other devices have been signed out") {
+		t.Fatalf("notice = %+v", m)
+	}
+}
@@ -0,0 +1,143 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mahi/server/internal/config"
+	"mahi/server/internal/ratelimit"
+)
+
+// how much of a request body byEmail reads looking for the address
+const rateLimitPeek = 64 << 10
+
+// Limits on /v1/auth. Every route there gets authLimit; the ones that send
+// mail, create accounts or check secrets get tighter ones on top.
+var (
+	authLimit        = perIP("auth", 60, time.Minute)
+	registerLimit    = perIP("register", 10, time.Hour)
+	loginIPLimit     = perIP("login", 10, time.Minute)
+	loginEmailLimit  = perEmail("login", 5, time.Minute)
+	mailIPLimit      = perIP("mail", 20, time.Hour) // password reset and magic link emails
+	mailEmailLimit   = perEmail("mail", 5, time.Hour)
+	codeLimit        = perIP("code", 10, time.Minute) // MFA, email codes, reset tokens
+	resendLimit      = perUser("resend", 5, time.Hour)
+	accountEditLimit = perUser("account", 10, time.Hour) // password and email changes
+)
+
+// rateRule is a policy and what it is counted per. A key func returning ""
+// skips the rule for that request.
+type rateRule struct {
+	policy ratelimit.Policy
+	key    func(r *http.Request) string
+}
+
+func perIP(name string, limit int, window time.Duration) rateRule {
+	return rateRule{ratelimit.Policy{Name: name + ":ip", Limit: limit, Window: window}, byIP}
+}
+
+func perUser(name string, limit int, window time.Duration) rateRule {
+	return rateRule{ratelimit.Policy{Name: name + ":user", Limit: limit, Window: window}, byUser}
+}
+
+func perEmail(name string, limit int, window time.Duration) rateRule {
+	return rateRule{ratelimit.Policy{Name: name + ":email", Limit: limit, Window: window}, byEmail}
+}
+
+func byIP(r *http.Request) string { return clientIP(r) }
+
+// byUser needs the authn middleware in front of it.
+func byUser(r *http.Request) string {
+	id, _ := r.Context().Value(ctxKeyUserID{}).(string)
+	return id
+}
+
+// byEmail reads the "email" field of a JSON body and puts the body back for
+// the handler.
+func byEmail(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, rateLimitPeek))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	if json.Unmarshal(b, &req) != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(req.Email))
+}
+
+func newRateLimiter(cfg config.Config, st Store) (*ratelimit.Limiter, error) {
+	switch cfg.RateLimitBackend {
+	case "memory", "":
+		return ratelimit.New(ratelimit.NewMemory()), nil
+	case "store":
+		return ratelimit.New(ratelimit.CounterFunc(st.IncrRateCounter)), nil
+	case "off":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q", cfg.RateLimitBackend)
+}
+
+// rateLimit counts each request against every rule and turns it away with
+// 429 once any of them is exceeded. The RateLimit-* headers describe the
+// rule closest to its limit, including rules of rateLimit middlewares
+// further out. A limiter that fails lets the request through.
+func (s *Server) rateLimit(rules ...rateRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.limiter == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for _, rule := range rules {
+				key := rule.key(r)
+				if key == "" {
+					continue
+				}
+				res, err := s.limiter.Allow(key, rule.policy)
+				if err != nil {
+					log.Printf("rate limit %s: %v", rule.policy.Name, err)
+					continue
+				}
+				setRateLimitHeaders(w, rule.policy, res)
+				if !res.Allowed {
+					secs := int(math.Ceil(res.RetryAfter.Seconds()))
+					w.Header().Set("Retry-After", strconv.Itoa(secs))
+					writeErr(w, http.StatusTooManyRequests, "rate_limited", map[string]any{"retry_after": secs})
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setRateLimitHeaders writes the RateLimit-* fields (IETF httpapi draft)
+// unless a rule with fewer requests left already did.
+func setRateLimitHeaders(w http.ResponseWriter, p ratelimit.Policy, res ratelimit.Result) {
+	h := w.Header()
+	if prev, err := strconv.Atoi(h.Get("RateLimit-Remaining")); err == nil && prev < res.Remaining {
+		return
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+	h.Set("RateLimit-Policy", p.String())
+}
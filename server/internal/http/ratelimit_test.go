@@ -0,0 +1,55 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mahi/server/internal/ratelimit"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.limiter = ratelimit.New(ratelimit.NewMemory())
+	var gotEmail string
+	h := s.rateLimit(perIP("t", 5, time.Minute), perEmail("t", 2, time.Minute))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the body survives byEmail reading it
+		var req struct{ Email string }
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		gotEmail = req.Email
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		email      string
+		want       int
+		remaining  string
+		retryAfter bool
+	}{
+		{"a@example.com", http.StatusNoContent, "1", false},
+		{"A@example.com ", http.StatusNoContent, "0", false},
+		{"a@example.com", http.StatusTooManyRequests, "0", true},
+		{"b@example.com", http.StatusNoContent, "1", false}, // per address 1 left, per email 1 left
+		{"c@example.com", http.StatusNoContent, "0", false},
+		{"d@example.com", http.StatusTooManyRequests, "0", true}, // address limit
+	}
+	for i, tt := range tests {
+		gotEmail = ""
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, jsonReq(t, http.MethodPost, "/v1/auth/login", map[string]string{"email": tt.email}))
+		if w.Code != tt.want {
+			t.Fatalf("request %d (%s): status %d, want %d", i, tt.email, w.Code, tt.want)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: RateLimit-Remaining %q, want %q", i, got, tt.remaining)
+		}
+		if (w.Header().Get("Retry-After") != "") != tt.retryAfter {
+			t.Errorf("request %d: Retry-After %q", i, w.Header().Get("Retry-After"))
+		}
+		if tt.want == http.StatusNoContent && gotEmail != tt.email {
+			t.Errorf("request %d: handler read email %q, want %q", i, gotEmail, tt.email)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package httpserver
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// how long after signing in a session counts as a fresh re-authentication
+const reauthMaxAge = 10 * time.Minute
+
+var errReauthRequired = errors.New("reauth_required")
+
+// stepUp proves the user is at the keyboard without a password: a current
+// TOTP code, or a passkey assertion against options from
+// /v1/users/me/reauth/webauthn/options.
+type stepUp struct {
+	TOTPCode   string         `json:"totp_code"`
+	State      string         `json:"state"`
+	Credential credentialJSON `json:"credential"`
+}
+
+// checkReauth accepts a session opened within reauthMaxAge, or a step-up
+// second factor. It stands in for the current password on accounts that
+// don't have one. TOTP codes count against the same per-user limit as at
+// sign-in, so a locked-out user gets errMFATooMany.
+func (s *Server) checkReauth(r *http.Request, userID string, up stepUp) error {
+	switch {
+	case up.TOTPCode != "":
+		err := s.checkTOTP(userID, up.TOTPCode, false)
+		if errors.Is(err, errMFATooMany) {
+			return err
+		}
+		if err != nil {
+			return errReauthRequired
+		}
+		return nil
+	case up.State != "":
+		st, err := s.parseWebAuthnState(up.State, "reauth")
+		if err != nil || st.UserID != userID {
+			return errReauthRequired
+		}
+		if _, err := s.checkAssertion(st, up.Credential, true); err != nil {
+			return errReauthRequired
+		}
+		return nil
+	}
+	current, _ := r.Context().Value(ctxKeySessionID{}).(string)
+	sessions, err := s.st.ListSessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		if sess.ID == current && time.Since(sess.CreatedAt) < reauthMaxAge {
+			return nil
+		}
+	}
+	return errReauthRequired
+}
+
+// reauthOK runs checkReauth and answers the request when it fails.
+func (s *Server) reauthOK(w http.ResponseWriter, r *http.Request, userID string, up stepUp) bool {
+	err := s.checkReauth(r, userID, up)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errReauthRequired):
+		writeErr(w, http.StatusForbidden, err.Error(), map[string]any{
+			"message": "Sign in again, or confirm with your authenticator app or a passkey.",
+		})
+	case errors.Is(err, errMFATooMany):
+		writeMFATooMany(w)
+	default:
+		writeErr(w, http.StatusInternalServerError, "reauth_failed", nil)
+	}
+	return false
+}
+
+// POST /v1/users/me/reauth/webauthn/options
+// Options for confirming a sensitive change with one of the user's passkeys.
+func (s *Server) reauthWebAuthnOptions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	creds, err := s.st.ListWebAuthnCredentials(userID)
+	if err != nil || len(creds) == 0 {
+		writeErr(w, http.StatusBadRequest, "reauth_method_unavailable", nil)
+		return
+	}
+	st, tok, err := s.newWebAuthnState("reauth", userID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "token_error", nil)
+		return
+	}
+	opts := s.rp.RequestOptions(st.Challenge, int(webauthnStateTTL.Milliseconds()), descriptors(creds), "required")
+	writeJSON(w, http.StatusOK, map[string]any{"publicKey": opts, "state": tok})
+}
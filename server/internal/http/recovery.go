@@ -0,0 +1,122 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/store"
+)
+
+// recovery codes handed out per batch
+const recoveryCodeCount = 10
+
+// issueRecoveryCodes replaces the user's recovery codes with a fresh batch and
+// returns them in the clear; this is the only time they are visible.
+func (s *Server) issueRecoveryCodes(userID string) ([]string, error) {
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	// 50 random bits need no password hash: the store keeps a peppered HMAC,
+	// which also spares the hash scheduler
+	normalized := make([]string, 0, len(codes))
+	for _, c := range codes {
+		normalized = append(normalized, auth.NormalizeRecoveryCode(c))
+	}
+	if err := s.st.ReplaceRecoveryCodes(userID, normalized); err != nil {
+		return nil, err
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditRecoveryCodesIssued})
+	return codes, nil
+}
+
+// firstRecoveryCodes issues recovery codes when a user enrolls a factor and
+// has none yet. It returns nil when the user already has codes.
+func (s *Server) firstRecoveryCodes(userID string) []string {
+	if left, err := s.st.UnusedRecoveryCodes(userID); err != nil || len(left) > 0 {
+		return nil
+	}
+	codes, err := s.issueRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("mfa: issue recovery codes: %v", err)
+	}
+	return codes
+}
+
+// dropRecoveryCodes forgets the recovery codes once the last factor is gone;
+// they would be no use, and must not outlive MFA into a later enrollment.
+func (s *Server) dropRecoveryCodes(userID string) {
+	if len(s.mfaMethods(userID)) > 0 {
+		return
+	}
+	if err := s.st.ReplaceRecoveryCodes(userID, nil); err != nil {
+		log.Printf("mfa: drop recovery codes: %v", err)
+	}
+}
+
+// checkRecoveryCode spends the recovery code matching code, if any.
+func (s *Server) checkRecoveryCode(userID, code string) error {
+	code = auth.NormalizeRecoveryCode(code)
+	if code == "" {
+		return errMFACodeInvalid
+	}
+	if err := s.st.ConsumeRecoveryCode(userID, code); err != nil {
+		return errMFACodeInvalid
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditRecoveryCodeUsed,
+		Detail: map[string]any{"remaining": s.recoveryCodesLeft(userID)}})
+	return nil
+}
+
+func (s *Server) recoveryCodesLeft(userID string) int {
+	left, err := s.st.UnusedRecoveryCodes(userID)
+	if err != nil {
+		return 0
+	}
+	return len(left)
+}
+
+// GET /v1/users/me/mfa/recovery-codes
+func (s *Server) recoveryCodesStatus(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	writeJSON(w, http.StatusOK, map[string]any{"remaining": s.recoveryCodesLeft(userID)})
+}
+
+// POST /v1/users/me/mfa/recovery-codes
+// Issues a new batch; every earlier code stops working. The new codes get
+// past the second factor, so a session that isn't fresh sends
+// {"reauth": {...}} with a TOTP code or passkey assertion.
+func (s *Server) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	var req struct {
+		Reauth stepUp `json:"reauth"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if len(s.mfaMethods(userID)) == 0 {
+		writeErr(w, http.StatusConflict, "mfa_not_enabled", nil)
+		return
+	}
+	if !s.reauthOK(w, r, userID, req.Reauth) {
+		return
+	}
+	codes, err := s.issueRecoveryCodes(userID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "mfa_error", nil)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+}
+
+// isRecoveryCode tells recovery codes from 6-digit authenticator codes on the
+// HTML sign-in page, which has a single code field.
+func isRecoveryCode(code string) bool {
+	return len(auth.NormalizeRecoveryCode(code)) > 6
+}
@@ -0,0 +1,98 @@
+package httpserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/store"
+)
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	s, _ := newTestServer(t)
+	u, err := s.st.CreateUser("rc@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := s.issueRecoveryCodes(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := s.st.UnusedRecoveryCodes(u.ID)
+	if len(codes) != recoveryCodeCount || len(rows) != recoveryCodeCount {
+		t.Fatalf("issued %d codes, stored %d", len(codes), len(rows))
+	}
+	for _, rc := range rows {
+		if _, isPassword := auth.SchemeOf(rc.Hash); isPassword || strings.Contains(rc.Hash, auth.NormalizeRecoveryCode(codes[0])) {
+			t.Fatalf("stored %q; want a peppered HMAC", rc.Hash)
+		}
+	}
+
+	// typed back in upper case with a space instead of the dash
+	typed := strings.ToUpper(strings.Replace(codes[3], "-", " ", 1))
+	if err := s.checkRecoveryCode(u.ID, typed); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkRecoveryCode(u.ID, codes[3]); !errors.Is(err, errMFACodeInvalid) {
+		t.Fatalf("second use: err = %v, want errMFACodeInvalid", err)
+	}
+	if n := s.recoveryCodesLeft(u.ID); n != recoveryCodeCount-1 {
+		t.Fatalf("%d codes left, want %d", n, recoveryCodeCount-1)
+	}
+	// a new batch retires the old one
+	if _, err := s.issueRecoveryCodes(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkRecoveryCode(u.ID, codes[4]); !errors.Is(err, errMFACodeInvalid) {
+		t.Fatalf("code from an old batch: err = %v", err)
+	}
+}
+
+func TestRegenerateRecoveryCodesNeedsReauth(t *testing.T) {
+	s, _ := newTestServer(t)
+	u, err := s.st.CreateUser("regen@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := auth.NewTOTPSecret()
+	if err := s.st.SaveTOTP(u.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / 30
+	if err := s.st.UseTOTPStep(u.ID, step-2, true); err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.issueRecoveryCodes(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := s.st.SaveRefresh(newRefreshToken(), u.ID, time.Now().Add(time.Hour), store.SessionMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	regenerate := func(session, body string) (int, map[string]any) {
+		r := httptest.NewRequest(http.MethodPost, "/v1/users/me/mfa/recovery-codes", strings.NewReader(body))
+		w, out := serve(s.regenerateRecoveryCodes, asUser(r, u.ID, session))
+		return w.Code, out
+	}
+
+	if code, out := regenerate("s_old", ""); code != http.StatusForbidden || out["error"] != "reauth_required" {
+		t.Fatalf("stale session: %d %v", code, out)
+	}
+	if s.recoveryCodesLeft(u.ID) != recoveryCodeCount {
+		t.Fatal("refused request replaced the codes")
+	}
+	if code, out := regenerate("s_old", `{"reauth": {"totp_code": "`+auth.TOTPCode(secret, step)+`"}}`); code != http.StatusOK || len(out["recovery_codes"].([]any)) != recoveryCodeCount {
+		t.Fatalf("totp step-up: %d %v", code, out)
+	}
+	if err := s.checkRecoveryCode(u.ID, old[0]); !errors.Is(err, errMFACodeInvalid) {
+		t.Fatalf("code from the replaced batch: err = %v", err)
+	}
+	if code, _ := regenerate(fresh, ""); code != http.StatusOK {
+		t.Fatalf("fresh sign-in: status %d", code)
+	}
+}
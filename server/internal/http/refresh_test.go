@@ -0,0 +1,45 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	s, _ := newTestServer(t)
+	first := login(t, s, "demo@demo.com", "password")
+	refresh := func(token string) (int, map[string]any) {
+		w, out := serve(s.refresh, jsonReq(t, http.MethodPost, "/v1/auth/refresh", refreshReq{RefreshToken: token}))
+		return w.Code, out
+	}
+
+	code, rotated := refresh(first.RefreshToken)
+	if code != http.StatusOK || rotated["session_id"] != first.SessionID {
+		t.Fatalf("refresh: %d %v", code, rotated)
+	}
+	second, _ := rotated["refresh_token"].(string)
+	access, _ := rotated["access_token"].(string)
+	if w, _ := withBearer(s, s.me, httptest.NewRequest(http.MethodGet, "/v1/users/me", nil), access); w.Code != http.StatusOK {
+		t.Fatalf("fresh access token: %d", w.Code)
+	}
+
+	// replaying the rotated token looks like theft: the whole session ends
+	if code, out := refresh(first.RefreshToken); code != http.StatusUnauthorized || out["error"] != "refresh_reused" {
+		t.Fatalf("reused token: %d %v", code, out)
+	}
+	if code, out := refresh(second); code != http.StatusUnauthorized || out["error"] != "refresh_invalid" {
+		t.Fatalf("newest token of a revoked family: %d %v", code, out)
+	}
+	for _, tok := range []string{first.AccessToken, access} {
+		if w, out := withBearer(s, s.me, httptest.NewRequest(http.MethodGet, "/v1/users/me", nil), tok); w.Code != http.StatusUnauthorized || out["error"] != "token_revoked" {
+			t.Fatalf("access token of a revoked family: %d %v", w.Code, out)
+		}
+	}
+
+	// other sessions of the same user are untouched
+	other := login(t, s, "demo@demo.com", "password")
+	if code, _ := refresh(other.RefreshToken); code != http.StatusOK {
+		t.Fatalf("unrelated session: %d", code)
+	}
+}
@@ -0,0 +1,108 @@
+package httpserver
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/store"
+)
+
+// revocationCache answers "is this access token revoked?" without a database
+// round trip. Local revocations apply immediately; revocations made by other
+// instances arrive with the next sync.
+type revocationCache struct {
+	st Store
+
+	mu       sync.RWMutex
+	entries  map[string]time.Time // kind + ":" + value -> exp
+	lastSync time.Time
+}
+
+func newRevocationCache(st Store) *revocationCache {
+	return &revocationCache{st: st, entries: map[string]time.Time{}}
+}
+
+// revoke persists a revocation and applies it locally.
+func (c *revocationCache) revoke(kind, value string, exp time.Time) error {
+	if value == "" {
+		return nil
+	}
+	c.mu.Lock()
+	c.entries[kind+":"+value] = exp
+	c.mu.Unlock()
+	return c.st.RevokeAccess(kind, value, exp)
+}
+
+// spend revokes a single-use token's jti. Of concurrent callers, only the one
+// that wrote the revocation gets nil.
+func (c *revocationCache) spend(jti string, exp time.Time) error {
+	if err := c.st.RevokeOnce(store.RevokeKindJTI, jti, exp); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.entries[store.RevokeKindJTI+":"+jti] = exp
+	c.mu.Unlock()
+	return nil
+}
+
+// isRevoked reports whether the token's session or jti has been revoked.
+func (c *revocationCache) isRevoked(claims *auth.Claims) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if claims.SessionID != "" {
+		if _, ok := c.entries[store.RevokeKindSession+":"+claims.SessionID]; ok {
+			return true
+		}
+	}
+	if claims.ID != "" {
+		if _, ok := c.entries[store.RevokeKindJTI+":"+claims.ID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sync pulls revocations recorded since the last sync (with some overlap for
+// clock skew between instances) and drops expired entries.
+func (c *revocationCache) sync() error {
+	c.mu.RLock()
+	since := c.lastSync.Add(-10 * time.Second)
+	c.mu.RUnlock()
+
+	started := time.Now()
+	rows, err := c.st.ListRevocations(since)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rv := range rows {
+		c.entries[rv.Kind+":"+rv.Value] = rv.Exp
+	}
+	for k, exp := range c.entries {
+		if started.After(exp) {
+			delete(c.entries, k)
+		}
+	}
+	c.lastSync = started
+	return nil
+}
+
+// run keeps the cache in sync with the store until the process exits.
+func (c *revocationCache) run(every time.Duration) {
+	if err := c.sync(); err != nil {
+		log.Printf("revocations: initial sync: %v", err)
+	}
+	if every <= 0 {
+		every = 5 * time.Second
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		if err := c.sync(); err != nil {
+			log.Printf("revocations: sync: %v", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mahi/server/internal/store"
+)
+
+func TestRevokedSessionRejectedEverywhere(t *testing.T) {
+	s, _ := newTestServer(t)
+	// a second instance sharing the database, e.g. behind the same load balancer
+	peer := *s
+	peer.revoked = newRevocationCache(s.st)
+
+	tok := login(t, s, "demo@demo.com", "password")
+	me := func(srv *Server) (int, any) {
+		w, out := withBearer(srv, srv.me, httptest.NewRequest(http.MethodGet, "/v1/users/me", nil), tok.AccessToken)
+		return w.Code, out["error"]
+	}
+	if code, _ := me(&peer); code != http.StatusOK {
+		t.Fatalf("before revoke: %d", code)
+	}
+
+	r := withURLParam(httptest.NewRequest(http.MethodDelete, "/v1/sessions/"+tok.SessionID, nil), "id", tok.SessionID)
+	if w, _ := withBearer(s, s.revokeSession, r, tok.AccessToken); w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d", w.Code)
+	}
+	if code, e := me(s); code != http.StatusUnauthorized || e != "token_revoked" {
+		t.Fatalf("same instance: %d %v", code, e)
+	}
+	if err := peer.revoked.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if code, e := me(&peer); code != http.StatusUnauthorized || e != "token_revoked" {
+		t.Fatalf("other instance after sync: %d %v", code, e)
+	}
+}
+
+func TestLogoutRevokesPresentedToken(t *testing.T) {
+	s, _ := newTestServer(t)
+	// an access token from before sessions only has its jti to revoke
+	access, _, err := s.jwt.NewAccess("u_1", "", s.cfg.AccessTTLMin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := login(t, s, "demo@demo.com", "password")
+
+	r := jsonReq(t, http.MethodPost, "/v1/auth/logout", logoutReq{RefreshToken: tok.RefreshToken})
+	r.Header.Set("Authorization", "Bearer "+access)
+	if w, _ := serve(s.logout, r); w.Code != http.StatusOK {
+		t.Fatalf("logout: %d", w.Code)
+	}
+	for _, a := range []string{access, tok.AccessToken} {
+		if w, out := withBearer(s, s.me, httptest.NewRequest(http.MethodGet, "/v1/users/me", nil), a); out["error"] != "token_revoked" {
+			t.Fatalf("after logout: %d %v", w.Code, out)
+		}
+	}
+}
+
+func TestRevocationsExpire(t *testing.T) {
+	s, _ := newTestServer(t)
+	if err := s.revoked.revoke(store.RevokeKindJTI, "old", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.revoked.revoke(store.RevokeKindJTI, "live", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.revoked.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.revoked.entries[store.RevokeKindJTI+":old"]; ok {
+		t.Fatal("expired revocation kept")
+	}
+	if _, ok := s.revoked.entries[store.RevokeKindJTI+":live"]; !ok {
+		t.Fatal("live revocation dropped")
+	}
+}
@@ -1,13 +1,22 @@
 package httpserver
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"mahi/server/internal/auth"
 	"mahi/server/internal/config"
+	"mahi/server/internal/federation"
+	"mahi/server/internal/mail"
+	"mahi/server/internal/ratelimit"
 	"mahi/server/internal/store"
+	"mahi/server/internal/webauthn"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
@@ -15,44 +24,157 @@ import (
 
 type Store interface {
     CreateUser(email, name string) (store.User, error)
-    SetPassword(userID, plain string) error
-    VerifyCreds(email, password string) (store.User, error)
+    SetPassword(ctx context.Context, hashes *auth.HashScheduler, userID, plain string) error
+    SetPasswordHash(userID, hash string) error
+    HasPassword(userID string) bool
+    VerifyCreds(ctx context.Context, hashes *auth.HashScheduler, email, password string) (store.User, error)
     GetUser(id string) (store.User, bool)
-    SaveRefresh(token, userID string, exp time.Time)
-    RotateRefresh(old, newToken, userID string, exp time.Time) error
-    LookupRefresh(token string) (string, time.Time, bool)
+    SaveRefresh(token, userID string, exp time.Time, meta store.SessionMeta) (string, error)
+    RotateRefresh(old, newToken string, exp time.Time, meta store.SessionMeta) (store.RefreshToken, error)
+    LookupRefresh(token string) (store.RefreshToken, bool)
 	DeleteRefresh(token string) error
+	RecordAudit(ev store.AuditEvent) error
+
+	// sessions (one per refresh token family)
+	ListSessions(userID string) ([]store.Session, error)
+	RevokeSession(userID, sessionID string) error
+	RevokeOtherSessions(userID, keepID string) ([]string, error)
+
+	// access token denylist (session ids and jtis)
+	RevokeAccess(kind, value string, exp time.Time) error
+	RevokeOnce(kind, value string, exp time.Time) error
+	ListRevocations(since time.Time) ([]store.Revocation, error)
+
+	// OAuth clients
+	UpsertClient(c store.Client, secret string) error
+	AuthenticateClient(id, secret string) (store.Client, error)
+	GetClient(id string) (store.Client, bool)
+	CreateClient(c store.Client, secret string) error
+	ListClients() ([]store.Client, error)
+	RotateClientSecret(id, secret string, graceUntil time.Time) error
+	SetClientDisabled(id string, disabled bool) error
+
+	// federated sign-in
+	GetUserByEmail(email string) (store.User, bool)
+	SetEmailVerified(userID string, verified bool) error
+	FindIdentity(provider, subject string) (store.User, bool)
+	LinkIdentity(ident store.Identity) error
+
+	// multi-factor auth
+	SaveTOTP(userID string, secret []byte) error
+	GetTOTP(userID string) (store.TOTP, error)
+	UseTOTPStep(userID string, step int64, confirm bool) error
+	DeleteTOTP(userID string) error
+	ReplaceRecoveryCodes(userID string, codes []string) error
+	UnusedRecoveryCodes(userID string) ([]store.RecoveryCode, error)
+	ConsumeRecoveryCode(userID, code string) error
+	SavePasswordReset(token, userID string, exp time.Time) error
+	PasswordResetUser(token string) (string, error)
+	ConsumePasswordReset(token string) (string, error)
+	SaveMagicLogin(userID, link, code string, exp time.Time) error
+	ConsumeMagicLink(link string) (string, error)
+	ConsumeMagicCode(userID, code string, maxTries int) error
+	ChangeEmail(userID, email string) error
+	ImportUser(email, name, pwHash string, verified bool) (store.User, error)
+	LoginThrottle(key string) (store.Throttle, error)
+	AddLoginFailure(key string, resetBefore time.Time) (int, error)
+	LockLogin(key string, until time.Time) error
+	ClearLoginFailures(key string) error
+	SaveEmailChange(userID, email, token string, exp time.Time) error
+	ConsumeEmailChange(token string) (string, string, error)
+	AddWebAuthnCredential(c store.WebAuthnCredential) error
+	ListWebAuthnCredentials(userID string) ([]store.WebAuthnCredential, error)
+	GetWebAuthnCredential(id string) (store.WebAuthnCredential, error)
+	UseWebAuthnCredential(id string, signCount uint32) error
+	DeleteWebAuthnCredential(userID, id string) error
+	SaveAuthCode(code string, ac store.AuthCode) error
+	ConsumeAuthCode(code, clientID, redirectURI string) (store.AuthCode, error)
+	SetAuthCodeSession(code, sessionID string) error
+	IncrRateCounter(key string, start time.Time, window time.Duration) (int, int, error)
 }
 
 type Server struct {
-    cfg config.Config
-    jwt *auth.JWTMaker
-    st  Store // use the interface instead of *store.Memory
+    cfg     config.Config
+    jwt     *auth.JWTMaker
+    st      Store // use the interface instead of *store.Memory
+    revoked *revocationCache
+    fed     *federation.Registry // nil when FEDERATION_FILE is unset
+    rp       webauthn.RelyingParty
+    mail     mail.Mailer
+    pwPolicy auth.PasswordPolicy
+    limiter  *ratelimit.Limiter // nil when RATE_LIMIT_BACKEND=off
+    hashes   *auth.HashScheduler
 }
 
 func NewRouter(cfg config.Config) http.Handler {
 	  var st Store
     var err error
 
+    dataKey := sha256.Sum256([]byte(cfg.DataKey))
+    keys := store.Keys{TokenPepper: []byte(cfg.TokenPepper), SecretKey: dataKey[:]}
     switch cfg.DBDriver {
     case "postgres":
-        st, err = store.NewPostgres(cfg.DBDSN)
+        st, err = store.NewPostgres(cfg.DBDSN, keys)
     case "sqlite":
         fallthrough
     default:
-        st, err = store.NewSQLite(cfg.DBPath)
+        st, err = store.NewSQLite(cfg.DBPath, keys)
     }
     if err != nil {
         panic(err)
     }
+    if cfg.OAuthClientsFile != "" {
+        if err := seedClients(st, cfg.OAuthClientsFile); err != nil {
+            panic(err)
+        }
+    }
+
+    active, verifyOnly, err := loadKeys(cfg)
+    if err != nil {
+        panic(err)
+    }
 
     s := &Server{
-        cfg: cfg,
-        jwt: auth.NewJWTMaker(cfg.JWTSecret),
-        st:  st,
+        cfg:     cfg,
+        jwt:     auth.NewJWTMakerWithKey(active, verifyOnly...),
+        st:      st,
+        revoked: newRevocationCache(st),
+        rp:       relyingParty(cfg),
+        hashes:   auth.NewHashScheduler(cfg.HashMaxConcurrent, cfg.HashQueueSize,
+            time.Duration(cfg.HashQueueTimeoutMS)*time.Millisecond),
+    }
+    if !s.jwt.Asymmetric() {
+        log.Printf("OpenID Connect is off: set JWT_KEY_FILE or JWT_KEYRING_FILE to an Ed25519 or RSA key to issue ID tokens")
+    }
+    if s.mail, err = newMailer(cfg); err != nil {
+        panic(err)
+    }
+    if s.pwPolicy, err = passwordPolicy(cfg); err != nil {
+        panic(err)
+    }
+    if s.limiter, err = newRateLimiter(cfg, st); err != nil {
+        panic(err)
+    }
+    proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+    if err != nil {
+        panic(err)
+    }
+    if cfg.FirebaseSignerKey != "" {
+        fb, err := auth.NewFirebaseScrypt(cfg.FirebaseSignerKey, cfg.FirebaseSaltSeparator, cfg.FirebaseRounds, cfg.FirebaseMemCost)
+        if err != nil {
+            panic(err)
+        }
+        auth.RegisterScheme(fb)
+    }
+    if cfg.FederationFile != "" {
+        if s.fed, err = federation.Load(cfg.FederationFile, nil); err != nil {
+            panic(err)
+        }
     }
+    go s.revoked.run(time.Duration(cfg.RevocationSyncSec) * time.Second)
 
 	r := chi.NewRouter()
+	r.Use(realIP(proxies))
 
 	// Dev CORS — loosen for now
 	r.Use(cors.Handler(cors.Options{
@@ -66,16 +188,98 @@ func NewRouter(cfg config.Config) http.Handler {
 	// Health
 	r.Get("/healthz", s.health)
 
+	// Public signing keys for services that verify our access tokens
+	r.Get("/.well-known/jwks.json", s.jwks)
+
+	// OpenID Connect discovery and userinfo
+	r.Get("/.well-known/openid-configuration", s.openIDConfig)
+	r.Group(func(or chi.Router) {
+		or.Use(s.bearerOnly)
+		or.Get("/oauth/userinfo", s.userinfo)
+		or.Post("/oauth/userinfo", s.userinfo)
+	})
+
+	// OAuth 2.0 authorization code flow (PKCE) for third-party apps
+	r.Get("/oauth/authorize", s.authorize)
+	r.Post("/oauth/authorize", s.authorize)
+	r.Post("/oauth/token", s.token)
+
+	// OAuth 2.0 token introspection / revocation for gateways and partners
+	r.Post("/oauth/introspect", s.introspect)
+	r.Post("/oauth/revoke", s.revokeToken)
+
 	// Auth
 	r.Route("/v1", func(r chi.Router) {
-		 r.Post("/auth/register", s.register)
-		r.Post("/auth/login", s.login)
-		r.Post("/auth/refresh", s.refresh)
-		r.Post("/auth/logout", s.logout) 
+		r.Group(func(r chi.Router) {
+			r.Use(s.rateLimit(authLimit))
+			r.With(s.rateLimit(registerLimit)).Post("/auth/register", s.register)
+			r.With(s.rateLimit(loginIPLimit, loginEmailLimit)).Post("/auth/login", s.login)
+			r.Post("/auth/refresh", s.refresh)
+			r.Post("/auth/logout", s.logout)
+			r.Get("/auth/verify-email", s.verifyEmail)
+			r.Post("/auth/verify-email", s.verifyEmail)
+			r.Get("/auth/email-change/confirm", s.confirmEmailChange)
+			r.Post("/auth/email-change/confirm", s.confirmEmailChange)
+			r.Get("/auth/email-change/revert", s.revertEmailChange)
+			r.Post("/auth/email-change/revert", s.revertEmailChange)
+			r.Get("/auth/unlock", s.unlockAccount)
+			r.Post("/auth/unlock", s.unlockAccount)
+			r.With(s.rateLimit(mailIPLimit, mailEmailLimit)).Post("/auth/password/forgot", s.forgotPassword)
+			r.With(s.rateLimit(codeLimit)).Post("/auth/password/reset", s.resetPassword)
+			r.With(s.rateLimit(mailIPLimit, mailEmailLimit)).Post("/auth/magic/start", s.magicStart)
+			r.With(s.rateLimit(codeLimit)).Post("/auth/magic/complete", s.magicComplete)
+
+			// Sign in with Google / Apple / GitHub
+			r.Get("/auth/federated/{provider}/start", s.federatedStart)
+			r.Get("/auth/federated/{provider}/callback", s.federatedCallback)
+			r.Post("/auth/federated/{provider}/callback", s.federatedCallback) // Apple form_post
+			r.Post("/auth/federated/{provider}/token", s.federatedToken)
+			r.Post("/auth/federated/exchange", s.federatedExchange)
+
+			// second step of a login when the account has MFA
+			r.With(s.rateLimit(codeLimit)).Post("/auth/mfa/verify", s.mfaVerify)
+			r.Post("/auth/mfa/webauthn/options", s.mfaWebAuthnOptions)
+
+			// passwordless sign-in with a passkey
+			r.Post("/auth/webauthn/login/options", s.webauthnLoginOptions)
+			r.Post("/auth/webauthn/login/verify", s.webauthnLoginVerify)
+		})
 
 		r.Group(func(pr chi.Router) {
 			pr.Use(s.authn) // JWT middleware
 			pr.Get("/users/me", s.me)
+			pr.With(s.rateLimit(accountEditLimit)).Post("/users/me/password", s.changePassword)
+			pr.With(s.rateLimit(accountEditLimit)).Post("/users/me/email", s.changeEmail)
+			pr.With(s.rateLimit(authLimit, resendLimit)).Post("/auth/verify-email/resend", s.resendVerification)
+			pr.Get("/sessions", s.listSessions)
+			pr.Delete("/sessions/{id}", s.revokeSession)
+			pr.Post("/sessions/revoke-others", s.revokeOtherSessions)
+			pr.Get("/users/me/mfa", s.mfaStatus)
+			pr.Post("/users/me/mfa/totp", s.totpEnroll)
+			pr.Post("/users/me/mfa/totp/confirm", s.totpConfirm)
+			pr.With(s.rateLimit(codeLimit, accountEditLimit)).Delete("/users/me/mfa/totp", s.totpDisable)
+			pr.Get("/users/me/mfa/recovery-codes", s.recoveryCodesStatus)
+			pr.Post("/users/me/mfa/recovery-codes", s.regenerateRecoveryCodes)
+			pr.Post("/users/me/reauth/webauthn/options", s.reauthWebAuthnOptions)
+			pr.Post("/users/me/webauthn/register/options", s.webauthnRegisterOptions)
+			pr.Post("/users/me/webauthn/register/verify", s.webauthnRegisterVerify)
+			pr.Get("/users/me/webauthn/credentials", s.listWebAuthnCredentials)
+			pr.Delete("/users/me/webauthn/credentials/{id}", s.deleteWebAuthnCredential)
+		})
+
+		r.Route("/admin", func(ar chi.Router) {
+			ar.Use(s.adminOnly)
+			ar.Get("/keys", s.listKeys)
+			ar.Post("/keys/rotate", s.rotateKey)
+			ar.Post("/keys/reload", s.reloadKeys)
+			ar.Get("/clients", s.listClients)
+			ar.Post("/clients", s.createClient)
+			ar.Post("/clients/{id}/secret", s.rotateClientSecret)
+			ar.Post("/clients/{id}/disable", s.setClientDisabled(true))
+			ar.Post("/clients/{id}/enable", s.setClientDisabled(false))
+			ar.Post("/users/import", s.importUsers)
+			ar.Post("/users/{id}/unlock", s.adminUnlockUser)
+			ar.Get("/metrics/hashing", s.hashingMetrics)
 		})
 	})
 
@@ -89,14 +293,16 @@ func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 //login
 
 type loginReq struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
 }
 type tokenResp struct {
 	AccessToken     string      `json:"access_token"`
 	AccessExpiresIn int         `json:"access_expires_in"`
 	RefreshToken    string      `json:"refresh_token"`
 	RefreshExpiresIn int        `json:"refresh_expires_in"`
+	SessionID       string      `json:"session_id"`
 	User            store.User  `json:"user"`
 }
 
@@ -106,29 +312,46 @@ func (s *Server) login(w http.ResponseWriter, r *http.Request) {
 		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
 		return
 	}
-	u, err := s.st.VerifyCreds(req.Email, req.Password)
+	u, err := s.verifyLogin(r, req.Email, req.Password)
+	var locked *errLoginLocked
+	if errors.As(err, &locked) {
+		writeLoginLocked(w, locked)
+		return
+	}
+	if s.hashBusy(w, err) {
+		return
+	}
 	if err != nil {
 		writeErr(w, http.StatusUnauthorized, "invalid_credentials", nil)
 		return
 	}
+	s.completeLogin(w, r, u, req.DeviceName)
+}
+
+// issueTokens opens a new session for u and writes the tokenResp.
+func (s *Server) issueTokens(w http.ResponseWriter, r *http.Request, status int, u store.User, deviceName string) {
+	// Refresh token (opaque) starts a new session
+	rt := newRefreshToken()
+	rtExp := time.Now().Add(time.Duration(s.cfg.RefreshTTLDays) * 24 * time.Hour)
+	sessionID, err := s.st.SaveRefresh(rt, u.ID, rtExp, sessionMeta(r, deviceName))
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "session_error", nil)
+		return
+	}
 
-	// Access token
-	access, _, err := s.jwt.NewAccess(u.ID, s.cfg.AccessTTLMin)
+	// Access token bound to that session
+	access, _, err := s.jwt.NewAccess(u.ID, sessionID, s.cfg.AccessTTLMin)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "token_error", nil)
 		return
 	}
 
-	// Refresh token (opaque string for demo)
-	rt := newRefreshToken()
-	rtExp := time.Now().Add(time.Duration(s.cfg.RefreshTTLDays) * 24 * time.Hour)
-	s.st.SaveRefresh(rt, u.ID, rtExp)
-
-	writeJSON(w, http.StatusOK, tokenResp{
+	writeJSON(w, status, tokenResp{
 		AccessToken: access,
 		AccessExpiresIn: s.cfg.AccessTTLMin*60,
 		RefreshToken: rt,
 		RefreshExpiresIn: int(time.Until(rtExp).Seconds()),
+		SessionID: sessionID,
 		User: u,
 	})
 }
@@ -144,8 +367,22 @@ func (s *Server) register(w http.ResponseWriter, r *http.Request) {
         writeErr(w, http.StatusBadRequest, "missing_fields", nil)
         return
     }
+    if !s.checkNewPassword(w, "password", req.Password, auth.PasswordContext{Email: req.Email, Name: req.Name}) {
+        return
+    }
 	
-    // 1) Create user (fails if email exists)
+    // 1) Hash first: when hashing is saturated we turn them away before
+    // there is an account without a password
+    hash, err := s.hashes.HashPassword(r.Context(), req.Password)
+    if s.hashBusy(w, err) {
+        return
+    }
+    if err != nil {
+        writeErr(w, http.StatusInternalServerError, "password_set_failed", nil)
+        return
+    }
+
+    // 2) Create user (fails if email exists)
     u, err := s.st.CreateUser(req.Email, req.Name)
     if err != nil {
         // expect something like store.ErrEmailExists; fall back to 409
@@ -161,41 +398,29 @@ func (s *Server) register(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // 2) Hash & set password
-    if err := s.st.SetPassword(u.ID, req.Password); err != nil {
+    // 3) Set password
+    if err := s.st.SetPasswordHash(u.ID, hash); err != nil {
         writeErr(w, http.StatusInternalServerError, "password_set_failed", nil)
         return
     }
 
-    // 3) Issue access token (JWT)
-    access, _, err := s.jwt.NewAccess(u.ID, s.cfg.AccessTTLMin)
-    if err != nil {
-        writeErr(w, http.StatusInternalServerError, "token_error", nil)
-        return
-    }
-
-    // 4) Issue refresh token (opaque) and persist it
-    rt := newRefreshToken()
-    rtExp := time.Now().Add(time.Duration(s.cfg.RefreshTTLDays) * 24 * time.Hour)
-    s.st.SaveRefresh(rt, u.ID, rtExp)
+    // 4) Ask them to confirm the address; the account works meanwhile, so a
+    // slow mail server mustn't hold up the response
+    go s.sendVerification(r, u)
 
-    // 5) Respond (201 Created)
-    writeJSON(w, http.StatusCreated, tokenResp{
-        AccessToken:       access,
-        AccessExpiresIn:   s.cfg.AccessTTLMin * 60,
-        RefreshToken:      rt,
-        RefreshExpiresIn:  int(time.Until(rtExp).Seconds()),
-        User:              u,
-    })
+    // 5) Open a session and respond with tokens (201 Created)
+    s.issueTokens(w, r, http.StatusCreated, u, req.DeviceName)
 }
 
 type refreshReq struct {
 	RefreshToken string `json:"refresh_token"`
+	DeviceName   string `json:"device_name"`
 }
 type registerReq struct {
-	Name     string `json:"name"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
 }
 func (s *Server) refresh(w http.ResponseWriter, r *http.Request) {
 	var req refreshReq
@@ -203,29 +428,41 @@ func (s *Server) refresh(w http.ResponseWriter, r *http.Request) {
 		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
 		return
 	}
-	userID, exp, ok := s.st.LookupRefresh(req.RefreshToken)
-	if !ok || time.Now().After(exp) {
-		writeErr(w, http.StatusUnauthorized, "refresh_invalid", nil)
-		return
-	}
-	// new access
-	access, _, err := s.jwt.NewAccess(userID, s.cfg.AccessTTLMin)
-	if err != nil {
-		writeErr(w, http.StatusInternalServerError, "token_error", nil)
+	// tokens of an OAuth grant belong to its client, which refreshes them at
+	// /oauth/token where it has to authenticate and can be disabled
+	if cur, ok := s.st.LookupRefresh(req.RefreshToken); ok && cur.ClientID != "" {
+		writeErr(w, http.StatusBadRequest, "refresh_wrong_endpoint", map[string]any{
+			"message": "This refresh token was issued to an OAuth client. Refresh it at /oauth/token.",
+		})
 		return
 	}
-	// rotate refresh
+	// rotate refresh; a token that was already rotated revokes its whole family
 	newRT := newRefreshToken()
 	newExp := time.Now().Add(time.Duration(s.cfg.RefreshTTLDays) * 24 * time.Hour)
-	if err := s.st.RotateRefresh(req.RefreshToken, newRT, userID, newExp); err != nil {
+	rt, err := s.st.RotateRefresh(req.RefreshToken, newRT, newExp, sessionMeta(r, req.DeviceName))
+	if errors.Is(err, store.ErrRefreshReused) {
+		s.revokeSessionAccess(rt.SessionID)
+		writeErr(w, http.StatusUnauthorized, "refresh_reused", map[string]any{
+			"message": "This refresh token was already used. The session has been signed out for your safety.",
+		})
+		return
+	}
+	if err != nil {
 		writeErr(w, http.StatusUnauthorized, "refresh_invalid", nil)
 		return
 	}
+	// new access (an OAuth grant keeps its client and scope)
+	access, _, err := s.jwt.NewOAuthAccess(rt.UserID, rt.SessionID, rt.ClientID, rt.Scope, s.cfg.AccessTTLMin)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "token_error", nil)
+		return
+	}
 	writeJSON(w, http.StatusOK, map[string]any{
 		"access_token": access,
 		"access_expires_in": s.cfg.AccessTTLMin*60,
 		"refresh_token": newRT,
 		"refresh_expires_in": int(time.Until(newExp).Seconds()),
+		"session_id": rt.SessionID,
 	})
 }
 
@@ -249,6 +486,13 @@ func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
         writeErr(w, http.StatusBadRequest, "invalid_json", nil); return
     }
     if req.RefreshToken == "" { writeErr(w, http.StatusBadRequest, "missing_token", nil); return }
+    if rt, ok := s.st.LookupRefresh(req.RefreshToken); ok {
+        s.revokeSessionAccess(rt.SessionID)
+    }
     _ = s.st.DeleteRefresh(req.RefreshToken)
+    // also kill the presented access token, even if it predates sessions
+    if claims, err := s.jwt.Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err == nil && claims.ExpiresAt != nil {
+        _ = s.revoked.revoke(store.RevokeKindJTI, claims.ID, claims.ExpiresAt.Time)
+    }
     writeJSON(w, http.StatusOK, map[string]string{"status":"ok"})
 }
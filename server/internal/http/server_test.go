@@ -0,0 +1,116 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/config"
+	"mahi/server/internal/mail"
+	"mahi/server/internal/store"
+)
+
+// newTestServer wires a Server to an in-memory store and a mail recorder,
+// without the router, background sync or config files NewRouter needs.
+func newTestServer(t *testing.T) (*Server, *mail.Recorder) {
+	t.Helper()
+	cfg := config.Config{
+		Issuer:              "http://mahi.test",
+		AppURL:              "mahiapp://",
+		AccessTTLMin:        15,
+		RefreshTTLDays:      30,
+		PasswordMinLength:   8,
+		PasswordMaxLength:   128,
+		PasswordMinStrength: 2,
+		LoginMaxFailures:    5,
+		LoginLockoutMin:     15,
+	}
+	st := store.NewMemory(store.Keys{TokenPepper: []byte("test-pepper"), SecretKey: make([]byte, 32)})
+	rec := &mail.Recorder{}
+	s := &Server{
+		cfg:      cfg,
+		jwt:      auth.NewJWTMaker("test-secret"),
+		st:       st,
+		revoked:  newRevocationCache(st),
+		rp:       relyingParty(cfg),
+		mail:     rec,
+		pwPolicy: auth.PasswordPolicy{MinLength: cfg.PasswordMinLength, MaxLength: cfg.PasswordMaxLength, MinStrength: cfg.PasswordMinStrength},
+		hashes:   auth.NewHashScheduler(4, 32, 5*time.Second),
+	}
+	return s, rec
+}
+
+// waitMail waits for the newest message to addr; account mail goes out in the background.
+func waitMail(t *testing.T, rec *mail.Recorder, addr string) mail.Message {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if m, ok := rec.Last(addr); ok {
+			return m
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no mail to %s", addr)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// mailToken extracts the token query parameter of the first link in text.
+func mailToken(t *testing.T, text string) string {
+	t.Helper()
+	for _, word := range strings.Fields(text) {
+		if u, err := url.Parse(word); err == nil && u.Query().Get("token") != "" {
+			return u.Query().Get("token")
+		}
+	}
+	t.Fatalf("no link with a token in %q", text)
+	return ""
+}
+
+// jsonReq builds a request with body encoded as JSON.
+func jsonReq(t *testing.T, method, path string, body any) *http.Request {
+	t.Helper()
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// serve runs h and decodes its JSON answer.
+func serve(h http.HandlerFunc, r *http.Request) (*httptest.ResponseRecorder, map[string]any) {
+	w := httptest.NewRecorder()
+	h(w, r)
+	var out map[string]any
+	_ = json.Unmarshal(w.Body.Bytes(), &out)
+	return w, out
+}
+
+// login signs in through the login handler and returns the issued tokens.
+func login(t *testing.T, s *Server, email, password string) tokenResp {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.login(w, jsonReq(t, http.MethodPost, "/v1/auth/login", loginReq{Email: email, Password: password}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login %s: %d %s", email, w.Code, w.Body)
+	}
+	var out tokenResp
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// withBearer runs h behind the authn middleware with the given access token.
+func withBearer(s *Server, h http.HandlerFunc, r *http.Request, access string) (*httptest.ResponseRecorder, map[string]any) {
+	r.Header.Set("Authorization", "Bearer "+access)
+	return serve(s.authn(h).ServeHTTP, r)
+}
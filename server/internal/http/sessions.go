@@ -0,0 +1,81 @@
+package httpserver
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"mahi/server/internal/store"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type sessionResp struct {
+	store.Session
+	Current bool `json:"current"`
+}
+
+// GET /v1/sessions
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	current, _ := r.Context().Value(ctxKeySessionID{}).(string)
+	sessions, err := s.st.ListSessions(userID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "session_error", nil)
+		return
+	}
+	out := make([]sessionResp, 0, len(sessions))
+	for _, sess := range sessions {
+		out = append(out, sessionResp{Session: sess, Current: sess.ID == current})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"sessions": out})
+}
+
+// DELETE /v1/sessions/{id}
+func (s *Server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	sessionID := chi.URLParam(r, "id")
+	err := s.st.RevokeSession(userID, sessionID)
+	if errors.Is(err, store.ErrSessionNotFound) {
+		writeErr(w, http.StatusNotFound, "session_not_found", nil)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "session_error", nil)
+		return
+	}
+	s.revokeSessionAccess(sessionID)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// POST /v1/sessions/revoke-others
+// Ends every session except the one the access token belongs to.
+func (s *Server) revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	current, _ := r.Context().Value(ctxKeySessionID{}).(string)
+	if current == "" {
+		writeErr(w, http.StatusBadRequest, "session_unknown", map[string]any{
+			"message": "This access token predates sessions. Refresh it and try again.",
+		})
+		return
+	}
+	revoked, err := s.st.RevokeOtherSessions(userID, current)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "session_error", nil)
+		return
+	}
+	for _, id := range revoked {
+		s.revokeSessionAccess(id)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "revoked": len(revoked)})
+}
+
+// revokeSessionAccess denies every access token issued for sessionID. Those
+// tokens live at most AccessTTLMin, so the denylist entry can expire with them.
+func (s *Server) revokeSessionAccess(sessionID string) {
+	exp := time.Now().Add(time.Duration(s.cfg.AccessTTLMin)*time.Minute + time.Minute)
+	if err := s.revoked.revoke(store.RevokeKindSession, sessionID, exp); err != nil {
+		log.Printf("revoke session %s: %v", sessionID, err)
+	}
+}
@@ -0,0 +1,88 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// withURLParam sets a chi route parameter as the router would.
+func withURLParam(r *http.Request, key, value string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add(key, value)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	s, _ := newTestServer(t)
+	phone := login(t, s, "demo@demo.com", "password")
+	laptop := login(t, s, "demo@demo.com", "password")
+	stranger, err := s.st.CreateUser("stranger@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, out := withBearer(s, s.listSessions, httptest.NewRequest(http.MethodGet, "/v1/sessions", nil), laptop.AccessToken)
+	sessions, _ := out["sessions"].([]any)
+	if w.Code != http.StatusOK || len(sessions) != 2 {
+		t.Fatalf("list: %d %v", w.Code, out)
+	}
+	for _, raw := range sessions {
+		sess := raw.(map[string]any)
+		if want := sess["id"] == laptop.SessionID; sess["current"] != want {
+			t.Fatalf("session %v: current = %v", sess["id"], sess["current"])
+		}
+	}
+
+	tests := []struct {
+		name   string
+		access string
+		id     string
+		want   int
+	}{
+		{"unknown session", laptop.AccessToken, "s_missing", http.StatusNotFound},
+		{"another device", laptop.AccessToken, phone.SessionID, http.StatusOK},
+		{"already revoked", laptop.AccessToken, phone.SessionID, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withURLParam(httptest.NewRequest(http.MethodDelete, "/v1/sessions/"+tt.id, nil), "id", tt.id)
+			if w, out := withBearer(s, s.revokeSession, r, tt.access); w.Code != tt.want {
+				t.Fatalf("revoke %s: %d %v", tt.id, w.Code, out)
+			}
+		})
+	}
+	// sessions are scoped to their owner
+	if err := s.st.RevokeSession(stranger.ID, laptop.SessionID); err == nil {
+		t.Fatal("revoked a session of another user")
+	}
+
+	if w, _ := serve(s.refresh, jsonReq(t, http.MethodPost, "/v1/auth/refresh", refreshReq{RefreshToken: phone.RefreshToken})); w.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh of a revoked session: %d", w.Code)
+	}
+	if _, out := withBearer(s, s.listSessions, httptest.NewRequest(http.MethodGet, "/v1/sessions", nil), laptop.AccessToken); len(out["sessions"].([]any)) != 1 {
+		t.Fatalf("sessions after revoke: %v", out)
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	s, _ := newTestServer(t)
+	keep := login(t, s, "demo@demo.com", "password")
+	others := []tokenResp{login(t, s, "demo@demo.com", "password"), login(t, s, "demo@demo.com", "password")}
+
+	w, out := withBearer(s, s.revokeOtherSessions, httptest.NewRequest(http.MethodPost, "/v1/sessions/revoke-others", nil), keep.AccessToken)
+	if w.Code != http.StatusOK || out["revoked"] != float64(2) {
+		t.Fatalf("revoke-others: %d %v", w.Code, out)
+	}
+	for _, o := range others {
+		if w, _ := serve(s.refresh, jsonReq(t, http.MethodPost, "/v1/auth/refresh", refreshReq{RefreshToken: o.RefreshToken})); w.Code != http.StatusUnauthorized {
+			t.Fatalf("refresh of a signed-out session: %d", w.Code)
+		}
+	}
+	if w, _ := serve(s.refresh, jsonReq(t, http.MethodPost, "/v1/auth/refresh", refreshReq{RefreshToken: keep.RefreshToken})); w.Code != http.StatusOK {
+		t.Fatalf("refresh of the kept session: %d", w.Code)
+	}
+}
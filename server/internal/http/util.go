@@ -3,7 +3,13 @@ package httpserver
 import (
 	"crypto/rand"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
+
+	"mahi/server/internal/store"
 )
 
 func writeJSON(w http.ResponseWriter, code int, v any) {
@@ -30,3 +36,99 @@ func newRefreshToken() string {
 	}
 	return string(out)
 }
+
+// clientIP is the address of the peer that connected to us, or of the client
+// behind it when the peer is a trusted proxy (see realIP).
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseTrustedProxies reads TRUSTED_PROXIES: comma-separated addresses or
+// CIDR ranges of the load balancers in front of us.
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			a, err := netip.ParseAddr(f)
+			if err != nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+			}
+			out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+func trusted(proxies []netip.Prefix, ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range proxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP replaces r.RemoteAddr with the client address from X-Forwarded-For
+// when the request came through a trusted proxy. The header is read right to
+// left: each trusted proxy appends the address it saw, so the first one that
+// isn't ours is the client. Anything left of it may be forged by the client.
+func realIP(proxies []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(proxies) == 0 || !trusted(proxies, clientIP(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var hops []string
+			for _, h := range r.Header.Values("X-Forwarded-For") {
+				hops = append(hops, strings.Split(h, ",")...)
+			}
+			client := ""
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := strings.TrimSpace(hops[i])
+				if _, err := netip.ParseAddr(hop); err != nil {
+					break // garbage from here on; stop at the last good hop
+				}
+				client = hop
+				if !trusted(proxies, hop) {
+					break
+				}
+			}
+			if client != "" {
+				r.RemoteAddr = net.JoinHostPort(client, "0")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sessionMeta collects what we record about the device behind a request.
+func sessionMeta(r *http.Request, deviceName string) store.SessionMeta {
+	ua := r.UserAgent()
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+	if len(deviceName) > 100 {
+		deviceName = deviceName[:100]
+	}
+	return store.SessionMeta{DeviceName: deviceName, IP: clientIP(r), UserAgent: ua}
+}
@@ -0,0 +1,391 @@
+package httpserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mahi/server/internal/auth"
+	"mahi/server/internal/config"
+	"mahi/server/internal/store"
+	"mahi/server/internal/webauthn"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	webauthnStateTyp = "webauthn+jwt"
+	// how long the platform prompt may stay open
+	webauthnStateTTL = 5 * time.Minute
+)
+
+var (
+	errWebAuthnState   = errors.New("webauthn_state_invalid")
+	errWebAuthnInvalid = errors.New("webauthn_invalid")
+)
+
+// relyingParty describes this server to authenticators. Without explicit
+// settings the RP ID is the Issuer's host and the Issuer is the only origin;
+// the Expo app has to be listed in WEBAUTHN_ORIGINS (android:apk-key-hash:...).
+func relyingParty(cfg config.Config) webauthn.RelyingParty {
+	rp := webauthn.RelyingParty{ID: cfg.WebAuthnRPID, Name: cfg.MFAIssuer}
+	if rp.ID == "" {
+		if u, err := url.Parse(cfg.Issuer); err == nil {
+			rp.ID = u.Hostname()
+		}
+	}
+	for _, o := range strings.Split(cfg.WebAuthnOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			rp.Origins = append(rp.Origins, o)
+		}
+	}
+	if len(rp.Origins) == 0 {
+		rp.Origins = []string{cfg.Issuer}
+	}
+	return rp
+}
+
+// webauthnState carries a ceremony's challenge from the options call to the
+// verify call. It is spent on success so a response can't be replayed.
+type webauthnState struct {
+	Purpose   string `json:"purpose"` // "register", "login", "mfa" or "reauth"
+	UserID    string `json:"uid,omitempty"`
+	Challenge string `json:"challenge"`
+	jwt.RegisteredClaims
+}
+
+func (s *Server) newWebAuthnState(purpose, userID string) (webauthnState, string, error) {
+	now := time.Now()
+	st := webauthnState{
+		Purpose:   purpose,
+		UserID:    userID,
+		Challenge: webauthn.NewChallenge(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(webauthnStateTTL)),
+			ID:        newRefreshToken(),
+		},
+	}
+	tok, err := s.jwt.Sign(webauthnStateTyp, st)
+	return st, tok, err
+}
+
+func (s *Server) parseWebAuthnState(tok, purpose string) (webauthnState, error) {
+	var st webauthnState
+	if err := s.jwt.ParseTyped(tok, webauthnStateTyp, &st); err != nil || st.Purpose != purpose ||
+		s.revoked.isRevoked(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{ID: st.ID}}) {
+		return webauthnState{}, errWebAuthnState
+	}
+	return st, nil
+}
+
+// spendWebAuthnState marks the ceremony done. When two responses to the same
+// challenge race, only the first gets nil.
+func (s *Server) spendWebAuthnState(st webauthnState) error {
+	err := s.revoked.spend(st.ID, st.ExpiresAt.Time)
+	if err != nil && !errors.Is(err, store.ErrAlreadyRevoked) {
+		log.Printf("webauthn: spend state: %v", err)
+	}
+	if err != nil {
+		return errWebAuthnState
+	}
+	return nil
+}
+
+// b64url is binary data that travels as base64url in JSON, as WebAuthn's
+// toJSON() encodes it. Padding is tolerated.
+type b64url []byte
+
+func (b *b64url) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = raw
+	return nil
+}
+
+// credentialJSON is a PublicKeyCredential as serialized by toJSON(), for
+// either ceremony.
+type credentialJSON struct {
+	RawID    b64url `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    b64url   `json:"clientDataJSON"`
+		AttestationObject b64url   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+		AuthenticatorData b64url   `json:"authenticatorData"`
+		Signature         b64url   `json:"signature"`
+		UserHandle        b64url   `json:"userHandle"`
+	} `json:"response"`
+}
+
+func descriptors(creds []store.WebAuthnCredential) []webauthn.CredDescriptor {
+	out := make([]webauthn.CredDescriptor, 0, len(creds))
+	for _, c := range creds {
+		out = append(out, webauthn.CredDescriptor{Type: "public-key", ID: c.ID, Transports: c.Transports})
+	}
+	return out
+}
+
+// POST /v1/users/me/webauthn/register/options
+func (s *Server) webauthnRegisterOptions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		writeErr(w, http.StatusNotFound, "user_not_found", nil)
+		return
+	}
+	existing, err := s.st.ListWebAuthnCredentials(userID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "webauthn_error", nil)
+		return
+	}
+	st, tok, err := s.newWebAuthnState("register", userID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "token_error", nil)
+		return
+	}
+	display := u.Name
+	if display == "" {
+		display = u.Email
+	}
+	// the user handle is our opaque user id; it comes back at passwordless sign-in
+	opts := s.rp.CreationOptions([]byte(u.ID), u.Email, display, st.Challenge,
+		int(webauthnStateTTL.Milliseconds()), descriptors(existing))
+	writeJSON(w, http.StatusOK, map[string]any{"publicKey": opts, "state": tok})
+}
+
+type webauthnRegisterReq struct {
+	State      string         `json:"state"`
+	Name       string         `json:"name"`
+	Credential credentialJSON `json:"credential"`
+	Reauth     stepUp         `json:"reauth"`
+}
+
+// POST /v1/users/me/webauthn/register/verify
+// A new passkey signs in on its own, so adding one needs a fresh sign-in or a
+// step-up with an existing factor.
+func (s *Server) webauthnRegisterVerify(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	var req webauthnRegisterReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if !s.reauthOK(w, r, userID, req.Reauth) {
+		return
+	}
+	st, err := s.parseWebAuthnState(req.State, "register")
+	if err != nil || st.UserID != userID {
+		writeErr(w, http.StatusBadRequest, errWebAuthnState.Error(), nil)
+		return
+	}
+	resp := req.Credential.Response
+	cred, err := s.rp.VerifyRegistration(resp.ClientDataJSON, resp.AttestationObject, st.Challenge, false)
+	if err != nil {
+		log.Printf("webauthn register: %v", err)
+		writeErr(w, http.StatusBadRequest, errWebAuthnInvalid.Error(), nil)
+		return
+	}
+	if err := s.spendWebAuthnState(st); err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	rec := store.WebAuthnCredential{
+		ID:         base64.RawURLEncoding.EncodeToString(cred.ID),
+		UserID:     userID,
+		Name:       name,
+		PublicKey:  cred.PublicKey,
+		SignCount:  cred.SignCount,
+		Transports: resp.Transports,
+	}
+	err = s.st.AddWebAuthnCredential(rec)
+	if errors.Is(err, store.ErrCredentialExists) {
+		writeErr(w, http.StatusConflict, "webauthn_credential_exists", nil)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "webauthn_error", nil)
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditWebAuthnAdded,
+		Detail: map[string]any{"credential_id": rec.ID, "name": name}})
+	rec.CreatedAt = time.Now().UTC()
+	rec.LastUsedAt = rec.CreatedAt
+	out := struct {
+		store.WebAuthnCredential
+		RecoveryCodes []string `json:"recovery_codes,omitempty"` // only with the user's first factor
+	}{rec, s.firstRecoveryCodes(userID)}
+	if out.RecoveryCodes != nil {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	writeJSON(w, http.StatusCreated, out)
+}
+
+// GET /v1/users/me/webauthn/credentials
+func (s *Server) listWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	creds, err := s.st.ListWebAuthnCredentials(userID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "webauthn_error", nil)
+		return
+	}
+	if creds == nil {
+		creds = []store.WebAuthnCredential{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"credentials": creds})
+}
+
+// DELETE /v1/users/me/webauthn/credentials/{id}
+// The body is optional: {"reauth": {...}} when the session isn't fresh.
+func (s *Server) deleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxKeyUserID{}).(string)
+	var req struct {
+		Reauth stepUp `json:"reauth"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	if !s.reauthOK(w, r, userID, req.Reauth) {
+		return
+	}
+	id := chi.URLParam(r, "id")
+	err := s.st.DeleteWebAuthnCredential(userID, id)
+	if errors.Is(err, store.ErrCredentialNotFound) {
+		writeErr(w, http.StatusNotFound, "webauthn_credential_not_found", nil)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "webauthn_error", nil)
+		return
+	}
+	_ = s.st.RecordAudit(store.AuditEvent{UserID: userID, Kind: store.AuditWebAuthnRemoved,
+		Detail: map[string]any{"credential_id": id}})
+	s.dropRecoveryCodes(userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /v1/auth/webauthn/login/options
+// Passwordless sign-in with a discoverable passkey: the allow list is empty,
+// so nothing about which accounts exist is revealed.
+func (s *Server) webauthnLoginOptions(w http.ResponseWriter, r *http.Request) {
+	st, tok, err := s.newWebAuthnState("login", "")
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "token_error", nil)
+		return
+	}
+	opts := s.rp.RequestOptions(st.Challenge, int(webauthnStateTTL.Milliseconds()), nil, "required")
+	writeJSON(w, http.StatusOK, map[string]any{"publicKey": opts, "state": tok})
+}
+
+type webauthnLoginReq struct {
+	State      string         `json:"state"`
+	Credential credentialJSON `json:"credential"`
+	DeviceName string         `json:"device_name"`
+}
+
+// POST /v1/auth/webauthn/login/verify
+// A user-verified passkey is possession plus PIN/biometrics, so it skips the
+// MFA challenge.
+func (s *Server) webauthnLoginVerify(w http.ResponseWriter, r *http.Request) {
+	var req webauthnLoginReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	st, err := s.parseWebAuthnState(req.State, "login")
+	if err != nil {
+		writeErr(w, http.StatusUnauthorized, err.Error(), nil)
+		return
+	}
+	userID, err := s.checkAssertion(st, req.Credential, true)
+	if err != nil {
+		writeErr(w, http.StatusUnauthorized, err.Error(), nil)
+		return
+	}
+	u, ok := s.st.GetUser(userID)
+	if !ok {
+		writeErr(w, http.StatusUnauthorized, errWebAuthnInvalid.Error(), nil)
+		return
+	}
+	s.issueTokens(w, r, http.StatusOK, u, req.DeviceName)
+}
+
+type mfaWebAuthnOptionsReq struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+// POST /v1/auth/mfa/webauthn/options
+// Options for using a passkey or security key as the second factor; the
+// response goes to /v1/auth/mfa/verify with method "webauthn".
+func (s *Server) mfaWebAuthnOptions(w http.ResponseWriter, r *http.Request) {
+	var req mfaWebAuthnOptionsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", nil)
+		return
+	}
+	c, err := s.parseMFAToken(req.MFAToken)
+	if err != nil {
+		writeErr(w, http.StatusUnauthorized, err.Error(), nil)
+		return
+	}
+	creds, err := s.st.ListWebAuthnCredentials(c.UserID)
+	if err != nil || len(creds) == 0 {
+		writeErr(w, http.StatusBadRequest, "mfa_method_unavailable", nil)
+		return
+	}
+	st, tok, err := s.newWebAuthnState("mfa", c.UserID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "token_error", nil)
+		return
+	}
+	opts := s.rp.RequestOptions(st.Challenge, int(webauthnStateTTL.Milliseconds()), descriptors(creds), "discouraged")
+	writeJSON(w, http.StatusOK, map[string]any{"publicKey": opts, "state": tok})
+}
+
+// checkAssertion verifies a passkey assertion for the ceremony in st and
+// returns the credential's owner. The state is spent on success.
+func (s *Server) checkAssertion(st webauthnState, cred credentialJSON, requireUV bool) (string, error) {
+	rec, err := s.st.GetWebAuthnCredential(base64.RawURLEncoding.EncodeToString(cred.RawID))
+	if err != nil {
+		return "", errWebAuthnInvalid
+	}
+	if st.UserID != "" && rec.UserID != st.UserID {
+		return "", errWebAuthnInvalid
+	}
+	if len(cred.Response.UserHandle) > 0 && string(cred.Response.UserHandle) != rec.UserID {
+		return "", errWebAuthnInvalid
+	}
+	resp := cred.Response
+	a, err := s.rp.VerifyAssertion(rec.PublicKey, rec.SignCount, resp.ClientDataJSON, resp.AuthenticatorData,
+		resp.Signature, st.Challenge, requireUV)
+	if err != nil {
+		log.Printf("webauthn assertion %s: %v", rec.ID, err)
+		return "", errWebAuthnInvalid
+	}
+	if err := s.spendWebAuthnState(st); err != nil {
+		return "", err
+	}
+	if err := s.st.UseWebAuthnCredential(rec.ID, a.SignCount); err != nil {
+		log.Printf("webauthn: save sign count: %v", err)
+	}
+	return rec.UserID, nil
+}
@@ -0,0 +1,88 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mahi/server/internal/store"
+)
+
+func TestPasskeyChangesNeedReauth(t *testing.T) {
+	s, _ := newTestServer(t)
+	u, err := s.st.CreateUser("keys@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.st.AddWebAuthnCredential(store.WebAuthnCredential{ID: "cred_1", UserID: u.ID, Name: "Phone",
+		PublicKey: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := s.st.SaveRefresh(newRefreshToken(), u.ID, time.Now().Add(time.Hour), store.SessionMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stolen, older access token can neither add nor remove passkeys
+	_, state, _ := s.newWebAuthnState("register", u.ID)
+	r := asUser(jsonReq(t, http.MethodPost, "/v1/users/me/webauthn/register/verify",
+		webauthnRegisterReq{State: state}), u.ID, "s_old")
+	if w, body := serve(s.webauthnRegisterVerify, r); w.Code != http.StatusForbidden || body["error"] != "reauth_required" {
+		t.Fatalf("register: status %d body %v", w.Code, body)
+	}
+	if _, err := s.parseWebAuthnState(state, "register"); err != nil {
+		t.Fatal("refused registration spent the state")
+	}
+
+	del := func(session, body string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/v1/users/me/webauthn/credentials/cred_1", strings.NewReader(body))
+		w, _ := serve(s.deleteWebAuthnCredential, withURLParam(asUser(r, u.ID, session), "id", "cred_1"))
+		return w.Code
+	}
+	if code := del("s_old", ""); code != http.StatusForbidden {
+		t.Fatalf("delete from a stale session: status %d", code)
+	}
+	if code := del("s_old", `{"reauth": {"totp_code": "123456"}}`); code != http.StatusForbidden {
+		t.Fatalf("delete with a TOTP code and no authenticator: status %d", code)
+	}
+	if _, err := s.st.GetWebAuthnCredential("cred_1"); err != nil {
+		t.Fatal("credential removed without re-authentication")
+	}
+	if code := del(fresh, ""); code != http.StatusNoContent {
+		t.Fatalf("delete from a fresh sign-in: status %d", code)
+	}
+}
+
+func TestWebAuthnStateSpentOnce(t *testing.T) {
+	s, _ := newTestServer(t)
+	st, tok, err := s.newWebAuthnState("login", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		won int
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.spendWebAuthnState(st) == nil {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Fatalf("%d verifications spent the same challenge", won)
+	}
+	if _, err := s.parseWebAuthnState(tok, "login"); err == nil {
+		t.Fatal("spent state still parses")
+	}
+}
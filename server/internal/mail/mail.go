@@ -0,0 +1,124 @@
+// Package mail sends the account emails (verification, password reset, security
+// notices). Mailer is the seam: SMTP in production, a file or stdout in
+// development, and Recorder wherever outgoing mail needs to be inspected.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrHeaderInjection = errors.New("mail: header contains a line break")
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// render formats m as an RFC 5322 message with a quoted-printable UTF-8 body.
+func render(from string, m Message, now time.Time) ([]byte, error) {
+	for _, h := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, ErrHeaderInjection
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(m.Text, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteString("\r\n")
+	return b.Bytes(), nil
+}
+
+// Writer prints each message, readable as is, to an io.Writer. It is meant
+// for development: links in the mail can be copied straight from the log.
+type Writer struct {
+	From string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriter(w io.Writer, from string) *Writer {
+	return &Writer{From: from, w: w}
+}
+
+// NewFile appends messages to the file at path, creating it if needed.
+func NewFile(path, from string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(f, from), nil
+}
+
+func (w *Writer) Send(_ context.Context, m Message) error {
+	for _, h := range []string{m.To, m.Subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return ErrHeaderInjection
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := fmt.Fprintf(w.w, "From: %s\nTo: %s\nSubject: %s\nDate: %s\n\n%s\n----\n",
+		w.From, m.To, m.Subject, time.Now().Format(time.RFC1123Z), m.Text)
+	return err
+}
+
+// Recorder keeps sent messages in memory instead of delivering them.
+type Recorder struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func (r *Recorder) Send(_ context.Context, m Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, m)
+	return nil
+}
+
+// Messages returns everything sent so far, oldest first.
+func (r *Recorder) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.sent...)
+}
+
+// Last returns the newest message sent to addr.
+func (r *Recorder) Last(addr string) (Message, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.sent) - 1; i >= 0; i-- {
+		if strings.EqualFold(r.sent[i].To, addr) {
+			return r.sent[i], true
+		}
+	}
+	return Message{}, false
+}
@@ -0,0 +1,145 @@
+// Package ratelimit implements a sliding-window rate limiter. Hits are
+// counted in fixed windows; a request is judged on the current window's
+// count plus the previous window's, weighted by how much of it still falls
+// inside the sliding window. Two counters per key is all a backend has to
+// keep, which makes it cheap to share through a database.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Policy is a limit of Limit requests per Window.
+type Policy struct {
+	Name   string // keeps counters of different policies on one key apart
+	Limit  int
+	Window time.Duration
+}
+
+// String is the RateLimit-Policy form, e.g. "10;w=60".
+func (p Policy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Limit, int(p.Window.Seconds()))
+}
+
+// Counter stores the hits. Incr adds one to key's window starting at start
+// and returns the hits in that window and in the one before it.
+type Counter interface {
+	Incr(key string, start time.Time, window time.Duration) (curr, prev int, err error)
+}
+
+// CounterFunc adapts a function, such as a store method, to Counter.
+type CounterFunc func(key string, start time.Time, window time.Duration) (int, int, error)
+
+func (f CounterFunc) Incr(key string, start time.Time, window time.Duration) (int, int, error) {
+	return f(key, start, window)
+}
+
+// Result is the outcome of one request against one policy.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the current window ends
+	RetryAfter time.Duration // when denied, until a request would be allowed
+}
+
+type Limiter struct {
+	c   Counter
+	now func() time.Time
+}
+
+func New(c Counter) *Limiter {
+	return &Limiter{c: c, now: time.Now}
+}
+
+// Allow counts a request for key under p. Denied requests count too, so a
+// client that keeps hammering stays limited.
+func (l *Limiter) Allow(key string, p Policy) (Result, error) {
+	now := l.now()
+	start := now.Truncate(p.Window)
+	curr, prev, err := l.c.Incr(p.Name+"|"+key, start, p.Window)
+	if err != nil {
+		return Result{}, err
+	}
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(p.Window)
+	used := float64(prev)*weight + float64(curr)
+	res := Result{
+		Allowed:   used <= float64(p.Limit),
+		Limit:     p.Limit,
+		Remaining: max(0, p.Limit-int(math.Ceil(used))),
+		Reset:     p.Window - elapsed,
+	}
+	if !res.Allowed {
+		res.RetryAfter = retryAfter(p, curr, prev, elapsed)
+	}
+	return res, nil
+}
+
+// retryAfter is how long until one more hit fits under the limit, assuming
+// no hits in between.
+func retryAfter(p Policy, curr, prev int, elapsed time.Duration) time.Duration {
+	w := float64(p.Window)
+	var t float64
+	if room := p.Limit - curr - 1; room >= 0 && prev > 0 {
+		// the previous window's share has to shrink to room
+		t = w*(1-float64(room)/float64(prev)) - float64(elapsed)
+	} else {
+		// wait into the next window, where this one's count is the old share
+		t = w - float64(elapsed) + w*(1-float64(p.Limit-1)/float64(curr))
+	}
+	// whole seconds, rounded up so the client doesn't come back a moment
+	// early; the millisecond rounding first keeps float noise from adding one
+	secs := math.Ceil(math.Round(t/float64(time.Millisecond)) / 1000)
+	return max(time.Second, time.Duration(secs)*time.Second)
+}
+
+// Memory is a Counter for a single instance.
+type Memory struct {
+	mu    sync.Mutex
+	keys  map[string]*memWindow
+	calls int
+}
+
+type memWindow struct {
+	start      time.Time
+	window     time.Duration
+	curr, prev int
+}
+
+func NewMemory() *Memory {
+	return &Memory{keys: map[string]*memWindow{}}
+}
+
+func (m *Memory) Incr(key string, start time.Time, window time.Duration) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.calls++; m.calls%1000 == 0 {
+		m.sweep(time.Now())
+	}
+	w, ok := m.keys[key]
+	switch {
+	case !ok:
+		w = &memWindow{start: start, window: window}
+		m.keys[key] = w
+	case w.start.Equal(start):
+	case w.start.Add(window).Equal(start):
+		w.start, w.prev, w.curr = start, w.curr, 0
+	default:
+		w.start, w.prev, w.curr = start, 0, 0
+	}
+	w.curr++
+	return w.curr, w.prev, nil
+}
+
+// sweep drops keys that haven't been hit for two windows.
+func (m *Memory) sweep(now time.Time) {
+	for k, w := range m.keys {
+		if now.Sub(w.start) > 2*w.window {
+			delete(m.keys, k)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// hits is n requests made at one moment.
+type hits struct {
+	at time.Duration
+	n  int
+}
+
+func TestLimiterSlidingWindow(t *testing.T) {
+	p := Policy{Name: "test", Limit: 10, Window: time.Minute}
+	base := time.Unix(6000, 0) // on a window boundary
+	tests := []struct {
+		name       string
+		before     []hits
+		at         time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{name: "first", at: 0, allowed: true, remaining: 9},
+		{name: "last that fits", before: []hits{{0, 9}}, at: 0, allowed: true, remaining: 0},
+		{name: "one over", before: []hits{{0, 10}}, at: 0, allowed: false, retryAfter: 71 * time.Second},
+		{name: "previous window half counted", before: []hits{{0, 10}}, at: 90 * time.Second, allowed: true, remaining: 4},
+		{name: "burst across the boundary", before: []hits{{59 * time.Second, 10}}, at: 60 * time.Second,
+			allowed: false, retryAfter: 12 * time.Second},
+		{name: "after two windows", before: []hits{{0, 10}}, at: 2 * time.Minute, allowed: true, remaining: 9},
+		{name: "denied requests count", before: []hits{{0, 10}, {30 * time.Second, 5}}, at: 70 * time.Second,
+			allowed: false, retryAfter: 18 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var now time.Time
+			l := New(NewMemory())
+			l.now = func() time.Time { return now }
+			for _, h := range tt.before {
+				now = base.Add(h.at)
+				for i := 0; i < h.n; i++ {
+					if _, err := l.Allow("k", p); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			now = base.Add(tt.at)
+			res, err := l.Allow("k", p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Allowed != tt.allowed || res.Limit != p.Limit {
+				t.Fatalf("got %+v, want allowed=%v", res, tt.allowed)
+			}
+			if tt.allowed && res.Remaining != tt.remaining {
+				t.Fatalf("remaining %d, want %d", res.Remaining, tt.remaining)
+			}
+			if !tt.allowed && res.RetryAfter != tt.retryAfter {
+				t.Fatalf("retry after %s, want %s", res.RetryAfter, tt.retryAfter)
+			}
+			if res.Reset != p.Window-tt.at%p.Window {
+				t.Fatalf("reset %s", res.Reset)
+			}
+		})
+	}
+}
+
+func TestLimiterRetryAfterIsEnough(t *testing.T) {
+	p := Policy{Name: "test", Limit: 5, Window: 10 * time.Second}
+	base := time.Unix(1000, 0)
+	for _, burst := range []struct{ at, n int }{{0, 6}, {9, 6}, {5, 12}, {3, 7}} {
+		now := base.Add(time.Duration(burst.at) * time.Second)
+		l := New(NewMemory())
+		l.now = func() time.Time { return now }
+		var res Result
+		for i := 0; i < burst.n; i++ {
+			res, _ = l.Allow("k", p)
+		}
+		if res.Allowed {
+			t.Fatalf("burst %+v: last hit allowed", burst)
+		}
+		now = now.Add(res.RetryAfter)
+		if again, _ := l.Allow("k", p); !again.Allowed {
+			t.Errorf("burst %+v: still denied after Retry-After %s", burst, res.RetryAfter)
+		}
+	}
+}
+
+func TestLimiterKeysAndPolicies(t *testing.T) {
+	l := New(NewMemory())
+	a := Policy{Name: "a", Limit: 1, Window: time.Hour}
+	b := Policy{Name: "b", Limit: 1, Window: time.Hour}
+	for _, step := range []struct {
+		key     string
+		p       Policy
+		allowed bool
+	}{
+		{"1.2.3.4", a, true},
+		{"1.2.3.4", a, false},
+		{"5.6.7.8", a, true},
+		{"1.2.3.4", b, true},
+	} {
+		res, err := l.Allow(step.key, step.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Allowed != step.allowed {
+			t.Errorf("%s under %s: allowed = %v, want %v", step.key, step.p.Name, res.Allowed, step.allowed)
+		}
+	}
+}
+
+func TestLimiterCounterError(t *testing.T) {
+	boom := errors.New("db down")
+	l := New(CounterFunc(func(string, time.Time, time.Duration) (int, int, error) { return 0, 0, boom }))
+	if _, err := l.Allow("k", Policy{Name: "x", Limit: 1, Window: time.Second}); !errors.Is(err, boom) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestPolicyString(t *testing.T) {
+	if got := (Policy{Limit: 10, Window: time.Minute}).String(); got != "10;w=60" {
+		t.Fatalf("String() = %q", got)
+	}
+}
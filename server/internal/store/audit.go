@@ -0,0 +1,50 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// AuditEvent is a security-relevant fact we keep for later investigation.
+type AuditEvent struct {
+	UserID    string         `json:"user_id"`
+	Kind      string         `json:"kind"`
+	Detail    map[string]any `json:"detail,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// Audit event kinds
+const (
+	AuditRefreshReuse    = "refresh_token.reuse_detected"
+	AuditIdentityLinked  = "identity.linked"
+	AuditFederatedSignup = "identity.signup"
+	AuditEmailVerified   = "email.verified"
+	AuditUserImported    = "user.imported"
+)
+
+// newID returns a random, URL-safe identifier with the given prefix.
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// auditArgs returns (user_id, kind, detail, created_at) ready for an INSERT.
+func auditArgs(ev AuditEvent) []any {
+	detail, err := json.Marshal(ev.Detail)
+	if err != nil || ev.Detail == nil {
+		detail = []byte("{}")
+	}
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now().UTC()
+	}
+	return []any{ev.UserID, ev.Kind, string(detail), ev.CreatedAt}
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrClientInvalid  = errors.New("unknown client or bad secret")
+	ErrClientExists   = errors.New("client already exists")
+	ErrClientNotFound = errors.New("client not found")
+	ErrCodeInvalid    = errors.New("invalid, expired or used authorization code")
+	ErrCodeReused     = errors.New("authorization code already exchanged")
+)
+
+// Client is an OAuth client (an API gateway, a partner service, a web app, ...).
+// Its secret is only ever stored as a peppered HMAC. Public clients (SPAs,
+// native apps) have no secret and must use PKCE.
+type Client struct {
+	ID           string   `json:"client_id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Public       bool     `json:"public"`
+	// Scopes a machine client may request with the client_credentials grant.
+	Scopes    []string  `json:"scopes"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AllowsScopes reports whether every scope in requested was granted to the client.
+func (c Client) AllowsScopes(requested []string) bool {
+	for _, r := range requested {
+		ok := false
+		for _, sc := range c.Scopes {
+			if sc == r {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsRedirect reports whether uri exactly matches a registered redirect URI.
+func (c Client) AllowsRedirect(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthCode is a pending authorization code grant; the code itself is only stored hashed.
+type AuthCode struct {
+	ClientID            string
+	UserID              string
+	RedirectURI         string
+	Scope               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string    // OpenID Connect nonce, echoed in the ID token
+	AuthTime            time.Time // when the user signed in on the authorize page
+	Exp                 time.Time
+	// the session the code was exchanged for, so a replay can take it back
+	SessionID string
+}
+
+// secretMatches compares a presented secret against the stored hash in constant time.
+func secretMatches(pepper []byte, secret, stored string) bool {
+	if stored == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(pepper, secret)), []byte(stored)) == 1
+}
+
+// clientSecretOK checks secret against the current hash, or against the
+// previous one while its rotation grace period lasts.
+func clientSecretOK(pepper []byte, secret, current, prev string, prevExp time.Time) bool {
+	if secretMatches(pepper, secret, current) {
+		return true
+	}
+	return time.Now().Before(prevExp) && secretMatches(pepper, secret, prev)
+}
+
+// scanClient reads the columns of sqliteSelectClient / pgSelectClient.
+func scanClient(row interface{ Scan(...any) error }) (Client, error) {
+	var c Client
+	var uris, scopes string
+	if err := row.Scan(&c.ID, &c.Name, &uris, &c.Public, &scopes, &c.Disabled, &c.CreatedAt); err != nil {
+		return Client{}, err
+	}
+	c.RedirectURIs, c.Scopes = decodeList(uris), decodeList(scopes)
+	return c, nil
+}
+
+// encodeList / decodeList store redirect URIs and scopes as a JSON array in a TEXT column.
+func encodeList(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+func decodeList(raw string) []string {
+	list := []string{}
+	_ = json.Unmarshal([]byte(raw), &list)
+	return list
+}
+
+// NewClientID returns a random id for a client registered without one.
+func NewClientID() string {
+	return newID("c_")
+}
@@ -0,0 +1,12 @@
+package store
+
+import "errors"
+
+var ErrEmailChangeInvalid = errors.New("email change token invalid or expired")
+
+// Audit event kinds for changing the account's email address
+const (
+	AuditEmailChangeRequested = "email.change_requested"
+	AuditEmailChanged         = "email.changed"
+	AuditEmailChangeReverted  = "email.change_reverted"
+)
@@ -0,0 +1,17 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrIdentityExists = errors.New("identity already linked")
+
+// Identity links a user to an account at an upstream provider (google, apple, github, ...).
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"-"`
+	UserID    string    `json:"-"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var (
+	ErrMagicInvalid = errors.New("magic login invalid or expired")
+	ErrMagicTooMany = errors.New("magic login: too many wrong codes")
+)
+
+// Audit event kinds for passwordless email login
+const (
+	AuditMagicRequested = "login.magic_requested"
+	AuditMagicLogin     = "login.magic"
+)
+
+// optionalHash is hashToken for a secret that may be absent; absent secrets
+// are stored as NULL so they never match anything.
+func optionalHash(pepper []byte, secret string) sql.NullString {
+	if secret == "" {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: hashToken(pepper, secret), Valid: true}
+}
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,9 +11,10 @@ import (
 
 // Domain model returned to API callers (no password field here)
 type User struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
-	Name  string `json:"name,omitempty"`
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	Name          string `json:"name,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
 }
 
 // Internal record keeps the hashed password
@@ -21,8 +24,10 @@ type userRecord struct {
 }
 
 type refreshRow struct {
-	UserID string
-	Exp    time.Time
+	UserID    string
+	FamilyID  string    // session id; every token minted from one login shares it
+	Exp       time.Time
+	RotatedAt time.Time // set once exchanged; presenting it again means theft
 }
 
 type Memory struct {
@@ -30,15 +35,94 @@ type Memory struct {
 	users   map[string]userRecord // id -> userRecord
 	byEmail map[string]string     // email -> id
 
-	// refresh token store (rotation): refresh -> { userID, exp }
-	refresh map[string]refreshRow
+	// refresh token store (rotation): hash(refresh) -> { userID, family, exp, rotatedAt }
+	refresh  map[string]refreshRow
+	sessions map[string]Session
+	pepper   []byte
+
+	audit       []AuditEvent
+	revocations []Revocation
+	clients     map[string]clientRecord
+	codes       map[string]codeRow // hash(code) -> grant
+	identities  map[string]Identity // provider + "\x00" + subject -> link
+	totp        map[string]totpRow  // userID -> sealed enrollment
+	webauthn    map[string]WebAuthnCredential // credential id -> passkey
+	recovery    map[string][]RecoveryCode      // userID -> unused recovery codes
+	resets      map[string]resetRow            // hash(token) -> password reset
+	magic       map[string]magicRow            // userID -> pending email login
+	emailChange map[string]emailChangeRow      // userID -> pending new address
+	throttle    map[string]Throttle            // "acct:"/"ip:" key -> failed sign-ins
+	rates       map[rateKey]rateHits           // rate limit hits per window
+	secretKey   []byte
+}
+
+type codeRow struct {
+	AuthCode
+	used bool
+}
+
+type totpRow struct {
+	sealed    []byte
+	confirmed bool
+	lastStep  int64
+	createdAt time.Time
+}
+
+type rateKey struct {
+	key   string
+	start int64 // unix
+}
+
+type rateHits struct {
+	hits int
+	exp  time.Time
 }
 
-func NewMemory() *Memory {
+type resetRow struct {
+	UserID string
+	Exp    time.Time
+}
+
+type magicRow struct {
+	linkHash      string
+	codeHash      string
+	attempts      int
+	attemptsUntil time.Time // attempts carry over to new codes until then
+	exp           time.Time
+}
+
+type emailChangeRow struct {
+	newEmail  string
+	tokenHash string
+	exp       time.Time
+}
+
+type clientRecord struct {
+	Client
+	secretHash string
+	prevHash   string // previous secret, valid until prevExp
+	prevExp    time.Time
+}
+
+func NewMemory(keys Keys) *Memory {
 	m := &Memory{
 		users:   map[string]userRecord{},
 		byEmail: map[string]string{},
-		refresh: map[string]refreshRow{},
+		refresh:  map[string]refreshRow{},
+		sessions: map[string]Session{},
+		clients:  map[string]clientRecord{},
+		codes:    map[string]codeRow{},
+		identities: map[string]Identity{},
+		totp:       map[string]totpRow{},
+		webauthn:   map[string]WebAuthnCredential{},
+		recovery:   map[string][]RecoveryCode{},
+		resets:     map[string]resetRow{},
+		magic:      map[string]magicRow{},
+		emailChange: map[string]emailChangeRow{},
+		throttle:    map[string]Throttle{},
+		rates:       map[rateKey]rateHits{},
+		pepper:   keys.TokenPepper,
+		secretKey: keys.SecretKey,
 	}
 
 	// Seed one demo user: demo@demo.com / password
@@ -69,8 +153,7 @@ func (m *Memory) CreateUser(email, name string) (User, error) {
 		return User{}, ErrEmailExists
 	}
 
-	// naive id generator for demo; replace with ULIDs/UUIDs in real DB
-	id := "u_" + time.Now().UTC().Format("20060102150405.000000000")
+	id := newID("u_")
 
 	rec := userRecord{
 		User: User{
@@ -85,8 +168,32 @@ func (m *Memory) CreateUser(email, name string) (User, error) {
 	return rec.User, nil
 }
 
-// SetPassword hashes and stores the password for a user id.
-func (m *Memory) SetPassword(userID, plain string) error {
+// ImportUser creates a user with a password hash made elsewhere (see
+// auth.SchemeOf); an empty hash leaves the account without a password.
+func (m *Memory) ImportUser(email, name, pwHash string, verified bool) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.byEmail[email]; exists {
+		return User{}, ErrEmailExists
+	}
+	id := newID("u_")
+	rec := userRecord{User: User{ID: id, Email: email, Name: name, EmailVerified: verified}, pwHash: pwHash}
+	m.users[id] = rec
+	m.byEmail[email] = id
+	return rec.User, nil
+}
+
+// SetPassword hashes the password on hashes and stores it for a user id.
+func (m *Memory) SetPassword(ctx context.Context, hashes *auth.HashScheduler, userID, plain string) error {
+	hash, err := hashes.HashPassword(ctx, plain)
+	if err != nil {
+		return err
+	}
+	return m.SetPasswordHash(userID, hash)
+}
+
+// SetPasswordHash saves a hash made by auth.HashPassword.
+func (m *Memory) SetPasswordHash(userID, hash string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -94,28 +201,43 @@ func (m *Memory) SetPassword(userID, plain string) error {
 	if !ok {
 		return ErrUserNotFound
 	}
-	hash, err := auth.HashPassword(plain)
-	if err != nil {
-		return err
-	}
 	rec.pwHash = hash
 	m.users[userID] = rec
 	return nil
 }
 
-// VerifyCreds checks email + password against the stored Argon2id hash.
-func (m *Memory) VerifyCreds(email, password string) (User, error) {
+// HasPassword reports whether the user can sign in with a password; accounts
+// made through a provider, a magic link or a passkey may never have set one.
+func (m *Memory) HasPassword(userID string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.users[userID].pwHash != ""
+}
 
+// VerifyCreds checks email + password against the stored Argon2id hash.
+// The hash runs outside the lock so it doesn't hold up the rest of the store.
+func (m *Memory) VerifyCreds(ctx context.Context, hashes *auth.HashScheduler, email, password string) (User, error) {
+	m.mu.Lock()
 	id, ok := m.byEmail[email]
-	if !ok {
+	rec := m.users[id]
+	m.mu.Unlock()
+	if !ok || rec.pwHash == "" {
 		return User{}, ErrInvalidCreds
 	}
-	rec := m.users[id]
-	if rec.pwHash == "" || !auth.VerifyPassword(password, rec.pwHash) {
+	if ok, err := hashes.VerifyPassword(ctx, password, rec.pwHash); err != nil {
+		return User{}, err
+	} else if !ok {
 		return User{}, ErrInvalidCreds
 	}
+	if h, ok := rehash(ctx, hashes, password, rec.pwHash); ok {
+		m.mu.Lock()
+		// the guard keeps a concurrent password change
+		if cur, ok := m.users[id]; ok && cur.pwHash == rec.pwHash {
+			cur.pwHash = h
+			m.users[id] = cur
+		}
+		m.mu.Unlock()
+	}
 	return rec.User, nil
 }
 
@@ -126,35 +248,743 @@ func (m *Memory) GetUser(id string) (User, bool) {
 	return rec.User, ok
 }
 
-// ---- Refresh token management (unchanged) ----
+// ---- Refresh token management ----
 
-func (m *Memory) SaveRefresh(token, userID string, exp time.Time) {
+// SaveRefresh opens a new session for userID with token as its first refresh token.
+func (m *Memory) SaveRefresh(token, userID string, exp time.Time, meta SessionMeta) (string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.refresh[token] = refreshRow{UserID: userID, Exp: exp}
+	now := time.Now().UTC()
+	sess := Session{
+		ID:         newID("s_"),
+		UserID:     userID,
+		DeviceName: meta.DeviceName,
+		IP:         meta.IP,
+		UserAgent:  meta.UserAgent,
+		ClientID:   meta.ClientID,
+		Scope:      meta.Scope,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+	m.sessions[sess.ID] = sess
+	m.refresh[hashToken(m.pepper, token)] = refreshRow{UserID: userID, FamilyID: sess.ID, Exp: exp}
+	return sess.ID, nil
 }
 
-func (m *Memory) RotateRefresh(old string, newToken string, userID string, exp time.Time) error {
+// RotateRefresh exchanges old for newToken within the same session and touches it.
+// If old was already rotated the session is revoked and ErrRefreshReused is returned.
+func (m *Memory) RotateRefresh(old string, newToken string, exp time.Time, meta SessionMeta) (RefreshToken, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	row, ok := m.refresh[old]
-	if !ok || row.UserID != userID || time.Now().After(row.Exp) {
-		return ErrRefreshInvalid
+	oldHash := hashToken(m.pepper, old)
+	row, ok := m.refresh[oldHash]
+	if !ok || time.Now().After(row.Exp) {
+		return RefreshToken{}, ErrRefreshInvalid
 	}
-	delete(m.refresh, old)
-	m.refresh[newToken] = refreshRow{UserID: userID, Exp: exp}
-	return nil
+	if !row.RotatedAt.IsZero() {
+		m.dropSessionLocked(row.FamilyID)
+		m.audit = append(m.audit, AuditEvent{
+			UserID:    row.UserID,
+			Kind:      AuditRefreshReuse,
+			Detail:    map[string]any{"family_id": row.FamilyID},
+			CreatedAt: time.Now().UTC(),
+		})
+		return RefreshToken{UserID: row.UserID, SessionID: row.FamilyID}, ErrRefreshReused
+	}
+	row.RotatedAt = time.Now()
+	m.refresh[oldHash] = row
+	m.refresh[hashToken(m.pepper, newToken)] = refreshRow{UserID: row.UserID, FamilyID: row.FamilyID, Exp: exp}
+	sess, ok := m.sessions[row.FamilyID]
+	if ok {
+		sess.LastUsedAt = time.Now().UTC()
+		sess.IP, sess.UserAgent = meta.IP, meta.UserAgent
+		if meta.DeviceName != "" {
+			sess.DeviceName = meta.DeviceName
+		}
+		m.sessions[sess.ID] = sess
+	}
+	return RefreshToken{UserID: row.UserID, SessionID: row.FamilyID, ClientID: sess.ClientID, Scope: sess.Scope, Exp: exp}, nil
 }
 
-func (m *Memory) LookupRefresh(token string) (string, time.Time, bool) {
+// LookupRefresh only reports live tokens; rotated ones are kept solely for reuse detection.
+func (m *Memory) LookupRefresh(token string) (RefreshToken, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	row, ok := m.refresh[token]
-	return row.UserID, row.Exp, ok
+	row, ok := m.refresh[hashToken(m.pepper, token)]
+	if !ok || !row.RotatedAt.IsZero() {
+		return RefreshToken{}, false
+	}
+	sess := m.sessions[row.FamilyID]
+	return RefreshToken{UserID: row.UserID, SessionID: row.FamilyID, ClientID: sess.ClientID, Scope: sess.Scope, Exp: row.Exp}, true
 }
 
+// DeleteRefresh ends the session the token belongs to (logout).
 func (m *Memory) DeleteRefresh(token string) error {
     m.mu.Lock(); defer m.mu.Unlock()
-    delete(m.refresh, token)
+    if row, ok := m.refresh[hashToken(m.pepper, token)]; ok {
+        m.dropSessionLocked(row.FamilyID)
+    }
     return nil
 }
+
+// ---- Sessions ----
+
+func (m *Memory) ListSessions(userID string) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Session{}
+	for _, sess := range m.sessions {
+		if sess.UserID == userID {
+			out = append(out, sess)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].LastUsedAt.After(out[b].LastUsedAt) })
+	return out, nil
+}
+
+func (m *Memory) RevokeSession(userID, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok || sess.UserID != userID {
+		return ErrSessionNotFound
+	}
+	m.dropSessionLocked(sessionID)
+	return nil
+}
+
+// RevokeOtherSessions ends every session of userID except keepID and returns the revoked ids.
+func (m *Memory) RevokeOtherSessions(userID, keepID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revoked := []string{}
+	for id, sess := range m.sessions {
+		if sess.UserID == userID && id != keepID {
+			m.dropSessionLocked(id)
+			revoked = append(revoked, id)
+		}
+	}
+	return revoked, nil
+}
+
+// ---- Access token revocation ----
+
+func (m *Memory) RevokeAccess(kind, value string, exp time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revocations = append(m.revocations, Revocation{Kind: kind, Value: value, Exp: exp, CreatedAt: time.Now().UTC()})
+	return nil
+}
+
+// RevokeOnce records a revocation unless one already exists, so exactly one
+// caller gets to spend a single-use token.
+func (m *Memory) RevokeOnce(kind, value string, exp time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rv := range m.revocations {
+		if rv.Kind == kind && rv.Value == value {
+			return ErrAlreadyRevoked
+		}
+	}
+	m.revocations = append(m.revocations, Revocation{Kind: kind, Value: value, Exp: exp, CreatedAt: time.Now().UTC()})
+	return nil
+}
+
+// ListRevocations returns unexpired revocations recorded after since.
+func (m *Memory) ListRevocations(since time.Time) ([]Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	out := []Revocation{}
+	live := m.revocations[:0]
+	for _, rv := range m.revocations {
+		if now.After(rv.Exp) {
+			continue
+		}
+		live = append(live, rv)
+		if rv.CreatedAt.After(since) {
+			out = append(out, rv)
+		}
+	}
+	m.revocations = live
+	return out, nil
+}
+
+// ---- Federated identities ----
+
+func (m *Memory) GetUserByEmail(email string) (User, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.byEmail[email]
+	if !ok {
+		return User{}, false
+	}
+	return m.users[id].User, true
+}
+
+func (m *Memory) SetEmailVerified(userID string, verified bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	rec.EmailVerified = verified
+	m.users[userID] = rec
+	return nil
+}
+
+// ChangeEmail moves a user to a new, confirmed address.
+func (m *Memory) ChangeEmail(userID, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if owner, taken := m.byEmail[email]; taken && owner != userID {
+		return ErrEmailExists
+	}
+	delete(m.byEmail, rec.Email)
+	rec.Email = email
+	rec.EmailVerified = true
+	m.users[userID] = rec
+	m.byEmail[email] = userID
+	return nil
+}
+
+// FindIdentity returns the user linked to subject at provider.
+func (m *Memory) FindIdentity(provider, subject string) (User, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link, ok := m.identities[provider+"\x00"+subject]
+	if !ok {
+		return User{}, false
+	}
+	rec, ok := m.users[link.UserID]
+	return rec.User, ok
+}
+
+// LinkIdentity links subject at provider to userID; ErrIdentityExists if it is linked already.
+func (m *Memory) LinkIdentity(ident Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := ident.Provider + "\x00" + ident.Subject
+	if _, ok := m.identities[k]; ok {
+		return ErrIdentityExists
+	}
+	ident.CreatedAt = time.Now().UTC()
+	m.identities[k] = ident
+	return nil
+}
+
+// ---- TOTP ----
+
+// SaveTOTP starts a (new) unconfirmed enrollment for userID.
+func (m *Memory) SaveTOTP(userID string, secret []byte) error {
+	sealed, err := seal(m.secretKey, secret, totpAAD(userID))
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totp[userID] = totpRow{sealed: sealed, createdAt: time.Now().UTC()}
+	return nil
+}
+
+func (m *Memory) GetTOTP(userID string) (TOTP, error) {
+	m.mu.Lock()
+	row, ok := m.totp[userID]
+	m.mu.Unlock()
+	if !ok {
+		return TOTP{}, ErrTOTPNotFound
+	}
+	secret, err := open(m.secretKey, row.sealed, totpAAD(userID))
+	if err != nil {
+		return TOTP{}, err
+	}
+	return TOTP{Secret: secret, Confirmed: row.confirmed, LastStep: row.lastStep, CreatedAt: row.createdAt}, nil
+}
+
+// UseTOTPStep records step as used, and confirms the enrollment if confirm is set.
+// It fails with ErrTOTPReplay unless step is newer than the last accepted one.
+func (m *Memory) UseTOTPStep(userID string, step int64, confirm bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row, ok := m.totp[userID]
+	if !ok {
+		return ErrTOTPNotFound
+	}
+	if step <= row.lastStep {
+		return ErrTOTPReplay
+	}
+	row.lastStep = step
+	row.confirmed = row.confirmed || confirm
+	m.totp[userID] = row
+	return nil
+}
+
+func (m *Memory) DeleteTOTP(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.totp, userID)
+	return nil
+}
+
+// ---- Recovery codes ----
+
+// ReplaceRecoveryCodes discards a user's recovery codes and stores new ones.
+func (m *Memory) ReplaceRecoveryCodes(userID string, codes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := make([]RecoveryCode, 0, len(codes))
+	for _, c := range codes {
+		rows = append(rows, RecoveryCode{ID: newID("rc_"), Hash: hashToken(m.pepper, c)})
+	}
+	m.recovery[userID] = rows
+	return nil
+}
+
+func (m *Memory) UnusedRecoveryCodes(userID string) ([]RecoveryCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RecoveryCode(nil), m.recovery[userID]...), nil
+}
+
+// ConsumeRecoveryCode spends the unused code equal to code; ErrRecoveryCodeUsed
+// if there is none.
+func (m *Memory) ConsumeRecoveryCode(userID, code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := hashToken(m.pepper, code)
+	codes := m.recovery[userID]
+	for i, c := range codes {
+		if c.Hash == h {
+			m.recovery[userID] = append(codes[:i:i], codes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRecoveryCodeUsed
+}
+
+// ---- OAuth clients ----
+
+// UpsertClient registers a client or replaces its settings and secret.
+// A disabled client stays disabled.
+func (m *Memory) UpsertClient(c Client, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.clients[c.ID]; ok {
+		c.CreatedAt = old.CreatedAt
+		c.Disabled = old.Disabled
+	} else {
+		c.CreatedAt = time.Now().UTC()
+	}
+	rec := clientRecord{Client: c}
+	if secret != "" {
+		rec.secretHash = hashToken(m.pepper, secret)
+	}
+	m.clients[c.ID] = rec
+	return nil
+}
+
+// CreateClient registers a new client; it fails with ErrClientExists if the id is taken.
+func (m *Memory) CreateClient(c Client, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[c.ID]; ok {
+		return ErrClientExists
+	}
+	c.CreatedAt = time.Now().UTC()
+	rec := clientRecord{Client: c}
+	if secret != "" {
+		rec.secretHash = hashToken(m.pepper, secret)
+	}
+	m.clients[c.ID] = rec
+	return nil
+}
+
+func (m *Memory) ListClients() ([]Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Client, 0, len(m.clients))
+	for _, rec := range m.clients {
+		out = append(out, rec.Client)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// RotateClientSecret replaces the secret; the old one keeps working until graceUntil.
+func (m *Memory) RotateClientSecret(id, secret string, graceUntil time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.clients[id]
+	if !ok {
+		return ErrClientNotFound
+	}
+	rec.prevHash, rec.prevExp = rec.secretHash, graceUntil
+	rec.secretHash = hashToken(m.pepper, secret)
+	m.clients[id] = rec
+	return nil
+}
+
+func (m *Memory) SetClientDisabled(id string, disabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.clients[id]
+	if !ok {
+		return ErrClientNotFound
+	}
+	rec.Disabled = disabled
+	m.clients[id] = rec
+	return nil
+}
+
+func (m *Memory) GetClient(id string) (Client, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.clients[id]
+	return rec.Client, ok
+}
+
+func (m *Memory) SaveAuthCode(code string, ac AuthCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for h, row := range m.codes {
+		if now.After(row.Exp) {
+			delete(m.codes, h)
+		}
+	}
+	m.codes[hashToken(m.pepper, code)] = codeRow{AuthCode: ac}
+	return nil
+}
+
+// ConsumeAuthCode spends code if it was issued to clientID for redirectURI; a
+// mismatch leaves it unspent. Spent codes are kept until they expire so that a
+// second exchange returns ErrCodeReused with the session the first one opened.
+func (m *Memory) ConsumeAuthCode(code, clientID, redirectURI string) (AuthCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := hashToken(m.pepper, code)
+	row, ok := m.codes[h]
+	if !ok || time.Now().After(row.Exp) || row.ClientID != clientID || row.RedirectURI != redirectURI {
+		return AuthCode{}, ErrCodeInvalid
+	}
+	if row.used {
+		return row.AuthCode, ErrCodeReused
+	}
+	row.used = true
+	m.codes[h] = row
+	return row.AuthCode, nil
+}
+
+// SetAuthCodeSession records the session a code was exchanged for.
+func (m *Memory) SetAuthCodeSession(code, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := hashToken(m.pepper, code)
+	if row, ok := m.codes[h]; ok {
+		row.SessionID = sessionID
+		m.codes[h] = row
+	}
+	return nil
+}
+
+// ---- Password resets ----
+
+func (m *Memory) SavePasswordReset(token, userID string, exp time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resets[hashToken(m.pepper, token)] = resetRow{UserID: userID, Exp: exp}
+	return nil
+}
+
+// PasswordResetUser returns the user a live reset token was issued to,
+// without using it up.
+func (m *Memory) PasswordResetUser(token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row, ok := m.resets[hashToken(m.pepper, token)]
+	if !ok || time.Now().After(row.Exp) {
+		return "", ErrResetInvalid
+	}
+	return row.UserID, nil
+}
+
+// ConsumePasswordReset returns the user a reset token was issued to. Using a
+// token voids every other outstanding reset token of that user.
+func (m *Memory) ConsumePasswordReset(token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := hashToken(m.pepper, token)
+	row, ok := m.resets[h]
+	if !ok || time.Now().After(row.Exp) {
+		delete(m.resets, h)
+		return "", ErrResetInvalid
+	}
+	for k, r := range m.resets {
+		if r.UserID == row.UserID {
+			delete(m.resets, k)
+		}
+	}
+	return row.UserID, nil
+}
+
+// ---- Magic links / email codes ----
+
+// SaveMagicLogin stores a pending email login for a user, replacing any
+// earlier one. link or code may be empty when only the other was sent.
+// Wrong codes entered against the earlier login still count until its
+// attempt window closes, so asking for a new code doesn't buy more guesses.
+func (m *Memory) SaveMagicLogin(userID, link, code string, exp time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row := magicRow{attemptsUntil: exp, exp: exp}
+	if prev, ok := m.magic[userID]; ok && time.Now().Before(prev.attemptsUntil) {
+		row.attempts, row.attemptsUntil = prev.attempts, prev.attemptsUntil
+	}
+	if link != "" {
+		row.linkHash = hashToken(m.pepper, link)
+	}
+	if code != "" {
+		row.codeHash = hashToken(m.pepper, code)
+	}
+	m.magic[userID] = row
+	return nil
+}
+
+// ConsumeMagicLink spends a magic link and returns the user it was sent to.
+func (m *Memory) ConsumeMagicLink(link string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := hashToken(m.pepper, link)
+	for userID, row := range m.magic {
+		if row.linkHash != "" && row.linkHash == h {
+			delete(m.magic, userID)
+			if time.Now().After(row.exp) {
+				return "", ErrMagicInvalid
+			}
+			return userID, nil
+		}
+	}
+	return "", ErrMagicInvalid
+}
+
+// ConsumeMagicCode checks an emailed code. A wrong code counts against the
+// pending login's attempt window; after maxTries in it the code is dropped
+// and codes sent before the window closes are refused too.
+func (m *Memory) ConsumeMagicCode(userID, code string, maxTries int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	row, ok := m.magic[userID]
+	if !ok || now.After(row.exp) {
+		delete(m.magic, userID)
+		return ErrMagicInvalid
+	}
+	if !now.Before(row.attemptsUntil) {
+		row.attempts, row.attemptsUntil = 0, row.exp
+	}
+	switch {
+	case row.attempts >= maxTries:
+		return ErrMagicTooMany
+	case row.codeHash == "":
+		return ErrMagicInvalid
+	case row.codeHash == hashToken(m.pepper, code):
+		delete(m.magic, userID)
+		return nil
+	}
+	row.attempts++
+	err := ErrMagicInvalid
+	if row.attempts >= maxTries {
+		row.codeHash, err = "", ErrMagicTooMany
+	}
+	m.magic[userID] = row
+	return err
+}
+
+// ---- Email changes ----
+
+// SaveEmailChange records a pending move to email, replacing any earlier one.
+// token is what the confirmation link sent to the new address carries.
+func (m *Memory) SaveEmailChange(userID, email, token string, exp time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emailChange[userID] = emailChangeRow{newEmail: email, tokenHash: hashToken(m.pepper, token), exp: exp}
+	return nil
+}
+
+// ConsumeEmailChange spends a confirmation token and returns the user and
+// the address it confirms.
+func (m *Memory) ConsumeEmailChange(token string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := hashToken(m.pepper, token)
+	for userID, row := range m.emailChange {
+		if row.tokenHash == h {
+			delete(m.emailChange, userID)
+			if time.Now().After(row.exp) {
+				return "", "", ErrEmailChangeInvalid
+			}
+			return userID, row.newEmail, nil
+		}
+	}
+	return "", "", ErrEmailChangeInvalid
+}
+
+// ---- Sign-in throttling ----
+
+// LoginThrottle returns the failed sign-in record of key; zero when clean.
+func (m *Memory) LoginThrottle(key string) (Throttle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.throttle[key], nil
+}
+
+// AddLoginFailure counts a failed sign-in against key and returns the new
+// count. Failures from before resetBefore are forgotten first.
+func (m *Memory) AddLoginFailure(key string, resetBefore time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.throttle[key]
+	if t.LastFailure.Before(resetBefore) {
+		t.Failures = 0
+	}
+	t.Failures++
+	t.LastFailure = time.Now()
+	m.throttle[key] = t
+	return t.Failures, nil
+}
+
+// LockLogin refuses sign-ins for key until the given time.
+func (m *Memory) LockLogin(key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.throttle[key]
+	t.LockedUntil = until
+	m.throttle[key] = t
+	return nil
+}
+
+// ClearLoginFailures forgets the failures of key and lifts any lock.
+func (m *Memory) ClearLoginFailures(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.throttle, key)
+	return nil
+}
+
+// IncrRateCounter adds a hit to key's rate limit window starting at start
+// and returns the hits in it and in the window before (see package ratelimit).
+func (m *Memory) IncrRateCounter(key string, start time.Time, window time.Duration) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if sweepRateCounters() {
+		for k, v := range m.rates {
+			if v.exp.Before(now) {
+				delete(m.rates, k)
+			}
+		}
+	}
+	k := rateKey{key, start.Unix()}
+	curr := m.rates[k]
+	curr.hits++
+	curr.exp = start.Add(2 * window)
+	m.rates[k] = curr
+	return curr.hits, m.rates[rateKey{key, start.Add(-window).Unix()}].hits, nil
+}
+
+// AuthenticateClient checks client credentials.
+func (m *Memory) AuthenticateClient(id, secret string) (Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.clients[id]
+	if !ok || rec.Disabled || !clientSecretOK(m.pepper, secret, rec.secretHash, rec.prevHash, rec.prevExp) {
+		return Client{}, ErrClientInvalid
+	}
+	return rec.Client, nil
+}
+
+// dropSessionLocked removes a session and all of its refresh tokens; m.mu must be held.
+func (m *Memory) dropSessionLocked(sessionID string) {
+	delete(m.sessions, sessionID)
+	for t, r := range m.refresh {
+		if r.FamilyID == sessionID {
+			delete(m.refresh, t)
+		}
+	}
+}
+
+func (m *Memory) RecordAudit(ev AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now().UTC()
+	}
+	m.audit = append(m.audit, ev)
+	return nil
+}
+
+// ---- WebAuthn credentials ----
+
+func (m *Memory) AddWebAuthnCredential(c WebAuthnCredential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webauthn[c.ID]; ok {
+		return ErrCredentialExists
+	}
+	c.CreatedAt = time.Now().UTC()
+	c.LastUsedAt = c.CreatedAt
+	m.webauthn[c.ID] = c
+	return nil
+}
+
+func (m *Memory) ListWebAuthnCredentials(userID string) ([]WebAuthnCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []WebAuthnCredential
+	for _, c := range m.webauthn {
+		if c.UserID == userID {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *Memory) GetWebAuthnCredential(id string) (WebAuthnCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.webauthn[id]
+	if !ok {
+		return WebAuthnCredential{}, ErrCredentialNotFound
+	}
+	return c, nil
+}
+
+// UseWebAuthnCredential stores the sign count of a successful assertion.
+func (m *Memory) UseWebAuthnCredential(id string, signCount uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.webauthn[id]
+	if !ok {
+		return ErrCredentialNotFound
+	}
+	c.SignCount = signCount
+	c.LastUsedAt = time.Now().UTC()
+	m.webauthn[id] = c
+	return nil
+}
+
+func (m *Memory) DeleteWebAuthnCredential(userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.webauthn[id]; !ok || c.UserID != userID {
+		return ErrCredentialNotFound
+	}
+	delete(m.webauthn, id)
+	return nil
+}
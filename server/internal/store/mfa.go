@@ -0,0 +1,47 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrTOTPNotFound = errors.New("no TOTP enrollment")
+	ErrTOTPReplay   = errors.New("TOTP code already used")
+)
+
+// TOTP is a user's authenticator app enrollment. Secret is decrypted on read;
+// the stores only ever persist it sealed with Keys.SecretKey.
+type TOTP struct {
+	Secret    []byte
+	Confirmed bool
+	LastStep  int64 // last accepted time step; codes for it or earlier are replays
+	CreatedAt time.Time
+}
+
+// Audit event kinds for multi-factor auth
+const (
+	AuditMFAEnabled  = "mfa.totp_enabled"
+	AuditMFADisabled = "mfa.totp_disabled"
+)
+
+// totpAAD binds a sealed TOTP secret to its user.
+func totpAAD(userID string) string { return "totp:" + userID }
+
+var ErrRecoveryCodeUsed = errors.New("recovery code already used")
+
+// RecoveryCode is an unused MFA recovery code. Only its peppered HMAC (see
+// hashToken) is stored. That is deliberate and the only scheme: a code has 50
+// random bits, so a password hash would add nothing against guessing, while
+// an HMAC is found with one indexed lookup and never waits on the hash
+// scheduler at sign-in.
+type RecoveryCode struct {
+	ID   string
+	Hash string
+}
+
+// Audit event kinds for recovery codes
+const (
+	AuditRecoveryCodeUsed    = "mfa.recovery_code_used"
+	AuditRecoveryCodesIssued = "mfa.recovery_codes_issued"
+)
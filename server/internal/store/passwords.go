@@ -0,0 +1,18 @@
+package store
+
+import (
+	"context"
+
+	"mahi/server/internal/auth"
+)
+
+// rehash returns a new hash, made on hashes, for a password that just
+// verified against stored, when stored is weaker than what auth.HashPassword
+// makes today.
+func rehash(ctx context.Context, hashes *auth.HashScheduler, plain, stored string) (string, bool) {
+	if !auth.NeedsRehash(stored) {
+		return "", false
+	}
+	h, err := hashes.HashPassword(ctx, plain)
+	return h, err == nil
+}
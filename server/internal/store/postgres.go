@@ -12,10 +12,12 @@ import (
 )
 
 type Postgres struct {
-    db *sql.DB
+    db        *sql.DB
+    pepper    []byte
+    secretKey []byte
 }
 
-func NewPostgres(dsn string) (*Postgres, error) {
+func NewPostgres(dsn string, keys Keys) (*Postgres, error) {
     db, err := sql.Open("pgx", dsn)
     if err != nil {
         return nil, err
@@ -25,7 +27,7 @@ func NewPostgres(dsn string) (*Postgres, error) {
     db.SetMaxIdleConns(5)
     db.SetConnMaxLifetime(30 * time.Minute)
 
-    p := &Postgres{db: db}
+    p := &Postgres{db: db, pepper: keys.TokenPepper, secretKey: keys.SecretKey}
     if err := p.migrate(); err != nil {
         return nil, err
     }
@@ -43,23 +45,192 @@ CREATE TABLE IF NOT EXISTS users (
   updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 CREATE TABLE IF NOT EXISTS refresh_tokens (
-  token TEXT PRIMARY KEY,
+  token_hash TEXT PRIMARY KEY,
   user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
   exp_unix BIGINT NOT NULL,
   created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
+CREATE TABLE IF NOT EXISTS audit_events (
+  id BIGSERIAL PRIMARY KEY,
+  user_id TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  detail JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS family_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS rotated_at TIMESTAMPTZ;
+UPDATE refresh_tokens SET family_id = 'f_' || substr(md5(random()::text || clock_timestamp()::text), 1, 24) WHERE family_id = '';
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
 CREATE INDEX IF NOT EXISTS idx_refresh_user ON refresh_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_family ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_audit_user ON audit_events(user_id);
+CREATE TABLE IF NOT EXISTS sessions (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  device_name TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+CREATE TABLE IF NOT EXISTS revocations (
+  kind TEXT NOT NULL,
+  value TEXT NOT NULL,
+  exp_unix BIGINT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (kind, value)
+);
+CREATE TABLE IF NOT EXISTS oauth_clients (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL DEFAULT '',
+  secret_hash TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS redirect_uris TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS public BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS client_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS mfa_totp (
+  user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  secret_enc BYTEA NOT NULL,
+  confirmed BOOLEAN NOT NULL DEFAULT false,
+  last_step BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS password_resets (
+  token_hash TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  exp_unix BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS magic_logins (
+  user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  link_hash TEXT UNIQUE,
+  code_hash TEXT,
+  attempts INT NOT NULL DEFAULT 0,
+  exp_unix BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS email_changes (
+  user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  new_email TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  exp_unix BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS login_throttle (
+  key TEXT PRIMARY KEY,
+  failures INT NOT NULL DEFAULT 0,
+  last_failure_unix BIGINT NOT NULL DEFAULT 0,
+  locked_until_unix BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+  key TEXT NOT NULL,
+  window_start BIGINT NOT NULL,
+  hits INT NOT NULL,
+  expires_unix BIGINT NOT NULL,
+  PRIMARY KEY (key, window_start)
+);
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_user ON mfa_recovery_codes(user_id);
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name TEXT NOT NULL DEFAULT '',
+  public_key BYTEA NOT NULL,
+  sign_count BIGINT NOT NULL DEFAULT 0,
+  transports TEXT NOT NULL DEFAULT '[]',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_webauthn_user ON webauthn_credentials(user_id);
+CREATE TABLE IF NOT EXISTS identities (
+  provider TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  email TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (provider, subject)
+);
+CREATE TABLE IF NOT EXISTS oauth_codes (
+  code_hash TEXT PRIMARY KEY,
+  client_id TEXT NOT NULL,
+  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  redirect_uri TEXT NOT NULL,
+  scope TEXT NOT NULL DEFAULT '',
+  code_challenge TEXT NOT NULL,
+  code_challenge_method TEXT NOT NULL,
+  exp_unix BIGINT NOT NULL
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS nonce TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS auth_time_unix BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS scopes TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS prev_secret_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS prev_secret_exp_unix BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE magic_logins ADD COLUMN IF NOT EXISTS attempts_until_unix BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS used BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS session_id TEXT NOT NULL DEFAULT '';
+UPDATE users SET pw_hash = '' WHERE pw_hash = 'placeholder';
+INSERT INTO sessions (id, user_id, created_at, last_used_at)
+  SELECT family_id, user_id, MIN(created_at), MAX(created_at) FROM refresh_tokens
+  WHERE family_id NOT IN (SELECT id FROM sessions) GROUP BY family_id, user_id;
 `)
-    return err
+    if err != nil {
+        return err
+    }
+    return p.hashPlaintextRefresh()
+}
+
+// hashPlaintextRefresh upgrades databases that stored raw refresh tokens in a
+// "token" column: the column is renamed to token_hash and every value replaced
+// by its HMAC so existing sessions keep working.
+func (p *Postgres) hashPlaintextRefresh() error {
+    var n int
+    err := p.db.QueryRow(`SELECT COUNT(*) FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'refresh_tokens' AND column_name = 'token'`).Scan(&n)
+    if err != nil || n == 0 {
+        return err
+    }
+    ctx := context.Background()
+    tx, err := p.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer func() { _ = tx.Rollback() }()
+
+    rows, err := tx.QueryContext(ctx, `SELECT token FROM refresh_tokens`)
+    if err != nil { return err }
+    var plain []string
+    for rows.Next() {
+        var t string
+        if err := rows.Scan(&t); err != nil {
+            _ = rows.Close()
+            return err
+        }
+        plain = append(plain, t)
+    }
+    _ = rows.Close()
+    if _, err := tx.ExecContext(ctx, `ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash`); err != nil {
+        return err
+    }
+    for _, t := range plain {
+        if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET token_hash=$1 WHERE token_hash=$2`, hashToken(p.pepper, t), t); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
 }
 
 func (p *Postgres) CreateUser(email, name string) (User, error) {
-    id := "u_" + time.Now().UTC().Format("20060102150405.000000000")
-    // insert with placeholder pw so row exists; SetPassword updates it
+    id := newID("u_")
+    // an empty pw_hash means no password (see HasPassword); SetPassword adds one
     _, err := p.db.Exec(`
-        INSERT INTO users (id,email,name,pw_hash) VALUES ($1,$2,$3,$4)
-    `, id, email, name, "placeholder")
+        INSERT INTO users (id,email,name,pw_hash) VALUES ($1,$2,$3,'')
+    `, id, email, name)
     if err != nil {
         if isPGUnique(err) {
             return User{}, ErrEmailExists
@@ -69,11 +240,31 @@ func (p *Postgres) CreateUser(email, name string) (User, error) {
     return User{ID: id, Email: email, Name: name}, nil
 }
 
-func (p *Postgres) SetPassword(userID, plain string) error {
-    hash, err := auth.HashPassword(plain)
+// ImportUser creates a user with a password hash made elsewhere (see
+// auth.SchemeOf); an empty hash leaves the account without a password.
+func (p *Postgres) ImportUser(email, name, pwHash string, verified bool) (User, error) {
+    id := newID("u_")
+    _, err := p.db.Exec(`INSERT INTO users (id,email,name,pw_hash,email_verified) VALUES ($1,$2,$3,$4,$5)`,
+        id, email, name, pwHash, verified)
+    if err != nil {
+        if isPGUnique(err) {
+            return User{}, ErrEmailExists
+        }
+        return User{}, err
+    }
+    return User{ID: id, Email: email, Name: name, EmailVerified: verified}, nil
+}
+
+func (p *Postgres) SetPassword(ctx context.Context, hashes *auth.HashScheduler, userID, plain string) error {
+    hash, err := hashes.HashPassword(ctx, plain)
     if err != nil {
         return err
     }
+    return p.SetPasswordHash(userID, hash)
+}
+
+// SetPasswordHash saves a hash made by auth.HashPassword.
+func (p *Postgres) SetPasswordHash(userID, hash string) error {
     res, err := p.db.Exec(`UPDATE users SET pw_hash=$1, updated_at=now() WHERE id=$2`, hash, userID)
     if err != nil {
         return err
@@ -85,75 +276,800 @@ func (p *Postgres) SetPassword(userID, plain string) error {
     return nil
 }
 
-func (p *Postgres) VerifyCreds(email, password string) (User, error) {
+// HasPassword reports whether the user can sign in with a password; accounts
+// made through a provider, a magic link or a passkey may never have set one.
+func (p *Postgres) HasPassword(userID string) bool {
+    var has bool
+    err := p.db.QueryRow(`SELECT pw_hash <> '' FROM users WHERE id=$1`, userID).Scan(&has)
+    return err == nil && has
+}
+
+func (p *Postgres) VerifyCreds(ctx context.Context, hashes *auth.HashScheduler, email, password string) (User, error) {
     var id, name, pwHash string
-    err := p.db.QueryRow(`SELECT id, COALESCE(name,''), pw_hash FROM users WHERE email=$1`, email).
-        Scan(&id, &name, &pwHash)
+    var verified bool
+    err := p.db.QueryRow(`SELECT id, COALESCE(name,''), pw_hash, email_verified FROM users WHERE email=$1`, email).
+        Scan(&id, &name, &pwHash, &verified)
     if errors.Is(err, sql.ErrNoRows) {
         return User{}, ErrInvalidCreds
     }
     if err != nil {
         return User{}, err
     }
-    if !auth.VerifyPassword(password, pwHash) {
+    if ok, err := hashes.VerifyPassword(ctx, password, pwHash); err != nil {
+        return User{}, err
+    } else if !ok {
         return User{}, ErrInvalidCreds
     }
-    return User{ID: id, Email: email, Name: name}, nil
+    if h, ok := rehash(ctx, hashes, password, pwHash); ok {
+        // best effort; the guard keeps a concurrent password change
+        _, _ = p.db.Exec(`UPDATE users SET pw_hash=$1, updated_at=now() WHERE id=$2 AND pw_hash=$3`, h, id, pwHash)
+    }
+    return User{ID: id, Email: email, Name: name, EmailVerified: verified}, nil
 }
 
 func (p *Postgres) GetUser(id string) (User, bool) {
-    var email, name string
-    err := p.db.QueryRow(`SELECT email, COALESCE(name,'') FROM users WHERE id=$1`, id).
-        Scan(&email, &name)
+    u := User{ID: id}
+    err := p.db.QueryRow(`SELECT email, COALESCE(name,''), email_verified FROM users WHERE id=$1`, id).
+        Scan(&u.Email, &u.Name, &u.EmailVerified)
     if errors.Is(err, sql.ErrNoRows) || err != nil {
         return User{}, false
     }
-    return User{ID: id, Email: email, Name: name}, true
+    return u, true
 }
 
-func (p *Postgres) SaveRefresh(token, userID string, exp time.Time) {
-    _, _ = p.db.Exec(`INSERT INTO refresh_tokens (token,user_id,exp_unix) VALUES ($1,$2,$3)
-                      ON CONFLICT (token) DO UPDATE SET user_id=EXCLUDED.user_id, exp_unix=EXCLUDED.exp_unix`,
-        token, userID, exp.Unix())
+func (p *Postgres) GetUserByEmail(email string) (User, bool) {
+    u := User{Email: email}
+    err := p.db.QueryRow(`SELECT id, COALESCE(name,''), email_verified FROM users WHERE email=$1`, email).
+        Scan(&u.ID, &u.Name, &u.EmailVerified)
+    if err != nil {
+        return User{}, false
+    }
+    return u, true
 }
 
-func (p *Postgres) RotateRefresh(old, newToken, userID string, exp time.Time) error {
-    ctx := context.Background()
-    tx, err := p.db.BeginTx(ctx, nil)
-    if err != nil { return err }
-    defer func() { _ = tx.Rollback() }()
+func (p *Postgres) SetEmailVerified(userID string, verified bool) error {
+    res, err := p.db.Exec(`UPDATE users SET email_verified=$1, updated_at=now() WHERE id=$2`, verified, userID)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrUserNotFound
+    }
+    return nil
+}
 
-    var uid string
+// ChangeEmail moves a user to a new, confirmed address. The UNIQUE
+// constraint on users.email settles two accounts racing for one address.
+func (p *Postgres) ChangeEmail(userID, email string) error {
+    res, err := p.db.Exec(`UPDATE users SET email=$1, email_verified=true, updated_at=now() WHERE id=$2`, email, userID)
+    if err != nil {
+        if isPGUnique(err) {
+            return ErrEmailExists
+        }
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrUserNotFound
+    }
+    return nil
+}
+
+// SaveEmailChange records a pending move to email, replacing any earlier one.
+// token is what the confirmation link sent to the new address carries.
+func (p *Postgres) SaveEmailChange(userID, email, token string, exp time.Time) error {
+    _, err := p.db.Exec(`INSERT INTO email_changes (user_id,new_email,token_hash,exp_unix) VALUES ($1,$2,$3,$4)
+        ON CONFLICT (user_id) DO UPDATE SET new_email=EXCLUDED.new_email, token_hash=EXCLUDED.token_hash,
+        exp_unix=EXCLUDED.exp_unix`,
+        userID, email, hashToken(p.pepper, token), exp.Unix())
+    return err
+}
+
+// ConsumeEmailChange spends a confirmation token and returns the user and
+// the address it confirms.
+func (p *Postgres) ConsumeEmailChange(token string) (string, string, error) {
+    var userID, email string
     var expUnix int64
-    err = tx.QueryRowContext(ctx, `SELECT user_id, exp_unix FROM refresh_tokens WHERE token=$1`, old).
-        Scan(&uid, &expUnix)
-    if errors.Is(err, sql.ErrNoRows) { return ErrRefreshInvalid }
-    if err != nil { return err }
-    if uid != userID || time.Now().Unix() > expUnix { return ErrRefreshInvalid }
+    err := p.db.QueryRow(`DELETE FROM email_changes WHERE token_hash=$1 RETURNING user_id, new_email, exp_unix`,
+        hashToken(p.pepper, token)).Scan(&userID, &email, &expUnix)
+    if err != nil || time.Now().Unix() > expUnix {
+        return "", "", ErrEmailChangeInvalid
+    }
+    return userID, email, nil
+}
+
+// SaveTOTP starts a (new) unconfirmed enrollment for userID.
+func (p *Postgres) SaveTOTP(userID string, secret []byte) error {
+    sealed, err := seal(p.secretKey, secret, totpAAD(userID))
+    if err != nil {
+        return err
+    }
+    _, err = p.db.Exec(`INSERT INTO mfa_totp (user_id,secret_enc) VALUES ($1,$2)
+        ON CONFLICT (user_id) DO UPDATE SET secret_enc=EXCLUDED.secret_enc, confirmed=false, last_step=0, created_at=now()`,
+        userID, sealed)
+    return err
+}
+
+func (p *Postgres) GetTOTP(userID string) (TOTP, error) {
+    var t TOTP
+    var sealed []byte
+    err := p.db.QueryRow(`SELECT secret_enc, confirmed, last_step, created_at FROM mfa_totp WHERE user_id=$1`, userID).
+        Scan(&sealed, &t.Confirmed, &t.LastStep, &t.CreatedAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return TOTP{}, ErrTOTPNotFound
+    }
+    if err != nil {
+        return TOTP{}, err
+    }
+    if t.Secret, err = open(p.secretKey, sealed, totpAAD(userID)); err != nil {
+        return TOTP{}, err
+    }
+    return t, nil
+}
+
+// UseTOTPStep records step as used, and confirms the enrollment if confirm is set.
+// It fails with ErrTOTPReplay unless step is newer than the last accepted one.
+func (p *Postgres) UseTOTPStep(userID string, step int64, confirm bool) error {
+    res, err := p.db.Exec(`UPDATE mfa_totp SET last_step=$1, confirmed=(confirmed OR $2) WHERE user_id=$3 AND last_step < $1`,
+        step, confirm, userID)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrTOTPReplay
+    }
+    return nil
+}
+
+func (p *Postgres) DeleteTOTP(userID string) error {
+    _, err := p.db.Exec(`DELETE FROM mfa_totp WHERE user_id=$1`, userID)
+    return err
+}
+
+func (p *Postgres) SavePasswordReset(token, userID string, exp time.Time) error {
+    _, err := p.db.Exec(`INSERT INTO password_resets (token_hash,user_id,exp_unix) VALUES ($1,$2,$3)`,
+        hashToken(p.pepper, token), userID, exp.Unix())
+    return err
+}
+
+// PasswordResetUser returns the user a live reset token was issued to,
+// without using it up.
+func (p *Postgres) PasswordResetUser(token string) (string, error) {
+    var userID string
+    var expUnix int64
+    err := p.db.QueryRow(`SELECT user_id, exp_unix FROM password_resets WHERE token_hash=$1`,
+        hashToken(p.pepper, token)).Scan(&userID, &expUnix)
+    if err != nil || time.Now().Unix() > expUnix {
+        return "", ErrResetInvalid
+    }
+    return userID, nil
+}
+
+// ConsumePasswordReset returns the user a reset token was issued to. Using a
+// token voids every other outstanding reset token of that user.
+func (p *Postgres) ConsumePasswordReset(token string) (string, error) {
+    var userID string
+    var expUnix int64
+    err := p.db.QueryRow(`DELETE FROM password_resets WHERE token_hash=$1 RETURNING user_id, exp_unix`,
+        hashToken(p.pepper, token)).Scan(&userID, &expUnix)
+    if err != nil {
+        return "", ErrResetInvalid
+    }
+    if time.Now().Unix() > expUnix {
+        // an expired link mustn't take the user's newer links with it
+        _, _ = p.db.Exec(`DELETE FROM password_resets WHERE exp_unix < $1`, time.Now().Unix())
+        return "", ErrResetInvalid
+    }
+    _, _ = p.db.Exec(`DELETE FROM password_resets WHERE user_id=$1 OR exp_unix < $2`, userID, time.Now().Unix())
+    return userID, nil
+}
 
-    if _, err := tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE token=$1`, old); err != nil {
+// SaveMagicLogin stores a pending email login for a user, replacing any
+// earlier one. link or code may be empty when only the other was sent.
+// Wrong codes entered against the earlier login still count until its
+// attempt window closes, so asking for a new code doesn't buy more guesses.
+func (p *Postgres) SaveMagicLogin(userID, link, code string, exp time.Time) error {
+    _, err := p.db.Exec(`INSERT INTO magic_logins (user_id,link_hash,code_hash,attempts,attempts_until_unix,exp_unix) VALUES ($1,$2,$3,0,$4,$4)
+        ON CONFLICT (user_id) DO UPDATE SET link_hash=EXCLUDED.link_hash, code_hash=EXCLUDED.code_hash, exp_unix=EXCLUDED.exp_unix,
+        attempts=CASE WHEN magic_logins.attempts_until_unix > $5 THEN magic_logins.attempts ELSE 0 END,
+        attempts_until_unix=CASE WHEN magic_logins.attempts_until_unix > $5 THEN magic_logins.attempts_until_unix ELSE EXCLUDED.attempts_until_unix END`,
+        userID, optionalHash(p.pepper, link), optionalHash(p.pepper, code), exp.Unix(), time.Now().Unix())
+    return err
+}
+
+// ConsumeMagicLink spends a magic link and returns the user it was sent to.
+func (p *Postgres) ConsumeMagicLink(link string) (string, error) {
+    var userID string
+    var expUnix int64
+    err := p.db.QueryRow(`DELETE FROM magic_logins WHERE link_hash=$1 RETURNING user_id, exp_unix`,
+        hashToken(p.pepper, link)).Scan(&userID, &expUnix)
+    if err != nil || time.Now().Unix() > expUnix {
+        return "", ErrMagicInvalid
+    }
+    return userID, nil
+}
+
+// ConsumeMagicCode checks an emailed code. A wrong code counts against the
+// pending login's attempt window; after maxTries in it the code is dropped
+// and codes sent before the window closes are refused too.
+func (p *Postgres) ConsumeMagicCode(userID, code string, maxTries int) error {
+    tx, err := p.db.BeginTx(context.Background(), nil)
+    if err != nil {
+        return err
+    }
+    defer func() { _ = tx.Rollback() }()
+
+    var codeHash sql.NullString
+    var attempts int
+    var untilUnix, expUnix int64
+    err = tx.QueryRow(`SELECT code_hash, attempts, attempts_until_unix, exp_unix FROM magic_logins WHERE user_id=$1 FOR UPDATE`, userID).
+        Scan(&codeHash, &attempts, &untilUnix, &expUnix)
+    if err != nil {
+        return ErrMagicInvalid
+    }
+    now := time.Now().Unix()
+    if now >= untilUnix {
+        attempts, untilUnix = 0, expUnix
+    }
+    result := ErrMagicInvalid
+    switch {
+    case now > expUnix:
+        _, err = tx.Exec(`DELETE FROM magic_logins WHERE user_id=$1`, userID)
+    case attempts >= maxTries:
+        result = ErrMagicTooMany
+    case !codeHash.Valid:
+    case codeHash.String == hashToken(p.pepper, code):
+        result = nil
+        _, err = tx.Exec(`DELETE FROM magic_logins WHERE user_id=$1`, userID)
+    case attempts+1 >= maxTries:
+        result = ErrMagicTooMany
+        _, err = tx.Exec(`UPDATE magic_logins SET attempts=$2, attempts_until_unix=$3, code_hash=NULL WHERE user_id=$1`,
+            userID, attempts+1, untilUnix)
+    default:
+        _, err = tx.Exec(`UPDATE magic_logins SET attempts=$2, attempts_until_unix=$3 WHERE user_id=$1`,
+            userID, attempts+1, untilUnix)
+    }
+    if err != nil {
+        return err
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    return result
+}
+
+// LoginThrottle returns the failed sign-in record of key; zero when clean.
+func (p *Postgres) LoginThrottle(key string) (Throttle, error) {
+    var t Throttle
+    var last, locked int64
+    err := p.db.QueryRow(`SELECT failures, last_failure_unix, locked_until_unix FROM login_throttle WHERE key=$1`, key).
+        Scan(&t.Failures, &last, &locked)
+    if errors.Is(err, sql.ErrNoRows) {
+        return Throttle{}, nil
+    }
+    if err != nil {
+        return Throttle{}, err
+    }
+    t.LastFailure, t.LockedUntil = unixOrZero(last), unixOrZero(locked)
+    return t, nil
+}
+
+// AddLoginFailure counts a failed sign-in against key and returns the new
+// count. Failures from before resetBefore are forgotten first.
+func (p *Postgres) AddLoginFailure(key string, resetBefore time.Time) (int, error) {
+    var n int
+    err := p.db.QueryRow(`INSERT INTO login_throttle (key,failures,last_failure_unix) VALUES ($1,1,$2)
+        ON CONFLICT (key) DO UPDATE SET
+        failures = CASE WHEN login_throttle.last_failure_unix < $3 THEN 1 ELSE login_throttle.failures + 1 END,
+        last_failure_unix = EXCLUDED.last_failure_unix
+        RETURNING failures`, key, time.Now().Unix(), resetBefore.Unix()).Scan(&n)
+    return n, err
+}
+
+// LockLogin refuses sign-ins for key until the given time.
+func (p *Postgres) LockLogin(key string, until time.Time) error {
+    _, err := p.db.Exec(`INSERT INTO login_throttle (key,locked_until_unix) VALUES ($1,$2)
+        ON CONFLICT (key) DO UPDATE SET locked_until_unix=EXCLUDED.locked_until_unix`, key, until.Unix())
+    return err
+}
+
+// ClearLoginFailures forgets the failures of key and lifts any lock.
+func (p *Postgres) ClearLoginFailures(key string) error {
+    _, err := p.db.Exec(`DELETE FROM login_throttle WHERE key=$1`, key)
+    return err
+}
+
+// IncrRateCounter adds a hit to key's rate limit window starting at start
+// and returns the hits in it and in the window before (see package ratelimit).
+func (p *Postgres) IncrRateCounter(key string, start time.Time, window time.Duration) (int, int, error) {
+    if sweepRateCounters() {
+        _, _ = p.db.Exec(`DELETE FROM rate_limit_counters WHERE expires_unix < $1`, time.Now().Unix())
+    }
+    var curr, prev int
+    err := p.db.QueryRow(`INSERT INTO rate_limit_counters (key,window_start,hits,expires_unix) VALUES ($1,$2,1,$3)
+        ON CONFLICT (key, window_start) DO UPDATE SET hits=rate_limit_counters.hits+1
+        RETURNING hits`, key, start.Unix(), start.Add(2*window).Unix()).Scan(&curr)
+    if err != nil {
+        return 0, 0, err
+    }
+    err = p.db.QueryRow(`SELECT hits FROM rate_limit_counters WHERE key=$1 AND window_start=$2`,
+        key, start.Add(-window).Unix()).Scan(&prev)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        return 0, 0, err
+    }
+    return curr, prev, nil
+}
+
+// ReplaceRecoveryCodes discards a user's recovery codes and stores new ones.
+func (p *Postgres) ReplaceRecoveryCodes(userID string, codes []string) error {
+    tx, err := p.db.BeginTx(context.Background(), nil)
+    if err != nil {
         return err
     }
-    if _, err := tx.ExecContext(ctx, `INSERT INTO refresh_tokens (token,user_id,exp_unix) VALUES ($1,$2,$3)`,
-        newToken, userID, exp.Unix()); err != nil {
+    defer func() { _ = tx.Rollback() }()
+    if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id=$1`, userID); err != nil {
         return err
     }
+    for _, c := range codes {
+        if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (id,user_id,code_hash) VALUES ($1,$2,$3)`, newID("rc_"), userID, hashToken(p.pepper, c)); err != nil {
+            return err
+        }
+    }
     return tx.Commit()
 }
 
-func (p *Postgres) LookupRefresh(token string) (string, time.Time, bool) {
-    var uid string
+func (p *Postgres) UnusedRecoveryCodes(userID string) ([]RecoveryCode, error) {
+    rows, err := p.db.Query(`SELECT id, code_hash FROM mfa_recovery_codes WHERE user_id=$1 AND used_at IS NULL`, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var out []RecoveryCode
+    for rows.Next() {
+        var c RecoveryCode
+        if err := rows.Scan(&c.ID, &c.Hash); err != nil {
+            return nil, err
+        }
+        out = append(out, c)
+    }
+    return out, rows.Err()
+}
+
+// ConsumeRecoveryCode spends the unused code equal to code; ErrRecoveryCodeUsed
+// if there is none.
+func (p *Postgres) ConsumeRecoveryCode(userID, code string) error {
+    res, err := p.db.Exec(`UPDATE mfa_recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`, userID, hashToken(p.pepper, code))
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrRecoveryCodeUsed
+    }
+    return nil
+}
+
+func (p *Postgres) AddWebAuthnCredential(c WebAuthnCredential) error {
+    _, err := p.db.Exec(`INSERT INTO webauthn_credentials (id,user_id,name,public_key,sign_count,transports) VALUES ($1,$2,$3,$4,$5,$6)`,
+        c.ID, c.UserID, c.Name, c.PublicKey, int64(c.SignCount), encodeList(c.Transports))
+    if isPGUnique(err) {
+        return ErrCredentialExists
+    }
+    return err
+}
+
+const pgSelectCredential = `SELECT id, user_id, name, public_key, sign_count, transports, created_at, last_used_at FROM webauthn_credentials`
+
+func (p *Postgres) ListWebAuthnCredentials(userID string) ([]WebAuthnCredential, error) {
+    rows, err := p.db.Query(pgSelectCredential+` WHERE user_id=$1 ORDER BY created_at`, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var out []WebAuthnCredential
+    for rows.Next() {
+        c, err := scanCredential(rows)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, c)
+    }
+    return out, rows.Err()
+}
+
+func (p *Postgres) GetWebAuthnCredential(id string) (WebAuthnCredential, error) {
+    c, err := scanCredential(p.db.QueryRow(pgSelectCredential+` WHERE id=$1`, id))
+    if errors.Is(err, sql.ErrNoRows) {
+        return WebAuthnCredential{}, ErrCredentialNotFound
+    }
+    return c, err
+}
+
+// UseWebAuthnCredential stores the sign count of a successful assertion.
+func (p *Postgres) UseWebAuthnCredential(id string, signCount uint32) error {
+    res, err := p.db.Exec(`UPDATE webauthn_credentials SET sign_count=$1, last_used_at=now() WHERE id=$2`, int64(signCount), id)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrCredentialNotFound
+    }
+    return nil
+}
+
+func (p *Postgres) DeleteWebAuthnCredential(userID, id string) error {
+    res, err := p.db.Exec(`DELETE FROM webauthn_credentials WHERE id=$1 AND user_id=$2`, id, userID)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrCredentialNotFound
+    }
+    return nil
+}
+
+// FindIdentity returns the user linked to subject at provider.
+func (p *Postgres) FindIdentity(provider, subject string) (User, bool) {
+    var userID string
+    err := p.db.QueryRow(`SELECT user_id FROM identities WHERE provider=$1 AND subject=$2`, provider, subject).Scan(&userID)
+    if err != nil {
+        return User{}, false
+    }
+    return p.GetUser(userID)
+}
+
+// LinkIdentity links subject at provider to a user; ErrIdentityExists if it is linked already.
+func (p *Postgres) LinkIdentity(ident Identity) error {
+    _, err := p.db.Exec(`INSERT INTO identities (provider,subject,user_id,email) VALUES ($1,$2,$3,$4)`,
+        ident.Provider, ident.Subject, ident.UserID, ident.Email)
+    if isPGUnique(err) {
+        return ErrIdentityExists
+    }
+    return err
+}
+
+// SaveRefresh opens a new session for userID with token as its first refresh token.
+func (p *Postgres) SaveRefresh(token, userID string, exp time.Time, meta SessionMeta) (string, error) {
+    ctx := context.Background()
+    tx, err := p.db.BeginTx(ctx, nil)
+    if err != nil { return "", err }
+    defer func() { _ = tx.Rollback() }()
+
+    sessionID := newID("s_")
+    if _, err := tx.ExecContext(ctx, `INSERT INTO sessions (id,user_id,device_name,ip,user_agent,client_id,scope) VALUES ($1,$2,$3,$4,$5,$6,$7)`,
+        sessionID, userID, meta.DeviceName, meta.IP, meta.UserAgent, meta.ClientID, meta.Scope); err != nil {
+        return "", err
+    }
+    if _, err := tx.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash,user_id,exp_unix,family_id) VALUES ($1,$2,$3,$4)`,
+        hashToken(p.pepper, token), userID, exp.Unix(), sessionID); err != nil {
+        return "", err
+    }
+    return sessionID, tx.Commit()
+}
+
+// RotateRefresh marks old as used and writes newToken into the same session.
+// Presenting an already rotated token revokes the whole session and is audited.
+func (p *Postgres) RotateRefresh(old, newToken string, exp time.Time, meta SessionMeta) (RefreshToken, error) {
+    ctx := context.Background()
+    tx, err := p.db.BeginTx(ctx, nil)
+    if err != nil { return RefreshToken{}, err }
+    defer func() { _ = tx.Rollback() }()
+
+    var uid, family string
     var expUnix int64
-    err := p.db.QueryRow(`SELECT user_id, exp_unix FROM refresh_tokens WHERE token=$1`, token).
-        Scan(&uid, &expUnix)
+    var rotatedAt sql.NullTime
+    oldHash := hashToken(p.pepper, old)
+    err = tx.QueryRowContext(ctx, `SELECT user_id, family_id, exp_unix, rotated_at FROM refresh_tokens WHERE token_hash=$1 FOR UPDATE`, oldHash).
+        Scan(&uid, &family, &expUnix, &rotatedAt)
+    if errors.Is(err, sql.ErrNoRows) { return RefreshToken{}, ErrRefreshInvalid }
+    if err != nil { return RefreshToken{}, err }
+    if time.Now().Unix() > expUnix { return RefreshToken{}, ErrRefreshInvalid }
+
+    if rotatedAt.Valid {
+        if err := p.dropSession(tx, family); err != nil {
+            return RefreshToken{}, err
+        }
+        if _, err := tx.ExecContext(ctx, pgInsertAudit, auditArgs(AuditEvent{
+            UserID: uid,
+            Kind:   AuditRefreshReuse,
+            Detail: map[string]any{"family_id": family},
+        })...); err != nil {
+            return RefreshToken{}, err
+        }
+        if err := tx.Commit(); err != nil { return RefreshToken{}, err }
+        return RefreshToken{UserID: uid, SessionID: family}, ErrRefreshReused
+    }
+
+    if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET rotated_at=now() WHERE token_hash=$1`, oldHash); err != nil {
+        return RefreshToken{}, err
+    }
+    if _, err := tx.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash,user_id,exp_unix,family_id) VALUES ($1,$2,$3,$4)`,
+        hashToken(p.pepper, newToken), uid, exp.Unix(), family); err != nil {
+        return RefreshToken{}, err
+    }
+    rt := RefreshToken{UserID: uid, SessionID: family, Exp: exp}
+    err = tx.QueryRowContext(ctx, `UPDATE sessions SET last_used_at=now(), ip=$1, user_agent=$2,
+        device_name=COALESCE(NULLIF($3,''), device_name) WHERE id=$4 RETURNING client_id, scope`,
+        meta.IP, meta.UserAgent, meta.DeviceName, family).Scan(&rt.ClientID, &rt.Scope)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        return RefreshToken{}, err
+    }
+    return rt, tx.Commit()
+}
+
+// LookupRefresh only reports live tokens; rotated ones are kept solely for reuse detection.
+func (p *Postgres) LookupRefresh(token string) (RefreshToken, bool) {
+    var rt RefreshToken
+    var expUnix int64
+    err := p.db.QueryRow(`SELECT t.user_id, t.family_id, t.exp_unix, COALESCE(s.client_id,''), COALESCE(s.scope,'')
+        FROM refresh_tokens t LEFT JOIN sessions s ON s.id = t.family_id
+        WHERE t.token_hash=$1 AND t.rotated_at IS NULL`, hashToken(p.pepper, token)).
+        Scan(&rt.UserID, &rt.SessionID, &expUnix, &rt.ClientID, &rt.Scope)
     if errors.Is(err, sql.ErrNoRows) || err != nil {
-        return "", time.Time{}, false
+        return RefreshToken{}, false
     }
-    return uid, time.Unix(expUnix, 0), true
+    rt.Exp = time.Unix(expUnix, 0)
+    return rt, true
 }
 
+// DeleteRefresh ends the token's whole session (logout).
 func (p *Postgres) DeleteRefresh(token string) error {
-    _, err := p.db.Exec(`DELETE FROM refresh_tokens WHERE token=$1`, token)
+    var sessionID string
+    err := p.db.QueryRow(`SELECT family_id FROM refresh_tokens WHERE token_hash=$1`, hashToken(p.pepper, token)).Scan(&sessionID)
+    if errors.Is(err, sql.ErrNoRows) { return nil }
+    if err != nil { return err }
+    return p.dropSession(p.db, sessionID)
+}
+
+func (p *Postgres) ListSessions(userID string) ([]Session, error) {
+    rows, err := p.db.Query(`SELECT id, device_name, ip, user_agent, client_id, scope, created_at, last_used_at FROM sessions
+        WHERE user_id=$1 ORDER BY last_used_at DESC`, userID)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    out := []Session{}
+    for rows.Next() {
+        sess := Session{UserID: userID}
+        if err := rows.Scan(&sess.ID, &sess.DeviceName, &sess.IP, &sess.UserAgent, &sess.ClientID, &sess.Scope, &sess.CreatedAt, &sess.LastUsedAt); err != nil {
+            return nil, err
+        }
+        out = append(out, sess)
+    }
+    return out, rows.Err()
+}
+
+func (p *Postgres) RevokeSession(userID, sessionID string) error {
+    var owner string
+    err := p.db.QueryRow(`SELECT user_id FROM sessions WHERE id=$1`, sessionID).Scan(&owner)
+    if err != nil || owner != userID { return ErrSessionNotFound }
+    return p.dropSession(p.db, sessionID)
+}
+
+// RevokeOtherSessions ends every session of userID except keepID and returns the revoked ids.
+func (p *Postgres) RevokeOtherSessions(userID, keepID string) ([]string, error) {
+    ctx := context.Background()
+    tx, err := p.db.BeginTx(ctx, nil)
+    if err != nil { return nil, err }
+    defer func() { _ = tx.Rollback() }()
+
+    rows, err := tx.QueryContext(ctx, `DELETE FROM sessions WHERE user_id=$1 AND id<>$2 RETURNING id`, userID, keepID)
+    if err != nil { return nil, err }
+    ids := []string{}
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            _ = rows.Close()
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    _ = rows.Close()
+    if _, err := tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE family_id = ANY($1)`, ids); err != nil {
+        return nil, err
+    }
+    return ids, tx.Commit()
+}
+
+func (p *Postgres) RevokeAccess(kind, value string, exp time.Time) error {
+    _, err := p.db.Exec(`INSERT INTO revocations (kind,value,exp_unix) VALUES ($1,$2,$3)
+        ON CONFLICT (kind,value) DO UPDATE SET exp_unix=EXCLUDED.exp_unix, created_at=now()`,
+        kind, value, exp.Unix())
+    return err
+}
+
+// RevokeOnce records a revocation unless one already exists, so exactly one
+// caller gets to spend a single-use token.
+func (p *Postgres) RevokeOnce(kind, value string, exp time.Time) error {
+    res, err := p.db.Exec(`INSERT INTO revocations (kind,value,exp_unix) VALUES ($1,$2,$3)
+        ON CONFLICT (kind,value) DO NOTHING`, kind, value, exp.Unix())
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrAlreadyRevoked
+    }
+    return nil
+}
+
+// ListRevocations returns unexpired revocations recorded after since and
+// forgets the expired ones.
+func (p *Postgres) ListRevocations(since time.Time) ([]Revocation, error) {
+    if _, err := p.db.Exec(`DELETE FROM revocations WHERE exp_unix < $1`, time.Now().Unix()); err != nil {
+        return nil, err
+    }
+    rows, err := p.db.Query(`SELECT kind, value, exp_unix, created_at FROM revocations WHERE created_at > $1`, since)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    out := []Revocation{}
+    for rows.Next() {
+        var rv Revocation
+        var expUnix int64
+        if err := rows.Scan(&rv.Kind, &rv.Value, &expUnix, &rv.CreatedAt); err != nil {
+            return nil, err
+        }
+        rv.Exp = time.Unix(expUnix, 0)
+        out = append(out, rv)
+    }
+    return out, rows.Err()
+}
+
+// UpsertClient registers a client or replaces its settings and secret.
+// Public clients pass an empty secret. A disabled client stays disabled.
+func (p *Postgres) UpsertClient(c Client, secret string) error {
+    secretHash := ""
+    if secret != "" {
+        secretHash = hashToken(p.pepper, secret)
+    }
+    _, err := p.db.Exec(`INSERT INTO oauth_clients (id,name,secret_hash,redirect_uris,public,scopes) VALUES ($1,$2,$3,$4,$5,$6)
+        ON CONFLICT (id) DO UPDATE SET name=EXCLUDED.name, secret_hash=EXCLUDED.secret_hash,
+            redirect_uris=EXCLUDED.redirect_uris, public=EXCLUDED.public, scopes=EXCLUDED.scopes`,
+        c.ID, c.Name, secretHash, encodeList(c.RedirectURIs), c.Public, encodeList(c.Scopes))
+    return err
+}
+
+// CreateClient registers a new client; it fails with ErrClientExists if the id is taken.
+func (p *Postgres) CreateClient(c Client, secret string) error {
+    secretHash := ""
+    if secret != "" {
+        secretHash = hashToken(p.pepper, secret)
+    }
+    _, err := p.db.Exec(`INSERT INTO oauth_clients (id,name,secret_hash,redirect_uris,public,scopes) VALUES ($1,$2,$3,$4,$5,$6)`,
+        c.ID, c.Name, secretHash, encodeList(c.RedirectURIs), c.Public, encodeList(c.Scopes))
+    if isPGUnique(err) {
+        return ErrClientExists
+    }
+    return err
+}
+
+const pgSelectClient = `SELECT id, name, redirect_uris, public, scopes, disabled, created_at FROM oauth_clients`
+
+func (p *Postgres) GetClient(id string) (Client, bool) {
+    c, err := scanClient(p.db.QueryRow(pgSelectClient+` WHERE id=$1`, id))
+    return c, err == nil
+}
+
+func (p *Postgres) ListClients() ([]Client, error) {
+    rows, err := p.db.Query(pgSelectClient + ` ORDER BY id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := []Client{}
+    for rows.Next() {
+        c, err := scanClient(rows)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, c)
+    }
+    return out, rows.Err()
+}
+
+// RotateClientSecret replaces the secret; the old one keeps working until graceUntil.
+func (p *Postgres) RotateClientSecret(id, secret string, graceUntil time.Time) error {
+    res, err := p.db.Exec(`UPDATE oauth_clients SET prev_secret_hash=secret_hash, prev_secret_exp_unix=$1, secret_hash=$2 WHERE id=$3`,
+        graceUntil.Unix(), hashToken(p.pepper, secret), id)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrClientNotFound
+    }
+    return nil
+}
+
+func (p *Postgres) SetClientDisabled(id string, disabled bool) error {
+    res, err := p.db.Exec(`UPDATE oauth_clients SET disabled=$1 WHERE id=$2`, disabled, id)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrClientNotFound
+    }
+    return nil
+}
+
+// AuthenticateClient checks client credentials; disabled clients never authenticate.
+func (p *Postgres) AuthenticateClient(id, secret string) (Client, error) {
+    var current, prev string
+    var prevExpUnix int64
+    err := p.db.QueryRow(`SELECT secret_hash, prev_secret_hash, prev_secret_exp_unix FROM oauth_clients WHERE id=$1`, id).
+        Scan(&current, &prev, &prevExpUnix)
+    if err != nil {
+        return Client{}, ErrClientInvalid
+    }
+    c, ok := p.GetClient(id)
+    if !ok || c.Disabled || !clientSecretOK(p.pepper, secret, current, prev, time.Unix(prevExpUnix, 0)) {
+        return Client{}, ErrClientInvalid
+    }
+    return c, nil
+}
+
+func (p *Postgres) SaveAuthCode(code string, ac AuthCode) error {
+    _, err := p.db.Exec(`INSERT INTO oauth_codes (code_hash,client_id,user_id,redirect_uri,scope,code_challenge,code_challenge_method,nonce,auth_time_unix,exp_unix)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)`,
+        hashToken(p.pepper, code), ac.ClientID, ac.UserID, ac.RedirectURI, ac.Scope, ac.CodeChallenge, ac.CodeChallengeMethod,
+        ac.Nonce, ac.AuthTime.Unix(), ac.Exp.Unix())
+    return err
+}
+
+// ConsumeAuthCode spends code if it was issued to clientID for redirectURI; a
+// mismatch leaves it unspent. Spent codes are kept until they expire so that a
+// second exchange returns ErrCodeReused with the session the first one opened.
+func (p *Postgres) ConsumeAuthCode(code, clientID, redirectURI string) (AuthCode, error) {
+    ctx := context.Background()
+    tx, err := p.db.BeginTx(ctx, nil)
+    if err != nil {
+        return AuthCode{}, err
+    }
+    defer func() { _ = tx.Rollback() }()
+
+    h := hashToken(p.pepper, code)
+    var ac AuthCode
+    var authUnix, expUnix int64
+    var used bool
+    err = tx.QueryRowContext(ctx, `SELECT client_id, user_id, redirect_uri, scope, code_challenge, code_challenge_method, nonce, auth_time_unix, exp_unix, used, session_id
+        FROM oauth_codes WHERE code_hash=$1 FOR UPDATE`, h).
+        Scan(&ac.ClientID, &ac.UserID, &ac.RedirectURI, &ac.Scope, &ac.CodeChallenge, &ac.CodeChallengeMethod, &ac.Nonce, &authUnix, &expUnix, &used, &ac.SessionID)
+    if err != nil {
+        return AuthCode{}, ErrCodeInvalid
+    }
+    ac.AuthTime = time.Unix(authUnix, 0)
+    ac.Exp = time.Unix(expUnix, 0)
+    if time.Now().After(ac.Exp) || ac.ClientID != clientID || ac.RedirectURI != redirectURI {
+        return AuthCode{}, ErrCodeInvalid
+    }
+    if used {
+        return ac, ErrCodeReused
+    }
+    if _, err := tx.ExecContext(ctx, `UPDATE oauth_codes SET used=true WHERE code_hash=$1`, h); err != nil {
+        return AuthCode{}, err
+    }
+    if _, err := tx.ExecContext(ctx, `DELETE FROM oauth_codes WHERE exp_unix < $1`, time.Now().Unix()); err != nil {
+        return AuthCode{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return AuthCode{}, err
+    }
+    return ac, nil
+}
+
+// SetAuthCodeSession records the session a code was exchanged for.
+func (p *Postgres) SetAuthCodeSession(code, sessionID string) error {
+    _, err := p.db.Exec(`UPDATE oauth_codes SET session_id=$1 WHERE code_hash=$2`, sessionID, hashToken(p.pepper, code))
+    return err
+}
+
+// dropSession deletes a session row together with its refresh tokens.
+func (p *Postgres) dropSession(db execer, sessionID string) error {
+    if _, err := db.Exec(`DELETE FROM refresh_tokens WHERE family_id=$1`, sessionID); err != nil {
+        return err
+    }
+    _, err := db.Exec(`DELETE FROM sessions WHERE id=$1`, sessionID)
+    return err
+}
+
+const pgInsertAudit = `INSERT INTO audit_events (user_id,kind,detail,created_at) VALUES ($1,$2,$3,$4)`
+
+func (p *Postgres) RecordAudit(ev AuditEvent) error {
+    _, err := p.db.Exec(pgInsertAudit, auditArgs(ev)...)
     return err
 }
 
@@ -0,0 +1,7 @@
+package store
+
+import "math/rand/v2"
+
+// sweepRateCounters says whether this call should also delete expired
+// counters; doing it now and then keeps the hot path to one upsert.
+func sweepRateCounters() bool { return rand.IntN(100) == 0 }
@@ -0,0 +1,12 @@
+package store
+
+import "errors"
+
+var ErrResetInvalid = errors.New("password reset token invalid or expired")
+
+// Audit event kinds for password recovery and changes
+const (
+	AuditPasswordResetRequested = "password.reset_requested"
+	AuditPasswordReset          = "password.reset"
+	AuditPasswordChanged        = "password.changed"
+)
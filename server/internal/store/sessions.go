@@ -0,0 +1,59 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrAlreadyRevoked  = errors.New("already revoked")
+)
+
+// Session is one signed-in device. Its ID doubles as the refresh token family:
+// every refresh token minted from the same login belongs to it.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	DeviceName string    `json:"device_name"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	ClientID   string    `json:"client_id,omitempty"` // set when opened through an OAuth grant
+	Scope      string    `json:"scope,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// SessionMeta is what the client tells us about itself on login/refresh.
+// ClientID and Scope are fixed when the session is opened.
+type SessionMeta struct {
+	DeviceName string
+	IP         string
+	UserAgent  string
+	ClientID   string
+	Scope      string
+}
+
+// RefreshToken is what a live refresh token resolves to.
+type RefreshToken struct {
+	UserID    string
+	SessionID string
+	ClientID  string
+	Scope     string
+	Exp       time.Time
+}
+
+// Revocation kinds: a whole session or a single access token.
+const (
+	RevokeKindSession = "sid"
+	RevokeKindJTI     = "jti"
+)
+
+// Revocation denies access tokens before they expire. Exp is when the last
+// affected token expires anyway; after that the row can be forgotten.
+type Revocation struct {
+	Kind      string
+	Value     string
+	Exp       time.Time
+	CreatedAt time.Time
+}
@@ -13,19 +13,28 @@ import (
 
 // SQLiteStore implements persistent storage using SQLite.
 type SQLiteStore struct {
-	db *sql.DB
+	db        *sql.DB
+	pepper    []byte
+	secretKey []byte
 }
 
-// DeleteRefresh implements httpserver.Store.
+// DeleteRefresh implements httpserver.Store. It ends the token's whole session (logout).
 func (s *SQLiteStore) DeleteRefresh(token string) error {
-    _, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE token=?`, token)
-    return err
+    var sessionID string
+    err := s.db.QueryRow(`SELECT family_id FROM refresh_tokens WHERE token_hash=?`, hashToken(s.pepper, token)).Scan(&sessionID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return s.dropSession(s.db, sessionID)
 }
 
 
 
 // NewSQLite opens (or creates) the DB file, runs migrations, and returns the store.
-func NewSQLite(dsn string) (*SQLiteStore, error) {
+func NewSQLite(dsn string, keys Keys) (*SQLiteStore, error) {
 	// dsn is usually a file path, e.g., "./data/app.db"
 	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
@@ -35,7 +44,7 @@ func NewSQLite(dsn string) (*SQLiteStore, error) {
 	db.SetMaxOpenConns(1)
 	db.SetMaxIdleConns(1)
 
-	s := &SQLiteStore{db: db}
+	s := &SQLiteStore{db: db, pepper: keys.TokenPepper, secretKey: keys.SecretKey}
 	if err := s.migrate(); err != nil {
 		_ = db.Close()
 		return nil, err
@@ -43,8 +52,8 @@ func NewSQLite(dsn string) (*SQLiteStore, error) {
 	return s, nil
 }
 
-// migrate creates tables if they don't exist.
-// Keep it simple: two tables, users and refresh_tokens.
+// migrate creates tables if they don't exist and adds columns that older
+// databases are missing.
 func (s *SQLiteStore) migrate() error {
 	ddl := `
 CREATE TABLE IF NOT EXISTS users (
@@ -55,14 +64,239 @@ CREATE TABLE IF NOT EXISTS users (
   created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 CREATE TABLE IF NOT EXISTS refresh_tokens (
-  token TEXT PRIMARY KEY,
+  token_hash TEXT PRIMARY KEY,
   user_id TEXT NOT NULL,
   exp DATETIME NOT NULL,
   created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
   FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
+CREATE TABLE IF NOT EXISTS audit_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  detail TEXT NOT NULL DEFAULT '{}',
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS sessions (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL,
+  device_name TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  last_used_at DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS revocations (
+  kind TEXT NOT NULL,
+  value TEXT NOT NULL,
+  exp DATETIME NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (kind, value)
+);
+CREATE TABLE IF NOT EXISTS oauth_clients (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL DEFAULT '',
+  secret_hash TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS mfa_totp (
+  user_id TEXT PRIMARY KEY,
+  secret_enc BLOB NOT NULL,
+  confirmed INTEGER NOT NULL DEFAULT 0,
+  last_step INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS password_resets (
+  token_hash TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL,
+  exp DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS magic_logins (
+  user_id TEXT PRIMARY KEY,
+  link_hash TEXT UNIQUE,
+  code_hash TEXT,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  exp DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS email_changes (
+  user_id TEXT PRIMARY KEY,
+  new_email TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  exp DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS login_throttle (
+  key TEXT PRIMARY KEY,
+  failures INTEGER NOT NULL DEFAULT 0,
+  last_failure_unix INTEGER NOT NULL DEFAULT 0,
+  locked_until_unix INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+  key TEXT NOT NULL,
+  window_start INTEGER NOT NULL,
+  hits INTEGER NOT NULL,
+  expires_unix INTEGER NOT NULL,
+  PRIMARY KEY (key, window_start)
+);
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL,
+  code_hash TEXT NOT NULL,
+  created_at DATETIME NOT NULL,
+  used_at DATETIME,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL,
+  name TEXT NOT NULL DEFAULT '',
+  public_key BLOB NOT NULL,
+  sign_count INTEGER NOT NULL DEFAULT 0,
+  transports TEXT NOT NULL DEFAULT '[]',
+  created_at DATETIME NOT NULL,
+  last_used_at DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS identities (
+  provider TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  user_id TEXT NOT NULL,
+  email TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (provider, subject),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS oauth_codes (
+  code_hash TEXT PRIMARY KEY,
+  client_id TEXT NOT NULL,
+  user_id TEXT NOT NULL,
+  redirect_uri TEXT NOT NULL,
+  scope TEXT NOT NULL DEFAULT '',
+  code_challenge TEXT NOT NULL,
+  code_challenge_method TEXT NOT NULL,
+  exp DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
 `
-	_, err := s.db.Exec(ddl)
+	if _, err := s.db.Exec(ddl); err != nil {
+		return err
+	}
+	// refresh token families (reuse detection)
+	if err := s.ensureColumn("refresh_tokens", "family_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("refresh_tokens", "rotated_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := s.hashPlaintextRefresh(); err != nil {
+		return err
+	}
+	// OAuth: sessions remember the grant they came from, clients their redirect URIs
+	for _, c := range []struct{ table, column, decl string }{
+		{"sessions", "client_id", "TEXT NOT NULL DEFAULT ''"},
+		{"sessions", "scope", "TEXT NOT NULL DEFAULT ''"},
+		{"oauth_clients", "redirect_uris", "TEXT NOT NULL DEFAULT '[]'"},
+		{"oauth_clients", "public", "INTEGER NOT NULL DEFAULT 0"},
+		// OpenID Connect
+		{"users", "email_verified", "INTEGER NOT NULL DEFAULT 0"},
+		{"oauth_codes", "nonce", "TEXT NOT NULL DEFAULT ''"},
+		{"oauth_codes", "auth_time", "DATETIME"},
+		// machine clients
+		{"oauth_clients", "scopes", "TEXT NOT NULL DEFAULT '[]'"},
+		{"oauth_clients", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"oauth_clients", "prev_secret_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"oauth_clients", "prev_secret_exp", "DATETIME"},
+		// magic code attempts outlive a new code until the window closes
+		{"magic_logins", "attempts_until_unix", "INTEGER NOT NULL DEFAULT 0"},
+		// spent authorization codes stay until they expire to catch replays
+		{"oauth_codes", "used", "INTEGER NOT NULL DEFAULT 0"},
+		{"oauth_codes", "session_id", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := s.ensureColumn(c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+	_, err := s.db.Exec(`
+UPDATE refresh_tokens SET family_id = 'f_' || lower(hex(randomblob(12))) WHERE family_id = '';
+CREATE INDEX IF NOT EXISTS idx_refresh_family ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_audit_user ON audit_events(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_webauthn_user ON webauthn_credentials(user_id);
+CREATE INDEX IF NOT EXISTS idx_recovery_user ON mfa_recovery_codes(user_id);
+INSERT INTO sessions (id, user_id, created_at, last_used_at)
+  SELECT family_id, user_id, MIN(created_at), MAX(created_at) FROM refresh_tokens
+  WHERE family_id NOT IN (SELECT id FROM sessions) GROUP BY family_id, user_id;
+`)
+	return err
+}
+
+// hashPlaintextRefresh upgrades databases that stored raw refresh tokens in a
+// "token" column: the column is renamed to token_hash and every value replaced
+// by its HMAC so existing sessions keep working.
+func (s *SQLiteStore) hashPlaintextRefresh() error {
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('refresh_tokens') WHERE name = 'token'`).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(`SELECT token FROM refresh_tokens`)
+	if err != nil {
+		return err
+	}
+	var plain []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		plain = append(plain, t)
+	}
+	_ = rows.Close()
+	if _, err := tx.Exec(`ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash`); err != nil {
+		return err
+	}
+	for _, t := range plain {
+		if _, err := tx.Exec(`UPDATE refresh_tokens SET token_hash = ? WHERE token_hash = ?`, hashToken(s.pepper, t), t); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ensureColumn adds a column to an existing table unless it is already there.
+func (s *SQLiteStore) ensureColumn(table, column, decl string) error {
+	rows, err := s.db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_ = rows.Close()
+	_, err = s.db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
 	return err
 }
 
@@ -73,13 +307,13 @@ var (
 	ErrUserNotFound   = errors.New("user not found")
 	ErrInvalidCreds   = errors.New("invalid email or password")
 	ErrRefreshInvalid = errors.New("invalid or expired refresh token")
+	ErrRefreshReused  = errors.New("refresh token reused; session revoked")
 )
 
 // CreateUser inserts a new user with a temporary empty password hash.
 // We'll set the real hash via SetPassword immediately after.
 func (s *SQLiteStore) CreateUser(email, name string) (User, error) {
-	// Generate a simple time-based id like the memory store did
-	id := "u_" + time.Now().UTC().Format("20060102150405.000000000")
+	id := newID("u_")
 
 	// We initially write an empty pw_hash, then SetPassword will update it.
 	_, err := s.db.Exec(`
@@ -95,12 +329,32 @@ INSERT INTO users (id, email, name, pw_hash) VALUES (?, ?, ?, '')
 	return User{ID: id, Email: email, Name: name}, nil
 }
 
-// SetPassword hashes and saves the password for a user.
-func (s *SQLiteStore) SetPassword(userID, plain string) error {
-	hash, err := auth.HashPassword(plain)
+// ImportUser creates a user with a password hash made elsewhere (see
+// auth.SchemeOf); an empty hash leaves the account without a password.
+func (s *SQLiteStore) ImportUser(email, name, pwHash string, verified bool) (User, error) {
+	id := newID("u_")
+	_, err := s.db.Exec(`INSERT INTO users (id, email, name, pw_hash, email_verified) VALUES (?, ?, ?, ?, ?)`,
+		id, email, name, pwHash, verified)
+	if err != nil {
+		if isUniqueConstraint(err) {
+			return User{}, ErrEmailExists
+		}
+		return User{}, err
+	}
+	return User{ID: id, Email: email, Name: name, EmailVerified: verified}, nil
+}
+
+// SetPassword hashes the password on hashes and saves it for a user.
+func (s *SQLiteStore) SetPassword(ctx context.Context, hashes *auth.HashScheduler, userID, plain string) error {
+	hash, err := hashes.HashPassword(ctx, plain)
 	if err != nil {
 		return err
 	}
+	return s.SetPasswordHash(userID, hash)
+}
+
+// SetPasswordHash saves a hash made by auth.HashPassword.
+func (s *SQLiteStore) SetPasswordHash(userID, hash string) error {
 	res, err := s.db.Exec(`UPDATE users SET pw_hash = ? WHERE id = ?`, hash, userID)
 	if err != nil {
 		return err
@@ -112,77 +366,906 @@ func (s *SQLiteStore) SetPassword(userID, plain string) error {
 	return nil
 }
 
+// HasPassword reports whether the user can sign in with a password; accounts
+// made through a provider, a magic link or a passkey may never have set one.
+func (s *SQLiteStore) HasPassword(userID string) bool {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND pw_hash <> ''`, userID).Scan(&n)
+	return err == nil && n > 0
+}
+
 // VerifyCreds checks email + password.
-func (s *SQLiteStore) VerifyCreds(email, plain string) (User, error) {
+func (s *SQLiteStore) VerifyCreds(ctx context.Context, hashes *auth.HashScheduler, email, plain string) (User, error) {
 	var (
 		id, name, pwHash string
+		verified         bool
 	)
-	row := s.db.QueryRow(`SELECT id, name, pw_hash FROM users WHERE email = ?`, email)
-	if err := row.Scan(&id, &name, &pwHash); err != nil {
+	row := s.db.QueryRow(`SELECT id, name, pw_hash, email_verified FROM users WHERE email = ?`, email)
+	if err := row.Scan(&id, &name, &pwHash, &verified); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, ErrInvalidCreds
 		}
 		return User{}, err
 	}
-	if pwHash == "" || !auth.VerifyPassword(plain, pwHash) {
+	if pwHash == "" {
 		return User{}, ErrInvalidCreds
 	}
-	return User{ID: id, Email: email, Name: name}, nil
+	if ok, err := hashes.VerifyPassword(ctx, plain, pwHash); err != nil {
+		return User{}, err
+	} else if !ok {
+		return User{}, ErrInvalidCreds
+	}
+	if h, ok := rehash(ctx, hashes, plain, pwHash); ok {
+		// best effort; the guard keeps a concurrent password change
+		_, _ = s.db.Exec(`UPDATE users SET pw_hash = ? WHERE id = ? AND pw_hash = ?`, h, id, pwHash)
+	}
+	return User{ID: id, Email: email, Name: name, EmailVerified: verified}, nil
 }
 
 func (s *SQLiteStore) GetUser(id string) (User, bool) {
-	var email, name string
-	row := s.db.QueryRow(`SELECT email, name FROM users WHERE id = ?`, id)
-	if err := row.Scan(&email, &name); err != nil {
+	u := User{ID: id}
+	row := s.db.QueryRow(`SELECT email, name, email_verified FROM users WHERE id = ?`, id)
+	if err := row.Scan(&u.Email, &u.Name, &u.EmailVerified); err != nil {
 		return User{}, false
 	}
-	return User{ID: id, Email: email, Name: name}, true
+	return u, true
 }
 
-// ---------- Refresh tokens ----------
+func (s *SQLiteStore) GetUserByEmail(email string) (User, bool) {
+	u := User{Email: email}
+	row := s.db.QueryRow(`SELECT id, name, email_verified FROM users WHERE email = ?`, email)
+	if err := row.Scan(&u.ID, &u.Name, &u.EmailVerified); err != nil {
+		return User{}, false
+	}
+	return u, true
+}
 
-// SaveRefresh stores/overwrites a refresh token for a user.
-func (s *SQLiteStore) SaveRefresh(token, userID string, exp time.Time) {
-	_, _ = s.db.Exec(`
-INSERT OR REPLACE INTO refresh_tokens (token, user_id, exp) VALUES (?, ?, ?)
-`, token, userID, exp.UTC())
+func (s *SQLiteStore) SetEmailVerified(userID string, verified bool) error {
+	res, err := s.db.Exec(`UPDATE users SET email_verified = ? WHERE id = ?`, verified, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
 }
 
-// RotateRefresh deletes old and writes new atomically (best-effort).
-func (s *SQLiteStore) RotateRefresh(old string, newToken string, userID string, exp time.Time) error {
-	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+// ChangeEmail moves a user to a new, confirmed address. The UNIQUE
+// constraint on users.email settles two accounts racing for one address.
+func (s *SQLiteStore) ChangeEmail(userID, email string) error {
+	res, err := s.db.Exec(`UPDATE users SET email = ?, email_verified = 1 WHERE id = ?`, email, userID)
 	if err != nil {
+		if isUniqueConstraint(err) {
+			return ErrEmailExists
+		}
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ---------- Email changes ----------
+
+// SaveEmailChange records a pending move to email, replacing any earlier one.
+// token is what the confirmation link sent to the new address carries.
+func (s *SQLiteStore) SaveEmailChange(userID, email, token string, exp time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO email_changes (user_id, new_email, token_hash, exp) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET new_email = excluded.new_email, token_hash = excluded.token_hash,
+		exp = excluded.exp`,
+		userID, email, hashToken(s.pepper, token), exp.UTC())
+	return err
+}
+
+// ConsumeEmailChange spends a confirmation token and returns the user and
+// the address it confirms.
+func (s *SQLiteStore) ConsumeEmailChange(token string) (string, string, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return "", "", err
+	}
 	defer func() { _ = tx.Rollback() }()
 
-	var owner string
-	row := tx.QueryRow(`SELECT user_id FROM refresh_tokens WHERE token = ?`, old)
-	if err := row.Scan(&owner); err != nil {
-		return ErrRefreshInvalid
+	var userID, email string
+	var exp time.Time
+	row := tx.QueryRow(`SELECT user_id, new_email, exp FROM email_changes WHERE token_hash = ?`, hashToken(s.pepper, token))
+	if err := row.Scan(&userID, &email, &exp); err != nil {
+		return "", "", ErrEmailChangeInvalid
+	}
+	if _, err := tx.Exec(`DELETE FROM email_changes WHERE user_id = ?`, userID); err != nil {
+		return "", "", err
 	}
-	if owner != userID {
-		return ErrRefreshInvalid
+	if err := tx.Commit(); err != nil {
+		return "", "", err
 	}
-	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE token = ?`, old); err != nil {
+	if time.Now().After(exp) {
+		return "", "", ErrEmailChangeInvalid
+	}
+	return userID, email, nil
+}
+
+// ---------- TOTP ----------
+
+// SaveTOTP starts a (new) unconfirmed enrollment for userID.
+func (s *SQLiteStore) SaveTOTP(userID string, secret []byte) error {
+	sealed, err := seal(s.secretKey, secret, totpAAD(userID))
+	if err != nil {
 		return err
 	}
-	if _, err := tx.Exec(`
-INSERT INTO refresh_tokens (token, user_id, exp) VALUES (?, ?, ?)
-`, newToken, userID, exp.UTC()); err != nil {
+	_, err = s.db.Exec(`
+INSERT INTO mfa_totp (user_id, secret_enc, confirmed, last_step, created_at) VALUES (?, ?, 0, 0, ?)
+ON CONFLICT (user_id) DO UPDATE SET secret_enc = excluded.secret_enc, confirmed = 0, last_step = 0, created_at = excluded.created_at
+`, userID, sealed, time.Now().UTC())
+	return err
+}
+
+func (s *SQLiteStore) GetTOTP(userID string) (TOTP, error) {
+	var t TOTP
+	var sealed []byte
+	row := s.db.QueryRow(`SELECT secret_enc, confirmed, last_step, created_at FROM mfa_totp WHERE user_id = ?`, userID)
+	if err := row.Scan(&sealed, &t.Confirmed, &t.LastStep, &t.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TOTP{}, ErrTOTPNotFound
+		}
+		return TOTP{}, err
+	}
+	secret, err := open(s.secretKey, sealed, totpAAD(userID))
+	if err != nil {
+		return TOTP{}, err
+	}
+	t.Secret = secret
+	return t, nil
+}
+
+// UseTOTPStep records step as used, and confirms the enrollment if confirm is set.
+// It fails with ErrTOTPReplay unless step is newer than the last accepted one.
+func (s *SQLiteStore) UseTOTPStep(userID string, step int64, confirm bool) error {
+	res, err := s.db.Exec(`
+UPDATE mfa_totp SET last_step = ?, confirmed = (confirmed OR ?) WHERE user_id = ? AND last_step < ?
+`, step, confirm, userID, step)
+	if err != nil {
 		return err
 	}
-	return tx.Commit()
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTOTPReplay
+	}
+	return nil
+}
+
+func (s *SQLiteStore) DeleteTOTP(userID string) error {
+	_, err := s.db.Exec(`DELETE FROM mfa_totp WHERE user_id = ?`, userID)
+	return err
+}
+
+// ---------- Password resets ----------
+
+func (s *SQLiteStore) SavePasswordReset(token, userID string, exp time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO password_resets (token_hash, user_id, exp) VALUES (?, ?, ?)`,
+		hashToken(s.pepper, token), userID, exp.UTC())
+	return err
 }
 
-func (s *SQLiteStore) LookupRefresh(token string) (string, time.Time, bool) {
+// PasswordResetUser returns the user a live reset token was issued to,
+// without using it up.
+func (s *SQLiteStore) PasswordResetUser(token string) (string, error) {
+	var userID string
+	var exp time.Time
+	row := s.db.QueryRow(`SELECT user_id, exp FROM password_resets WHERE token_hash = ?`, hashToken(s.pepper, token))
+	if err := row.Scan(&userID, &exp); err != nil || time.Now().After(exp) {
+		return "", ErrResetInvalid
+	}
+	return userID, nil
+}
+
+// ConsumePasswordReset returns the user a reset token was issued to. Using a
+// token voids every other outstanding reset token of that user.
+func (s *SQLiteStore) ConsumePasswordReset(token string) (string, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
 	var userID string
 	var exp time.Time
-	row := s.db.QueryRow(`SELECT user_id, exp FROM refresh_tokens WHERE token = ?`, token)
+	row := tx.QueryRow(`DELETE FROM password_resets WHERE token_hash = ? RETURNING user_id, exp`, hashToken(s.pepper, token))
 	if err := row.Scan(&userID, &exp); err != nil {
-		return "", time.Time{}, false
+		return "", ErrResetInvalid
+	}
+	now := time.Now()
+	if now.After(exp) {
+		// an expired link mustn't take the user's newer links with it
+		userID = ""
+	}
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ? OR exp < ?`, userID, now.UTC()); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	if userID == "" {
+		return "", ErrResetInvalid
+	}
+	return userID, nil
+}
+
+// ---------- Magic links / email codes ----------
+
+// SaveMagicLogin stores a pending email login for a user, replacing any
+// earlier one. link or code may be empty when only the other was sent.
+// Wrong codes entered against the earlier login still count until its
+// attempt window closes, so asking for a new code doesn't buy more guesses.
+func (s *SQLiteStore) SaveMagicLogin(userID, link, code string, exp time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO magic_logins (user_id, link_hash, code_hash, attempts, attempts_until_unix, exp) VALUES (?, ?, ?, 0, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET link_hash = excluded.link_hash, code_hash = excluded.code_hash, exp = excluded.exp,
+		attempts = CASE WHEN magic_logins.attempts_until_unix > ? THEN magic_logins.attempts ELSE 0 END,
+		attempts_until_unix = CASE WHEN magic_logins.attempts_until_unix > ? THEN magic_logins.attempts_until_unix ELSE excluded.attempts_until_unix END`,
+		userID, optionalHash(s.pepper, link), optionalHash(s.pepper, code), exp.Unix(), exp.UTC(),
+		time.Now().Unix(), time.Now().Unix())
+	return err
+}
+
+// ConsumeMagicLink spends a magic link and returns the user it was sent to.
+func (s *SQLiteStore) ConsumeMagicLink(link string) (string, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var userID string
+	var exp time.Time
+	row := tx.QueryRow(`SELECT user_id, exp FROM magic_logins WHERE link_hash = ?`, hashToken(s.pepper, link))
+	if err := row.Scan(&userID, &exp); err != nil {
+		return "", ErrMagicInvalid
+	}
+	if _, err := tx.Exec(`DELETE FROM magic_logins WHERE user_id = ?`, userID); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	if time.Now().After(exp) {
+		return "", ErrMagicInvalid
+	}
+	return userID, nil
+}
+
+// ConsumeMagicCode checks an emailed code. A wrong code counts against the
+// pending login's attempt window; after maxTries in it the code is dropped
+// and codes sent before the window closes are refused too.
+func (s *SQLiteStore) ConsumeMagicCode(userID, code string, maxTries int) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var codeHash sql.NullString
+	var attempts int
+	var until int64
+	var exp time.Time
+	row := tx.QueryRow(`SELECT code_hash, attempts, attempts_until_unix, exp FROM magic_logins WHERE user_id = ?`, userID)
+	if err := row.Scan(&codeHash, &attempts, &until, &exp); err != nil {
+		return ErrMagicInvalid
+	}
+	now := time.Now()
+	if now.Unix() >= until {
+		attempts, until = 0, exp.Unix()
+	}
+	result := ErrMagicInvalid
+	switch {
+	case now.After(exp):
+		_, err = tx.Exec(`DELETE FROM magic_logins WHERE user_id = ?`, userID)
+	case attempts >= maxTries:
+		result = ErrMagicTooMany
+	case !codeHash.Valid:
+	case codeHash.String == hashToken(s.pepper, code):
+		result = nil
+		_, err = tx.Exec(`DELETE FROM magic_logins WHERE user_id = ?`, userID)
+	case attempts+1 >= maxTries:
+		result = ErrMagicTooMany
+		_, err = tx.Exec(`UPDATE magic_logins SET attempts = ?, attempts_until_unix = ?, code_hash = NULL WHERE user_id = ?`,
+			attempts+1, until, userID)
+	default:
+		_, err = tx.Exec(`UPDATE magic_logins SET attempts = ?, attempts_until_unix = ? WHERE user_id = ?`,
+			attempts+1, until, userID)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return result
+}
+
+// ---------- Sign-in throttling ----------
+
+// LoginThrottle returns the failed sign-in record of key; zero when clean.
+func (s *SQLiteStore) LoginThrottle(key string) (Throttle, error) {
+	var t Throttle
+	var last, locked int64
+	err := s.db.QueryRow(`SELECT failures, last_failure_unix, locked_until_unix FROM login_throttle WHERE key = ?`, key).
+		Scan(&t.Failures, &last, &locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Throttle{}, nil
+	}
+	if err != nil {
+		return Throttle{}, err
+	}
+	t.LastFailure, t.LockedUntil = unixOrZero(last), unixOrZero(locked)
+	return t, nil
+}
+
+// AddLoginFailure counts a failed sign-in against key and returns the new
+// count. Failures from before resetBefore are forgotten first.
+func (s *SQLiteStore) AddLoginFailure(key string, resetBefore time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRow(`INSERT INTO login_throttle (key, failures, last_failure_unix) VALUES (?, 1, ?)
+		ON CONFLICT(key) DO UPDATE SET
+		failures = CASE WHEN last_failure_unix < ? THEN 1 ELSE failures + 1 END,
+		last_failure_unix = excluded.last_failure_unix
+		RETURNING failures`, key, time.Now().Unix(), resetBefore.Unix()).Scan(&n)
+	return n, err
+}
+
+// LockLogin refuses sign-ins for key until the given time.
+func (s *SQLiteStore) LockLogin(key string, until time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO login_throttle (key, locked_until_unix) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET locked_until_unix = excluded.locked_until_unix`, key, until.Unix())
+	return err
+}
+
+// ClearLoginFailures forgets the failures of key and lifts any lock.
+func (s *SQLiteStore) ClearLoginFailures(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_throttle WHERE key = ?`, key)
+	return err
+}
+
+// IncrRateCounter adds a hit to key's rate limit window starting at start
+// and returns the hits in it and in the window before (see package ratelimit).
+func (s *SQLiteStore) IncrRateCounter(key string, start time.Time, window time.Duration) (int, int, error) {
+	if sweepRateCounters() {
+		_, _ = s.db.Exec(`DELETE FROM rate_limit_counters WHERE expires_unix < ?`, time.Now().Unix())
+	}
+	var curr, prev int
+	err := s.db.QueryRow(`INSERT INTO rate_limit_counters (key, window_start, hits, expires_unix) VALUES (?, ?, 1, ?)
+		ON CONFLICT(key, window_start) DO UPDATE SET hits = hits + 1
+		RETURNING hits`, key, start.Unix(), start.Add(2*window).Unix()).Scan(&curr)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = s.db.QueryRow(`SELECT hits FROM rate_limit_counters WHERE key = ? AND window_start = ?`,
+		key, start.Add(-window).Unix()).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, err
 	}
-	return userID, exp.UTC(), true
+	return curr, prev, nil
+}
+
+// ---------- Recovery codes ----------
+
+// ReplaceRecoveryCodes discards a user's recovery codes and stores new ones.
+func (s *SQLiteStore) ReplaceRecoveryCodes(userID string, codes []string) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, c := range codes {
+		if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (id, user_id, code_hash, created_at) VALUES (?, ?, ?, ?)`,
+			newID("rc_"), userID, hashToken(s.pepper, c), now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UnusedRecoveryCodes(userID string) ([]RecoveryCode, error) {
+	rows, err := s.db.Query(`SELECT id, code_hash FROM mfa_recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []RecoveryCode
+	for rows.Next() {
+		var c RecoveryCode
+		if err := rows.Scan(&c.ID, &c.Hash); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// ConsumeRecoveryCode spends the unused code equal to code; ErrRecoveryCodeUsed
+// if there is none.
+func (s *SQLiteStore) ConsumeRecoveryCode(userID, code string) error {
+	res, err := s.db.Exec(`UPDATE mfa_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		time.Now().UTC(), userID, hashToken(s.pepper, code))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRecoveryCodeUsed
+	}
+	return nil
+}
+
+// ---------- WebAuthn credentials ----------
+
+func (s *SQLiteStore) AddWebAuthnCredential(c WebAuthnCredential) error {
+	now := time.Now().UTC()
+	_, err := s.db.Exec(`
+INSERT INTO webauthn_credentials (id, user_id, name, public_key, sign_count, transports, created_at, last_used_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+`, c.ID, c.UserID, c.Name, c.PublicKey, c.SignCount, encodeList(c.Transports), now, now)
+	if isUniqueConstraint(err) {
+		return ErrCredentialExists
+	}
+	return err
+}
+
+const sqliteSelectCredential = `SELECT id, user_id, name, public_key, sign_count, transports, created_at, last_used_at FROM webauthn_credentials`
+
+func (s *SQLiteStore) ListWebAuthnCredentials(userID string) ([]WebAuthnCredential, error) {
+	rows, err := s.db.Query(sqliteSelectCredential+` WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []WebAuthnCredential
+	for rows.Next() {
+		c, err := scanCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) GetWebAuthnCredential(id string) (WebAuthnCredential, error) {
+	c, err := scanCredential(s.db.QueryRow(sqliteSelectCredential+` WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebAuthnCredential{}, ErrCredentialNotFound
+	}
+	return c, err
+}
+
+// UseWebAuthnCredential stores the sign count of a successful assertion.
+func (s *SQLiteStore) UseWebAuthnCredential(id string, signCount uint32) error {
+	res, err := s.db.Exec(`UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ? WHERE id = ?`,
+		signCount, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) DeleteWebAuthnCredential(userID, id string) error {
+	res, err := s.db.Exec(`DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// ---------- Federated identities ----------
+
+// FindIdentity returns the user linked to subject at provider.
+func (s *SQLiteStore) FindIdentity(provider, subject string) (User, bool) {
+	var userID string
+	row := s.db.QueryRow(`SELECT user_id FROM identities WHERE provider = ? AND subject = ?`, provider, subject)
+	if err := row.Scan(&userID); err != nil {
+		return User{}, false
+	}
+	return s.GetUser(userID)
+}
+
+// LinkIdentity links subject at provider to a user; ErrIdentityExists if it is linked already.
+func (s *SQLiteStore) LinkIdentity(ident Identity) error {
+	_, err := s.db.Exec(`
+INSERT INTO identities (provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)
+`, ident.Provider, ident.Subject, ident.UserID, ident.Email, time.Now().UTC())
+	if isUniqueConstraint(err) {
+		return ErrIdentityExists
+	}
+	return err
+}
+
+// ---------- Refresh tokens ----------
+
+// SaveRefresh opens a new session for userID with token as its first refresh token.
+func (s *SQLiteStore) SaveRefresh(token, userID string, exp time.Time, meta SessionMeta) (string, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	sessionID := newID("s_")
+	now := time.Now().UTC()
+	if _, err := tx.Exec(`
+INSERT INTO sessions (id, user_id, device_name, ip, user_agent, client_id, scope, created_at, last_used_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+`, sessionID, userID, meta.DeviceName, meta.IP, meta.UserAgent, meta.ClientID, meta.Scope, now, now); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`
+INSERT INTO refresh_tokens (token_hash, user_id, exp, family_id) VALUES (?, ?, ?, ?)
+`, hashToken(s.pepper, token), userID, exp.UTC(), sessionID); err != nil {
+		return "", err
+	}
+	return sessionID, tx.Commit()
+}
+
+// RotateRefresh marks old as used and writes newToken into the same session.
+// Presenting an already rotated token revokes the whole session and is audited.
+func (s *SQLiteStore) RotateRefresh(old string, newToken string, exp time.Time, meta SessionMeta) (RefreshToken, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var (
+		owner, family string
+		oldExp        time.Time
+		rotatedAt     sql.NullTime
+	)
+	oldHash := hashToken(s.pepper, old)
+	row := tx.QueryRow(`SELECT user_id, family_id, exp, rotated_at FROM refresh_tokens WHERE token_hash = ?`, oldHash)
+	if err := row.Scan(&owner, &family, &oldExp, &rotatedAt); err != nil {
+		return RefreshToken{}, ErrRefreshInvalid
+	}
+	if time.Now().After(oldExp) {
+		return RefreshToken{}, ErrRefreshInvalid
+	}
+	if rotatedAt.Valid {
+		if err := s.dropSession(tx, family); err != nil {
+			return RefreshToken{}, err
+		}
+		if _, err := tx.Exec(sqliteInsertAudit, auditArgs(AuditEvent{
+			UserID: owner,
+			Kind:   AuditRefreshReuse,
+			Detail: map[string]any{"family_id": family},
+		})...); err != nil {
+			return RefreshToken{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{UserID: owner, SessionID: family}, ErrRefreshReused
+	}
+	now := time.Now().UTC()
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE token_hash = ?`, now, oldHash); err != nil {
+		return RefreshToken{}, err
+	}
+	if _, err := tx.Exec(`
+INSERT INTO refresh_tokens (token_hash, user_id, exp, family_id) VALUES (?, ?, ?, ?)
+`, hashToken(s.pepper, newToken), owner, exp.UTC(), family); err != nil {
+		return RefreshToken{}, err
+	}
+	if _, err := tx.Exec(`
+UPDATE sessions SET last_used_at = ?, ip = ?, user_agent = ?,
+  device_name = CASE WHEN ? = '' THEN device_name ELSE ? END
+WHERE id = ?
+`, now, meta.IP, meta.UserAgent, meta.DeviceName, meta.DeviceName, family); err != nil {
+		return RefreshToken{}, err
+	}
+	rt := RefreshToken{UserID: owner, SessionID: family, Exp: exp}
+	_ = tx.QueryRow(`SELECT client_id, scope FROM sessions WHERE id = ?`, family).Scan(&rt.ClientID, &rt.Scope)
+	return rt, tx.Commit()
+}
+
+// LookupRefresh only reports live tokens; rotated ones are kept solely for reuse detection.
+func (s *SQLiteStore) LookupRefresh(token string) (RefreshToken, bool) {
+	var rt RefreshToken
+	row := s.db.QueryRow(`
+SELECT t.user_id, t.family_id, t.exp, COALESCE(s.client_id, ''), COALESCE(s.scope, '')
+FROM refresh_tokens t LEFT JOIN sessions s ON s.id = t.family_id
+WHERE t.token_hash = ? AND t.rotated_at IS NULL
+`, hashToken(s.pepper, token))
+	if err := row.Scan(&rt.UserID, &rt.SessionID, &rt.Exp, &rt.ClientID, &rt.Scope); err != nil {
+		return RefreshToken{}, false
+	}
+	rt.Exp = rt.Exp.UTC()
+	return rt, true
+}
+
+// ---------- Sessions ----------
+
+func (s *SQLiteStore) ListSessions(userID string) ([]Session, error) {
+	rows, err := s.db.Query(`
+SELECT id, device_name, ip, user_agent, client_id, scope, created_at, last_used_at FROM sessions
+WHERE user_id = ? ORDER BY last_used_at DESC
+`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Session{}
+	for rows.Next() {
+		sess := Session{UserID: userID}
+		if err := rows.Scan(&sess.ID, &sess.DeviceName, &sess.IP, &sess.UserAgent, &sess.ClientID, &sess.Scope, &sess.CreatedAt, &sess.LastUsedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, sess)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) RevokeSession(userID, sessionID string) error {
+	var owner string
+	if err := s.db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, sessionID).Scan(&owner); err != nil || owner != userID {
+		return ErrSessionNotFound
+	}
+	return s.dropSession(s.db, sessionID)
+}
+
+// RevokeOtherSessions ends every session of userID except keepID and returns the revoked ids.
+func (s *SQLiteStore) RevokeOtherSessions(userID, keepID string) ([]string, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(`SELECT id FROM sessions WHERE user_id = ? AND id <> ?`, userID, keepID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	_ = rows.Close()
+	for _, id := range ids {
+		if err := s.dropSession(tx, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// ---------- Access token revocation ----------
+
+func (s *SQLiteStore) RevokeAccess(kind, value string, exp time.Time) error {
+	_, err := s.db.Exec(`
+INSERT INTO revocations (kind, value, exp, created_at) VALUES (?, ?, ?, ?)
+ON CONFLICT (kind, value) DO UPDATE SET exp = excluded.exp, created_at = excluded.created_at
+`, kind, value, exp.UTC(), time.Now().UTC())
+	return err
+}
+
+// RevokeOnce records a revocation unless one already exists, so exactly one
+// caller gets to spend a single-use token.
+func (s *SQLiteStore) RevokeOnce(kind, value string, exp time.Time) error {
+	res, err := s.db.Exec(`
+INSERT INTO revocations (kind, value, exp, created_at) VALUES (?, ?, ?, ?)
+ON CONFLICT (kind, value) DO NOTHING
+`, kind, value, exp.UTC(), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAlreadyRevoked
+	}
+	return nil
+}
+
+// ListRevocations returns unexpired revocations recorded after since and
+// forgets the expired ones.
+func (s *SQLiteStore) ListRevocations(since time.Time) ([]Revocation, error) {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`DELETE FROM revocations WHERE exp < ?`, now); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT kind, value, exp, created_at FROM revocations WHERE created_at > ?`, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Revocation{}
+	for rows.Next() {
+		var rv Revocation
+		if err := rows.Scan(&rv.Kind, &rv.Value, &rv.Exp, &rv.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, rv)
+	}
+	return out, rows.Err()
+}
+
+// ---------- OAuth clients ----------
+
+// UpsertClient registers a client or replaces its settings and secret.
+// Public clients pass an empty secret. A disabled client stays disabled.
+func (s *SQLiteStore) UpsertClient(c Client, secret string) error {
+	secretHash := ""
+	if secret != "" {
+		secretHash = hashToken(s.pepper, secret)
+	}
+	_, err := s.db.Exec(`
+INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, public, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET name = excluded.name, secret_hash = excluded.secret_hash,
+  redirect_uris = excluded.redirect_uris, public = excluded.public, scopes = excluded.scopes
+`, c.ID, c.Name, secretHash, encodeList(c.RedirectURIs), c.Public, encodeList(c.Scopes), time.Now().UTC())
+	return err
+}
+
+// CreateClient registers a new client; it fails with ErrClientExists if the id is taken.
+func (s *SQLiteStore) CreateClient(c Client, secret string) error {
+	secretHash := ""
+	if secret != "" {
+		secretHash = hashToken(s.pepper, secret)
+	}
+	_, err := s.db.Exec(`
+INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, public, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+`, c.ID, c.Name, secretHash, encodeList(c.RedirectURIs), c.Public, encodeList(c.Scopes), time.Now().UTC())
+	if isUniqueConstraint(err) {
+		return ErrClientExists
+	}
+	return err
+}
+
+const sqliteSelectClient = `SELECT id, name, redirect_uris, public, scopes, disabled, created_at FROM oauth_clients`
+
+func (s *SQLiteStore) GetClient(id string) (Client, bool) {
+	c, err := scanClient(s.db.QueryRow(sqliteSelectClient+` WHERE id = ?`, id))
+	return c, err == nil
+}
+
+func (s *SQLiteStore) ListClients() ([]Client, error) {
+	rows, err := s.db.Query(sqliteSelectClient + ` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Client{}
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// RotateClientSecret replaces the secret; the old one keeps working until graceUntil.
+func (s *SQLiteStore) RotateClientSecret(id, secret string, graceUntil time.Time) error {
+	res, err := s.db.Exec(`
+UPDATE oauth_clients SET prev_secret_hash = secret_hash, prev_secret_exp = ?, secret_hash = ? WHERE id = ?
+`, graceUntil.UTC(), hashToken(s.pepper, secret), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetClientDisabled(id string, disabled bool) error {
+	res, err := s.db.Exec(`UPDATE oauth_clients SET disabled = ? WHERE id = ?`, disabled, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+// AuthenticateClient checks client credentials; disabled clients never authenticate.
+func (s *SQLiteStore) AuthenticateClient(id, secret string) (Client, error) {
+	var (
+		current, prev string
+		prevExp       sql.NullTime
+	)
+	row := s.db.QueryRow(`SELECT secret_hash, prev_secret_hash, prev_secret_exp FROM oauth_clients WHERE id = ?`, id)
+	if err := row.Scan(&current, &prev, &prevExp); err != nil {
+		return Client{}, ErrClientInvalid
+	}
+	c, ok := s.GetClient(id)
+	if !ok || c.Disabled || !clientSecretOK(s.pepper, secret, current, prev, prevExp.Time) {
+		return Client{}, ErrClientInvalid
+	}
+	return c, nil
+}
+
+func (s *SQLiteStore) SaveAuthCode(code string, ac AuthCode) error {
+	_, err := s.db.Exec(`
+INSERT INTO oauth_codes (code_hash, client_id, user_id, redirect_uri, scope, code_challenge, code_challenge_method, nonce, auth_time, exp)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`, hashToken(s.pepper, code), ac.ClientID, ac.UserID, ac.RedirectURI, ac.Scope, ac.CodeChallenge, ac.CodeChallengeMethod,
+		ac.Nonce, ac.AuthTime.UTC(), ac.Exp.UTC())
+	return err
+}
+
+// ConsumeAuthCode spends code if it was issued to clientID for redirectURI; a
+// mismatch leaves it unspent. Spent codes are kept until they expire so that a
+// second exchange returns ErrCodeReused with the session the first one opened.
+func (s *SQLiteStore) ConsumeAuthCode(code, clientID, redirectURI string) (AuthCode, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return AuthCode{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	h := hashToken(s.pepper, code)
+	var ac AuthCode
+	var used bool
+	row := tx.QueryRow(`
+SELECT client_id, user_id, redirect_uri, scope, code_challenge, code_challenge_method, nonce, auth_time, exp, used, session_id
+FROM oauth_codes WHERE code_hash = ?
+`, h)
+	var authTime sql.NullTime
+	if err := row.Scan(&ac.ClientID, &ac.UserID, &ac.RedirectURI, &ac.Scope, &ac.CodeChallenge, &ac.CodeChallengeMethod,
+		&ac.Nonce, &authTime, &ac.Exp, &used, &ac.SessionID); err != nil {
+		return AuthCode{}, ErrCodeInvalid
+	}
+	ac.AuthTime = authTime.Time
+	if time.Now().After(ac.Exp) || ac.ClientID != clientID || ac.RedirectURI != redirectURI {
+		return AuthCode{}, ErrCodeInvalid
+	}
+	if used {
+		return ac, ErrCodeReused
+	}
+	if _, err := tx.Exec(`UPDATE oauth_codes SET used = 1 WHERE code_hash = ?`, h); err != nil {
+		return AuthCode{}, err
+	}
+	if _, err := tx.Exec(`DELETE FROM oauth_codes WHERE exp < ?`, time.Now().UTC()); err != nil {
+		return AuthCode{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return AuthCode{}, err
+	}
+	return ac, nil
+}
+
+// SetAuthCodeSession records the session a code was exchanged for.
+func (s *SQLiteStore) SetAuthCodeSession(code, sessionID string) error {
+	_, err := s.db.Exec(`UPDATE oauth_codes SET session_id = ? WHERE code_hash = ?`, sessionID, hashToken(s.pepper, code))
+	return err
+}
+
+// dropSession deletes a session row together with its refresh tokens.
+func (s *SQLiteStore) dropSession(db execer, sessionID string) error {
+	if _, err := db.Exec(`DELETE FROM refresh_tokens WHERE family_id = ?`, sessionID); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM sessions WHERE id = ?`, sessionID)
+	return err
+}
+
+// ---------- Audit ----------
+
+const sqliteInsertAudit = `INSERT INTO audit_events (user_id, kind, detail, created_at) VALUES (?, ?, ?, ?)`
+
+func (s *SQLiteStore) RecordAudit(ev AuditEvent) error {
+	_, err := s.db.Exec(sqliteInsertAudit, auditArgs(ev)...)
+	return err
 }
 
 // ---------- helpers ----------
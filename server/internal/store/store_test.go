@@ -0,0 +1,234 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mahi/server/internal/auth"
+)
+
+// driver is the part of the stores the tests below exercise.
+type driver interface {
+	CreateUser(email, name string) (User, error)
+	SaveRefresh(token, userID string, exp time.Time, meta SessionMeta) (string, error)
+	LookupRefresh(token string) (RefreshToken, bool)
+	SaveAuthCode(code string, ac AuthCode) error
+	ConsumeAuthCode(code, clientID, redirectURI string) (AuthCode, error)
+	SetAuthCodeSession(code, sessionID string) error
+	RevokeOnce(kind, value string, exp time.Time) error
+	SavePasswordReset(token, userID string, exp time.Time) error
+	ConsumePasswordReset(token string) (string, error)
+	HasPassword(userID string) bool
+	SetPassword(ctx context.Context, hashes *auth.HashScheduler, userID, plain string) error
+	VerifyCreds(ctx context.Context, hashes *auth.HashScheduler, email, plain string) (User, error)
+}
+
+// opener opens a store over the same database with the given keys; nil for memory.
+type opener func(t *testing.T, keys Keys) (driver, *sql.DB)
+
+func testKeys() Keys {
+	return Keys{TokenPepper: []byte("test-pepper"), SecretKey: make([]byte, 32)}
+}
+
+// eachStore runs fn against every driver. Postgres runs only when
+// TEST_POSTGRES_DSN points at a database the test may write to.
+func eachStore(t *testing.T, fn func(t *testing.T, st driver, db *sql.DB, reopen opener)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemory(testKeys()), nil, nil)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "app.db")
+		open := func(t *testing.T, keys Keys) (driver, *sql.DB) {
+			t.Helper()
+			s, err := NewSQLite(path, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = s.db.Close() })
+			return s, s.db
+		}
+		st, db := open(t, testKeys())
+		fn(t, st, db, open)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("TEST_POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("TEST_POSTGRES_DSN not set")
+		}
+		open := func(t *testing.T, keys Keys) (driver, *sql.DB) {
+			t.Helper()
+			p, err := NewPostgres(dsn, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = p.db.Close() })
+			return p, p.db
+		}
+		st, db := open(t, testKeys())
+		fn(t, st, db, open)
+	})
+}
+
+// uniqueEmail keeps tests independent on a shared Postgres database.
+func uniqueEmail(prefix string) string {
+	return prefix + "+" + newID("") + "@example.com"
+}
+
+func TestRefreshTokensHashedAtRest(t *testing.T) {
+	eachStore(t, func(t *testing.T, st driver, db *sql.DB, reopen opener) {
+		u, err := st.CreateUser(uniqueEmail("rt"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := newID("rt_")
+		sessionID, err := st.SaveRefresh(token, u.ID, time.Now().Add(time.Hour), SessionMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rt, ok := st.LookupRefresh(token); !ok || rt.UserID != u.ID || rt.SessionID != sessionID {
+			t.Fatalf("lookup = %+v, %v", rt, ok)
+		}
+		if db == nil {
+			return
+		}
+
+		var stored string
+		if err := db.QueryRow(`SELECT token_hash FROM refresh_tokens WHERE family_id = '` + sessionID + `'`).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored == token || stored != hashToken([]byte("test-pepper"), token) {
+			t.Fatalf("stored %q for token %q", stored, token)
+		}
+
+		// a dump of the table is useless without the pepper
+		other, _ := reopen(t, Keys{TokenPepper: []byte("other-pepper"), SecretKey: make([]byte, 32)})
+		if _, ok := other.LookupRefresh(token); ok {
+			t.Fatal("token found with a different pepper")
+		}
+		if _, ok := other.LookupRefresh(stored); ok {
+			t.Fatal("stored hash accepted as a token")
+		}
+	})
+}
+
+func TestConsumeAuthCode(t *testing.T) {
+	eachStore(t, func(t *testing.T, st driver, _ *sql.DB, _ opener) {
+		u, err := st.CreateUser(uniqueEmail("code"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		save := func(exp time.Time) string {
+			code := newID("c_")
+			err := st.SaveAuthCode(code, AuthCode{ClientID: "web", UserID: u.ID, RedirectURI: "https://app.example/cb",
+				CodeChallenge: "challenge", CodeChallengeMethod: "S256", AuthTime: time.Now(), Exp: exp})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return code
+		}
+		code := save(time.Now().Add(time.Minute))
+
+		for _, tt := range []struct{ name, code, client, redirect string }{
+			{"unknown code", "nope", "web", "https://app.example/cb"},
+			{"another client", code, "other", "https://app.example/cb"},
+			{"another redirect_uri", code, "web", "https://evil.example/cb"},
+			{"expired", save(time.Now().Add(-time.Second)), "web", "https://app.example/cb"},
+		} {
+			if _, err := st.ConsumeAuthCode(tt.code, tt.client, tt.redirect); !errors.Is(err, ErrCodeInvalid) {
+				t.Fatalf("%s: err = %v, want ErrCodeInvalid", tt.name, err)
+			}
+		}
+
+		ac, err := st.ConsumeAuthCode(code, "web", "https://app.example/cb")
+		if err != nil || ac.UserID != u.ID || ac.CodeChallenge != "challenge" {
+			t.Fatalf("first exchange: %+v, %v", ac, err)
+		}
+		if err := st.SetAuthCodeSession(code, "s_granted"); err != nil {
+			t.Fatal(err)
+		}
+		ac, err = st.ConsumeAuthCode(code, "web", "https://app.example/cb")
+		if !errors.Is(err, ErrCodeReused) || ac.SessionID != "s_granted" || ac.UserID != u.ID {
+			t.Fatalf("second exchange: %+v, %v", ac, err)
+		}
+	})
+}
+
+func TestRevokeOnce(t *testing.T) {
+	eachStore(t, func(t *testing.T, st driver, _ *sql.DB, _ opener) {
+		jti := newID("jti_")
+		exp := time.Now().Add(time.Minute)
+		if err := st.RevokeOnce(RevokeKindJTI, jti, exp); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.RevokeOnce(RevokeKindJTI, jti, exp); !errors.Is(err, ErrAlreadyRevoked) {
+			t.Fatalf("second spend: err = %v, want ErrAlreadyRevoked", err)
+		}
+		if err := st.RevokeOnce(RevokeKindSession, jti, exp); err != nil {
+			t.Fatalf("same value, other kind: %v", err)
+		}
+	})
+}
+
+func TestPasswordResetSingleUse(t *testing.T) {
+	eachStore(t, func(t *testing.T, st driver, _ *sql.DB, _ opener) {
+		u, err := st.CreateUser(uniqueEmail("reset"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, second, expired := newID("pr_"), newID("pr_"), newID("pr_")
+		for tok, exp := range map[string]time.Time{
+			first:   time.Now().Add(time.Hour),
+			second:  time.Now().Add(time.Hour),
+			expired: time.Now().Add(-time.Second),
+		} {
+			if err := st.SavePasswordReset(tok, u.ID, exp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := st.ConsumePasswordReset(expired); !errors.Is(err, ErrResetInvalid) {
+			t.Fatalf("expired link: err = %v", err)
+		}
+		if id, err := st.ConsumePasswordReset(first); err != nil || id != u.ID {
+			t.Fatalf("first use: %q, %v", id, err)
+		}
+		// using one link spends every link the user was sent
+		for _, tok := range []string{first, second} {
+			if _, err := st.ConsumePasswordReset(tok); !errors.Is(err, ErrResetInvalid) {
+				t.Fatalf("reuse: err = %v, want ErrResetInvalid", err)
+			}
+		}
+	})
+}
+
+func TestHasPassword(t *testing.T) {
+	eachStore(t, func(t *testing.T, st driver, _ *sql.DB, _ opener) {
+		email := uniqueEmail("haspw")
+		u, err := st.CreateUser(email, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.HasPassword(u.ID) {
+			t.Fatal("new account reports a password")
+		}
+		ctx, hashes := context.Background(), auth.NewHashScheduler(1, 4, 5*time.Second)
+		for _, guess := range []string{"", "placeholder"} {
+			if _, err := st.VerifyCreds(ctx, hashes, email, guess); !errors.Is(err, ErrInvalidCreds) {
+				t.Fatalf("sign-in with %q on a passwordless account: err = %v", guess, err)
+			}
+		}
+		if err := st.SetPassword(ctx, hashes, u.ID, "plum orbit canvas ladder"); err != nil {
+			t.Fatal(err)
+		}
+		if !st.HasPassword(u.ID) {
+			t.Fatal("password not reported after SetPassword")
+		}
+		if st.HasPassword("u_missing") {
+			t.Fatal("unknown user reports a password")
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package store
+
+import "time"
+
+// Throttle is the failed sign-in record of one key: an account ("acct:" +
+// email), a client address ("ip:" + address) or the second factor of a user
+// ("mfa:" + user id).
+type Throttle struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time // no attempts before this; zero when not locked
+}
+
+// Audit event kinds for sign-in lockouts
+const (
+	AuditAccountLocked   = "login.locked"
+	AuditAccountUnlocked = "login.unlocked"
+)
+
+func unixOrZero(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Keys holds the server-side secrets the stores use to protect data at rest.
+type Keys struct {
+	// TokenPepper keys the HMAC applied to refresh tokens before they are stored,
+	// so a database dump alone cannot be replayed as live sessions.
+	TokenPepper []byte
+	// SecretKey (32 bytes) encrypts secrets we must be able to read back,
+	// like TOTP seeds, with AES-256-GCM.
+	SecretKey []byte
+}
+
+var errCiphertext = errors.New("malformed or tampered ciphertext")
+
+// seal encrypts plain as nonce||AES-GCM(plain); aad binds it to its row (e.g. the user id)
+// so ciphertexts can't be swapped between users.
+func seal(key, plain []byte, aad string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, []byte(aad)), nil
+}
+
+// open reverses seal.
+func open(key, sealed []byte, aad string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errCiphertext
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(aad))
+	if err != nil {
+		return nil, errCiphertext
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hashToken returns hex(HMAC-SHA256(pepper, token)); this is what we persist and look up by.
+func hashToken(pepper []byte, token string) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrCredentialNotFound = errors.New("webauthn credential not found")
+	ErrCredentialExists   = errors.New("webauthn credential already registered")
+)
+
+// WebAuthnCredential is a passkey or security key registered to a user.
+// ID is the base64url credential ID the authenticator chose.
+type WebAuthnCredential struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	Name       string    `json:"name"`
+	PublicKey  []byte    `json:"-"` // COSE_Key
+	SignCount  uint32    `json:"-"`
+	Transports []string  `json:"transports"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// Audit event kinds for passkeys
+const (
+	AuditWebAuthnAdded   = "mfa.webauthn_added"
+	AuditWebAuthnRemoved = "mfa.webauthn_removed"
+)
+
+// scanCredential reads the columns of sqliteSelectCredential / pgSelectCredential.
+func scanCredential(row interface{ Scan(...any) error }) (WebAuthnCredential, error) {
+	var c WebAuthnCredential
+	var transports string
+	if err := row.Scan(&c.ID, &c.UserID, &c.Name, &c.PublicKey, &c.SignCount, &transports, &c.CreatedAt, &c.LastUsedAt); err != nil {
+		return WebAuthnCredential{}, err
+	}
+	c.Transports = decodeList(transports)
+	return c, nil
+}
@@ -0,0 +1,147 @@
+package webauthn
+
+import (
+	"errors"
+	"math"
+)
+
+var errCBOR = errors.New("webauthn: malformed CBOR")
+
+// maps and arrays nest this deep at most in anything an authenticator sends
+const maxCBORDepth = 8
+
+// decodeCBOR reads one CBOR data item from the start of b and reports how many
+// bytes it used. Only what WebAuthn needs is supported: integers (as int64),
+// byte strings, text strings, arrays, maps keyed by integers or strings,
+// booleans and null. Indefinite lengths, tags and floats are rejected.
+func decodeCBOR(b []byte) (any, int, error) {
+	d := cborDecoder{b: b}
+	v, err := d.item(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, d.off, nil
+}
+
+type cborDecoder struct {
+	b   []byte
+	off int
+}
+
+func (d *cborDecoder) head() (major, info byte, arg uint64, err error) {
+	if d.off >= len(d.b) {
+		return 0, 0, 0, errCBOR
+	}
+	major, info = d.b[d.off]>>5, d.b[d.off]&0x1f
+	d.off++
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(d.b)-d.off < n {
+			return 0, 0, 0, errCBOR
+		}
+		for _, c := range d.b[d.off : d.off+n] {
+			arg = arg<<8 | uint64(c)
+		}
+		d.off += n
+		return major, info, arg, nil
+	}
+	return 0, 0, 0, errCBOR
+}
+
+func (d *cborDecoder) item(depth int) (any, error) {
+	if depth > maxCBORDepth {
+		return nil, errCBOR
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	// every element of a string, array or map takes at least one byte
+	remaining := uint64(len(d.b) - d.off)
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errCBOR
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errCBOR
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		if arg > remaining {
+			return nil, errCBOR
+		}
+		s := d.b[d.off : d.off+int(arg)]
+		d.off += int(arg)
+		if major == 3 {
+			return string(s), nil
+		}
+		return append([]byte(nil), s...), nil
+	case 4:
+		if arg > remaining {
+			return nil, errCBOR
+		}
+		arr := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 5:
+		if arg > remaining/2 {
+			return nil, errCBOR
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, errCBOR
+			}
+			if _, dup := m[k]; dup {
+				return nil, errCBOR
+			}
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		}
+	}
+	return nil, errCBOR
+}
+
+// cborMap decodes b as a single CBOR map with nothing after it.
+func cborMap(b []byte) (map[any]any, error) {
+	v, n, err := decodeCBOR(b)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[any]any)
+	if !ok || n != len(b) {
+		return nil, errCBOR
+	}
+	return m, nil
+}
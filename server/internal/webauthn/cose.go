@@ -0,0 +1,132 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) we accept for credentials.
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// Algs lists the supported algorithms in order of preference, for pubKeyCredParams.
+var Algs = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+var ErrUnsupportedKey = errors.New("webauthn: unsupported credential key")
+
+// COSE_Key labels
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // EC2/OKP curve; RSA modulus n
+	coseX   = -2 // EC2/OKP x; RSA exponent e
+	coseY   = -3
+
+	ktyOKP = 1
+	ktyEC2 = 2
+	ktyRSA = 3
+
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+// coseKey is a credential public key decoded from its COSE_Key encoding.
+type coseKey struct {
+	alg int64
+	pub crypto.PublicKey
+}
+
+func parseCOSEKey(raw []byte) (coseKey, error) {
+	m, err := cborMap(raw)
+	if err != nil {
+		return coseKey{}, err
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+	switch {
+	case kty == ktyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != crvP256 || len(x) != 32 || len(y) != 32 {
+			return coseKey{}, ErrUnsupportedKey
+		}
+		// ecdh rejects points that aren't on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return coseKey{}, ErrUnsupportedKey
+		}
+		return coseKey{alg, &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}}, nil
+	case kty == ktyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != crvEd25519 || len(x) != ed25519.PublicKeySize {
+			return coseKey{}, ErrUnsupportedKey
+		}
+		return coseKey{alg, ed25519.PublicKey(x)}, nil
+	case kty == ktyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseCrv)].([]byte)
+		e, _ := m[int64(coseX)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return coseKey{}, ErrUnsupportedKey
+		}
+		exp := new(big.Int).SetBytes(e)
+		return coseKey{alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}}, nil
+	}
+	return coseKey{}, ErrUnsupportedKey
+}
+
+// verify checks sig over msg with the key's own algorithm.
+func (k coseKey) verify(msg, sig []byte) error {
+	return verifySig(k.alg, k.pub, msg, sig)
+}
+
+// verifySig checks a signature made with a COSE algorithm by pub.
+func verifySig(alg int64, pub crypto.PublicKey, msg, sig []byte) error {
+	bad := errors.New("webauthn: bad signature")
+	switch alg {
+	case AlgES256:
+		pk, ok := pub.(*ecdsa.PublicKey)
+		sum := sha256.Sum256(msg)
+		if !ok || !ecdsa.VerifyASN1(pk, sum[:], sig) {
+			return bad
+		}
+	case AlgEdDSA:
+		pk, ok := pub.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pk, msg, sig) {
+			return bad
+		}
+	case AlgRS256:
+		pk, ok := pub.(*rsa.PublicKey)
+		sum := sha256.Sum256(msg)
+		if !ok || rsa.VerifyPKCS1v15(pk, crypto.SHA256, sum[:], sig) != nil {
+			return bad
+		}
+	default:
+		return ErrUnsupportedKey
+	}
+	return nil
+}
+
+// x509Alg maps a COSE algorithm to the matching certificate signature algorithm.
+func x509Alg(alg int64) x509.SignatureAlgorithm {
+	switch alg {
+	case AlgES256:
+		return x509.ECDSAWithSHA256
+	case AlgEdDSA:
+		return x509.PureEd25519
+	case AlgRS256:
+		return x509.SHA256WithRSA
+	}
+	return x509.UnknownSignatureAlgorithm
+}
@@ -0,0 +1,92 @@
+package webauthn
+
+import "encoding/base64"
+
+// The option types mirror PublicKeyCredentialCreationOptionsJSON and
+// PublicKeyCredentialRequestOptionsJSON from WebAuthn Level 3: binary fields
+// are base64url strings, which browsers (PublicKeyCredential.parse*OptionsFromJSON)
+// and the native passkey modules take as is.
+
+type RPEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          string `json:"id"` // base64url user handle
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredParam struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"` // base64url credential ID
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+type CreationOptions struct {
+	RP                     RPEntity               `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              string                 `json:"challenge"`
+	PubKeyCredParams       []CredParam            `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredDescriptor       `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+type RequestOptions struct {
+	Challenge        string           `json:"challenge"`
+	Timeout          int              `json:"timeout"`
+	RPID             string           `json:"rpId"`
+	AllowCredentials []CredDescriptor `json:"allowCredentials"`
+	UserVerification string           `json:"userVerification"`
+}
+
+// CreationOptions builds the options for registering a passkey for a user.
+// userHandle must be stable and carry no personal data; exclude lists the
+// user's existing credentials so an authenticator isn't registered twice.
+func (rp RelyingParty) CreationOptions(userHandle []byte, name, displayName, challenge string, timeoutMS int, exclude []CredDescriptor) CreationOptions {
+	params := make([]CredParam, 0, len(Algs))
+	for _, alg := range Algs {
+		params = append(params, CredParam{Type: "public-key", Alg: alg})
+	}
+	if exclude == nil {
+		exclude = []CredDescriptor{}
+	}
+	return CreationOptions{
+		RP:                     RPEntity{ID: rp.ID, Name: rp.Name},
+		User:                   UserEntity{ID: base64.RawURLEncoding.EncodeToString(userHandle), Name: name, DisplayName: displayName},
+		Challenge:              challenge,
+		PubKeyCredParams:       params,
+		Timeout:                timeoutMS,
+		ExcludeCredentials:     exclude,
+		AuthenticatorSelection: AuthenticatorSelection{ResidentKey: "required", UserVerification: "required"},
+		Attestation:            "none",
+	}
+}
+
+// RequestOptions builds the options for signing in. An empty allow list lets
+// the platform offer any discoverable passkey for this relying party.
+func (rp RelyingParty) RequestOptions(challenge string, timeoutMS int, allow []CredDescriptor, userVerification string) RequestOptions {
+	if allow == nil {
+		allow = []CredDescriptor{}
+	}
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          timeoutMS,
+		RPID:             rp.ID,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
@@ -0,0 +1,161 @@
+package webauthn
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func fixtureRP(f string) RelyingParty {
+	return RelyingParty{ID: fixtureRPID, Name: "Mahi", Origins: []string{f}}
+}
+
+func flip(b []byte, i int) []byte {
+	out := append([]byte(nil), b...)
+	if i < 0 {
+		i += len(out)
+	}
+	out[i] ^= 0x01
+	return out
+}
+
+func TestVerifyRegistrationFixtures(t *testing.T) {
+	for _, name := range []string{"none", "packed", "packed_self", "fido_u2f"} {
+		t.Run(name, func(t *testing.T) {
+			var f registrationFixture
+			loadFixture(t, "registration_"+name+".json", &f)
+			cred, err := fixtureRP(f.Origin).VerifyRegistration(f.ClientDataJSON, f.AttestationObject, f.Challenge, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.AttestationFormat != f.Format || !bytes.Equal(cred.ID, f.CredentialID) ||
+				!bytes.Equal(cred.PublicKey, f.PublicKey) || cred.SignCount != f.SignCount {
+				t.Fatalf("credential = %+v", cred)
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	var none, packed, u2f registrationFixture
+	loadFixture(t, "registration_none.json", &none)
+	loadFixture(t, "registration_packed.json", &packed)
+	loadFixture(t, "registration_fido_u2f.json", &u2f)
+
+	// the client data still parses and matches, but its hash no longer does
+	tamperedCD := func(f registrationFixture) []byte {
+		return append(bytes.TrimSuffix(f.ClientDataJSON, []byte("}")), []byte(`,"extra":1}`)...)
+	}
+
+	tests := []struct {
+		name      string
+		rp        RelyingParty
+		f         registrationFixture
+		cd        []byte
+		challenge string
+		requireUV bool
+		want      error
+	}{
+		{name: "bad origin", rp: fixtureRP("https://evil.test"), f: none, want: ErrClientData},
+		{name: "wrong challenge", rp: fixtureRP(fixtureOrigin), f: none, challenge: NewChallenge(), want: ErrClientData},
+		{name: "assertion client data", rp: fixtureRP(fixtureOrigin), f: none,
+			cd: bytes.Replace(none.ClientDataJSON, []byte("webauthn.create"), []byte("webauthn.get"), 1), want: ErrClientData},
+		{name: "wrong RP ID hash", rp: RelyingParty{ID: "evil.test", Origins: []string{fixtureOrigin}}, f: packed, want: ErrRPID},
+		{name: "user not verified", rp: fixtureRP(fixtureOrigin), f: u2f, requireUV: true, want: ErrUserPresence},
+		{name: "packed signature over other client data", rp: fixtureRP(fixtureOrigin), f: packed, cd: tamperedCD(packed), want: ErrAttestation},
+		{name: "fido-u2f signature over other client data", rp: fixtureRP(fixtureOrigin), f: u2f, cd: tamperedCD(u2f), want: ErrAttestation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd, challenge := tt.f.ClientDataJSON, tt.f.Challenge
+			if tt.cd != nil {
+				cd = tt.cd
+			}
+			if tt.challenge != "" {
+				challenge = tt.challenge
+			}
+			if _, err := tt.rp.VerifyRegistration(cd, tt.f.AttestationObject, challenge, tt.requireUV); !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// a flipped byte in the attestation signature or in the signed authenticator data
+	for _, f := range []registrationFixture{packed, u2f} {
+		att, err := cborMap(f.AttestationObject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := att["attStmt"].(map[any]any)["sig"].([]byte)
+		ad := att["authData"].([]byte)
+		for _, part := range [][]byte{sig, ad[len(ad)-40:]} {
+			i := bytes.Index(f.AttestationObject, part) + len(part) - 1
+			if _, err := fixtureRP(fixtureOrigin).VerifyRegistration(f.ClientDataJSON, flip(f.AttestationObject, i), f.Challenge, false); err == nil {
+				t.Fatalf("%s: attestation object with byte %d flipped verified", f.Format, i)
+			}
+		}
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	var f, synced assertionFixture
+	loadFixture(t, "assertion_es256.json", &f)
+	loadFixture(t, "assertion_synced.json", &synced)
+	rp := fixtureRP(fixtureOrigin)
+
+	a, err := rp.VerifyAssertion(f.PublicKey, f.SignCount-1, f.ClientDataJSON, f.AuthenticatorData, f.Signature, f.Challenge, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.SignCount != f.SignCount || !a.UserVerified {
+		t.Fatalf("assertion = %+v", a)
+	}
+	// synced passkeys never count
+	if _, err := rp.VerifyAssertion(synced.PublicKey, 0, synced.ClientDataJSON, synced.AuthenticatorData, synced.Signature, synced.Challenge, true); err != nil {
+		t.Fatalf("synced passkey: %v", err)
+	}
+
+	type input struct {
+		rp        RelyingParty
+		stored    uint32
+		cd, ad    []byte
+		sig       []byte
+		challenge string
+	}
+	valid := func() input {
+		return input{rp: rp, stored: f.SignCount - 1, cd: f.ClientDataJSON, ad: f.AuthenticatorData, sig: f.Signature, challenge: f.Challenge}
+	}
+	tests := []struct {
+		name   string
+		mutate func(*input)
+		want   error // nil: any error
+	}{
+		{"bad origin", func(in *input) { in.rp = fixtureRP("https://evil.test") }, ErrClientData},
+		{"android origin not registered", func(in *input) { in.rp = fixtureRP("android:apk-key-hash:abc") }, ErrClientData},
+		{"wrong challenge", func(in *input) { in.challenge = NewChallenge() }, ErrClientData},
+		{"wrong RP ID hash", func(in *input) { in.rp = RelyingParty{ID: "evil.test", Origins: []string{fixtureOrigin}} }, ErrRPID},
+		{"sign count replayed", func(in *input) { in.stored = f.SignCount }, ErrSignCount},
+		{"sign count regressed", func(in *input) { in.stored = f.SignCount + 10 }, ErrSignCount},
+		{"counter dropped to 0", func(in *input) {
+			in.stored = 3
+			in.ad = synced.AuthenticatorData
+			in.cd = synced.ClientDataJSON
+			in.sig = synced.Signature
+			in.challenge = synced.Challenge
+		}, ErrSignCount},
+		{"tampered signature", func(in *input) { in.sig = flip(in.sig, -1) }, nil},
+		{"tampered authenticator data", func(in *input) { in.ad = flip(in.ad, -1) }, nil},
+		{"signature from another ceremony", func(in *input) { in.sig = synced.Signature }, nil},
+		{"truncated authenticator data", func(in *input) { in.ad = in.ad[:36] }, ErrAuthData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := valid()
+			tt.mutate(&in)
+			_, err := in.rp.VerifyAssertion(f.PublicKey, in.stored, in.cd, in.ad, in.sig, in.challenge, true)
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+-- refresh token families: rotated tokens are kept (rotated_at set) so that
+-- presenting one again revokes every token in the family
+ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN rotated_at DATETIME;
+
+CREATE TABLE IF NOT EXISTS audit_events (
+  id         INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id    TEXT NOT NULL,
+  kind       TEXT NOT NULL,
+  detail     TEXT NOT NULL DEFAULT '{}',   -- JSON
+  created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_family ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_audit_user ON audit_events(user_id);
@@ -0,0 +1,6 @@
+-- refresh tokens are stored as hex(HMAC-SHA256(TOKEN_PEPPER, token)).
+-- The server performs this migration on startup and converts existing rows in
+-- place. When applying it by hand (no pepper available to SQL) the plaintext
+-- rows are invalidated instead, which signs everyone out once.
+DELETE FROM refresh_tokens;
+ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
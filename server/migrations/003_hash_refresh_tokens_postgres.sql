@@ -0,0 +1,3 @@
+-- see 003_hash_refresh_tokens.sql
+DELETE FROM refresh_tokens;
+ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
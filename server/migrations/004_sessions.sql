@@ -0,0 +1,17 @@
+-- one row per signed-in device; refresh_tokens.family_id is the session id
+CREATE TABLE IF NOT EXISTS sessions (
+  id           TEXT PRIMARY KEY,
+  user_id      TEXT NOT NULL,
+  device_name  TEXT NOT NULL DEFAULT '',
+  ip           TEXT NOT NULL DEFAULT '',
+  user_agent   TEXT NOT NULL DEFAULT '',
+  created_at   DATETIME NOT NULL,
+  last_used_at DATETIME NOT NULL,
+  FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+
+-- existing refresh token families become sessions
+INSERT INTO sessions (id, user_id, created_at, last_used_at)
+  SELECT family_id, user_id, MIN(created_at), MAX(created_at) FROM refresh_tokens
+  WHERE family_id NOT IN (SELECT id FROM sessions) GROUP BY family_id, user_id;
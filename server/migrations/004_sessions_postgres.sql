@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS sessions (
+  id           TEXT PRIMARY KEY,
+  user_id      TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  device_name  TEXT NOT NULL DEFAULT '',
+  ip           TEXT NOT NULL DEFAULT '',
+  user_agent   TEXT NOT NULL DEFAULT '',
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+
+INSERT INTO sessions (id, user_id, created_at, last_used_at)
+  SELECT family_id, user_id, MIN(created_at), MAX(created_at) FROM refresh_tokens
+  WHERE family_id NOT IN (SELECT id FROM sessions) GROUP BY family_id, user_id;
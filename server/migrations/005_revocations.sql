@@ -0,0 +1,9 @@
+-- access token denylist: revoked session ids ("sid") and token ids ("jti");
+-- rows can be dropped once exp has passed
+CREATE TABLE IF NOT EXISTS revocations (
+  kind       TEXT NOT NULL,
+  value      TEXT NOT NULL,
+  exp        DATETIME NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (kind, value)
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS revocations (
+  kind       TEXT NOT NULL,
+  value      TEXT NOT NULL,
+  exp_unix   BIGINT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (kind, value)
+);
@@ -0,0 +1,8 @@
+-- confidential OAuth clients (introspection / revocation callers);
+-- secret_hash is hex(HMAC-SHA256(TOKEN_PEPPER, secret))
+CREATE TABLE IF NOT EXISTS oauth_clients (
+  id          TEXT PRIMARY KEY,
+  name        TEXT NOT NULL DEFAULT '',
+  secret_hash TEXT NOT NULL,
+  created_at  DATETIME NOT NULL DEFAULT (datetime('now'))
+);
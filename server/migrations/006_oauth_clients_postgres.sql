@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+  id          TEXT PRIMARY KEY,
+  name        TEXT NOT NULL DEFAULT '',
+  secret_hash TEXT NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
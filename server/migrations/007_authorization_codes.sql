@@ -0,0 +1,19 @@
+-- OAuth authorization code flow: clients get redirect URIs and may be public
+-- (PKCE only, empty secret_hash); sessions remember the grant they came from
+ALTER TABLE oauth_clients ADD COLUMN redirect_uris TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE oauth_clients ADD COLUMN public INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sessions ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+
+-- single-use codes; code_hash is hex(HMAC-SHA256(TOKEN_PEPPER, code))
+CREATE TABLE IF NOT EXISTS oauth_codes (
+  code_hash             TEXT PRIMARY KEY,
+  client_id             TEXT NOT NULL,
+  user_id               TEXT NOT NULL,
+  redirect_uri          TEXT NOT NULL,
+  scope                 TEXT NOT NULL DEFAULT '',
+  code_challenge        TEXT NOT NULL,
+  code_challenge_method TEXT NOT NULL,
+  exp                   DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,15 @@
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS redirect_uris TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS public BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS client_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS oauth_codes (
+  code_hash             TEXT PRIMARY KEY,
+  client_id             TEXT NOT NULL,
+  user_id               TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  redirect_uri          TEXT NOT NULL,
+  scope                 TEXT NOT NULL DEFAULT '',
+  code_challenge        TEXT NOT NULL,
+  code_challenge_method TEXT NOT NULL,
+  exp_unix              BIGINT NOT NULL
+);
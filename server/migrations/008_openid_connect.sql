@@ -0,0 +1,5 @@
+-- OpenID Connect: email_verified claim, nonce and auth_time carried from
+-- the authorize request to the ID token
+ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE oauth_codes ADD COLUMN nonce TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_codes ADD COLUMN auth_time DATETIME;
@@ -0,0 +1,6 @@
+-- machine clients (client_credentials grant): allowed scopes, kill switch,
+-- and the previous secret kept valid during a rotation grace period
+ALTER TABLE oauth_clients ADD COLUMN scopes TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE oauth_clients ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE oauth_clients ADD COLUMN prev_secret_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN prev_secret_exp DATETIME;
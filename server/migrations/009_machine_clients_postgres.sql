@@ -0,0 +1,4 @@
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS scopes TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS prev_secret_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS prev_secret_exp_unix BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,10 @@
+-- accounts at upstream identity providers (Google, Apple, GitHub) linked to users
+CREATE TABLE IF NOT EXISTS identities (
+  provider   TEXT NOT NULL,
+  subject    TEXT NOT NULL,
+  user_id    TEXT NOT NULL,
+  email      TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+  PRIMARY KEY (provider, subject),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
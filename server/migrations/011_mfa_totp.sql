@@ -0,0 +1,10 @@
+-- TOTP authenticators; the secret is sealed with DATA_KEY (AES-256-GCM)
+-- last_step is the newest accepted time step, so a code can't be replayed
+CREATE TABLE IF NOT EXISTS mfa_totp (
+  user_id    TEXT PRIMARY KEY,
+  secret_enc BLOB NOT NULL,
+  confirmed  INTEGER NOT NULL DEFAULT 0,
+  last_step  INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
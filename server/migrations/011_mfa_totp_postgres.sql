@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS mfa_totp (
+  user_id    TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  secret_enc BYTEA NOT NULL,
+  confirmed  BOOLEAN NOT NULL DEFAULT false,
+  last_step  BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,13 @@
+-- passkeys and security keys; id is the base64url credential ID, public_key a COSE_Key
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+  id           TEXT PRIMARY KEY,
+  user_id      TEXT NOT NULL,
+  name         TEXT NOT NULL DEFAULT '',
+  public_key   BLOB NOT NULL,
+  sign_count   INTEGER NOT NULL DEFAULT 0,
+  transports   TEXT NOT NULL DEFAULT '[]', -- JSON array, passed back to the platform as hints
+  created_at   DATETIME NOT NULL DEFAULT (datetime('now')),
+  last_used_at DATETIME NOT NULL DEFAULT (datetime('now')),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_webauthn_user ON webauthn_credentials(user_id);
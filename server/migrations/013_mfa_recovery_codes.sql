@@ -0,0 +1,10 @@
+-- single-use MFA recovery codes; only Argon2id hashes (auth.HashPassword) are kept
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  id         TEXT PRIMARY KEY,
+  user_id    TEXT NOT NULL,
+  code_hash  TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+  used_at    DATETIME,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_user ON mfa_recovery_codes(user_id);
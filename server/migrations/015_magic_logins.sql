@@ -0,0 +1,10 @@
+-- pending passwordless email logins, one per user; only peppered hashes of
+-- the link token and the 6-digit code are kept
+CREATE TABLE IF NOT EXISTS magic_logins (
+  user_id   TEXT PRIMARY KEY,
+  link_hash TEXT UNIQUE,
+  code_hash TEXT,
+  attempts  INTEGER NOT NULL DEFAULT 0,
+  exp       DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
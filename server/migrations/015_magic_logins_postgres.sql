@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS magic_logins (
+  user_id   TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  link_hash TEXT UNIQUE,
+  code_hash TEXT,
+  attempts  INT NOT NULL DEFAULT 0,
+  exp_unix  BIGINT NOT NULL
+);
@@ -0,0 +1,9 @@
+-- pending email address changes, one per user; the confirmation token is
+-- stored as its peppered hash
+CREATE TABLE IF NOT EXISTS email_changes (
+  user_id    TEXT PRIMARY KEY,
+  new_email  TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  exp        DATETIME NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
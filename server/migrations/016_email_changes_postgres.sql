@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS email_changes (
+  user_id    TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  new_email  TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  exp_unix   BIGINT NOT NULL
+);
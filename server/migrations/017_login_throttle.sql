@@ -0,0 +1,8 @@
+-- failed sign-ins per account ("acct:" + email) and per client address
+-- ("ip:" + address), for backoff and lockouts
+CREATE TABLE IF NOT EXISTS login_throttle (
+  key               TEXT PRIMARY KEY,
+  failures          INTEGER NOT NULL DEFAULT 0,
+  last_failure_unix INTEGER NOT NULL DEFAULT 0,
+  locked_until_unix INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS login_throttle (
+  key               TEXT PRIMARY KEY,
+  failures          INT NOT NULL DEFAULT 0,
+  last_failure_unix BIGINT NOT NULL DEFAULT 0,
+  locked_until_unix BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,9 @@
+-- hits per rate limit key and fixed window, shared by all instances when
+-- RATE_LIMIT_BACKEND=store
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+  key          TEXT NOT NULL,
+  window_start INTEGER NOT NULL,
+  hits         INTEGER NOT NULL,
+  expires_unix INTEGER NOT NULL,
+  PRIMARY KEY (key, window_start)
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+  key          TEXT NOT NULL,
+  window_start BIGINT NOT NULL,
+  hits         INT NOT NULL,
+  expires_unix BIGINT NOT NULL,
+  PRIMARY KEY (key, window_start)
+);
@@ -0,0 +1,3 @@
+-- wrong magic codes keep counting when a new code is requested, until the
+-- attempt window of the first one closes
+ALTER TABLE magic_logins ADD COLUMN attempts_until_unix INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE magic_logins ADD COLUMN IF NOT EXISTS attempts_until_unix BIGINT NOT NULL DEFAULT 0;
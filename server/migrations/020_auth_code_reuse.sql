@@ -0,0 +1,4 @@
+-- spent authorization codes are kept until they expire, with the session they
+-- were exchanged for, so a replayed code can revoke what it was used to get
+ALTER TABLE oauth_codes ADD COLUMN used INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE oauth_codes ADD COLUMN session_id TEXT NOT NULL DEFAULT '';
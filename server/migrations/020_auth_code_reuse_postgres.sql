@@ -0,0 +1,2 @@
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS used BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS session_id TEXT NOT NULL DEFAULT '';
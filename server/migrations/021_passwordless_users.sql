@@ -0,0 +1,3 @@
+-- accounts created without a password hold an empty pw_hash; SQLite always
+-- wrote '', so this only matters for databases copied from Postgres
+UPDATE users SET pw_hash = '' WHERE pw_hash = 'placeholder';
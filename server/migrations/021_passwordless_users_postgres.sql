@@ -0,0 +1,3 @@
+-- users created without a password got the literal 'placeholder' as their
+-- hash, so HasPassword reported one; an empty pw_hash means none
+UPDATE users SET pw_hash = '' WHERE pw_hash = 'placeholder';